@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 
 	lua "github.com/hootrhino/gopher-lua"
 	"github.com/hootrhino/rulex/glogger"
@@ -17,6 +18,7 @@ import (
  */
 type AppStack struct {
 	re           typex.RuleX
+	locker       sync.RWMutex // 接口和配置目录同步都会改 applications
 	applications map[string]*typex.Application
 }
 
@@ -53,7 +55,9 @@ func (as *AppStack) LoadApp(app *typex.Application) error {
 	// 加载库
 	LoadAppLib(app, as.re)
 	// 加载到内存里
+	as.locker.Lock()
 	as.applications[app.UUID] = app
+	as.locker.Unlock()
 	return nil
 }
 
@@ -63,7 +67,9 @@ func (as *AppStack) LoadApp(app *typex.Application) error {
 *
  */
 func (as *AppStack) StartApp(uuid string) error {
+	as.locker.RLock()
 	app, ok := as.applications[uuid]
+	as.locker.RUnlock()
 	if !ok {
 		return fmt.Errorf("app not exists:%s", uuid)
 	}
@@ -74,11 +80,14 @@ func (as *AppStack) StartApp(uuid string) error {
 	ctx, cancel := context.WithCancel(typex.GCTX)
 	app.SetCnC(ctx, cancel)
 	go func(app *typex.Application) {
+		var appErr interface{}
 		defer func() {
 			glogger.GLogger.Debug("App exit:", app.UUID)
 			if err := recover(); err != nil {
 				glogger.GLogger.Error("App recover:", err)
+				appErr = err
 			}
+			as.publishExit(app, appErr)
 		}()
 		glogger.GLogger.Debugf("Ready to run app:%s", app.UUID)
 		app.AppState = 1
@@ -95,6 +104,7 @@ func (as *AppStack) StartApp(uuid string) error {
 		}, lua.LBool(false))
 		if err != nil {
 			glogger.GLogger.Error("normal app.VM().CallByParam error:", err)
+			appErr = err
 		}
 		app.AppState = 0
 	}(app)
@@ -102,12 +112,36 @@ func (as *AppStack) StartApp(uuid string) error {
 	return nil
 }
 
+/*
+*
+* APP 退出以后发布 APP_EXIT 事件, 出错或者 panic 的时候 error 不为空
+*
+ */
+func (as *AppStack) publishExit(app *typex.Application, appErr interface{}) {
+	if as.re == nil || as.re.GetEventBus() == nil {
+		return
+	}
+	errMsg := ""
+	if appErr != nil {
+		errMsg = fmt.Sprintf("%v", appErr)
+	}
+	as.re.GetEventBus().Publish(typex.Event{
+		Type:     typex.EVENT_APP_EXIT,
+		Resource: "APP",
+		UUID:     app.UUID,
+		Name:     app.Name,
+		Data:     map[string]interface{}{"error": errMsg},
+	})
+}
+
 /*
 *
 * 从内存里面删除APP
 *
  */
 func (as *AppStack) RemoveApp(uuid string) error {
+	as.locker.Lock()
+	defer as.locker.Unlock()
 	if app, ok := as.applications[uuid]; ok {
 		app.Remove()
 		delete(as.applications, uuid)
@@ -122,6 +156,8 @@ func (as *AppStack) RemoveApp(uuid string) error {
 *
  */
 func (as *AppStack) StopApp(uuid string) error {
+	as.locker.Lock()
+	defer as.locker.Unlock()
 	if app, ok := as.applications[uuid]; ok {
 		app.Remove()
 		delete(as.applications, uuid)
@@ -136,6 +172,8 @@ func (as *AppStack) StopApp(uuid string) error {
 *
  */
 func (as *AppStack) UpdateApp(app typex.Application) error {
+	as.locker.Lock()
+	defer as.locker.Unlock()
 	if oldApp, ok := as.applications[app.UUID]; ok {
 		oldApp.Name = app.Name
 		oldApp.Version = app.Version
@@ -146,6 +184,8 @@ func (as *AppStack) UpdateApp(app typex.Application) error {
 
 }
 func (as *AppStack) GetApp(uuid string) *typex.Application {
+	as.locker.RLock()
+	defer as.locker.RUnlock()
 	if app, ok := as.applications[uuid]; ok {
 		return app
 	}
@@ -158,6 +198,8 @@ func (as *AppStack) GetApp(uuid string) *typex.Application {
 *
  */
 func (as *AppStack) ListApp() []*typex.Application {
+	as.locker.RLock()
+	defer as.locker.RUnlock()
 	apps := []*typex.Application{}
 	for _, v := range as.applications {
 		apps = append(apps, v)
@@ -166,6 +208,8 @@ func (as *AppStack) ListApp() []*typex.Application {
 }
 
 func (as *AppStack) Stop() {
+	as.locker.RLock()
+	defer as.locker.RUnlock()
 	for _, app := range as.applications {
 		glogger.GLogger.Info("Stop App:", app.UUID)
 		app.Stop()
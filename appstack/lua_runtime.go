@@ -117,6 +117,9 @@ func LoadAppLib(app *typex.Application, e typex.RuleX) {
 	// 数据持久化
 	addAppLib(app, e, "applib", "DataToTdEngine", rulexlib.DataToTdEngine(e))
 	addAppLib(app, e, "applib", "DataToMongo", rulexlib.DataToMongo(e))
+	addAppLib(app, e, "applib", "DataToSparkplug", rulexlib.DataToSparkplug(e))
+	addAppLib(app, e, "applib", "DataToKafka", rulexlib.DataToKafka(e))
+	addAppLib(app, e, "applib", "DataToTimeSeries", rulexlib.DataToTimeSeries(e))
 	// 时间库
 	addAppLib(app, e, "applib", "Time", rulexlib.Time(e))
 	addAppLib(app, e, "applib", "TsUnix", rulexlib.TsUnix(e))
@@ -130,6 +133,8 @@ func LoadAppLib(app *typex.Application, e typex.RuleX) {
 	// JSON
 	addAppLib(app, e, "applib", "T2J", rulexlib.JSONE(e)) // Lua Table -> JSON
 	addAppLib(app, e, "applib", "J2T", rulexlib.JSOND(e)) // JSON -> Lua Table
+	// 数据质量
+	addAppLib(app, e, "applib", "FilterQuality", rulexlib.FilterQuality(e))
 
 	// Codec
 	addAppLib(app, e, "applib", "RPCENC", rulexlib.RPCEncode(e))
@@ -137,6 +142,8 @@ func LoadAppLib(app *typex.Application, e typex.RuleX) {
 	// Device R/W
 	addAppLib(app, e, "applib", "ReadDevice", rulexlib.ReadDevice(e))
 	addAppLib(app, e, "applib", "WriteDevice", rulexlib.WriteDevice(e))
+	// Modbus 从机寄存器
+	addAppLib(app, e, "applib", "SetRegister", rulexlib.SetRegister(e))
 	// Ctrl Device: request --> response
 	addAppLib(app, e, "applib", "CtrlDevice", rulexlib.CtrlDevice(e))
 	// Source R/W
@@ -158,6 +165,8 @@ func LoadAppLib(app *typex.Application, e typex.RuleX) {
 	// 设备操作
 	//------------------------------------------------------------------------
 	addAppLib(app, e, "device", "DCACall", rulexlib.DCACall(e))
+	addAppLib(app, e, "device", "Get", rulexlib.GetShadowTag(e))
+	addAppLib(app, e, "device", "Shadow", rulexlib.GetShadow(e))
 	//------------------------------------------------------------------------
 	// 十六进制编码处理
 	//------------------------------------------------------------------------
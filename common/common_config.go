@@ -36,6 +36,44 @@ type MqttConfig struct {
 	Password string `json:"password" validate:"required" title:"连接密码"`
 	PubTopic string `json:"pubTopic" title:"上报TOPIC" info:"上报TOPIC"` // 上报数据的 Topic
 	SubTopic string `json:"subTopic" title:"订阅TOPIC" info:"订阅TOPIC"` // 上报数据的 Topic
+	// 连接方式和证书, 默认 tcp
+	TlsConfig MqttTlsConfig `json:"tlsConfig" title:"TLS配置"`
+}
+
+/*
+*
+* Kafka 连接配置: brokers 是 host:port 的列表, 连上任意一个就能拿到整个集群
+*
+ */
+type KafkaConfig struct {
+	Brokers  []string        `json:"brokers" validate:"required,min=1" title:"服务地址" info:"host:port"`
+	ClientId string          `json:"clientId" title:"客户端ID"`
+	Sasl     KafkaSaslConfig `json:"sasl" title:"SASL认证"`
+	Tls      KafkaTlsConfig  `json:"tls" title:"TLS配置"`
+}
+
+/*
+*
+* SASL 认证, mechanism 为空的时候不认证
+*
+ */
+type KafkaSaslConfig struct {
+	Mechanism string `json:"mechanism" validate:"omitempty,oneof=PLAIN SCRAM-SHA-256 SCRAM-SHA-512" title:"认证方式" info:"PLAIN/SCRAM-SHA-256/SCRAM-SHA-512"`
+	Username  string `json:"username" title:"连接账户"`
+	Password  string `json:"password" title:"连接密码"`
+}
+
+/*
+*
+* TLS 配置, 证书可以直接填 PEM 内容, 也可以填文件路径; 填了客户端证书和私钥就是双向认证
+*
+ */
+type KafkaTlsConfig struct {
+	Enable             bool   `json:"enable" title:"启用TLS"`
+	CaCert             string `json:"caCert" title:"CA证书" info:"为空的时候用系统的CA"`
+	ClientCert         string `json:"clientCert" title:"客户端证书"`
+	ClientKey          string `json:"clientKey" title:"客户端私钥"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" title:"跳过证书校验"`
 }
 
 /*
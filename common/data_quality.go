@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 数据质量
+const (
+	QUALITY_GOOD            string = "GOOD"            // 正常
+	QUALITY_BAD_COMM        string = "BAD_COMM"        // 通信失败, 没有读到值
+	QUALITY_BAD_CONFIG      string = "BAD_CONFIG"      // 配置错误, 比如地址不存在, 数据类型不匹配
+	QUALITY_UNCERTAIN_STALE string = "UNCERTAIN_STALE" // 不确定, 比如设备离线以后最后一次的值
+)
+
+var DataQualities = []string{
+	QUALITY_GOOD,
+	QUALITY_BAD_COMM,
+	QUALITY_BAD_CONFIG,
+	QUALITY_UNCERTAIN_STALE,
+}
+
+/*
+*
+* 采集值的数据质量和时间戳, 驱动输出的每个点位都带上; 时间是毫秒时间戳,
+* 设备没有给出时间的时候 sourceTs 等于 gatewayTs
+*
+ */
+type DataQuality struct {
+	Quality   string `json:"quality"`
+	SourceTs  int64  `json:"sourceTs"`        // 设备给出的时间
+	GatewayTs int64  `json:"gatewayTs"`       // 网关采集的时间
+	Error     string `json:"error,omitempty"` // 质量不好的原因
+}
+
+func NewDataQuality(quality string, sourceTs time.Time, err error) *DataQuality {
+	now := time.Now()
+	if sourceTs.IsZero() {
+		sourceTs = now
+	}
+	q := &DataQuality{
+		Quality:   quality,
+		SourceTs:  sourceTs.UnixMilli(),
+		GatewayTs: now.UnixMilli(),
+	}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	return q
+}
+
+// 没有自己的点位结构的驱动用这个格式输出点位: {"value": 值, "quality": ..., "sourceTs": ..., "gatewayTs": ...}
+type QualityValue struct {
+	Value interface{} `json:"value"`
+	*DataQuality
+}
+
+func dataQualityOf(value interface{}) (string, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	quality, ok := object["quality"].(string)
+	return quality, ok
+}
+
+/*
+*
+* 按数据质量过滤: 数据是 JSON 对象的时候过滤带 quality 的点位, 是数组的时候过滤带 quality 的元素,
+* 不带 quality 的保留; 对象顶层有 quality 的时候整条数据一起判断。
+* 过滤以后没有剩下数据的时候返回 false; 不是 JSON 的数据原样返回
+*
+ */
+func FilterQuality(data string, qualities []string) (string, bool) {
+	if len(qualities) == 0 {
+		return data, true
+	}
+	accepted := func(quality string) bool {
+		for _, q := range qualities {
+			if q == quality {
+				return true
+			}
+		}
+		return false
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return data, true
+	}
+	if quality, ok := dataQualityOf(value); ok {
+		return data, accepted(quality)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		filtered := map[string]interface{}{}
+		for key, item := range v {
+			if quality, ok := dataQualityOf(item); ok && !accepted(quality) {
+				continue
+			}
+			filtered[key] = item
+		}
+		if len(filtered) == len(v) {
+			return data, true
+		}
+		if len(filtered) == 0 {
+			return "", false
+		}
+		bytes, _ := json.Marshal(filtered)
+		return string(bytes), true
+	case []interface{}:
+		filtered := []interface{}{}
+		for _, item := range v {
+			if quality, ok := dataQualityOf(item); ok && !accepted(quality) {
+				continue
+			}
+			filtered = append(filtered, item)
+		}
+		if len(filtered) == len(v) {
+			return data, true
+		}
+		if len(filtered) == 0 {
+			return "", false
+		}
+		bytes, _ := json.Marshal(filtered)
+		return string(bytes), true
+	}
+	return data, true
+}
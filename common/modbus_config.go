@@ -40,15 +40,22 @@ type Registers struct {
  */
 type RegisterRW struct {
 	Tag string `json:"tag" validate:"required" title:"数据Tag"`
-	// 用来给值增加初始值和权重系数，即: Value = Value *Weight + Offset
-	Weight    float64 `json:"weight" validate:"required" title:"权重系数"`
-	InitValue float64 `json:"initValue" validate:"required" title:"权重初始值"`
+	// 用来给值增加初始值和权重系数，即: Value = Value *Weight + InitValue, Weight 为 0 的时候当作 1
+	Weight    float64 `json:"weight" title:"权重系数"`
+	InitValue float64 `json:"initValue" title:"权重初始值"`
+	// 数据类型和字节序, DataType 为空的时候只输出原始的十六进制 Value
+	DataType  string `json:"dataType" title:"数据类型" info:"BOOL/INT16/UINT16/INT32/UINT32/INT64/UINT64/FLOAT32/FLOAT64"`
+	DataOrder string `json:"dataOrder" title:"字节序" info:"ABCD/BADC/CDAB/DCBA, 默认ABCD"`
 	//
 	Function int    `json:"function" validate:"required" title:"Modbus功能"` // Function
 	SlaverId byte   `json:"slaverId" validate:"required" title:"从机ID"`     // 从机ID
 	Address  uint16 `json:"address" validate:"required" title:"地址"`        // Address
 	Quantity uint16 `json:"quantity" validate:"required" title:"数量"`       // Quantity
 	Value    string `json:"value" title:"值" info:"本地系统的串口路径"`              // Value
+	// 按 DataType 解码并且乘了权重以后的工程值, 多个值的时候是数组
+	DataValue interface{} `json:"dataValue,omitempty"`
+	// 采集结果的数据质量和时间戳, 配置里不用填
+	*DataQuality `json:",omitempty"`
 }
 
 /*
@@ -61,6 +68,10 @@ type RegisterW struct {
 	SlaverId byte   `json:"slaverId"` // 从机ID
 	Address  uint16 `json:"address"`  // Address
 	Values   []byte `json:"values"`   // Value
+	// 按配置的点位写工程值: Tag 不为空的时候忽略上面的字段, 按点位的
+	// DataType/DataOrder/Weight/InitValue 反向编码以后写入
+	Tag   string      `json:"tag"`
+	Value interface{} `json:"value"`
 }
 
 // Uart "/dev/ttyUSB0"
@@ -88,3 +99,25 @@ type ModBusConfig struct {
 	Config    interface{}  `json:"config" validate:"required" title:"工作模式"`
 	Registers []RegisterRW `json:"registers" validate:"required" title:"寄存器配置"`
 }
+
+// Modbus 从机的寄存器类型
+const (
+	MODBUS_COIL             = "COIL"             // 线圈, 主站可读写
+	MODBUS_DISCRETE_INPUT   = "DISCRETE_INPUT"   // 离散输入, 主站只读
+	MODBUS_HOLDING_REGISTER = "HOLDING_REGISTER" // 保持寄存器, 主站可读写
+	MODBUS_INPUT_REGISTER   = "INPUT_REGISTER"   // 输入寄存器, 主站只读
+)
+
+/*
+*
+* Modbus 从机的寄存器映射, 一个 Tag 占用从 Address 开始的 Quantity 个寄存器
+*
+ */
+type SlaverRegister struct {
+	Tag      string `json:"tag" validate:"required" title:"数据Tag"`
+	Type     string `json:"type" validate:"required" title:"寄存器类型" info:"COIL/DISCRETE_INPUT/HOLDING_REGISTER/INPUT_REGISTER"`
+	Address  uint16 `json:"address" title:"起始地址"`
+	Quantity uint16 `json:"quantity" validate:"required" title:"数量"`
+	// 初始值, 长度不够的部分补0
+	InitValues []int `json:"initValues" title:"初始值"`
+}
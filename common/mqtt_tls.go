@@ -0,0 +1,143 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MQTT 连接方式
+const (
+	MQTT_SCHEME_TCP string = "tcp"
+	MQTT_SCHEME_SSL string = "ssl"
+	MQTT_SCHEME_WS  string = "ws"
+	MQTT_SCHEME_WSS string = "wss"
+)
+
+/*
+*
+* MQTT 的连接方式和证书: 证书可以直接填 PEM 内容, 也可以填文件路径(HTTP 接口上传证书以后返回的路径);
+* 填了客户端证书和私钥就是双向认证
+*
+ */
+type MqttTlsConfig struct {
+	Scheme             string `json:"scheme" title:"连接方式" info:"tcp/ssl/ws/wss, 默认tcp"`
+	WsPath             string `json:"wsPath" title:"WebSocket路径" info:"ws/wss 的时候用, 默认/mqtt"`
+	CaCert             string `json:"caCert" title:"CA证书" info:"为空的时候用系统的CA"`
+	ClientCert         string `json:"clientCert" title:"客户端证书"`
+	ClientKey          string `json:"clientKey" title:"客户端私钥"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" title:"跳过证书校验"`
+}
+
+/*
+*
+* 生成 Broker 地址和 TLS 配置, tcp 和 ws 的时候 TLS 配置是 nil
+*
+ */
+func (c MqttTlsConfig) Broker(host string, port int) (string, *tls.Config, error) {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = MQTT_SCHEME_TCP
+	}
+	broker := fmt.Sprintf("%s://%s:%v", scheme, host, port)
+	switch scheme {
+	case MQTT_SCHEME_TCP, MQTT_SCHEME_SSL:
+	case MQTT_SCHEME_WS, MQTT_SCHEME_WSS:
+		path := c.WsPath
+		if path == "" {
+			path = "/mqtt"
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		broker += path
+	default:
+		return "", nil, fmt.Errorf("unsupported mqtt scheme:%s", scheme)
+	}
+	if scheme == MQTT_SCHEME_TCP || scheme == MQTT_SCHEME_WS {
+		return broker, nil, nil
+	}
+	tlsConfig, err := NewClientTlsConfig(c.CaCert, c.ClientCert, c.ClientKey, c.InsecureSkipVerify)
+	if err != nil {
+		return "", nil, err
+	}
+	return broker, tlsConfig, nil
+}
+
+// 读 PEM: 内容本身是 PEM 的时候直接用, 否则当作文件路径
+func readPem(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+func NewClientTlsConfig(caCert, clientCert, clientKey string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pool, err := newCertPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return nil, fmt.Errorf("client cert and key must be set together")
+	}
+	if clientCert != "" {
+		cert, err := loadKeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+/*
+*
+* 服务端的 TLS 配置, caCert 不为空的时候要求客户端证书(双向认证)
+*
+ */
+func NewServerTlsConfig(cert, key, caCert string) (*tls.Config, error) {
+	keyPair, err := loadKeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if caCert != "" {
+		pool, err := newCertPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func newCertPool(caCert string) (*x509.CertPool, error) {
+	pem, err := readPem(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("read ca cert failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("invalid ca cert")
+	}
+	return pool, nil
+}
+
+func loadKeyPair(cert, key string) (tls.Certificate, error) {
+	certPem, err := readPem(cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read cert failed: %v", err)
+	}
+	keyPem, err := readPem(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read key failed: %v", err)
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
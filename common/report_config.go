@@ -0,0 +1,30 @@
+package common
+
+// 死区类型
+const (
+	DEADBAND_ABS     string = "ABS"     // 绝对值: |新值 - 上次上报的值| > deadband
+	DEADBAND_PERCENT string = "PERCENT" // 百分比: |新值 - 上次上报的值| > |上次上报的值| * deadband / 100
+)
+
+/*
+*
+* 变化上报(Report By Exception)配置, 轮询类设备用来过滤没有变化的数据:
+*   - 数值类点位超过死区才算变化, 非数值类点位不相等就算变化
+*   - heartbeat 秒内一直没有上报的时候强制上报一次全量快照
+*   - changedOnly 为 true 的时候只上报变化了的点位, 否则有变化就上报全量快照
+*
+ */
+type ReportConfig struct {
+	Enable       bool    `json:"enable" title:"启用变化上报"`
+	ChangedOnly  bool    `json:"changedOnly" title:"只上报变化的点位"`
+	DeadbandType string  `json:"deadbandType" title:"死区类型" info:"ABS/PERCENT, 默认ABS"`
+	Deadband     float64 `json:"deadband" title:"死区" info:"0表示有变化就上报"`
+	Heartbeat    int     `json:"heartbeat" title:"最大静默时间" info:"单位秒, 0表示不强制上报"`
+	// 单独给某些点位配置死区, 没有配置的点位用上面的默认值
+	Tags map[string]TagDeadband `json:"tags" title:"点位死区"`
+}
+
+type TagDeadband struct {
+	DeadbandType string  `json:"deadbandType" title:"死区类型" info:"ABS/PERCENT, 默认ABS"`
+	Deadband     float64 `json:"deadband" title:"死区"`
+}
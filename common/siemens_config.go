@@ -32,4 +32,6 @@ type S1200BlockValue struct {
 	Start   int    `json:"start" title:"起始地址"` // 起始地址
 	Size    int    `json:"size" title:"服务地址"`  // 数据长度
 	Value   []byte `json:"value" title:"数据长度"` // 值
+	// 采集结果的数据质量和时间戳, 写的时候不用填
+	*DataQuality `json:",omitempty"`
 }
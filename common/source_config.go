@@ -11,6 +11,8 @@ type GenericIoTHUBMqttConfig struct {
 	ClientId string `json:"clientId" validate:"required" title:"客户端ID"`
 	Username string `json:"username" validate:"required" title:"连接账户"`
 	Password string `json:"password" validate:"required" title:"连接密码"`
+	// 连接方式和证书, 默认 tcp
+	TlsConfig MqttTlsConfig `json:"tlsConfig" title:"TLS配置"`
 }
 type IThingsMqttConfig struct {
 	Mode       string `json:"mode" validate:"required" title:"模式:GW(网关)|DC(直连)"`
@@ -23,6 +25,40 @@ type IThingsMqttConfig struct {
 	ClientId string `json:"clientId" validate:"required" title:"客户端ID"`
 	Username string `json:"username" validate:"required" title:"连接账户"`
 	Password string `json:"password" validate:"required" title:"连接密码"`
+	// 连接方式和证书, 默认 tcp
+	TlsConfig MqttTlsConfig `json:"tlsConfig" title:"TLS配置"`
+}
+
+/*
+*
+* Sparkplug B 边缘节点, devices 是要发布的设备 UUID, 为空的时候是所有设备
+*
+ */
+type SparkplugBConfig struct {
+	Host       string   `json:"host" validate:"required" title:"服务地址"`
+	Port       int      `json:"port" validate:"required" title:"服务端口"`
+	ClientId   string   `json:"clientId" validate:"required" title:"客户端ID"`
+	Username   string   `json:"username" title:"连接账户"`
+	Password   string   `json:"password" title:"连接密码"`
+	GroupId    string   `json:"groupId" validate:"required" title:"组ID"`
+	EdgeNodeId string   `json:"edgeNodeId" validate:"required" title:"节点ID"`
+	Devices    []string `json:"devices" title:"设备"`
+	// 连接方式和证书, 默认 tcp
+	TlsConfig MqttTlsConfig `json:"tlsConfig" title:"TLS配置"`
+}
+
+/*
+*
+* Kafka 输入: 用消费组消费, 提交的位置保存在 Kafka 里, 重启以后接着消费
+*
+ */
+type KafkaSourceConfig struct {
+	KafkaConfig
+	Topics           []string `json:"topics" validate:"required,min=1" title:"Topic"`
+	GroupId          string   `json:"groupId" validate:"required" title:"消费组"`
+	StartOffset      string   `json:"startOffset" validate:"omitempty,oneof=earliest latest" title:"起始位置" info:"消费组没有提交过的时候从哪里开始: earliest/latest, 默认 latest"`
+	SessionTimeoutMs int      `json:"sessionTimeoutMs" title:"会话超时(毫秒)" info:"默认 10000"`
+	CommitIntervalMs int      `json:"commitIntervalMs" title:"提交间隔(毫秒)" info:"默认 5000"`
 }
 
 /*
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+*
+* Sparkplug B: Topic 是 spBv1.0/{groupId}/{消息类型}/{edgeNodeId}[/{deviceId}],
+* 负载是 protobuf 编码的 Payload, 定义在 source/sparkplugb/sparkplug_b.proto
+*
+ */
+const SPARKPLUG_NAMESPACE = "spBv1.0"
+
+const (
+	SPARKPLUG_NBIRTH = "NBIRTH"
+	SPARKPLUG_NDEATH = "NDEATH"
+	SPARKPLUG_DBIRTH = "DBIRTH"
+	SPARKPLUG_DDEATH = "DDEATH"
+	SPARKPLUG_NDATA  = "NDATA"
+	SPARKPLUG_DDATA  = "DDATA"
+	SPARKPLUG_NCMD   = "NCMD"
+	SPARKPLUG_DCMD   = "DCMD"
+)
+
+// 节点控制指标
+const (
+	SPARKPLUG_BDSEQ   = "bdSeq"
+	SPARKPLUG_REBIRTH = "Node Control/Rebirth"
+)
+
+func SparkplugTopic(groupId, messageType, edgeNodeId, deviceId string) string {
+	if deviceId == "" {
+		return fmt.Sprintf("%s/%s/%s/%s", SPARKPLUG_NAMESPACE, groupId, messageType, edgeNodeId)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", SPARKPLUG_NAMESPACE, groupId, messageType, edgeNodeId, deviceId)
+}
+
+/*
+*
+* 解析 Topic, 返回 groupId, 消息类型, edgeNodeId, deviceId; 节点消息的 deviceId 是空串
+*
+ */
+func ParseSparkplugTopic(topic string) (string, string, string, string, error) {
+	parts := strings.Split(topic, "/")
+	if (len(parts) != 4 && len(parts) != 5) || parts[0] != SPARKPLUG_NAMESPACE {
+		return "", "", "", "", fmt.Errorf("invalid sparkplug topic: %s", topic)
+	}
+	deviceId := ""
+	if len(parts) == 5 {
+		deviceId = parts[4]
+	}
+	return parts[1], parts[2], parts[3], deviceId, nil
+}
@@ -61,3 +61,102 @@ type NatsConfig struct {
 	Port     int    `json:"port" validate:"required" title:"端口"`
 	Topic    string `json:"topic" validate:"required" title:"转发Topic"`
 }
+
+/*
+*
+* OutEnd 离线缓存配置, 放在 OutEnd 配置的 cacheConfig 字段里面, 对所有类型的目标都有效
+*
+ */
+type OutEndCacheConfig struct {
+	Enable         bool   `json:"enable" title:"启用离线缓存"`
+	MaxBytes       int64  `json:"maxBytes" title:"最大缓存字节数"`          // 0 表示不限制
+	Ttl            int    `json:"ttl" title:"数据有效期(秒)"`              // 0 表示永不过期
+	DropPolicy     string `json:"dropPolicy" title:"溢出策略"`           // DROP_OLDEST | DROP_NEWEST
+	ReplayInterval int    `json:"replayInterval" title:"补发检查间隔(毫秒)"` // 默认 5000
+}
+
+/*
+*
+* MQTT 输出: pubTopic 可以是模板, 比如 factory/{deviceName}/{tag}, 字段从消息 JSON 里取;
+* 消息是 JSON 数组的时候每个元素单独发布。MQTT5 的属性只在 protocolVersion 是 5 的时候有效
+*
+ */
+type MqttTargetConfig struct {
+	MqttConfig
+	Qos             *int              `json:"qos" title:"QoS" info:"0/1/2, 默认 1"`
+	Retain          bool              `json:"retain" title:"保留消息"`
+	ProtocolVersion int               `json:"protocolVersion" validate:"omitempty,oneof=3 4 5" title:"协议版本" info:"3(3.1.1) 或者 5, 默认 3"`
+	PersistSession  bool              `json:"persistSession" title:"保持会话" info:"重连以后恢复会话, 不清理服务端的会话"`
+	SessionExpiry   uint32            `json:"sessionExpiry" title:"会话过期(秒)" info:"MQTT5, 保持会话的时候默认 3600"`
+	Keepalive       uint16            `json:"keepalive" title:"心跳(秒)" info:"默认 30"`
+	MessageExpiry   uint32            `json:"messageExpiry" title:"消息过期(秒)" info:"MQTT5, 0 表示不过期"`
+	ResponseTopic   string            `json:"responseTopic" title:"响应Topic" info:"MQTT5, 可以是模板"`
+	UserProperties  map[string]string `json:"userProperties" title:"用户属性" info:"MQTT5, 值可以是模板"`
+}
+
+/*
+*
+* Sparkplug B 输出: 设备数据交给 Sparkplug B 输入资源(边缘节点)发布
+*
+ */
+type SparkplugBTargetConfig struct {
+	SourceId string `json:"sourceId" validate:"required" title:"边缘节点资源"`
+}
+
+/*
+*
+* Kafka 输出: topic 和 key 可以是模板, 比如 plant.{site}, 字段从消息 JSON 里取;
+* 消息是 JSON 数组的时候每个元素是一条记录
+*
+ */
+type KafkaTargetConfig struct {
+	KafkaConfig
+	Topic       string `json:"topic" validate:"required" title:"Topic" info:"可以是模板"`
+	Key         string `json:"key" title:"消息Key" info:"可以是模板, 为空的时候一批一批轮流写到各个分区"`
+	Compression string `json:"compression" validate:"omitempty,oneof=none gzip snappy zstd" title:"压缩方式" info:"none/gzip/snappy/zstd, 默认 none"`
+	Acks        *int   `json:"acks" title:"确认方式" info:"-1(所有副本)/0/1, 默认 -1"`
+	Idempotent  bool   `json:"idempotent" title:"幂等写入" info:"打开以后 acks 只能是 -1"`
+	BatchBytes  int    `json:"batchBytes" title:"批量大小(字节)" info:"默认 1MB"`
+	LingerMs    int    `json:"lingerMs" title:"攒批等待(毫秒)" info:"默认 5"`
+	TimeoutMs   int    `json:"timeoutMs" title:"写入超时(毫秒)" info:"默认 10000"`
+}
+
+/*
+*
+* 时序数据库输出: 支持 InfluxDB v1/v2 的行协议和 Prometheus remote write;
+* 消息按 mapping 转成数据点, 攒批以后写入, 失败的时候重试
+*
+ */
+type TimeSeriesTargetConfig struct {
+	Protocol        string            `json:"protocol" validate:"required,oneof=INFLUXDB_V1 INFLUXDB_V2 PROMETHEUS" title:"协议" info:"INFLUXDB_V1/INFLUXDB_V2/PROMETHEUS"`
+	Url             string            `json:"url" validate:"required" title:"服务地址" info:"InfluxDB 是服务地址, 比如 http://127.0.0.1:8086; Prometheus 是 remote write 的完整地址"`
+	Database        string            `json:"database" title:"数据库" info:"InfluxDB v1"`
+	RetentionPolicy string            `json:"retentionPolicy" title:"保留策略" info:"InfluxDB v1, 为空的时候用默认的"`
+	Org             string            `json:"org" title:"组织" info:"InfluxDB v2"`
+	Bucket          string            `json:"bucket" title:"Bucket" info:"InfluxDB v2"`
+	Username        string            `json:"username" title:"用户" info:"InfluxDB v1 或者 Prometheus 的 Basic 认证"`
+	Password        string            `json:"password" title:"密码"`
+	Token           string            `json:"token" title:"Token" info:"InfluxDB v2 的 Token 或者 Prometheus 的 Bearer Token"`
+	Precision       string            `json:"precision" validate:"omitempty,oneof=ns us ms s" title:"时间精度" info:"InfluxDB 写入的时间精度: ns/us/ms/s, 默认 ms"`
+	Mapping         TimeSeriesMapping `json:"mapping" title:"数据映射"`
+	BatchSize       int               `json:"batchSize" title:"批量大小" info:"攒够多少个数据点写一次, 默认 500"`
+	FlushIntervalMs int               `json:"flushIntervalMs" title:"写入间隔(毫秒)" info:"没攒够也写的间隔, 默认 1000"`
+	MaxRetries      int               `json:"maxRetries" title:"重试次数" info:"默认 3, 0 表示用默认值, 负数表示不重试"`
+	RetryIntervalMs int               `json:"retryIntervalMs" title:"重试间隔(毫秒)" info:"每次重试翻倍, 默认 500"`
+	MaxBufferSize   int               `json:"maxBufferSize" title:"缓存上限" info:"缓存的数据点超过的时候丢掉最早的, 默认 10000"`
+	TimeoutMs       int               `json:"timeoutMs" title:"请求超时(毫秒)" info:"默认 5000"`
+}
+
+/*
+*
+* 消息到数据点的映射: measurement 和标签的值可以是模板, 比如 {device};
+* fields 是字段名到消息字段的映射, 为空的时候消息里其它的简单值都是字段
+*
+ */
+type TimeSeriesMapping struct {
+	Measurement   string            `json:"measurement" validate:"required" title:"Measurement" info:"可以是模板; Prometheus 的指标名是 measurement_字段名"`
+	Tags          map[string]string `json:"tags" title:"标签" info:"标签名到值, 值可以是模板"`
+	Fields        map[string]string `json:"fields" title:"字段" info:"字段名到消息里的字段, 可以用 . 取下一级"`
+	Timestamp     string            `json:"timestamp" title:"时间字段" info:"为空的时候用收到数据的时间"`
+	TimestampUnit string            `json:"timestampUnit" validate:"omitempty,oneof=ns us ms s" title:"时间字段单位" info:"ns/us/ms/s, 默认 ms"`
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/hootrhino/rulex/common/prompb"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+*
+* 时序数据库的一个数据点, 字段的值是 float64、bool 或者 string
+*
+ */
+type TimeSeriesPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+var timeSeriesPrecisions = map[string]time.Duration{
+	"":   time.Millisecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// 时间精度或者单位对应的时间长度, 比如 ms 是 1 毫秒, 空的时候是毫秒
+func TimeSeriesPrecision(precision string) time.Duration {
+	if unit, ok := timeSeriesPrecisions[precision]; ok {
+		return unit
+	}
+	return time.Millisecond
+}
+
+// 换行没法转义, 换成转义的空格
+var (
+	lineMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\ `)
+	lineKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\ `)
+	lineStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+/*
+*
+* 编码成 InfluxDB 行协议, 一个数据点一行: measurement,tag=v field=1 时间;
+* 标签按名字排序, 值是空的标签不写; 没有字段的数据点跳过
+*
+ */
+func EncodeLineProtocol(points []TimeSeriesPoint, precision string) []byte {
+	unit := TimeSeriesPrecision(precision)
+	buffer := strings.Builder{}
+	for _, point := range points {
+		if len(point.Fields) == 0 {
+			continue
+		}
+		buffer.WriteString(lineMeasurementEscaper.Replace(point.Measurement))
+		for _, key := range sortedKeys(point.Tags) {
+			if point.Tags[key] == "" {
+				continue
+			}
+			buffer.WriteByte(',')
+			buffer.WriteString(lineKeyEscaper.Replace(key))
+			buffer.WriteByte('=')
+			buffer.WriteString(lineKeyEscaper.Replace(point.Tags[key]))
+		}
+		buffer.WriteByte(' ')
+		for i, key := range sortedFieldKeys(point.Fields) {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteString(lineKeyEscaper.Replace(key))
+			buffer.WriteByte('=')
+			switch v := point.Fields[key].(type) {
+			case float64:
+				buffer.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			case bool:
+				buffer.WriteString(strconv.FormatBool(v))
+			case string:
+				buffer.WriteString(`"` + lineStringEscaper.Replace(v) + `"`)
+			}
+		}
+		buffer.WriteByte(' ')
+		buffer.WriteString(strconv.FormatInt(point.Time.UnixNano()/int64(unit), 10))
+		buffer.WriteByte('\n')
+	}
+	return []byte(buffer.String())
+}
+
+var (
+	prometheusNameRegexp  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	prometheusLabelRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// Prometheus 的指标名只能有字母、数字、下划线和冒号, 不能用数字开头
+func PrometheusMetricName(name string) string {
+	name = prometheusNameRegexp.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func prometheusLabelName(name string) string {
+	name = prometheusLabelRegexp.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+/*
+*
+* 编码成 Prometheus remote write 的请求(protobuf 加 snappy 压缩): 每个字段是一个指标,
+* 名字是 measurement_字段名, 标签是数据点的标签; bool 写成 0 和 1, 字符串字段跳过
+*
+ */
+func EncodeRemoteWrite(points []TimeSeriesPoint) ([]byte, error) {
+	request := &prompb.WriteRequest{}
+	index := map[string]*prompb.TimeSeries{}
+	for _, point := range points {
+		for _, field := range sortedFieldKeys(point.Fields) {
+			sample := 0.0
+			switch v := point.Fields[field].(type) {
+			case float64:
+				sample = v
+			case bool:
+				if v {
+					sample = 1
+				}
+			default:
+				continue
+			}
+			labels := []*prompb.Label{{Name: "__name__", Value: PrometheusMetricName(point.Measurement + "_" + field)}}
+			for _, key := range sortedKeys(point.Tags) {
+				if point.Tags[key] != "" {
+					labels = append(labels, &prompb.Label{Name: prometheusLabelName(key), Value: point.Tags[key]})
+				}
+			}
+			// remote write 要求标签按名字排序
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+			key := ""
+			for _, label := range labels {
+				key += label.Name + "\xff" + label.Value + "\xff"
+			}
+			series, ok := index[key]
+			if !ok {
+				series = &prompb.TimeSeries{Labels: labels}
+				index[key] = series
+				request.Timeseries = append(request.Timeseries, series)
+			}
+			series.Samples = append(series.Samples,
+				&prompb.Sample{Value: sample, Timestamp: point.Time.UnixMilli()})
+		}
+	}
+	// 同一个序列的样本按时间排序
+	for _, series := range request.Timeseries {
+		samples := series.Samples
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+	}
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFieldKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,221 @@
+package configdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hootrhino/rulex/utils"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+*
+* 声明式配置: 从一个目录里的 YAML/JSON 文件加载输入资源, 输出资源, 设备, 规则和应用,
+* 目录里的文件就是这几类资源的全部配置, 文件里没有的会被删掉
+*
+ */
+const MODE = "dir"
+
+// 目录模式下由配置文件管理的资源类型
+var RESOURCES = []string{"INEND", "OUTEND", "DEVICE", "RULE", "APP"}
+
+type configFile struct {
+	InEnds  []Resource `yaml:"inends"`
+	OutEnds []Resource `yaml:"outends"`
+	Devices []Resource `yaml:"devices"`
+	Rules   []Rule     `yaml:"rules"`
+	Apps    []App      `yaml:"apps"`
+}
+
+// 输入资源, 输出资源和设备; BindRules 是从规则的 fromSource 和 fromDevice 推出来的
+type Resource struct {
+	UUID        string                 `yaml:"uuid"`
+	Name        string                 `yaml:"name"`
+	Type        string                 `yaml:"type"`
+	Description string                 `yaml:"description"`
+	Config      map[string]interface{} `yaml:"config"`
+	BindRules   []string               `yaml:"-"`
+}
+
+type Rule struct {
+	UUID        string   `yaml:"uuid"`
+	Name        string   `yaml:"name"`
+	Type        string   `yaml:"type"` // lua(默认) 或者 expr
+	Description string   `yaml:"description"`
+	FromSource  []string `yaml:"fromSource"`
+	FromDevice  []string `yaml:"fromDevice"`
+	FromEvent   []string `yaml:"fromEvent"`
+	Expression  string   `yaml:"expression"`
+	ToRules     []string `yaml:"toRules"`
+	ToTargets   []string `yaml:"toTargets"`
+	ToDevices   []string `yaml:"toDevices"`
+	DeviceCmd   string   `yaml:"deviceCmd"`
+	Actions     string   `yaml:"actions"`
+	Success     string   `yaml:"success"`
+	Failed      string   `yaml:"failed"`
+}
+
+type App struct {
+	UUID        string `yaml:"uuid"`
+	Name        string `yaml:"name"`
+	Version     string `yaml:"version"`
+	AutoStart   bool   `yaml:"autoStart"`
+	Description string `yaml:"description"`
+	Script      string `yaml:"script"` // 脚本文件, 相对于配置目录
+	LuaSource   string `yaml:"luaSource"`
+}
+
+/*
+*
+* 配置目录里的全部配置; 应用脚本已经读出来了, 放在 Scripts 里, KEY 是应用的 UUID
+*
+ */
+type Config struct {
+	InEnds  []Resource
+	OutEnds []Resource
+	Devices []Resource
+	Rules   []Rule
+	Apps    []App
+	Scripts map[string][]byte
+}
+
+func nonNilList(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+/*
+*
+* 读取配置目录(包括子目录)里所有的 .yaml .yml .json 文件, 合成一份配置;
+* 输入资源和设备绑定的规则从规则的 fromSource 和 fromDevice 推出来, 不用重复写
+*
+ */
+func Read(dir string) (*Config, error) {
+	config := &Config{
+		InEnds:  []Resource{},
+		OutEnds: []Resource{},
+		Devices: []Resource{},
+		Rules:   []Rule{},
+		Apps:    []App{},
+		Scripts: map[string][]byte{},
+	}
+	files, err := configFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file := configFile{}
+		if err := yaml.Unmarshal(content, &file); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+		}
+		for _, r := range append(append(file.InEnds, file.OutEnds...), file.Devices...) {
+			if r.UUID == "" {
+				return nil, fmt.Errorf("invalid config file %s: resource '%s' missing uuid", path, r.Name)
+			}
+		}
+		config.InEnds = append(config.InEnds, file.InEnds...)
+		config.OutEnds = append(config.OutEnds, file.OutEnds...)
+		config.Devices = append(config.Devices, file.Devices...)
+		for _, rule := range file.Rules {
+			if rule.UUID == "" {
+				return nil, fmt.Errorf("invalid config file %s: rule '%s' missing uuid", path, rule.Name)
+			}
+			if rule.Type == "" {
+				rule.Type = "lua"
+			}
+			if rule.Success == "" {
+				rule.Success = "function Success() end"
+			}
+			if rule.Failed == "" {
+				rule.Failed = "function Failed(error) end"
+			}
+			rule.FromSource = nonNilList(rule.FromSource)
+			rule.FromDevice = nonNilList(rule.FromDevice)
+			rule.FromEvent = nonNilList(rule.FromEvent)
+			rule.ToRules = nonNilList(rule.ToRules)
+			rule.ToTargets = nonNilList(rule.ToTargets)
+			rule.ToDevices = nonNilList(rule.ToDevices)
+			config.Rules = append(config.Rules, rule)
+		}
+		for _, app := range file.Apps {
+			if app.UUID == "" {
+				return nil, fmt.Errorf("invalid config file %s: app '%s' missing uuid", path, app.Name)
+			}
+			script := []byte(app.LuaSource)
+			if app.Script != "" {
+				if script, err = os.ReadFile(filepath.Join(dir, app.Script)); err != nil {
+					return nil, fmt.Errorf("read app [%s] script error: %s", app.UUID, err)
+				}
+			}
+			config.Apps = append(config.Apps, app)
+			config.Scripts[app.UUID] = script
+		}
+	}
+	// 规则绑定到输入资源和设备上
+	bind := func(resources []Resource, from func(Rule) []string) {
+		for i := range resources {
+			resources[i].BindRules = []string{}
+			for _, rule := range config.Rules {
+				if utils.SContains(from(rule), resources[i].UUID) {
+					resources[i].BindRules = append(resources[i].BindRules, rule.UUID)
+				}
+			}
+			sort.Strings(resources[i].BindRules)
+		}
+	}
+	bind(config.InEnds, func(rule Rule) []string { return rule.FromSource })
+	bind(config.Devices, func(rule Rule) []string { return rule.FromDevice })
+	return config, nil
+}
+
+func configFiles(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+			if !d.IsDir() {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+/*
+*
+* 配置目录的指纹, 任何一个文件(包括应用脚本)有变化指纹就会变
+*
+ */
+func Fingerprint(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash.Write([]byte(path))
+		hash.Write(content)
+		return nil
+	})
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
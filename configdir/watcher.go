@@ -0,0 +1,127 @@
+package configdir
+
+import (
+	"context"
+	"time"
+
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+/*
+*
+* 同步的结果: 新建, 修改, 删除的资源 UUID(按资源类型分), 以及加载失败的错误
+*
+ */
+type Report struct {
+	Created    map[string][]string
+	Updated    map[string][]string
+	Deleted    map[string][]string
+	LoadErrors []string
+}
+
+/*
+*
+* 配置的存放方: 把目录里的配置写到数据库, load 为 true 的时候顺便热加载有变化的资源;
+* 目前是 HTTP 接口插件, 数据库在它那里
+*
+ */
+type Store interface {
+	ApplyConfigDir(config *Config, load bool) (*Report, error)
+}
+
+/*
+*
+* 读一次配置目录, 同步到 store; 配置有错误的时候什么都不改
+*
+ */
+func Reconcile(dir string, store Store, load bool) (*Report, error) {
+	config, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	return store.ApplyConfigDir(config, load)
+}
+
+func logReport(dir string, report *Report) {
+	count := func(resources map[string][]string) int {
+		total := 0
+		for _, uuids := range resources {
+			total += len(uuids)
+		}
+		return total
+	}
+	glogger.GLogger.Infof("Config directory [%s] reconciled, created: %d, updated: %d, deleted: %d",
+		dir, count(report.Created), count(report.Updated), count(report.Deleted))
+	for _, err := range report.LoadErrors {
+		glogger.GLogger.Error("Config directory load failed:", err)
+	}
+}
+
+/*
+*
+* 目录模式启动: 先把配置目录同步到数据库, 然后按正常流程从数据库加载
+*
+ */
+func Sync(dir string, store Store) error {
+	report, err := Reconcile(dir, store, false)
+	if err != nil {
+		return err
+	}
+	logReport(dir, report)
+	return nil
+}
+
+/*
+*
+* 监听配置目录: 定时检查, 有变化就同步; 配置有错误的时候保持现有配置不变, 等下一次修改
+*
+ */
+type Watcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func Watch(dir string, interval time.Duration, store Store) *Watcher {
+	fingerprint, _ := Fingerprint(dir)
+	ctx, cancel := context.WithCancel(typex.GCTX)
+	w := &Watcher{cancel: cancel, done: make(chan struct{})}
+	go func(ctx context.Context) {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			newFingerprint, err := Fingerprint(dir)
+			if err != nil {
+				glogger.GLogger.Error("Read config directory error:", err)
+				continue
+			}
+			if newFingerprint == fingerprint {
+				continue
+			}
+			fingerprint = newFingerprint
+			report, err := Reconcile(dir, store, true)
+			if err != nil {
+				glogger.GLogger.Error("Reconcile config directory error:", err)
+				continue
+			}
+			logReport(dir, report)
+		}
+	}(ctx)
+	return w
+}
+
+/*
+*
+* 停止监听, 等正在进行的同步做完再返回
+*
+ */
+func (w *Watcher) Stop() {
+	w.cancel()
+	<-w.done
+}
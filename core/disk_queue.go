@@ -0,0 +1,304 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 离线缓存的溢出策略
+const (
+	DROP_OLDEST string = "DROP_OLDEST" // 丢弃最老的数据, 默认
+	DROP_NEWEST string = "DROP_NEWEST" // 丢弃新来的数据
+)
+
+// 每条记录的头: 8字节时间戳(纳秒) + 4字节长度
+const _DISK_QUEUE_HEADER_SIZE int64 = 12
+
+var errDiskQueueFull = errors.New("disk queue is full, new data dropped")
+
+/*
+*
+* DiskQueue: 基于文件的持久化队列, 每个 OutEnd 一个目录:
+*   - queue.dat: 追加写的数据文件
+*   - queue.idx: 当前读指针
+* 数据全部消费完以后会把文件截断, 避免无限增长。
+*
+ */
+type DiskQueue struct {
+	locker       sync.Mutex
+	replayLocker sync.Mutex // 同一时间只有一个 Replay, 防止重复发送
+	config       common.OutEndCacheConfig
+	dir          string
+	file         *os.File
+	head         int64 // 读指针
+	tail         int64 // 写指针, 即文件大小
+	count        int
+	epoch        uint64 // 每次截断文件加一, 截断以后偏移量会重复
+	dirty        bool   // 读指针还没有落盘
+}
+
+/*
+*
+* 打开(或者新建)一个持久化队列, 上次没有发完的数据会被保留下来
+*
+ */
+func NewDiskQueue(dir string, config common.OutEndCacheConfig) (typex.XPersistQueue, error) {
+	if config.DropPolicy == "" {
+		config.DropPolicy = DROP_OLDEST
+	}
+	if config.DropPolicy != DROP_OLDEST && config.DropPolicy != DROP_NEWEST {
+		return nil, fmt.Errorf("unsupported drop policy:%s", config.DropPolicy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "queue.dat"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dq := &DiskQueue{config: config, dir: dir, file: file}
+	if err := dq.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return dq, nil
+}
+
+/*
+*
+* 恢复读写指针, 末尾不完整的记录(比如写一半断电了)直接截掉
+*
+ */
+func (dq *DiskQueue) recover() error {
+	stat, err := dq.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if bytes, err := os.ReadFile(filepath.Join(dq.dir, "queue.idx")); err == nil {
+		if head, err := strconv.ParseInt(string(bytes), 10, 64); err == nil && head <= size {
+			dq.head = head
+		}
+	}
+	offset := dq.head
+	for offset < size {
+		_, length, err := dq.readHeader(offset)
+		if err != nil || offset+_DISK_QUEUE_HEADER_SIZE+length > size {
+			glogger.GLogger.Warnf("Disk queue [%s] has broken tail at %d, truncated", dq.dir, offset)
+			break
+		}
+		offset += _DISK_QUEUE_HEADER_SIZE + length
+		dq.count++
+	}
+	dq.tail = offset
+	return dq.file.Truncate(offset)
+}
+
+func (dq *DiskQueue) readHeader(offset int64) (time.Time, int64, error) {
+	header := make([]byte, _DISK_QUEUE_HEADER_SIZE)
+	if _, err := dq.file.ReadAt(header, offset); err != nil {
+		return time.Time{}, 0, err
+	}
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+	length := int64(binary.BigEndian.Uint32(header[8:12]))
+	return ts, length, nil
+}
+
+/*
+*
+* 写入队尾
+*
+ */
+func (dq *DiskQueue) Push(data string) error {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	recordSize := _DISK_QUEUE_HEADER_SIZE + int64(len(data))
+	if dq.config.MaxBytes > 0 {
+		if recordSize > dq.config.MaxBytes {
+			return errDiskQueueFull
+		}
+		for dq.tail-dq.head+recordSize > dq.config.MaxBytes {
+			if dq.config.DropPolicy == DROP_NEWEST {
+				return errDiskQueueFull
+			}
+			if err := dq.skip(); err != nil {
+				return err
+			}
+		}
+		if err := dq.flushIndex(); err != nil {
+			return err
+		}
+	}
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(record[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(data)))
+	copy(record[_DISK_QUEUE_HEADER_SIZE:], data)
+	if _, err := dq.file.WriteAt(record, dq.tail); err != nil {
+		return err
+	}
+	if err := dq.file.Sync(); err != nil {
+		return err
+	}
+	dq.tail += recordSize
+	dq.count++
+	return nil
+}
+
+/*
+*
+* 按顺序重放数据, 直到队列为空或者回调失败; 失败的那条数据会保留在队头。
+* 回调一般是网络发送, 读出一条以后先放锁再发, 不挡住 Push;
+* 读指针在这一批发完以后才落盘一次, 中途断电的时候会重发, 不会丢
+*
+ */
+func (dq *DiskQueue) Replay(f func(data string) error) (int, error) {
+	dq.replayLocker.Lock()
+	defer dq.replayLocker.Unlock()
+	defer func() {
+		dq.locker.Lock()
+		defer dq.locker.Unlock()
+		if err := dq.flushIndex(); err != nil {
+			glogger.GLogger.Error("Disk queue save index error:", dq.dir, ", ", err)
+		}
+	}()
+	replayed := 0
+	for {
+		data, head, epoch, ok, err := dq.peek()
+		if err != nil || !ok {
+			return replayed, err
+		}
+		if err := f(data); err != nil {
+			return replayed, err
+		}
+		if err := dq.ack(head, epoch); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+/*
+*
+* 读出队头的一条数据, 过期的顺便丢掉; 返回读的位置, 确认的时候用
+*
+ */
+func (dq *DiskQueue) peek() (string, int64, uint64, bool, error) {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	for dq.head < dq.tail {
+		ts, length, err := dq.readHeader(dq.head)
+		if err != nil {
+			return "", 0, 0, false, err
+		}
+		if dq.config.Ttl > 0 &&
+			time.Since(ts) > time.Duration(dq.config.Ttl)*time.Second {
+			if err := dq.skip(); err != nil {
+				return "", 0, 0, false, err
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := dq.file.ReadAt(data, dq.head+_DISK_QUEUE_HEADER_SIZE); err != nil && err != io.EOF {
+			return "", 0, 0, false, err
+		}
+		return string(data), dq.head, dq.epoch, true, nil
+	}
+	return "", 0, 0, false, nil
+}
+
+/*
+*
+* 确认发送成功; 发送期间这条数据可能已经被 Push 按 DROP_OLDEST 挤掉了, 这时候什么都不做
+*
+ */
+func (dq *DiskQueue) ack(head int64, epoch uint64) error {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	if dq.head != head || dq.epoch != epoch {
+		return nil
+	}
+	return dq.skip()
+}
+
+/*
+*
+* 丢弃队头的一条数据, 只改内存里的读指针, 由调用者 flushIndex 落盘;
+* 截断文件的时候例外, 索引当场落盘
+*
+ */
+func (dq *DiskQueue) skip() error {
+	if dq.head >= dq.tail {
+		return nil
+	}
+	_, length, err := dq.readHeader(dq.head)
+	if err != nil {
+		return err
+	}
+	dq.head += _DISK_QUEUE_HEADER_SIZE + length
+	dq.count--
+	dq.dirty = true
+	// 全部消费完了, 截断文件
+	if dq.head >= dq.tail {
+		if err := dq.file.Truncate(0); err != nil {
+			return err
+		}
+		dq.head, dq.tail, dq.count = 0, 0, 0
+		dq.epoch++
+		// 文件已经截断了, 索引要马上跟上, 不然断电以后旧索引会指到新写进来的数据中间
+		return dq.flushIndex()
+	}
+	return nil
+}
+
+/*
+*
+* 读指针落盘: 先写临时文件再改名, 断电的时候不会留下写了一半的索引
+*
+ */
+func (dq *DiskQueue) flushIndex() error {
+	if !dq.dirty {
+		return nil
+	}
+	path := filepath.Join(dq.dir, "queue.idx")
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, []byte(strconv.FormatInt(dq.head, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return err
+	}
+	dq.dirty = false
+	return nil
+}
+
+func (dq *DiskQueue) Count() int {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	return dq.count
+}
+
+func (dq *DiskQueue) Size() int64 {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	return dq.tail - dq.head
+}
+
+func (dq *DiskQueue) Close() error {
+	dq.locker.Lock()
+	defer dq.locker.Unlock()
+	if err := dq.flushIndex(); err != nil {
+		glogger.GLogger.Error("Disk queue save index error:", dq.dir, ", ", err)
+	}
+	return dq.file.Close()
+}
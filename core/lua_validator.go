@@ -33,6 +33,9 @@ func ExecuteFailed(vm *lua.LState, arg lua.LValue) (interface{}, error) {
 *
  */
 func ExecuteExpression(rule *typex.Rule, env map[string]interface{}) (interface{}, error) {
+	if rule.ExprVM == nil {
+		return nil, errors.New("expression not compiled:" + rule.UUID)
+	}
 	return expr.Run(rule.ExprVM, env)
 }
 
@@ -42,6 +45,17 @@ func ExecuteExpression(rule *typex.Rule, env map[string]interface{}) (interface{
 *
  */
 func ExecuteActions(rule *typex.Rule, arg lua.LValue) (lua.LValue, error) {
+	value, _, err := ExecuteActionsToEnd(rule, arg)
+	return value, err
+}
+
+/*
+*
+* 和 ExecuteActions 一样, 多返回一个值表示 Actions 是否全部执行完了,
+* 中途有回调返回 false 的时候是 false
+*
+ */
+func ExecuteActionsToEnd(rule *typex.Rule, arg lua.LValue) (lua.LValue, bool, error) {
 	// 原始 lua 数据结构
 	luaOriginTable := rule.LuaVM.GetGlobal(ACTIONS_KEY)
 	if luaOriginTable != nil && luaOriginTable.Type() == lua.LTTable {
@@ -58,17 +72,17 @@ func ExecuteActions(rule *typex.Rule, arg lua.LValue) (lua.LValue, error) {
 			}
 		})
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		if rule.Status != typex.RULE_STOP {
-			return typex.RunPipline(rule.LuaVM, funcs, arg)
+			return typex.RunPiplineToEnd(rule.LuaVM, funcs, arg)
 		}
 		// if stopped, log warning information
 		glogger.GLogger.Warn("Rule has stopped:" + rule.UUID)
-		return lua.LNil, nil
+		return lua.LNil, false, nil
 
 	} else {
-		return nil, errors.New("'Actions' not a lua table or not exist")
+		return nil, false, errors.New("'Actions' not a lua table or not exist")
 	}
 }
 
@@ -129,14 +143,18 @@ func VerifyLuaSyntax(r *typex.Rule) error {
 
 /*
 *
-* 验证expr表达式的语法
+* 验证expr表达式的语法, 验证通过以后把编译结果交给规则
+* 注意: 数据的字段是运行时才知道的, 所以编译的时候不能指定 Env, 否则未知变量会报错
 *
  */
 func VerifyExprSyntax(r *typex.Rule) error {
-	env := map[string]interface{}{}
-	_, err := expr.Compile(r.Expression, expr.Env(env))
+	if r.Expression == "" {
+		return errors.New("'expression' can not be empty")
+	}
+	program, err := expr.Compile(r.Expression)
 	if err != nil {
 		return err
 	}
+	r.ExprVM = program
 	return nil
 }
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+)
+
+/*
+*
+* ReportFilter: 轮询类设备的变化上报过滤器, 每个设备一个。
+* 设备每次采集到的快照是 {"tag": 点位数据} 格式的 JSON, 点位数据可以是:
+*   - 对象: 优先比较 dataValue 字段, 没有的时候比较 value 字段(Modbus, OPCUA, Bacnet)
+*   - 普通值: 直接比较
+* 数值(包括能转成数字的字符串)按死区比较, Modbus 的十六进制原始值只比较是否相等;
+* 比较的基准是上次上报出去的值, 这样缓慢的漂移累计超过死区以后也会被上报;
+* 点位的数据质量(quality 字段)变了的时候不管值有没有变都上报。
+*
+ */
+type ReportFilter struct {
+	locker      sync.Mutex
+	config      common.ReportConfig
+	lastValues  map[string]interface{}
+	lastQuality map[string]string
+	lastReport  time.Time
+}
+
+func NewReportFilter(config common.ReportConfig) (*ReportFilter, error) {
+	if err := checkDeadband("", config.DeadbandType, config.Deadband); err != nil {
+		return nil, err
+	}
+	for tag, deadband := range config.Tags {
+		if err := checkDeadband(tag, deadband.DeadbandType, deadband.Deadband); err != nil {
+			return nil, err
+		}
+	}
+	if config.Heartbeat < 0 {
+		return nil, fmt.Errorf("'heartbeat' must not be negative")
+	}
+	return &ReportFilter{
+		config:      config,
+		lastValues:  map[string]interface{}{},
+		lastQuality: map[string]string{},
+	}, nil
+}
+
+func checkDeadband(tag string, deadbandType string, deadband float64) error {
+	if deadbandType != "" && deadbandType != common.DEADBAND_ABS &&
+		deadbandType != common.DEADBAND_PERCENT {
+		return fmt.Errorf("tag [%s] unsupported deadband type:%s", tag, deadbandType)
+	}
+	if deadband < 0 {
+		return fmt.Errorf("tag [%s] deadband must not be negative", tag)
+	}
+	return nil
+}
+
+/*
+*
+* 过滤一次快照, 返回需要上报的数据以及是否需要上报;
+* 没有启用或者快照不是 JSON 对象的时候原样上报
+*
+ */
+func (f *ReportFilter) Filter(snapshot []byte) ([]byte, bool) {
+	if f == nil || !f.config.Enable {
+		return snapshot, true
+	}
+	tags := map[string]json.RawMessage{}
+	if err := json.Unmarshal(snapshot, &tags); err != nil {
+		return snapshot, true
+	}
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	now := time.Now()
+	heartbeat := f.config.Heartbeat > 0 &&
+		now.Sub(f.lastReport) >= time.Duration(f.config.Heartbeat)*time.Second
+	changed := map[string]json.RawMessage{}
+	for tag, raw := range tags {
+		value := reportValue(raw)
+		last, ok := f.lastValues[tag]
+		if !ok || f.isChanged(tag, last, value) ||
+			f.lastQuality[tag] != reportQuality(raw) {
+			changed[tag] = raw
+		}
+	}
+	if len(changed) == 0 && !heartbeat {
+		return nil, false
+	}
+	// 心跳或者全量模式都要把所有点位的基准更新掉
+	reported := changed
+	if heartbeat || !f.config.ChangedOnly {
+		reported = tags
+	}
+	for tag, raw := range reported {
+		f.lastValues[tag] = reportValue(raw)
+		f.lastQuality[tag] = reportQuality(raw)
+	}
+	f.lastReport = now
+	if len(reported) == len(tags) {
+		return snapshot, true
+	}
+	bytes, _ := json.Marshal(reported)
+	return bytes, true
+}
+
+// 只比较是否相等的原始值
+type rawReportValue string
+
+// 取出点位里用来比较的值
+func reportValue(raw json.RawMessage) interface{} {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return string(raw)
+	}
+	if object, ok := value.(map[string]interface{}); ok {
+		if dataValue, ok := object["dataValue"]; ok {
+			return dataValue
+		}
+		if v, ok := object["value"]; ok {
+			// 没有配置数据类型的 Modbus 点位, value 是原始的十六进制, 不能当数字比较
+			if _, isRegister := object["quantity"]; isRegister {
+				return rawReportValue(fmt.Sprintf("%v", v))
+			}
+			return v
+		}
+	}
+	return value
+}
+
+// 点位的数据质量, 没有的时候是空
+func reportQuality(raw json.RawMessage) string {
+	point := struct {
+		Quality string `json:"quality"`
+	}{}
+	json.Unmarshal(raw, &point)
+	return point.Quality
+}
+
+func (f *ReportFilter) isChanged(tag string, last interface{}, value interface{}) bool {
+	deadbandType, deadband := f.config.DeadbandType, f.config.Deadband
+	if tagDeadband, ok := f.config.Tags[tag]; ok {
+		deadbandType, deadband = tagDeadband.DeadbandType, tagDeadband.Deadband
+	}
+	lastList, ok1 := last.([]interface{})
+	valueList, ok2 := value.([]interface{})
+	if ok1 && ok2 {
+		if len(lastList) != len(valueList) {
+			return true
+		}
+		for i := range valueList {
+			if exceedDeadband(deadbandType, deadband, lastList[i], valueList[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	return exceedDeadband(deadbandType, deadband, last, value)
+}
+
+func exceedDeadband(deadbandType string, deadband float64, last interface{}, value interface{}) bool {
+	lastNumber, ok1 := reportNumber(last)
+	number, ok2 := reportNumber(value)
+	if !ok1 || !ok2 {
+		return !reflect.DeepEqual(last, value)
+	}
+	delta := math.Abs(number - lastNumber)
+	if deadbandType == common.DEADBAND_PERCENT {
+		return delta > math.Abs(lastNumber)*deadband/100
+	}
+	return delta > deadband
+}
+
+func reportNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
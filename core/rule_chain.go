@@ -0,0 +1,40 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+*
+* 检查规则链有没有环, graph 是所有规则的 UUID 到下游规则 UUID 的映射,
+* 从 uuid 出发深度优先遍历, 遇到还在路径上的规则就是成环了
+*
+ */
+func VerifyRuleChain(uuid string, graph map[string][]string) error {
+	path := []string{}
+	onPath := map[string]bool{}
+	done := map[string]bool{}
+	var visit func(string) error
+	visit = func(current string) error {
+		if onPath[current] {
+			return fmt.Errorf("rule chain has cycle: %s -> %s",
+				strings.Join(path, " -> "), current)
+		}
+		if done[current] {
+			return nil
+		}
+		path = append(path, current)
+		onPath[current] = true
+		for _, next := range graph[current] {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		onPath[current] = false
+		done[current] = true
+		return nil
+	}
+	return visit(uuid)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"github.com/BeatTime/bacnet"
 	"github.com/BeatTime/bacnet/btypes"
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
 	"github.com/hootrhino/rulex/utils"
@@ -34,6 +36,8 @@ type bacnetIpNodeConfig struct {
 type BacnetIpConfig struct {
 	CommonConfig bacnetIpCommonConfig `json:"commonConfig"`
 	NodeConfig   []bacnetIpNodeConfig `json:"nodeConfig"`
+	// 变化上报, 没有启用的时候每次采集都上报全量快照
+	ReportConfig common.ReportConfig `json:"reportConfig" title:"变化上报"`
 }
 
 type GenericBacnetIpDevice struct {
@@ -42,6 +46,7 @@ type GenericBacnetIpDevice struct {
 	RuleEngine     typex.RuleX
 	bacnetIpConfig BacnetIpConfig
 	devId          string
+	reporter       *core.ReportFilter
 
 	// Bacnet
 	bacnetClient bacnet.Client
@@ -64,7 +69,8 @@ func (dev *GenericBacnetIpDevice) Init(devId string, configMap map[string]interf
 	if err != nil {
 		return err
 	}
-	return nil
+	dev.reporter, err = core.NewReportFilter(dev.bacnetIpConfig.ReportConfig)
+	return err
 }
 
 func (dev *GenericBacnetIpDevice) Start(cctx typex.CCTX) error {
@@ -129,8 +135,8 @@ func (dev *GenericBacnetIpDevice) Start(cctx typex.CCTX) error {
 			read, err2 := dev.read()
 			if err2 != nil {
 				glogger.GLogger.Error(err2)
-			} else {
-				dev.RuleEngine.WorkDevice(dev.Details(), string(read))
+			} else if data, ok := dev.reporter.Filter(read); ok {
+				dev.RuleEngine.WorkDevice(dev.Details(), string(data))
 			}
 			<-ticker.C
 		}
@@ -149,19 +155,28 @@ func (dev *GenericBacnetIpDevice) OnRead(cmd []byte, data []byte) (int, error) {
 	return len, nil
 }
 
+// 读失败的点位也输出, 质量是 BAD_COMM
 func (dev *GenericBacnetIpDevice) read() ([]byte, error) {
-	retMap := map[string]string{}
+	retMap := map[string]common.QualityValue{}
 	for _, v := range dev.bacnetIpConfig.NodeConfig {
 		property, err := dev.bacnetClient.ReadProperty(dev.remoteDev, v.property)
+		if err == nil && len(property.Object.Properties) == 0 {
+			err = errors.New("empty property")
+		}
 		if err != nil {
-			glogger.GLogger.Error("read failed. tag = %v, err=%v", v.Tag, err)
+			glogger.GLogger.Errorf("read failed. tag = %v, err=%v", v.Tag, err)
+			retMap[v.Tag] = common.QualityValue{
+				DataQuality: common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{}, err),
+			}
 			continue
 		}
-		value := fmt.Sprintf("%v", property.Object.Properties[0].Data)
-		retMap[v.Tag] = value
+		retMap[v.Tag] = common.QualityValue{
+			Value:       fmt.Sprintf("%v", property.Object.Properties[0].Data),
+			DataQuality: common.NewDataQuality(common.QUALITY_GOOD, time.Time{}, nil),
+		}
 	}
 	bytes, _ := json.Marshal(retMap)
-	glogger.GLogger.Debugf("%v", retMap)
+	glogger.GLogger.Debugf("%s", bytes)
 	return bytes, nil
 }
 
@@ -45,6 +45,8 @@ type _GMODCommonConfig struct {
 	Timeout     int    `json:"timeout" validate:"required" title:"连接超时"`
 	AutoRequest bool   `json:"autoRequest" title:"启动轮询"`
 	Frequency   int64  `json:"frequency" validate:"required" title:"采集频率"`
+	// 地址间隔不超过 MaxGap 的点位合并成一次读, 中间空出来的寄存器也会被读出来
+	MaxGap int `json:"maxGap" title:"合并间隔" info:"0表示只合并连续地址"`
 }
 type _GMODHostConfig struct {
 	Host string `json:"host" title:"服务地址"`
@@ -56,6 +58,8 @@ type _GMODConfig struct {
 	RtuConfig    common.CommonUartConfig `json:"rtuConfig"`
 	TcpConfig    _GMODHostConfig         `json:"tcpConfig"`
 	Registers    []common.RegisterRW     `json:"registers" validate:"required" title:"寄存器配置"`
+	// 变化上报, 没有启用的时候每次采集都上报全量快照
+	ReportConfig common.ReportConfig `json:"reportConfig" title:"变化上报"`
 }
 type generic_modbus_device struct {
 	typex.XStatus ``
@@ -67,6 +71,7 @@ type generic_modbus_device struct {
 	mainConfig    _GMODConfig
 	locker        sync.Locker
 	retryTimes    int
+	reporter      *core.ReportFilter
 }
 
 /*
@@ -110,6 +115,9 @@ func (mdev *generic_modbus_device) Init(devId string, configMap map[string]inter
 		return errors.New("'frequency' must grate than 50 millisecond")
 
 	}
+	if mdev.mainConfig.CommonConfig.MaxGap < 0 || mdev.mainConfig.CommonConfig.MaxGap > 124 {
+		return errors.New("'maxGap' must between 0 and 124")
+	}
 	// 检查Tag有没有重复
 	tags := []string{}
 	for _, register := range mdev.mainConfig.Registers {
@@ -118,10 +126,20 @@ func (mdev *generic_modbus_device) Init(devId string, configMap map[string]inter
 	if utils.IsListDuplicated(tags) {
 		return errors.New("tag duplicated")
 	}
+	// 检查数据类型和字节序
+	for _, register := range mdev.mainConfig.Registers {
+		if err := driver.CheckRegisterDataType(register); err != nil {
+			return err
+		}
+	}
 	if !utils.SContains([]string{"RTU", "TCP"}, mdev.mainConfig.CommonConfig.Mode) {
 		return errors.New("unsupported mode, only can be one of 'TCP' or 'RTU'")
 	}
-
+	reporter, err := core.NewReportFilter(mdev.mainConfig.ReportConfig)
+	if err != nil {
+		return err
+	}
+	mdev.reporter = reporter
 	return nil
 }
 
@@ -149,7 +167,8 @@ func (mdev *generic_modbus_device) Start(cctx typex.CCTX) error {
 		client := modbus.NewClient(mdev.rtuHandler)
 		mdev.driver = driver.NewModBusRtuDriver(mdev.Details(),
 			mdev.RuleEngine, mdev.mainConfig.Registers, mdev.rtuHandler,
-			client, mdev.mainConfig.CommonConfig.Frequency)
+			client, mdev.mainConfig.CommonConfig.Frequency,
+			uint16(mdev.mainConfig.CommonConfig.MaxGap))
 	}
 	if mdev.mainConfig.CommonConfig.Mode == "TCP" {
 		mdev.tcpHandler = modbus.NewTCPClientHandler(
@@ -166,7 +185,8 @@ func (mdev *generic_modbus_device) Start(cctx typex.CCTX) error {
 		client := modbus.NewClient(mdev.tcpHandler)
 		mdev.driver = driver.NewModBusTCPDriver(mdev.Details(),
 			mdev.RuleEngine, mdev.mainConfig.Registers, mdev.tcpHandler, client,
-			mdev.mainConfig.CommonConfig.Frequency)
+			mdev.mainConfig.CommonConfig.Frequency,
+			uint16(mdev.mainConfig.CommonConfig.MaxGap))
 	}
 	//---------------------------------------------------------------------------------
 	// Start
@@ -192,8 +212,8 @@ func (mdev *generic_modbus_device) Start(cctx typex.CCTX) error {
 			if err != nil {
 				glogger.GLogger.Error(err)
 				mdev.retryTimes++
-			} else {
-				mdev.RuleEngine.WorkDevice(mdev.Details(), string(buffer[:n]))
+			} else if data, ok := mdev.reporter.Filter(buffer[:n]); ok {
+				mdev.RuleEngine.WorkDevice(mdev.Details(), string(data))
 			}
 		}
 
@@ -52,12 +52,16 @@ const (
 )
 
 type modbusPointPosition struct {
-	DeviceUuid   string `json:"deviceUuid"  `
-	Tag          string `json:"tag"         `
-	Function     int    `json:"function"    `
-	SlaverId     byte   `json:"slaverId"    `
-	StartAddress uint16 `json:"startAddress"`
-	Quality      uint16 `json:"quality"     `
+	DeviceUuid   string  `json:"deviceUuid"  `
+	Tag          string  `json:"tag"         `
+	Function     int     `json:"function"    `
+	SlaverId     byte    `json:"slaverId"    `
+	StartAddress uint16  `json:"startAddress"`
+	Quality      uint16  `json:"quality"     `
+	DataType     string  `json:"dataType"    `
+	DataOrder    string  `json:"dataOrder"   `
+	Weight       float64 `json:"weight"      `
+	InitValue    float64 `json:"initValue"   `
 }
 
 type _GMODExcelCommonConfig struct {
@@ -65,6 +69,8 @@ type _GMODExcelCommonConfig struct {
 	Timeout     int    `json:"timeout" validate:"required" title:"连接超时"`
 	AutoRequest bool   `json:"autoRequest" title:"启动轮询"`
 	Frequency   int64  `json:"frequency" validate:"required" title:"采集频率"`
+	// 地址间隔不超过 MaxGap 的点位合并成一次读, 中间空出来的寄存器也会被读出来
+	MaxGap int `json:"maxGap" title:"合并间隔" info:"0表示只合并连续地址"`
 }
 type _GMODExcelHostConfig struct {
 	Host string `json:"host" title:"服务地址"`
@@ -76,6 +82,8 @@ type _GMODExcelConfig struct {
 	RtuConfig    common.CommonUartConfig `json:"rtuConfig" validate:"required"`
 	TcpConfig    _GMODExcelHostConfig    `json:"tcpConfig" validate:"required"`
 	Registers    []common.RegisterRW     `json:"registers" validate:"required" title:"寄存器配置"`
+	// 变化上报, 没有启用的时候每次采集都上报全量快照
+	ReportConfig common.ReportConfig `json:"reportConfig" title:"变化上报"`
 }
 type generic_modbus_excel_device struct {
 	typex.XStatus ``
@@ -87,6 +95,7 @@ type generic_modbus_excel_device struct {
 	mainConfig    _GMODExcelConfig
 	locker        sync.Locker
 	retryTimes    int
+	reporter      *core.ReportFilter
 	sqliteDb      *gorm.DB
 }
 
@@ -134,6 +143,9 @@ func (mdev *generic_modbus_excel_device) Init(devId string, configMap map[string
 		return errors.New("'frequency' must grate than 50 millisecond")
 
 	}
+	if mdev.mainConfig.CommonConfig.MaxGap < 0 || mdev.mainConfig.CommonConfig.MaxGap > 124 {
+		return errors.New("'maxGap' must between 0 and 124")
+	}
 
 	// 初始哈DB
 	mdev.sqliteDb, err = gorm.Open(sqlite.Open(DEFAULT_DB_PATH), &gorm.Config{
@@ -153,11 +165,15 @@ func (mdev *generic_modbus_excel_device) Init(devId string, configMap map[string
 	if len(list) > 0 {
 		for _, v := range list {
 			mdev.mainConfig.Registers = append(mdev.mainConfig.Registers, common.RegisterRW{
-				Tag:      v.Tag,
-				Function: v.Function,
-				SlaverId: v.SlaverId,
-				Address:  v.StartAddress,
-				Quantity: v.Quality,
+				Tag:       v.Tag,
+				Function:  v.Function,
+				SlaverId:  v.SlaverId,
+				Address:   v.StartAddress,
+				Quantity:  v.Quality,
+				DataType:  v.DataType,
+				DataOrder: v.DataOrder,
+				Weight:    v.Weight,
+				InitValue: v.InitValue,
 			})
 		}
 	}
@@ -170,11 +186,17 @@ func (mdev *generic_modbus_excel_device) Init(devId string, configMap map[string
 	if utils.IsListDuplicated(tags) {
 		return errors.New("tag duplicated")
 	}
+	// 检查数据类型和字节序
+	for _, register := range mdev.mainConfig.Registers {
+		if err := driver.CheckRegisterDataType(register); err != nil {
+			return err
+		}
+	}
 	if !utils.SContains([]string{"RTU", "TCP"}, mdev.mainConfig.CommonConfig.Mode) {
 		return errors.New("unsupported mode, only can be one of 'TCP' or 'RTU'")
 	}
-
-	return nil
+	mdev.reporter, err = core.NewReportFilter(mdev.mainConfig.ReportConfig)
+	return err
 }
 
 // 启动
@@ -201,7 +223,8 @@ func (mdev *generic_modbus_excel_device) Start(cctx typex.CCTX) error {
 		client := modbus.NewClient(mdev.rtuHandler)
 		mdev.driver = driver.NewModBusRtuDriver(mdev.Details(),
 			mdev.RuleEngine, mdev.mainConfig.Registers, mdev.rtuHandler,
-			client, mdev.mainConfig.CommonConfig.Frequency)
+			client, mdev.mainConfig.CommonConfig.Frequency,
+			uint16(mdev.mainConfig.CommonConfig.MaxGap))
 	}
 	if mdev.mainConfig.CommonConfig.Mode == "TCP" {
 		mdev.tcpHandler = modbus.NewTCPClientHandler(
@@ -217,7 +240,8 @@ func (mdev *generic_modbus_excel_device) Start(cctx typex.CCTX) error {
 		client := modbus.NewClient(mdev.tcpHandler)
 		mdev.driver = driver.NewModBusTCPDriver(mdev.Details(),
 			mdev.RuleEngine, mdev.mainConfig.Registers, mdev.tcpHandler, client,
-			mdev.mainConfig.CommonConfig.Frequency)
+			mdev.mainConfig.CommonConfig.Frequency,
+			uint16(mdev.mainConfig.CommonConfig.MaxGap))
 	}
 	// ---------------------------------------------------------------------------------
 	// Start
@@ -252,8 +276,8 @@ func (mdev *generic_modbus_excel_device) Start(cctx typex.CCTX) error {
 			if err != nil {
 				glogger.GLogger.Error(err)
 				mdev.retryTimes++
-			} else {
-				mdev.RuleEngine.WorkDevice(mdev.Details(), string(buffer[:n]))
+			} else if data, ok := mdev.reporter.Filter(buffer[:n]); ok {
+				mdev.RuleEngine.WorkDevice(mdev.Details(), string(data))
 			}
 		}
 
@@ -0,0 +1,210 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/driver"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+	serial "github.com/wwhai/goserial"
+)
+
+// Modbus 从机: 把网关采集到的数据通过寄存器重新暴露给 SCADA 之类的主站
+//
+// 规则里用 rulexlib:SetRegister(uuid, tag, value) 更新寄存器; 主站写线圈或者保持寄存器以后,
+// 被写到的 Tag 会作为事件推给规则引擎:
+//
+//	{
+//	    "event":"write",
+//	    "tag":"setPoint",
+//	    "type":"HOLDING_REGISTER",
+//	    "address":0,
+//	    "quantity":2,
+//	    "values":[1, 2]
+//	}
+type _GMODSlaverCommonConfig struct {
+	Mode     string `json:"mode" validate:"required" title:"工作模式" info:"RTU/TCP"`
+	SlaverId byte   `json:"slaverId" validate:"required" title:"从机ID"`
+}
+
+type _GMODSlaverConfig struct {
+	CommonConfig _GMODSlaverCommonConfig `json:"commonConfig" validate:"required"`
+	RtuConfig    common.CommonUartConfig `json:"rtuConfig"`
+	TcpConfig    _GMODHostConfig         `json:"tcpConfig"`
+	Registers    []common.SlaverRegister `json:"registers" validate:"required" title:"寄存器映射"`
+}
+
+type genericModbusSlaver struct {
+	typex.XStatus
+	lock       sync.Mutex
+	status     typex.DeviceState
+	RuleEngine typex.RuleX
+	driver     *driver.ModbusSlaverDriver
+	serialPort serial.Port
+	mainConfig _GMODSlaverConfig
+}
+
+func NewGenericModbusSlaver(e typex.RuleX) typex.XDevice {
+	mdev := new(genericModbusSlaver)
+	mdev.RuleEngine = e
+	mdev.mainConfig = _GMODSlaverConfig{
+		CommonConfig: _GMODSlaverCommonConfig{Mode: "TCP", SlaverId: 1},
+		TcpConfig:    _GMODHostConfig{Host: "0.0.0.0", Port: 502},
+		RtuConfig: common.CommonUartConfig{
+			Timeout:  3000,
+			Uart:     "/dev/ttyS1",
+			BaudRate: 9600,
+			DataBits: 8,
+			Parity:   "N",
+			StopBits: 1,
+		},
+		Registers: []common.SlaverRegister{},
+	}
+	mdev.status = typex.DEV_DOWN
+	return mdev
+}
+
+// 初始化
+func (mdev *genericModbusSlaver) Init(devId string, configMap map[string]interface{}) error {
+	mdev.PointId = devId
+	if err := utils.BindSourceConfig(configMap, &mdev.mainConfig); err != nil {
+		return err
+	}
+	if !utils.SContains([]string{"RTU", "TCP"}, mdev.mainConfig.CommonConfig.Mode) {
+		return errors.New("unsupported mode, only can be one of 'TCP' or 'RTU'")
+	}
+	if mdev.mainConfig.CommonConfig.SlaverId < 1 || mdev.mainConfig.CommonConfig.SlaverId > 247 {
+		return errors.New("'slaverId' must between 1 and 247")
+	}
+	// 寄存器映射有问题的时候直接报错, 不要等到启动
+	Driver, err := driver.NewModbusSlaverDriver(mdev.mainConfig.CommonConfig.SlaverId,
+		mdev.mainConfig.Registers, mdev.onMasterWrite)
+	if err != nil {
+		return err
+	}
+	mdev.driver = Driver
+	return nil
+}
+
+// 启动
+func (mdev *genericModbusSlaver) Start(cctx typex.CCTX) error {
+	mdev.Ctx = cctx.Ctx
+	mdev.CancelCTX = cctx.CancelCTX
+	if mdev.mainConfig.CommonConfig.Mode == "TCP" {
+		if err := mdev.driver.ListenTCP(fmt.Sprintf("%s:%v",
+			mdev.mainConfig.TcpConfig.Host, mdev.mainConfig.TcpConfig.Port)); err != nil {
+			return err
+		}
+		mdev.SetState(typex.DEV_UP)
+	}
+	if mdev.mainConfig.CommonConfig.Mode == "RTU" {
+		serialPort, err := serial.Open(&serial.Config{
+			Address:  mdev.mainConfig.RtuConfig.Uart,
+			BaudRate: mdev.mainConfig.RtuConfig.BaudRate,
+			DataBits: mdev.mainConfig.RtuConfig.DataBits,
+			Parity:   mdev.mainConfig.RtuConfig.Parity,
+			StopBits: mdev.mainConfig.RtuConfig.StopBits,
+			Timeout:  time.Duration(mdev.mainConfig.RtuConfig.Timeout) * time.Millisecond,
+		})
+		if err != nil {
+			return err
+		}
+		mdev.serialPort = serialPort
+		mdev.SetState(typex.DEV_UP)
+		go func() {
+			if err := mdev.driver.ServeRTU(mdev.Ctx, serialPort); err != nil {
+				glogger.GLogger.Error("Modbus slaver serve RTU error:", err)
+				mdev.SetState(typex.DEV_DOWN)
+			}
+		}()
+	}
+	return nil
+}
+
+/*
+*
+* 主站写了寄存器, 每个被写的 Tag 推一条事件给规则引擎
+*
+ */
+func (mdev *genericModbusSlaver) onMasterWrite(values []driver.ModbusSlaverValue) {
+	for _, value := range values {
+		bytes, _ := json.Marshal(map[string]interface{}{
+			"event":    "write",
+			"tag":      value.Tag,
+			"type":     value.Type,
+			"address":  value.Address,
+			"quantity": value.Quantity,
+			"values":   value.Values,
+		})
+		if Device := mdev.Details(); Device != nil {
+			mdev.RuleEngine.WorkDevice(Device, string(bytes))
+		}
+	}
+}
+
+// 读寄存器的值, cmd 是 Tag, 为空的时候返回全部
+func (mdev *genericModbusSlaver) OnRead(cmd []byte, data []byte) (int, error) {
+	return mdev.driver.Read(cmd, data)
+}
+
+// 更新寄存器的值, cmd 是 Tag, data 是数字或者数字数组
+func (mdev *genericModbusSlaver) OnWrite(cmd []byte, data []byte) (int, error) {
+	return mdev.driver.Write(cmd, data)
+}
+
+// 设备当前状态, 服务异常退出以后是 DOWN, 交给监控重启
+func (mdev *genericModbusSlaver) Status() typex.DeviceState {
+	mdev.lock.Lock()
+	defer mdev.lock.Unlock()
+	return mdev.status
+}
+
+// 停止设备
+func (mdev *genericModbusSlaver) Stop() {
+	if mdev.CancelCTX != nil {
+		mdev.CancelCTX()
+	}
+	mdev.SetState(typex.DEV_DOWN)
+	if mdev.serialPort != nil {
+		mdev.serialPort.Close()
+	}
+	if mdev.driver != nil {
+		mdev.driver.Stop()
+	}
+}
+
+// 设备属性，是一系列属性描述
+func (mdev *genericModbusSlaver) Property() []typex.DeviceProperty {
+	return []typex.DeviceProperty{}
+}
+
+// 真实设备
+func (mdev *genericModbusSlaver) Details() *typex.Device {
+	return mdev.RuleEngine.GetDevice(mdev.PointId)
+}
+
+// 状态
+func (mdev *genericModbusSlaver) SetState(status typex.DeviceState) {
+	mdev.lock.Lock()
+	defer mdev.lock.Unlock()
+	mdev.status = status
+}
+
+// 驱动
+func (mdev *genericModbusSlaver) Driver() typex.XExternalDriver {
+	return mdev.driver
+}
+
+func (mdev *genericModbusSlaver) OnDCACall(UUID string, Command string, Args interface{}) typex.DCAResult {
+	return typex.DCAResult{}
+}
+
+func (mdev *genericModbusSlaver) OnCtrl(cmd []byte, args []byte) ([]byte, error) {
+	return []byte{}, nil
+}
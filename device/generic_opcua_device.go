@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"sync"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/gopcua/opcua"
 	"github.com/gopcua/opcua/ua"
 	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
 	"github.com/hootrhino/rulex/utils"
@@ -36,6 +38,9 @@ type opcuaCommonConfig struct {
 	Timeout   int    `json:"timeout" title:"超时" info:""`
 	Frequency int64  `json:"frequency" title:"采集频率" validate:"required" info:""`
 	RetryTime int    `json:"retryTime" title:"错误次数" validate:"required"` // 几次以后重启,0 表示不重启
+	// 订阅模式: 用 OPCUA 订阅代替轮询, 服务端推送的数据变化直接交给规则引擎
+	Subscribe       bool `json:"subscribe" title:"订阅模式" info:""`
+	PublishInterval int  `json:"publishInterval" title:"发布间隔" info:"单位毫秒, 默认100"`
 }
 type OpcuaNode struct {
 	Tag         string `json:"tag" validate:"required" title:"数据Tag" info:""`
@@ -43,21 +48,32 @@ type OpcuaNode struct {
 	NodeID      string `json:"nodeId" validate:"required" title:"NodeID" example:"ns=1;s=Test"`
 	DataType    string `json:"dataType" title:"数据类型" tag:"String" info:""`
 	Value       string `json:"value" title:"值" info:"从OPCUA获取的值"` //不需要配置
+	// 下面是订阅模式的参数, 轮询模式下不起作用
+	SamplingInterval float64 `json:"samplingInterval,omitempty" title:"采样间隔" info:"单位毫秒, 0表示尽快"`
+	QueueSize        uint32  `json:"queueSize,omitempty" title:"队列长度" info:"默认10"`
+	DeadbandType     string  `json:"deadbandType,omitempty" title:"死区类型" info:"ABS/PERCENT, 为空表示不过滤"`
+	Deadband         float64 `json:"deadband,omitempty" title:"死区"`
+	// 采集结果的数据质量和时间戳, 不需要配置
+	*common.DataQuality `json:",omitempty"`
 }
 type opcua_CustomProtocolConfig struct {
 	OpcuaCommonConfig opcuaCommonConfig `json:"commonConfig" validate:"required"`
 	OpcNodes          []OpcuaNode       `json:"opcuaNodes" validate:"required" title:"采集节点" info:""`
+	// 变化上报, 没有启用的时候每次采集都上报全量快照
+	ReportConfig common.ReportConfig `json:"reportConfig" title:"变化上报"`
 }
 type genericOpcuaDevice struct {
 	typex.XStatus
-	status     typex.DeviceState
-	RuleEngine typex.RuleX
-	driver     typex.XExternalDriver
-	client     *opcua.Client
-	mainConfig opcua_CustomProtocolConfig
-	// subscription *opcua.Subscription
-	locker     sync.Locker
-	errorCount int // 记录最大容错数，默认5次，出错超过5此就重启
+	status       typex.DeviceState
+	statusLocker sync.Mutex
+	RuleEngine   typex.RuleX
+	driver       typex.XExternalDriver
+	client       *opcua.Client
+	mainConfig   opcua_CustomProtocolConfig
+	subscription *opcua.Subscription
+	locker       sync.Locker
+	errorCount   int // 记录最大容错数，默认5次，出错超过5此就重启
+	reporter     *core.ReportFilter
 }
 type PolicyFlag string
 
@@ -106,6 +122,23 @@ func (sd *genericOpcuaDevice) Init(devId string, configMap map[string]interface{
 	if err := utils.BindSourceConfig(configMap, &sd.mainConfig); err != nil {
 		return err
 	}
+	for _, node := range sd.mainConfig.OpcNodes {
+		if _, err := ua.ParseNodeID(node.NodeID); err != nil {
+			return fmt.Errorf("tag [%s] invalid node id:%s", node.Tag, node.NodeID)
+		}
+		if node.DeadbandType != "" && node.DeadbandType != common.DEADBAND_ABS &&
+			node.DeadbandType != common.DEADBAND_PERCENT {
+			return fmt.Errorf("tag [%s] unsupported deadband type:%s", node.Tag, node.DeadbandType)
+		}
+	}
+	if sd.mainConfig.OpcuaCommonConfig.PublishInterval < 0 {
+		return fmt.Errorf("'publishInterval' must not be negative")
+	}
+	reporter, err := core.NewReportFilter(sd.mainConfig.ReportConfig)
+	if err != nil {
+		return err
+	}
+	sd.reporter = reporter
 	return nil
 }
 
@@ -139,13 +172,31 @@ func (opcDev *genericOpcuaDevice) Start(cctx typex.CCTX) error {
 		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeAnonymous))
 		break
 	}
+	if opcDev.mainConfig.OpcuaCommonConfig.Timeout > 0 {
+		opts = append(opts, opcua.RequestTimeout(
+			time.Duration(opcDev.mainConfig.OpcuaCommonConfig.Timeout)*time.Millisecond))
+	}
+	// 订阅模式不用客户端的自动重连: 会话断了以后订阅就没了, 设备置为 DOWN,
+	// 重启的时候重新建会话和订阅
+	if opcDev.mainConfig.OpcuaCommonConfig.Subscribe {
+		opts = append(opts, opcua.AutoReconnect(false))
+	}
 	//连接opcua -判断连接是否正常
-	opcDev.client = opcua.NewClient(ep.EndpointURL, opcua.SecurityMode(ua.MessageSecurityModeNone))
+	opcDev.client = opcua.NewClient(ep.EndpointURL, opts...)
 	if err := opcDev.client.Connect(cctx.Ctx); err != nil {
 		glogger.GLogger.Error("Connect opcua client failed:", err)
 		return err
 	}
-	opcua.RequestTimeout(time.Duration(opcDev.mainConfig.OpcuaCommonConfig.Timeout) * time.Millisecond)
+	if opcDev.mainConfig.OpcuaCommonConfig.Subscribe {
+		if err := opcDev.subscribe(cctx.Ctx); err != nil {
+			glogger.GLogger.Error("Subscribe opcua nodes failed:", err)
+			opcDev.client.CloseWithContext(context.Background())
+			return err
+		}
+		go opcDev.watchConnection(cctx.Ctx, opcDev.client)
+		opcDev.SetState(typex.DEV_UP)
+		return nil
+	}
 	// 起一个线程去判断是否要轮询
 	// FIX: 此处需要用参数判断是否开启轮询
 	// if !opcDev.mainConfig.CommonConfig.AutoRequest {
@@ -177,9 +228,9 @@ func (opcDev *genericOpcuaDevice) Start(cctx typex.CCTX) error {
 			opcDev.locker.Unlock()
 			if err != nil {
 				glogger.GLogger.Error(err)
-			} else {
+			} else if data, ok := opcDev.reporter.Filter(buffer[:n]); ok {
 				//周期轮询node数据
-				opcDev.RuleEngine.WorkDevice(opcDev.Details(), string(buffer[:n]))
+				opcDev.RuleEngine.WorkDevice(opcDev.Details(), string(data))
 			}
 			opcDev.Busy = false
 			<-ticker.C
@@ -187,15 +238,133 @@ func (opcDev *genericOpcuaDevice) Start(cctx typex.CCTX) error {
 		}
 	}(cctx.Ctx, opcDev.driver)
 
-	opcDev.status = typex.DEV_UP
+	opcDev.SetState(typex.DEV_UP)
 	return nil
 }
+
+/*
+*
+* 订阅模式下检查连接: 连接断开以后客户端不会重连, 订阅也收不到通知了, 设备置为 DOWN 等待重启
+*
+ */
+func (opcDev *genericOpcuaDevice) watchConnection(ctx context.Context, client *opcua.Client) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		switch client.State() {
+		case opcua.Disconnected, opcua.Closed:
+			glogger.GLogger.Errorf("OPCUA session closed, subscription lost: %s",
+				opcDev.mainConfig.OpcuaCommonConfig.Endpoint)
+			opcDev.SetState(typex.DEV_DOWN)
+			return
+		}
+	}
+}
+
+/*
+*
+* 订阅模式: 每个节点一个监控项, ClientHandle 就是节点在配置里的下标
+*
+ */
+func (opcDev *genericOpcuaDevice) subscribe(ctx context.Context) error {
+	interval := opcua.DefaultSubscriptionInterval
+	if opcDev.mainConfig.OpcuaCommonConfig.PublishInterval > 0 {
+		interval = time.Duration(opcDev.mainConfig.OpcuaCommonConfig.PublishInterval) * time.Millisecond
+	}
+	notifyCh := make(chan *opcua.PublishNotificationData, 64)
+	sub, err := opcDev.client.SubscribeWithContext(ctx,
+		&opcua.SubscriptionParameters{Interval: interval}, notifyCh)
+	if err != nil {
+		return err
+	}
+	items := []*ua.MonitoredItemCreateRequest{}
+	for i, node := range opcDev.mainConfig.OpcNodes {
+		id, _ := ua.ParseNodeID(node.NodeID)
+		items = append(items, newOpcuaMonitoredItem(id, uint32(i), node))
+	}
+	resp, err := sub.MonitorWithContext(ctx, ua.TimestampsToReturnBoth, items...)
+	if err != nil {
+		sub.Cancel(context.Background())
+		return err
+	}
+	for i, result := range resp.Results {
+		if result.StatusCode != ua.StatusOK && i < len(opcDev.mainConfig.OpcNodes) {
+			glogger.GLogger.Errorf("Monitor node [%s] failed: %v",
+				opcDev.mainConfig.OpcNodes[i].Tag, result.StatusCode)
+		}
+	}
+	opcDev.subscription = sub
+	go opcDev.handleNotifications(ctx, notifyCh)
+	return nil
+}
+
+func newOpcuaMonitoredItem(id *ua.NodeID, handle uint32, node OpcuaNode) *ua.MonitoredItemCreateRequest {
+	item := opcua.NewMonitoredItemCreateRequestWithDefaults(id, ua.AttributeIDValue, handle)
+	item.RequestedParameters.SamplingInterval = node.SamplingInterval
+	if node.QueueSize > 0 {
+		item.RequestedParameters.QueueSize = node.QueueSize
+	}
+	if node.DeadbandType != "" {
+		deadbandType := ua.DeadbandTypeAbsolute
+		if node.DeadbandType == common.DEADBAND_PERCENT {
+			deadbandType = ua.DeadbandTypePercent
+		}
+		item.RequestedParameters.Filter = ua.NewExtensionObject(&ua.DataChangeFilter{
+			Trigger:       ua.DataChangeTriggerStatusValue,
+			DeadbandType:  uint32(deadbandType),
+			DeadbandValue: node.Deadband,
+		})
+	}
+	return item
+}
+
+// 数据变化通知转成和轮询一样的格式, 只带变化了的节点
+func (opcDev *genericOpcuaDevice) handleNotifications(ctx context.Context,
+	notifyCh <-chan *opcua.PublishNotificationData) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notify := <-notifyCh:
+			if notify.Error != nil {
+				opcDev.errorCount++
+				glogger.GLogger.Error("OPCUA subscription error:", notify.Error)
+				continue
+			}
+			changes, ok := notify.Value.(*ua.DataChangeNotification)
+			if !ok {
+				continue
+			}
+			dataMap := map[string]OpcuaNode{}
+			for _, item := range changes.MonitoredItems {
+				if int(item.ClientHandle) >= len(opcDev.mainConfig.OpcNodes) || item.Value == nil {
+					continue
+				}
+				node := opcDev.mainConfig.OpcNodes[item.ClientHandle]
+				dataMap[node.Tag] = newOpcuaValue(node, item.Value, nil)
+			}
+			if len(dataMap) == 0 {
+				continue
+			}
+			bytes, _ := json.Marshal(dataMap)
+			if data, ok := opcDev.reporter.Filter(bytes); ok {
+				opcDev.RuleEngine.WorkDevice(opcDev.Details(), string(data))
+			}
+		}
+	}
+}
+
 func (opcDev *genericOpcuaDevice) OnRead(cmd []byte, data []byte) (int, error) {
 
 	n, err := opcDev.readNodes(cmd, data)
 	if err != nil {
 		glogger.GLogger.Error(err)
-		opcDev.status = typex.DEV_DOWN
+		opcDev.SetState(typex.DEV_DOWN)
 	}
 	return n, err
 }
@@ -207,7 +376,8 @@ func (opcDev *genericOpcuaDevice) readNodes(cmd []byte, data []byte) (int, error
 		time.Sleep(time.Duration(100) * time.Millisecond)
 		id, err := ua.ParseNodeID(r.NodeID)
 		if err != nil {
-			glogger.GLogger.Error("invalid node id: %v", err)
+			dataMap[r.Tag] = newOpcuaValue(r, &ua.DataValue{Status: ua.StatusBadNodeIDInvalid}, nil)
+			continue
 		}
 		req := &ua.ReadRequest{
 			MaxAge: 2000,
@@ -218,29 +388,21 @@ func (opcDev *genericOpcuaDevice) readNodes(cmd []byte, data []byte) (int, error
 		}
 		ctx := context.Background()
 		resp, err := opcDev.client.ReadWithContext(ctx, req)
+		if err == nil && len(resp.Results) == 0 {
+			err = fmt.Errorf("empty read response")
+		}
 		if err != nil {
 			opcDev.errorCount++
-			glogger.GLogger.Error("Read failed: %s", err)
+			glogger.GLogger.Errorf("Read failed: %s", err)
+			dataMap[r.Tag] = newOpcuaValue(r, nil, err)
+			continue
 		}
-		if resp.Results[0].Status != ua.StatusOK {
+		value := newOpcuaValue(r, resp.Results[0], nil)
+		if value.Quality != common.QUALITY_GOOD {
 			opcDev.errorCount++
-			glogger.GLogger.Error("Status not OK: %v", resp.Results[0].Status)
-
+			glogger.GLogger.Errorf("Read node [%s] failed: %s", r.Tag, value.Error)
 		}
-		value := OpcuaNode{
-			Tag:         r.Tag,
-			NodeID:      r.NodeID,
-			Description: r.Description,
-			DataType:    r.DataType,
-			Value:       "",
-		}
-		value.Value, err = interfaceToString(resp.Results[0].Value.Value())
 		dataMap[r.Tag] = value
-		if err != nil {
-			opcDev.errorCount++
-			glogger.GLogger.Error("OPCUA value not match type: %s", err)
-		}
-
 	}
 	bytes, _ := json.Marshal(dataMap)
 
@@ -248,6 +410,57 @@ func (opcDev *genericOpcuaDevice) readNodes(cmd []byte, data []byte) (int, error
 	return len(bytes), nil
 
 }
+
+/*
+*
+* 生成采集结果: 按 OPCUA 的状态码给出数据质量, 服务端给了 SourceTimestamp 的时候用它做 sourceTs
+*
+ */
+func newOpcuaValue(node OpcuaNode, dv *ua.DataValue, readErr error) OpcuaNode {
+	value := OpcuaNode{
+		Tag:         node.Tag,
+		NodeID:      node.NodeID,
+		Description: node.Description,
+		DataType:    node.DataType,
+	}
+	if readErr != nil {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{}, readErr)
+		return value
+	}
+	quality := opcuaQuality(dv.Status)
+	var err error
+	if dv.Status != ua.StatusOK {
+		err = dv.Status
+	}
+	if quality != common.QUALITY_BAD_COMM && quality != common.QUALITY_BAD_CONFIG {
+		if dv.Value == nil {
+			quality, err = common.QUALITY_BAD_COMM, fmt.Errorf("empty value")
+		} else if v, err1 := interfaceToString(dv.Value.Value()); err1 != nil {
+			quality, err = common.QUALITY_BAD_CONFIG, err1
+		} else {
+			value.Value = v
+		}
+	}
+	value.DataQuality = common.NewDataQuality(quality, dv.SourceTimestamp, err)
+	return value
+}
+
+// OPCUA 状态码的最高两位是严重程度: 00 好, 01 不确定, 10 坏
+func opcuaQuality(status ua.StatusCode) string {
+	switch {
+	case uint32(status)&0xC0000000 == 0:
+		return common.QUALITY_GOOD
+	case uint32(status)&0xC0000000 == 0x40000000:
+		return common.QUALITY_UNCERTAIN_STALE
+	}
+	switch status {
+	case ua.StatusBadNodeIDInvalid, ua.StatusBadNodeIDUnknown,
+		ua.StatusBadTypeMismatch, ua.StatusBadAttributeIDInvalid:
+		return common.QUALITY_BAD_CONFIG
+	}
+	return common.QUALITY_BAD_COMM
+}
+
 func interfaceToString(value interface{}) (string, error) {
 	switch v := value.(type) {
 	case string:
@@ -281,21 +494,154 @@ func interfaceToString(value interface{}) (string, error) {
 	}
 }
 
+/*
+*
+* 把 JSON 值转成 OPCUA 的 Variant, dataType 是节点的数据类型:
+* Boolean/SByte/Byte/Int16/UInt16/Int32/UInt32/Int64/UInt64/Float/Double/String,
+* 为空的时候按 JSON 的类型推断
+*
+ */
+func NewOpcuaVariant(dataType string, value interface{}) (*ua.Variant, error) {
+	if dataType == "" {
+		return ua.NewVariant(value)
+	}
+	if dataType == "String" {
+		if v, ok := value.(string); ok {
+			return ua.NewVariant(v)
+		}
+		return ua.NewVariant(fmt.Sprintf("%v", value))
+	}
+	if dataType == "Boolean" {
+		switch v := value.(type) {
+		case bool:
+			return ua.NewVariant(v)
+		case float64:
+			return ua.NewVariant(v != 0)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, err
+			}
+			return ua.NewVariant(b)
+		}
+		return nil, fmt.Errorf("value must be bool:%v", value)
+	}
+	var number float64
+	switch v := value.(type) {
+	case float64:
+		number = v
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		number = n
+	case bool:
+		if v {
+			number = 1
+		}
+	default:
+		return nil, fmt.Errorf("value must be number:%v", value)
+	}
+	limits := map[string][2]float64{
+		"SByte":  {math.MinInt8, math.MaxInt8},
+		"Byte":   {0, math.MaxUint8},
+		"Int16":  {math.MinInt16, math.MaxInt16},
+		"UInt16": {0, math.MaxUint16},
+		"Int32":  {math.MinInt32, math.MaxInt32},
+		"UInt32": {0, math.MaxUint32},
+		"Int64":  {math.MinInt64, math.MaxInt64},
+		"UInt64": {0, math.MaxUint64},
+	}
+	if limit, ok := limits[dataType]; ok {
+		if number != math.Trunc(number) || number < limit[0] || number > limit[1] {
+			return nil, fmt.Errorf("value %v out of range of %s", value, dataType)
+		}
+	}
+	switch dataType {
+	case "SByte":
+		return ua.NewVariant(int8(number))
+	case "Byte":
+		return ua.NewVariant(uint8(number))
+	case "Int16":
+		return ua.NewVariant(int16(number))
+	case "UInt16":
+		return ua.NewVariant(uint16(number))
+	case "Int32":
+		return ua.NewVariant(int32(number))
+	case "UInt32":
+		return ua.NewVariant(uint32(number))
+	case "Int64":
+		return ua.NewVariant(int64(number))
+	case "UInt64":
+		return ua.NewVariant(uint64(number))
+	case "Float":
+		return ua.NewVariant(float32(number))
+	case "Double":
+		return ua.NewVariant(number)
+	}
+	return nil, fmt.Errorf("unsupported data type:%s", dataType)
+}
+
+/*
+*
+* 写节点的值, cmd 是 Tag, data 是 JSON 格式的值, 按节点配置的 DataType 转换:
+*   rulexlib:WriteDevice(uuid, "setPoint", "12.5")
+*
+ */
 func (sd *genericOpcuaDevice) OnWrite(cmd []byte, data []byte) (int, error) {
-	n, err := sd.driver.Write(cmd, data)
-	//opc 协议写数据 待完善
+	var node *OpcuaNode
+	for i := range sd.mainConfig.OpcNodes {
+		if sd.mainConfig.OpcNodes[i].Tag == string(cmd) {
+			node = &sd.mainConfig.OpcNodes[i]
+			break
+		}
+	}
+	if node == nil {
+		return 0, fmt.Errorf("tag not exists:%s", string(cmd))
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return 0, err
+	}
+	variant, err := NewOpcuaVariant(node.DataType, value)
+	if err != nil {
+		return 0, err
+	}
+	id, err := ua.ParseNodeID(node.NodeID)
+	if err != nil {
+		return 0, err
+	}
+	if sd.client == nil {
+		return 0, fmt.Errorf("opcua client not connected")
+	}
+	sd.locker.Lock()
+	resp, err := sd.client.WriteWithContext(sd.Ctx, &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{{
+			NodeID:      id,
+			AttributeID: ua.AttributeIDValue,
+			Value: &ua.DataValue{
+				EncodingMask: ua.DataValueValue,
+				Value:        variant,
+			},
+		}},
+	})
+	sd.locker.Unlock()
 	if err != nil {
+		sd.errorCount++
 		glogger.GLogger.Error(err)
-		sd.status = typex.DEV_DOWN
+		return 0, err
 	}
-	return n, err
+	if len(resp.Results) > 0 && resp.Results[0] != ua.StatusOK {
+		return 0, resp.Results[0]
+	}
+	return len(data), nil
 }
 
-// 设备当前状态
+// 设备当前状态, RetryTime 为 0 的时候不按错误次数重启, 但是连接断开还是 DOWN
 func (sd *genericOpcuaDevice) Status() typex.DeviceState {
-	if sd.mainConfig.OpcuaCommonConfig.RetryTime == 0 {
-		sd.status = typex.DEV_UP
-	}
+	sd.statusLocker.Lock()
+	defer sd.statusLocker.Unlock()
 	if sd.mainConfig.OpcuaCommonConfig.RetryTime > 0 {
 		if sd.errorCount >= sd.mainConfig.OpcuaCommonConfig.RetryTime {
 			sd.status = typex.DEV_DOWN
@@ -306,10 +652,16 @@ func (sd *genericOpcuaDevice) Status() typex.DeviceState {
 
 // 停止设备
 func (sd *genericOpcuaDevice) Stop() {
-	sd.status = typex.DEV_DOWN
+	sd.SetState(typex.DEV_DOWN)
 	sd.CancelCTX()
+	if sd.subscription != nil {
+		sd.subscription.Cancel(context.Background())
+		sd.subscription = nil
+	}
+	if sd.client != nil {
+		sd.client.CloseWithContext(context.Background())
+	}
 	if sd.driver != nil {
-		sd.client.CloseWithContext(sd.Ctx)
 		sd.driver.Stop()
 	}
 }
@@ -326,8 +678,9 @@ func (sd *genericOpcuaDevice) Details() *typex.Device {
 
 // 状态
 func (sd *genericOpcuaDevice) SetState(status typex.DeviceState) {
+	sd.statusLocker.Lock()
 	sd.status = status
-
+	sd.statusLocker.Unlock()
 }
 
 // 驱动
@@ -12,9 +12,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gosnmp/gosnmp"
 
+	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
 )
@@ -29,6 +31,7 @@ type snmpDriver struct {
 	client     *gosnmp.GoSNMP
 	RuleEngine typex.RuleX
 	device     *typex.Device
+	lastErr    error // 这一次读的时候最后一个错误
 }
 
 func NewSnmpDriver(
@@ -66,16 +69,25 @@ type _snmp_data struct {
 	PCUserName    string
 	PCHardIFaces  []string
 	PCTotalMemory int
+	*common.DataQuality
 }
 
 func (sd *snmpDriver) Read(cmd []byte, data []byte) (int, error) {
-	bites, err := json.Marshal(_snmp_data{
+	sd.lastErr = nil
+	value := _snmp_data{
 		PCHost:        sd.client.Target,
 		PCDescription: sd.systemDescription(),
 		PCUserName:    sd.pCUserName(),
 		PCTotalMemory: sd.totalMemory(),
 		PCHardIFaces:  sd.hardwareNetInterfaceMac(),
-	})
+	}
+	// 有一个 OID 读失败整条数据就是 BAD_COMM
+	if sd.lastErr != nil {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{}, sd.lastErr)
+	} else {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_GOOD, time.Time{}, nil)
+	}
+	bites, err := json.Marshal(value)
 	copy(data, bites)
 	return len(bites), err
 }
@@ -102,6 +114,7 @@ func (sd *snmpDriver) connect() error {
 	if err1 != nil {
 		glogger.GLogger.Error("Connect() err: %v", err1)
 		sd.state = typex.DRIVER_DOWN
+		sd.lastErr = err1
 		return err1
 	}
 	return nil
@@ -129,6 +142,7 @@ func (sd *snmpDriver) systemDescription() string {
 	if err != nil {
 		glogger.GLogger.Error(err)
 		sd.state = typex.DRIVER_DOWN
+		sd.lastErr = err
 	}
 	return s
 }
@@ -147,6 +161,7 @@ func (sd *snmpDriver) pCUserName() string {
 	if err != nil {
 		glogger.GLogger.Error(err)
 		sd.state = typex.DRIVER_DOWN
+		sd.lastErr = err
 	}
 	return s
 }
@@ -170,6 +185,7 @@ func (sd *snmpDriver) totalMemory() int {
 	if err != nil {
 		glogger.GLogger.Error(err)
 		sd.state = typex.DRIVER_DOWN
+		sd.lastErr = err
 	}
 	return v
 
@@ -210,6 +226,7 @@ func (sd *snmpDriver) hardwareNetInterfaceMac() []string {
 	if err != nil {
 		glogger.GLogger.Error(err)
 		sd.state = typex.DRIVER_DOWN
+		sd.lastErr = err
 	}
 	return result
 }
@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hootrhino/rulex/common"
+	modbus "github.com/wwhai/gomodbus"
+)
+
+// 单次请求的上限: 寄存器 125 个, 线圈 2000 个
+const (
+	_MODBUS_MAX_READ_REGISTERS uint16 = 125
+	_MODBUS_MAX_READ_BITS      uint16 = 2000
+)
+
+/*
+*
+* 合并以后的一次读请求, 覆盖同一个从机同一个功能码的若干个点位
+*
+ */
+type modbusReadBatch struct {
+	SlaverId  byte
+	Function  int
+	Address   uint16
+	Quantity  uint16
+	Registers []common.RegisterRW
+}
+
+func isModbusBitFunction(function int) bool {
+	return function == common.READ_COIL || function == common.READ_DISCRETE_INPUT
+}
+
+/*
+*
+* 把点位按从机和功能码分组, 地址相邻(间隔不超过 maxGap)的合并成一次读,
+* 合并以后的长度不能超过单次请求的上限; 只处理 1~4 号读功能码
+*
+ */
+func planModbusReads(registers []common.RegisterRW, maxGap uint16) []modbusReadBatch {
+	sorted := []common.RegisterRW{}
+	for _, r := range registers {
+		if r.Function >= common.READ_COIL && r.Function <= common.READ_INPUT_REGISTERS {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].SlaverId != sorted[j].SlaverId {
+			return sorted[i].SlaverId < sorted[j].SlaverId
+		}
+		if sorted[i].Function != sorted[j].Function {
+			return sorted[i].Function < sorted[j].Function
+		}
+		return sorted[i].Address < sorted[j].Address
+	})
+	batches := []modbusReadBatch{}
+	for _, r := range sorted {
+		if n := len(batches); n > 0 {
+			last := &batches[n-1]
+			limit := _MODBUS_MAX_READ_REGISTERS
+			if isModbusBitFunction(r.Function) {
+				limit = _MODBUS_MAX_READ_BITS
+			}
+			lastEnd := int(last.Address) + int(last.Quantity)
+			end := int(r.Address) + int(r.Quantity)
+			if end < lastEnd {
+				end = lastEnd
+			}
+			if last.SlaverId == r.SlaverId && last.Function == r.Function &&
+				int(r.Address) <= lastEnd+int(maxGap) &&
+				end-int(last.Address) <= int(limit) {
+				last.Quantity = uint16(end - int(last.Address))
+				last.Registers = append(last.Registers, r)
+				continue
+			}
+		}
+		batches = append(batches, modbusReadBatch{
+			SlaverId:  r.SlaverId,
+			Function:  r.Function,
+			Address:   r.Address,
+			Quantity:  r.Quantity,
+			Registers: []common.RegisterRW{r},
+		})
+	}
+	return batches
+}
+
+// 发起一次读请求
+func (b modbusReadBatch) read(client modbus.Client) ([]byte, error) {
+	switch b.Function {
+	case common.READ_COIL:
+		return client.ReadCoils(b.Address, b.Quantity)
+	case common.READ_DISCRETE_INPUT:
+		return client.ReadDiscreteInputs(b.Address, b.Quantity)
+	case common.READ_HOLDING_REGISTERS:
+		return client.ReadHoldingRegisters(b.Address, b.Quantity)
+	case common.READ_INPUT_REGISTERS:
+		return client.ReadInputRegisters(b.Address, b.Quantity)
+	}
+	return nil, fmt.Errorf("unsupported read function:%d", b.Function)
+}
+
+/*
+*
+* 从合并读的结果里面切出一个点位的数据, 线圈要按位重新打包;
+* 结果为空或者长度不够的时候返回空
+*
+ */
+func (b modbusReadBatch) slice(r common.RegisterRW, results []byte) []byte {
+	offset := int(r.Address) - int(b.Address)
+	if isModbusBitFunction(b.Function) {
+		if (offset+int(r.Quantity)+7)/8 > len(results) {
+			return nil
+		}
+		bits := make([]byte, (r.Quantity+7)/8)
+		for i := 0; i < int(r.Quantity); i++ {
+			bit := offset + i
+			if results[bit/8]>>(bit%8)&1 == 1 {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		return bits
+	}
+	start, end := offset*2, (offset+int(r.Quantity))*2
+	if end > len(results) {
+		return nil
+	}
+	return results[start:end]
+}
@@ -0,0 +1,351 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/utils"
+	modbus "github.com/wwhai/gomodbus"
+)
+
+// 每种数据类型占用的字节数, BOOL 是按位的, 不在这里
+var _MODBUS_DATA_TYPE_SIZE = map[string]int{
+	"INT16":   2,
+	"UINT16":  2,
+	"INT32":   4,
+	"UINT32":  4,
+	"FLOAT32": 4,
+	"INT64":   8,
+	"UINT64":  8,
+	"FLOAT64": 8,
+}
+
+/*
+*
+* 检查点位的数据类型配置, 设备 Init 的时候调用, 配置错了尽早报错
+*
+ */
+func CheckRegisterDataType(r common.RegisterRW) error {
+	if r.DataType == "" {
+		return nil
+	}
+	if !utils.SContains([]string{"", "ABCD", "BADC", "CDAB", "DCBA"}, r.DataOrder) {
+		return fmt.Errorf("tag [%s] unsupported data order:%s", r.Tag, r.DataOrder)
+	}
+	isBit := r.Function == common.READ_COIL || r.Function == common.READ_DISCRETE_INPUT
+	if r.DataType == "BOOL" {
+		if !isBit {
+			return fmt.Errorf("tag [%s] BOOL only for coil or discrete input", r.Tag)
+		}
+		return nil
+	}
+	size, ok := _MODBUS_DATA_TYPE_SIZE[r.DataType]
+	if !ok {
+		return fmt.Errorf("tag [%s] unsupported data type:%s", r.Tag, r.DataType)
+	}
+	if isBit {
+		return fmt.Errorf("tag [%s] coil or discrete input only support BOOL", r.Tag)
+	}
+	if r.Quantity == 0 || int(r.Quantity)*2%size != 0 {
+		return fmt.Errorf("tag [%s] quantity %d not match data type %s",
+			r.Tag, r.Quantity, r.DataType)
+	}
+	return nil
+}
+
+/*
+*
+* 按字节序调整顺序: CDAB 是字(寄存器)倒序, BADC 是字内字节交换, DCBA 两个都做;
+* 两种变换都是自己的逆变换, 所以编码解码用同一个函数
+*
+ */
+func reorderModbusBytes(data []byte, order string) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	if order == "CDAB" || order == "DCBA" {
+		for i, j := 0, len(result)-2; i < j; i, j = i+2, j-2 {
+			result[i], result[i+1], result[j], result[j+1] =
+				result[j], result[j+1], result[i], result[i+1]
+		}
+	}
+	if order == "BADC" || order == "DCBA" {
+		for i := 0; i+1 < len(result); i += 2 {
+			result[i], result[i+1] = result[i+1], result[i]
+		}
+	}
+	return result
+}
+
+// 权重为 0 的时候当作 1
+func registerWeight(r common.RegisterRW) float64 {
+	if r.Weight == 0 {
+		return 1
+	}
+	return r.Weight
+}
+
+/*
+*
+* 把读到的原始字节解码成工程值: Value = Raw * Weight + InitValue;
+* 没有配置权重的时候整数保持整数, 一个点位有多个值的时候返回数组
+*
+ */
+func DecodeRegisterValue(r common.RegisterRW, raw []byte) (interface{}, error) {
+	if r.DataType == "" || len(raw) == 0 {
+		return nil, nil
+	}
+	if r.DataType == "BOOL" {
+		values := []interface{}{}
+		for i := 0; i < int(r.Quantity) && i/8 < len(raw); i++ {
+			values = append(values, raw[i/8]>>(i%8)&1 == 1)
+		}
+		return singleOrList(values), nil
+	}
+	size, ok := _MODBUS_DATA_TYPE_SIZE[r.DataType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported data type:%s", r.DataType)
+	}
+	if len(raw)%size != 0 {
+		return nil, fmt.Errorf("tag [%s] data length %d not match data type %s",
+			r.Tag, len(raw), r.DataType)
+	}
+	weight := registerWeight(r)
+	scaled := weight != 1 || r.InitValue != 0
+	values := []interface{}{}
+	for i := 0; i < len(raw); i += size {
+		b := reorderModbusBytes(raw[i:i+size], r.DataOrder)
+		var value interface{}
+		var number float64
+		switch r.DataType {
+		case "INT16":
+			v := int16(binary.BigEndian.Uint16(b))
+			value, number = v, float64(v)
+		case "UINT16":
+			v := binary.BigEndian.Uint16(b)
+			value, number = v, float64(v)
+		case "INT32":
+			v := int32(binary.BigEndian.Uint32(b))
+			value, number = v, float64(v)
+		case "UINT32":
+			v := binary.BigEndian.Uint32(b)
+			value, number = v, float64(v)
+		case "INT64":
+			v := int64(binary.BigEndian.Uint64(b))
+			value, number = v, float64(v)
+		case "UINT64":
+			v := binary.BigEndian.Uint64(b)
+			value, number = v, float64(v)
+		case "FLOAT32":
+			v := math.Float32frombits(binary.BigEndian.Uint32(b))
+			value, number = v, float64(v)
+		case "FLOAT64":
+			v := math.Float64frombits(binary.BigEndian.Uint64(b))
+			value, number = v, v
+		}
+		if scaled {
+			value = number*weight + r.InitValue
+		}
+		values = append(values, value)
+	}
+	return singleOrList(values), nil
+}
+
+func singleOrList(values []interface{}) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+/*
+*
+* 把工程值反向编码成要写入的字节: Raw = (Value - InitValue) / Weight;
+* value 是数字(布尔)或者数组, 数组长度必须和点位的值个数一致
+*
+ */
+func EncodeRegisterValue(r common.RegisterRW, value interface{}) ([]byte, error) {
+	if r.DataType == "" {
+		return nil, fmt.Errorf("tag [%s] has no data type", r.Tag)
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	if r.DataType == "BOOL" {
+		if len(values) != int(r.Quantity) {
+			return nil, fmt.Errorf("tag [%s] need %d values", r.Tag, r.Quantity)
+		}
+		result := make([]byte, (len(values)+7)/8)
+		for i, v := range values {
+			bit, err := toFloat64(v)
+			if err != nil {
+				return nil, err
+			}
+			if bit != 0 {
+				result[i/8] |= 1 << (i % 8)
+			}
+		}
+		return result, nil
+	}
+	size, ok := _MODBUS_DATA_TYPE_SIZE[r.DataType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported data type:%s", r.DataType)
+	}
+	if len(values) != int(r.Quantity)*2/size {
+		return nil, fmt.Errorf("tag [%s] need %d values", r.Tag, int(r.Quantity)*2/size)
+	}
+	result := []byte{}
+	for _, v := range values {
+		number, err := toFloat64(v)
+		if err != nil {
+			return nil, err
+		}
+		number = (number - r.InitValue) / registerWeight(r)
+		b := make([]byte, size)
+		switch r.DataType {
+		case "INT16":
+			if err := checkRange(r.Tag, number, math.MinInt16, math.MaxInt16); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(b, uint16(int16(math.Round(number))))
+		case "UINT16":
+			if err := checkRange(r.Tag, number, 0, math.MaxUint16); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(b, uint16(math.Round(number)))
+		case "INT32":
+			if err := checkRange(r.Tag, number, math.MinInt32, math.MaxInt32); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(b, uint32(int32(math.Round(number))))
+		case "UINT32":
+			if err := checkRange(r.Tag, number, 0, math.MaxUint32); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(b, uint32(math.Round(number)))
+		case "INT64":
+			binary.BigEndian.PutUint64(b, uint64(int64(math.Round(number))))
+		case "UINT64":
+			if err := checkRange(r.Tag, number, 0, math.MaxUint64); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint64(b, uint64(math.Round(number)))
+		case "FLOAT32":
+			binary.BigEndian.PutUint32(b, math.Float32bits(float32(number)))
+		case "FLOAT64":
+			binary.BigEndian.PutUint64(b, math.Float64bits(number))
+		}
+		result = append(result, reorderModbusBytes(b, r.DataOrder)...)
+	}
+	return result, nil
+}
+
+func checkRange(tag string, v float64, min float64, max float64) error {
+	if math.Round(v) < min || math.Round(v) > max {
+		return fmt.Errorf("tag [%s] value %v out of range", tag, v)
+	}
+	return nil
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("value must be number or bool:%v", v)
+}
+
+/*
+*
+* 生成采集结果, 原始十六进制和解码后的工程值都带上; 读失败或者返回的数据不够的时候
+* 质量是 BAD_COMM, 读到了但是按配置解码不了的时候是 BAD_CONFIG
+*
+ */
+func newRegisterValue(r common.RegisterRW, results []byte, readErr error) common.RegisterRW {
+	value := common.RegisterRW{
+		Tag:      r.Tag,
+		Function: r.Function,
+		SlaverId: r.SlaverId,
+		Address:  r.Address,
+		Quantity: r.Quantity,
+		Value:    covertEmptyHex(results),
+	}
+	if readErr != nil {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{}, readErr)
+		return value
+	}
+	// 设备返回的数据不够长
+	if results == nil {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{},
+			fmt.Errorf("tag [%s] response too short", r.Tag))
+		return value
+	}
+	dataValue, err := DecodeRegisterValue(r, results)
+	if err != nil {
+		value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_CONFIG, time.Time{}, err)
+		return value
+	}
+	value.DataValue = dataValue
+	value.DataQuality = common.NewDataQuality(common.QUALITY_GOOD, time.Time{}, nil)
+	return value
+}
+
+/*
+*
+* 按点位写工程值, 点位是线圈的时候写线圈, 是保持寄存器的时候写寄存器
+*
+ */
+func writeRegisterTag(client modbus.Client, setSlaverId func(byte),
+	registers []common.RegisterRW, w common.RegisterW) error {
+	var register *common.RegisterRW
+	for i := range registers {
+		if registers[i].Tag == w.Tag {
+			register = &registers[i]
+			break
+		}
+	}
+	if register == nil {
+		return fmt.Errorf("tag not exists:%s", w.Tag)
+	}
+	bytes, err := EncodeRegisterValue(*register, w.Value)
+	if err != nil {
+		return err
+	}
+	setSlaverId(register.SlaverId)
+	switch register.Function {
+	case common.READ_COIL, common.WRITE_SINGLE_COIL, common.WRITE_MULTIPLE_COILS:
+		if register.Quantity == 1 {
+			value := uint16(0x0000)
+			if bytes[0]&1 == 1 {
+				value = 0xFF00
+			}
+			_, err = client.WriteSingleCoil(register.Address, value)
+		} else {
+			_, err = client.WriteMultipleCoils(register.Address, register.Quantity, bytes)
+		}
+	case common.READ_HOLDING_REGISTERS, common.WRITE_SINGLE_HOLDING_REGISTER,
+		common.WRITE_MULTIPLE_HOLDING_REGISTERS:
+		if len(bytes) == 2 {
+			_, err = client.WriteSingleRegister(register.Address, binary.BigEndian.Uint16(bytes))
+		} else {
+			_, err = client.WriteMultipleRegisters(register.Address, uint16(len(bytes)/2), bytes)
+		}
+	default:
+		err = fmt.Errorf("tag [%s] is read only", w.Tag)
+	}
+	return err
+}
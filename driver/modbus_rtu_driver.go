@@ -23,6 +23,7 @@ type modBusRtuDriver struct {
 	client     modbus.Client
 	RuleEngine typex.RuleX
 	Registers  []common.RegisterRW
+	batches    []modbusReadBatch
 	device     *typex.Device
 	lock       sync.Mutex
 	frequency  int64
@@ -33,7 +34,7 @@ func NewModBusRtuDriver(
 	e typex.RuleX,
 	Registers []common.RegisterRW,
 	handler *modbus.RTUClientHandler,
-	client modbus.Client, frequency int64) typex.XExternalDriver {
+	client modbus.Client, frequency int64, maxGap uint16) typex.XExternalDriver {
 	return &modBusRtuDriver{
 		state:      typex.DRIVER_UP,
 		device:     d,
@@ -41,6 +42,7 @@ func NewModBusRtuDriver(
 		client:     client,
 		handler:    handler,
 		Registers:  Registers,
+		batches:    planModbusReads(Registers, maxGap),
 		lock:       sync.Mutex{},
 		frequency:  frequency,
 	}
@@ -64,83 +66,21 @@ func (d *modBusRtuDriver) State() typex.DriverState {
 
 func (d *modBusRtuDriver) Read(cmd []byte, data []byte) (int, error) {
 	var err error
-	var results []byte
 	dataMap := map[string]common.RegisterRW{}
 	count := len(d.Registers)
-	for _, r := range d.Registers {
-		d.handler.SlaveId = r.SlaverId
-		if r.Function == common.READ_COIL {
-			d.lock.Lock()
-			results, err = d.client.ReadCoils(r.Address, r.Quantity)
-			d.lock.Unlock()
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
-		}
-		if r.Function == common.READ_DISCRETE_INPUT {
-			d.lock.Lock()
-			results, err = d.client.ReadDiscreteInputs(r.Address, r.Quantity)
-			d.lock.Unlock()
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
-
-		}
-		if r.Function == common.READ_HOLDING_REGISTERS {
-			d.lock.Lock()
-			results, err = d.client.ReadHoldingRegisters(r.Address, r.Quantity)
-			d.lock.Unlock()
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
+	// 合并过的请求, 一次读回来再按点位切开
+	for _, batch := range d.batches {
+		d.lock.Lock()
+		d.handler.SlaveId = batch.SlaverId
+		results, err1 := batch.read(d.client)
+		d.lock.Unlock()
+		if err1 != nil {
+			err = err1
+			count -= len(batch.Registers)
+			glogger.GLogger.Error(err1)
 		}
-		if r.Function == common.READ_INPUT_REGISTERS {
-			d.lock.Lock()
-			results, err = d.client.ReadInputRegisters(r.Address, r.Quantity)
-			d.lock.Unlock()
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
+		for _, r := range batch.Registers {
+			dataMap[r.Tag] = newRegisterValue(r, batch.slice(r, results), err1)
 		}
 		time.Sleep(time.Duration(d.frequency) * time.Millisecond)
 	}
@@ -152,7 +92,6 @@ func (d *modBusRtuDriver) Read(cmd []byte, data []byte) (int, error) {
 		return len(bytes), nil
 	}
 	return len(bytes), err
-
 }
 
 /*
@@ -166,6 +105,18 @@ func (d *modBusRtuDriver) Write(_ []byte, data []byte) (int, error) {
 		return 0, err
 	}
 	for _, r := range dataMap {
+		// 按点位写工程值
+		if r.Tag != "" {
+			d.lock.Lock()
+			err := writeRegisterTag(d.client, func(slaverId byte) {
+				d.handler.SlaveId = slaverId
+			}, d.Registers, r)
+			d.lock.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
 		// 5
 		if r.Function == common.WRITE_SINGLE_COIL {
 			d.lock.Lock()
@@ -196,7 +147,7 @@ func (d *modBusRtuDriver) Write(_ []byte, data []byte) (int, error) {
 		// 16
 		if r.Function == common.WRITE_MULTIPLE_HOLDING_REGISTERS {
 			d.lock.Lock()
-			_, err := d.client.WriteMultipleRegisters(r.Address, uint16(len(r.Values)), r.Values)
+			_, err := d.client.WriteMultipleRegisters(r.Address, uint16(len(r.Values)/2), r.Values)
 			d.lock.Unlock()
 			if err != nil {
 				return 0, err
@@ -0,0 +1,439 @@
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/tbrandon/mbserver"
+	serial "github.com/wwhai/goserial"
+)
+
+/*
+*
+* 一个 Tag 当前的值, 也是主站写入以后推给规则引擎的事件
+*
+ */
+type ModbusSlaverValue struct {
+	Tag      string   `json:"tag"`
+	Type     string   `json:"type"`
+	Address  uint16   `json:"address"`
+	Quantity uint16   `json:"quantity"`
+	Values   []uint16 `json:"values"`
+}
+
+// mbserver 的功能码处理函数
+type modbusFunction func(*mbserver.Server, mbserver.Framer) ([]byte, *mbserver.Exception)
+
+/*
+*
+* Modbus 从机驱动: 协议和寄存器内存交给 mbserver, 这里只维护 Tag 到地址的映射;
+* 只有映射过的地址才能访问, 其他地址返回 ILLEGAL_DATA_ADDRESS
+*
+ */
+type ModbusSlaverDriver struct {
+	state     typex.DriverState
+	locker    sync.RWMutex
+	slaverId  byte
+	server    *mbserver.Server
+	closeOnce sync.Once
+	functions map[uint8]modbusFunction
+	registers map[string]common.SlaverRegister
+	owners    map[string]map[uint16]string // 寄存器类型 -> 地址 -> Tag
+	onWrite   func([]ModbusSlaverValue)    // 主站写入以后的回调
+}
+
+func NewModbusSlaverDriver(slaverId byte, registers []common.SlaverRegister,
+	onWrite func([]ModbusSlaverValue)) (*ModbusSlaverDriver, error) {
+	d := &ModbusSlaverDriver{
+		state:     typex.DRIVER_UP,
+		slaverId:  slaverId,
+		server:    mbserver.NewServer(),
+		functions: map[uint8]modbusFunction{},
+		registers: map[string]common.SlaverRegister{},
+		owners:    map[string]map[uint16]string{},
+		onWrite:   onWrite,
+	}
+	for _, Type := range []string{common.MODBUS_COIL, common.MODBUS_DISCRETE_INPUT,
+		common.MODBUS_HOLDING_REGISTER, common.MODBUS_INPUT_REGISTER} {
+		d.owners[Type] = map[uint16]string{}
+	}
+	for _, r := range registers {
+		if _, ok := d.owners[r.Type]; !ok {
+			return nil, fmt.Errorf("tag [%s] unsupported register type:%s", r.Tag, r.Type)
+		}
+		if _, ok := d.registers[r.Tag]; ok {
+			return nil, fmt.Errorf("tag duplicated:%s", r.Tag)
+		}
+		if r.Quantity == 0 || int(r.Address)+int(r.Quantity) > 65536 {
+			return nil, fmt.Errorf("tag [%s] invalid address or quantity", r.Tag)
+		}
+		for i := uint16(0); i < r.Quantity; i++ {
+			address := r.Address + i
+			if owner, ok := d.owners[r.Type][address]; ok {
+				return nil, fmt.Errorf("tag [%s] overlap with [%s] at %s %d",
+					r.Tag, owner, r.Type, address)
+			}
+			d.owners[r.Type][address] = r.Tag
+		}
+		d.registers[r.Tag] = r
+		if err := d.setValues(r, r.InitValues); err != nil {
+			return nil, err
+		}
+	}
+	// 读写之前先检查地址有没有映射, 再交给 mbserver 默认的处理函数
+	for function, f := range map[uint8]struct {
+		Type        string
+		maxQuantity uint16
+		handler     modbusFunction
+	}{
+		common.READ_COIL:                        {common.MODBUS_COIL, 2000, mbserver.ReadCoils},
+		common.READ_DISCRETE_INPUT:              {common.MODBUS_DISCRETE_INPUT, 2000, mbserver.ReadDiscreteInputs},
+		common.READ_HOLDING_REGISTERS:           {common.MODBUS_HOLDING_REGISTER, 125, mbserver.ReadHoldingRegisters},
+		common.READ_INPUT_REGISTERS:             {common.MODBUS_INPUT_REGISTER, 125, mbserver.ReadInputRegisters},
+		common.WRITE_SINGLE_COIL:                {common.MODBUS_COIL, 1, mbserver.WriteSingleCoil},
+		common.WRITE_SINGLE_HOLDING_REGISTER:    {common.MODBUS_HOLDING_REGISTER, 1, mbserver.WriteHoldingRegister},
+		common.WRITE_MULTIPLE_COILS:             {common.MODBUS_COIL, 1968, mbserver.WriteMultipleCoils},
+		common.WRITE_MULTIPLE_HOLDING_REGISTERS: {common.MODBUS_HOLDING_REGISTER, 123, mbserver.WriteHoldingRegisters},
+	} {
+		d.functions[function] = d.mappedFunction(function, f.Type, f.maxQuantity, f.handler)
+		d.server.RegisterFunctionHandler(function, d.functions[function])
+	}
+	return d, nil
+}
+
+func (d *ModbusSlaverDriver) Test() error {
+	return nil
+}
+
+func (d *ModbusSlaverDriver) Init(map[string]string) error {
+	return nil
+}
+
+func (d *ModbusSlaverDriver) Work() error {
+	return nil
+}
+
+func (d *ModbusSlaverDriver) State() typex.DriverState {
+	return d.state
+}
+
+/*
+*
+* 读 Tag 的当前值, cmd 是 Tag, 为空的时候返回全部
+*
+ */
+func (d *ModbusSlaverDriver) Read(cmd []byte, data []byte) (int, error) {
+	var bytes []byte
+	var err error
+	if len(cmd) == 0 {
+		bytes, err = json.Marshal(d.Values())
+	} else {
+		var value ModbusSlaverValue
+		if value, err = d.GetValues(string(cmd)); err != nil {
+			return 0, err
+		}
+		bytes, err = json.Marshal(value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(bytes) > len(data) {
+		return 0, errors.New("read buffer too small")
+	}
+	return copy(data, bytes), nil
+}
+
+/*
+*
+* 更新 Tag 的值, cmd 是 Tag, data 是一个数字或者数字数组, 例如: 12 或 [1, 2]
+*
+ */
+func (d *ModbusSlaverDriver) Write(cmd []byte, data []byte) (int, error) {
+	values := []int{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		value := 0
+		if err1 := json.Unmarshal(data, &value); err1 != nil {
+			return 0, fmt.Errorf("values must be number or number array:%s", string(data))
+		}
+		values = []int{value}
+	}
+	if err := d.SetValues(string(cmd), values); err != nil {
+		return 0, err
+	}
+	return len(values), nil
+}
+
+func (d *ModbusSlaverDriver) DriverDetail() typex.DriverDetail {
+	return typex.DriverDetail{
+		Name:        "Generic ModBus Slaver Driver",
+		Type:        "TCP/RTU",
+		Description: "Generic ModBus Slaver Driver",
+	}
+}
+
+func (d *ModbusSlaverDriver) Stop() error {
+	d.state = typex.DRIVER_STOP
+	d.closeOnce.Do(d.server.Close)
+	return nil
+}
+
+/*
+*
+* Modbus TCP 交给 mbserver 监听, 单元ID 不做检查; Stop 的时候关掉
+*
+ */
+func (d *ModbusSlaverDriver) ListenTCP(address string) error {
+	return d.server.ListenTCP(address)
+}
+
+/*
+*
+* 本地更新寄存器, 线圈非0即1, 寄存器支持 -32768 ~ 65535
+*
+ */
+func (d *ModbusSlaverDriver) SetValues(tag string, values []int) error {
+	r, ok := d.registers[tag]
+	if !ok {
+		return fmt.Errorf("tag not exists:%s", tag)
+	}
+	if len(values) > int(r.Quantity) {
+		return fmt.Errorf("tag [%s] only has %d registers", tag, r.Quantity)
+	}
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	return d.setValues(r, values)
+}
+
+func (d *ModbusSlaverDriver) setValues(r common.SlaverRegister, values []int) error {
+	if len(values) > int(r.Quantity) {
+		values = values[:r.Quantity]
+	}
+	for i, v := range values {
+		if v < -32768 || v > 65535 {
+			return fmt.Errorf("tag [%s] value out of range:%d", r.Tag, v)
+		}
+		value := uint16(v)
+		if r.Type == common.MODBUS_COIL || r.Type == common.MODBUS_DISCRETE_INPUT {
+			if v != 0 {
+				value = 1
+			}
+		}
+		d.set(r.Type, r.Address+uint16(i), value)
+	}
+	return nil
+}
+
+func (d *ModbusSlaverDriver) GetValues(tag string) (ModbusSlaverValue, error) {
+	r, ok := d.registers[tag]
+	if !ok {
+		return ModbusSlaverValue{}, fmt.Errorf("tag not exists:%s", tag)
+	}
+	d.locker.RLock()
+	defer d.locker.RUnlock()
+	return d.valueOf(r), nil
+}
+
+func (d *ModbusSlaverDriver) Values() map[string]ModbusSlaverValue {
+	d.locker.RLock()
+	defer d.locker.RUnlock()
+	values := map[string]ModbusSlaverValue{}
+	for tag, r := range d.registers {
+		values[tag] = d.valueOf(r)
+	}
+	return values
+}
+
+func (d *ModbusSlaverDriver) valueOf(r common.SlaverRegister) ModbusSlaverValue {
+	values := make([]uint16, r.Quantity)
+	for i := range values {
+		values[i] = d.get(r.Type, r.Address+uint16(i))
+	}
+	return ModbusSlaverValue{
+		Tag:      r.Tag,
+		Type:     r.Type,
+		Address:  r.Address,
+		Quantity: r.Quantity,
+		Values:   values,
+	}
+}
+
+// 寄存器的值放在 mbserver 的内存里
+func (d *ModbusSlaverDriver) get(Type string, address uint16) uint16 {
+	switch Type {
+	case common.MODBUS_COIL:
+		return uint16(d.server.Coils[address])
+	case common.MODBUS_DISCRETE_INPUT:
+		return uint16(d.server.DiscreteInputs[address])
+	case common.MODBUS_HOLDING_REGISTER:
+		return d.server.HoldingRegisters[address]
+	}
+	return d.server.InputRegisters[address]
+}
+
+func (d *ModbusSlaverDriver) set(Type string, address uint16, value uint16) {
+	switch Type {
+	case common.MODBUS_COIL:
+		d.server.Coils[address] = byte(value)
+	case common.MODBUS_DISCRETE_INPUT:
+		d.server.DiscreteInputs[address] = byte(value)
+	case common.MODBUS_HOLDING_REGISTER:
+		d.server.HoldingRegisters[address] = value
+	default:
+		d.server.InputRegisters[address] = value
+	}
+}
+
+/*
+*
+* 包一层 mbserver 的处理函数: 检查请求长度和地址映射, 加锁, 写完以后把被写到的 Tag 推出去;
+* mbserver 自己不检查长度, 残帧会让它 panic
+*
+ */
+func (d *ModbusSlaverDriver) mappedFunction(function uint8, Type string, maxQuantity uint16,
+	handler modbusFunction) modbusFunction {
+	return func(s *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+		data := frame.GetData()
+		if len(data) < 4 {
+			return []byte{}, &mbserver.IllegalDataValue
+		}
+		address := binary.BigEndian.Uint16(data[0:2])
+		quantity := binary.BigEndian.Uint16(data[2:4])
+		switch function {
+		case common.WRITE_SINGLE_COIL:
+			if len(data) != 4 || (quantity != 0xFF00 && quantity != 0x0000) {
+				return []byte{}, &mbserver.IllegalDataValue
+			}
+			quantity = 1
+		case common.WRITE_SINGLE_HOLDING_REGISTER:
+			if len(data) != 4 {
+				return []byte{}, &mbserver.IllegalDataValue
+			}
+			quantity = 1
+		case common.WRITE_MULTIPLE_COILS, common.WRITE_MULTIPLE_HOLDING_REGISTERS:
+			size := int(quantity) * 2
+			if function == common.WRITE_MULTIPLE_COILS {
+				size = (int(quantity) + 7) / 8
+			}
+			if len(data) < 5 || int(data[4]) != size || len(data) != 5+size {
+				return []byte{}, &mbserver.IllegalDataValue
+			}
+		default:
+			if len(data) != 4 {
+				return []byte{}, &mbserver.IllegalDataValue
+			}
+		}
+		if quantity < 1 || quantity > maxQuantity {
+			return []byte{}, &mbserver.IllegalDataValue
+		}
+		if !d.mapped(Type, address, quantity) {
+			return []byte{}, &mbserver.IllegalDataAddress
+		}
+		d.locker.Lock()
+		response, exception := handler(s, frame)
+		writes := []ModbusSlaverValue{}
+		if exception == &mbserver.Success && function >= common.WRITE_SINGLE_COIL {
+			for _, tag := range d.writtenTags(Type, address, quantity) {
+				writes = append(writes, d.valueOf(d.registers[tag]))
+			}
+		}
+		d.locker.Unlock()
+		// 回调放在锁外面, 回调里面可能会再读写寄存器
+		if len(writes) > 0 && d.onWrite != nil {
+			d.onWrite(writes)
+		}
+		return response, exception
+	}
+}
+
+// 地址范围是否全部映射过
+func (d *ModbusSlaverDriver) mapped(Type string, address uint16, quantity uint16) bool {
+	if int(address)+int(quantity) > 65536 {
+		return false
+	}
+	for i := uint16(0); i < quantity; i++ {
+		if _, ok := d.owners[Type][address+i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// 被写到的 Tag, 按名字排序, 保证事件顺序稳定
+func (d *ModbusSlaverDriver) writtenTags(Type string, address uint16, quantity uint16) []string {
+	tags := map[string]bool{}
+	for i := uint16(0); i < quantity; i++ {
+		tags[d.owners[Type][address+i]] = true
+	}
+	result := []string{}
+	for tag := range tags {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result
+}
+
+/*
+*
+* Modbus RTU: mbserver 自己打开串口, 打不开的时候直接退出进程, 而且不管从机地址,
+* 所以串口由设备打开, 这里每次读到的数据当作一帧, 用 mbserver 解析和处理
+*
+ */
+func (d *ModbusSlaverDriver) ServeRTU(ctx context.Context, port io.ReadWriter) error {
+	buffer := make([]byte, 512)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		n, err := port.Read(buffer)
+		if err != nil {
+			if errors.Is(err, serial.ErrTimeout) {
+				continue
+			}
+			return err
+		}
+		if response := d.HandleRTUFrame(buffer[:n]); response != nil {
+			if _, err := port.Write(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+*
+* 处理一个完整的 RTU 帧, 校验错误, 不是发给自己的或者广播的时候返回 nil
+*
+ */
+func (d *ModbusSlaverDriver) HandleRTUFrame(packet []byte) []byte {
+	frame, err := mbserver.NewRTUFrame(packet)
+	if err != nil {
+		return nil
+	}
+	if frame.Address != d.slaverId && frame.Address != 0 {
+		return nil
+	}
+	response := frame.Copy()
+	if function, ok := d.functions[frame.Function]; ok {
+		data, exception := function(d.server, frame)
+		response.SetData(data)
+		if exception != &mbserver.Success {
+			response.SetException(exception)
+		}
+	} else {
+		response.SetException(&mbserver.IllegalFunction)
+	}
+	if frame.Address == 0 {
+		return nil
+	}
+	return response.Bytes()
+}
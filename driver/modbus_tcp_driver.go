@@ -22,6 +22,7 @@ type modBusTCPDriver struct {
 	client     modbus.Client
 	RuleEngine typex.RuleX
 	Registers  []common.RegisterRW
+	batches    []modbusReadBatch
 	device     *typex.Device
 	frequency  int64
 }
@@ -31,7 +32,7 @@ func NewModBusTCPDriver(
 	e typex.RuleX,
 	Registers []common.RegisterRW,
 	handler *modbus.TCPClientHandler,
-	client modbus.Client, frequency int64) typex.XExternalDriver {
+	client modbus.Client, frequency int64, maxGap uint16) typex.XExternalDriver {
 	return &modBusTCPDriver{
 		state:      typex.DRIVER_UP,
 		device:     d,
@@ -39,6 +40,7 @@ func NewModBusTCPDriver(
 		client:     client,
 		handler:    handler,
 		Registers:  Registers,
+		batches:    planModbusReads(Registers, maxGap),
 		frequency:  frequency,
 	}
 
@@ -60,76 +62,20 @@ func (d *modBusTCPDriver) State() typex.DriverState {
 }
 
 func (d *modBusTCPDriver) Read(cmd []byte, data []byte) (int, error) {
-	dataMap := map[string]common.RegisterRW{}
 	var err error
-	var results []byte
+	dataMap := map[string]common.RegisterRW{}
 	count := len(d.Registers)
-	for _, r := range d.Registers {
-		d.handler.SlaveId = r.SlaverId
-		if r.Function == common.READ_COIL {
-			results, err = d.client.ReadCoils(r.Address, r.Quantity)
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
+	// 合并过的请求, 一次读回来再按点位切开
+	for _, batch := range d.batches {
+		d.handler.SlaveId = batch.SlaverId
+		results, err1 := batch.read(d.client)
+		if err1 != nil {
+			err = err1
+			count -= len(batch.Registers)
+			glogger.GLogger.Error(err1)
 		}
-		if r.Function == common.READ_DISCRETE_INPUT {
-			results, err = d.client.ReadDiscreteInputs(r.Address, r.Quantity)
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
-
-		}
-		if r.Function == common.READ_HOLDING_REGISTERS {
-			results, err = d.client.ReadHoldingRegisters(r.Address, r.Quantity)
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
-		}
-		if r.Function == common.READ_INPUT_REGISTERS {
-			results, err = d.client.ReadInputRegisters(r.Address, r.Quantity)
-			if err != nil {
-				count--
-				glogger.GLogger.Error(err)
-			}
-			value := common.RegisterRW{
-				Tag:      r.Tag,
-				Function: r.Function,
-				SlaverId: r.SlaverId,
-				Address:  r.Address,
-				Quantity: r.Quantity,
-				Value:    covertEmptyHex(results),
-			}
-			dataMap[r.Tag] = value
+		for _, r := range batch.Registers {
+			dataMap[r.Tag] = newRegisterValue(r, batch.slice(r, results), err1)
 		}
 		time.Sleep(time.Duration(d.frequency) * time.Millisecond)
 	}
@@ -141,35 +87,44 @@ func (d *modBusTCPDriver) Read(cmd []byte, data []byte) (int, error) {
 		return len(bytes), nil
 	}
 	return len(bytes), err
-
 }
 
 func (d *modBusTCPDriver) Write(cmd []byte, data []byte) (int, error) {
-	dataMap := []common.RegisterRW{}
+	dataMap := []common.RegisterW{}
 	if err := json.Unmarshal(data, &dataMap); err != nil {
 		return 0, err
 	}
-	for _, r := range d.Registers {
+	for _, r := range dataMap {
+		// 按点位写工程值
+		if r.Tag != "" {
+			if err := writeRegisterTag(d.client, func(slaverId byte) {
+				d.handler.SlaveId = slaverId
+			}, d.Registers, r); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		d.handler.SlaveId = r.SlaverId
 		if r.Function == common.WRITE_SINGLE_COIL {
-			_, err := d.client.WriteSingleCoil(r.Address, binary.BigEndian.Uint16([]byte(r.Value)[0:2]))
+			_, err := d.client.WriteSingleCoil(r.Address, binary.BigEndian.Uint16(r.Values))
 			if err != nil {
 				return 0, err
 			}
 		}
 		if r.Function == common.WRITE_MULTIPLE_COILS {
-			_, err := d.client.WriteMultipleCoils(r.Address, r.Quantity, []byte(r.Value))
+			_, err := d.client.WriteMultipleCoils(r.Address, uint16(len(r.Values)), r.Values)
 			if err != nil {
 				return 0, err
 			}
 		}
 		if r.Function == common.WRITE_SINGLE_HOLDING_REGISTER {
-			_, err := d.client.WriteSingleRegister(r.Address, binary.BigEndian.Uint16([]byte(r.Value)[0:2]))
+			_, err := d.client.WriteSingleRegister(r.Address, binary.BigEndian.Uint16(r.Values))
 			if err != nil {
 				return 0, err
 			}
 		}
 		if r.Function == common.WRITE_MULTIPLE_HOLDING_REGISTERS {
-			_, err := d.client.WriteMultipleRegisters(r.Address, r.Quantity, []byte(r.Value))
+			_, err := d.client.WriteMultipleRegisters(r.Address, uint16(len(r.Values)/2), r.Values)
 			if err != nil {
 				return 0, err
 			}
@@ -3,6 +3,7 @@ package driver
 import (
 	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
@@ -70,25 +71,37 @@ func (s1200 *siemens_s1200_driver) State() typex.DriverState {
 // 读: db --> dbNumber, start, size, buffer[]
 func (s1200 *siemens_s1200_driver) Read(cmd []byte, data []byte) (int, error) {
 	values := []common.S1200BlockValue{}
+	var err error
+	failed := 0
 	for _, db := range s1200.dbs {
-		rData := []byte{}
+		rData := make([]byte, db.Size)
 		s1200.lock.Lock()
-		if err := s1200.s7client.AGReadDB(db.Address, db.Start, db.Size, rData); err != nil {
-			s1200.lock.Unlock()
-			return 0, err
-		}
+		err1 := s1200.s7client.AGReadDB(db.Address, db.Start, db.Size, rData)
 		s1200.lock.Unlock()
-		values = append(values, common.S1200BlockValue{
+		value := common.S1200BlockValue{
 			Tag:     db.Tag,
 			Address: db.Address,
 			Start:   db.Start,
 			Size:    db.Size,
-			Value:   rData,
-		})
-
+		}
+		// 一个块读失败不影响其他块, 失败的块质量是 BAD_COMM
+		if err1 != nil {
+			err = err1
+			failed++
+			glogger.GLogger.Error(err1)
+			value.DataQuality = common.NewDataQuality(common.QUALITY_BAD_COMM, time.Time{}, err1)
+		} else {
+			value.Value = rData
+			value.DataQuality = common.NewDataQuality(common.QUALITY_GOOD, time.Time{}, nil)
+		}
+		values = append(values, value)
 	}
 	bytes, _ := json.Marshal(values)
 	copy(data, bytes)
+	// 全部失败的时候才认为读失败
+	if len(s1200.dbs) > 0 && failed == len(s1200.dbs) {
+		return len(bytes), err
+	}
 	return len(bytes), nil
 }
 
@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+/*
+*
+* 设备影子: 设备数据经过通道的时候更新 reported, 设备上线的时候把 delta 写到设备
+*
+ */
+type deviceShadows struct {
+	sync.RWMutex
+	e       *RuleEngine
+	shadows map[string]*typex.DeviceShadow
+}
+
+func newDeviceShadows(e *RuleEngine) *deviceShadows {
+	s := &deviceShadows{e: e, shadows: map[string]*typex.DeviceShadow{}}
+	e.events.Subscribe([]typex.EventType{typex.EVENT_RESOURCE_STATE}, s.onStateChange)
+	return s
+}
+
+func (e *RuleEngine) GetDeviceShadow() typex.XDeviceShadow {
+	return e.shadows
+}
+
+// 调用的时候要持有锁
+func (s *deviceShadows) shadow(uuid string) *typex.DeviceShadow {
+	shadow, ok := s.shadows[uuid]
+	if !ok {
+		shadow = &typex.DeviceShadow{
+			UUID:     uuid,
+			Reported: map[string]typex.ShadowValue{},
+			Desired:  map[string]interface{}{},
+		}
+		s.shadows[uuid] = shadow
+	}
+	return shadow
+}
+
+// 值一样: JSON 编码以后相同, 1 和 1.0 算一样
+func shadowValueEqual(a, b interface{}) bool {
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ja) == string(jb)
+}
+
+// 期望值和上报值不一样的点位, 调用的时候要持有锁
+func shadowDelta(shadow *typex.DeviceShadow) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for tag, desired := range shadow.Desired {
+		if reported, ok := shadow.Reported[tag]; ok && shadowValueEqual(reported.Value, desired) {
+			continue
+		}
+		delta[tag] = desired
+	}
+	return delta
+}
+
+func copyShadow(shadow *typex.DeviceShadow) *typex.DeviceShadow {
+	c := &typex.DeviceShadow{
+		UUID:     shadow.UUID,
+		Reported: make(map[string]typex.ShadowValue, len(shadow.Reported)),
+		Desired:  make(map[string]interface{}, len(shadow.Desired)),
+		Delta:    shadowDelta(shadow),
+	}
+	for tag, value := range shadow.Reported {
+		c.Reported[tag] = value
+	}
+	for tag, value := range shadow.Desired {
+		c.Desired[tag] = value
+	}
+	return c
+}
+
+func (s *deviceShadows) Get(uuid string) *typex.DeviceShadow {
+	s.RLock()
+	defer s.RUnlock()
+	if shadow, ok := s.shadows[uuid]; ok {
+		return copyShadow(shadow)
+	}
+	return nil
+}
+
+func (s *deviceShadows) GetTag(uuid string, tag string) (typex.ShadowValue, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if shadow, ok := s.shadows[uuid]; ok {
+		value, ok := shadow.Reported[tag]
+		return value, ok
+	}
+	return typex.ShadowValue{}, false
+}
+
+func (s *deviceShadows) All() []*typex.DeviceShadow {
+	s.RLock()
+	defer s.RUnlock()
+	shadows := make([]*typex.DeviceShadow, 0, len(s.shadows))
+	for _, shadow := range s.shadows {
+		shadows = append(shadows, copyShadow(shadow))
+	}
+	return shadows
+}
+
+/*
+*
+* 设备上报: 数据 JSON 顶层的每个字段是一个点位, 点位是对象的时候取 dataValue 或者 value,
+* 对象里有 quality 的时候用它做数据质量
+*
+ */
+func (s *deviceShadows) Report(uuid string, data string) {
+	tags := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		return
+	}
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	shadow := s.shadow(uuid)
+	for tag, value := range tags {
+		reported := typex.ShadowValue{Value: value, Quality: common.QUALITY_GOOD, Time: now}
+		if object, ok := value.(map[string]interface{}); ok {
+			if v, ok := object["dataValue"]; ok {
+				reported.Value = v
+			} else if v, ok := object["value"]; ok {
+				reported.Value = v
+			}
+			if quality, ok := object["quality"].(string); ok && quality != "" {
+				reported.Quality = quality
+			}
+		}
+		shadow.Reported[tag] = reported
+	}
+}
+
+func (s *deviceShadows) SetDesired(uuid string, desired map[string]interface{}) error {
+	s.Lock()
+	shadow := s.shadow(uuid)
+	for tag, value := range desired {
+		if value == nil {
+			delete(shadow.Desired, tag)
+			continue
+		}
+		shadow.Desired[tag] = value
+	}
+	s.Unlock()
+	if dev := s.e.GetDevice(uuid); dev != nil && dev.Device != nil &&
+		dev.Device.Status() == typex.DEV_UP {
+		return s.sync(dev)
+	}
+	return nil
+}
+
+func (s *deviceShadows) Delete(uuid string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.shadows, uuid)
+}
+
+/*
+*
+* 把 delta 写到设备: OnWrite(点位, JSON 值); 写失败的点位留在 delta 里, 下次上线再写
+*
+ */
+func (s *deviceShadows) sync(dev *typex.Device) error {
+	s.RLock()
+	delta := map[string]interface{}{}
+	if shadow, ok := s.shadows[dev.UUID]; ok {
+		delta = shadowDelta(shadow)
+	}
+	s.RUnlock()
+	errs := []string{}
+	for tag, value := range delta {
+		data, _ := json.Marshal(value)
+		if _, err := dev.Device.OnWrite([]byte(tag), data); err != nil {
+			glogger.GLogger.Errorf("Device [%s] shadow sync %s error: %v", dev.UUID, tag, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", tag, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("shadow sync failed, %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 设备上线的时候同步期望值, 离线以后上报的值变成不确定
+func (s *deviceShadows) onStateChange(event typex.Event) {
+	if event.Resource != _RESOURCE_DEVICE {
+		return
+	}
+	switch event.Data["to"] {
+	case "UP":
+		if dev := s.e.GetDevice(event.UUID); dev != nil && dev.Device != nil {
+			// 写设备可能很慢, 不能卡住事件总线
+			go s.sync(dev)
+		}
+	case "DOWN", "STOP":
+		s.Lock()
+		if shadow, ok := s.shadows[event.UUID]; ok {
+			for tag, value := range shadow.Reported {
+				if value.Quality != common.QUALITY_GOOD {
+					continue
+				}
+				value.Quality = common.QUALITY_UNCERTAIN_STALE
+				shadow.Reported[tag] = value
+			}
+		}
+		s.Unlock()
+	}
+}
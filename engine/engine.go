@@ -13,6 +13,7 @@ import (
 	"github.com/hootrhino/rulex/core"
 	"github.com/hootrhino/rulex/device"
 	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/rulexlib"
 	"github.com/hootrhino/rulex/source"
 	"github.com/hootrhino/rulex/target"
 	"github.com/hootrhino/rulex/trailer"
@@ -38,6 +39,11 @@ type RuleEngine struct {
 	SourceTypeManager typex.SourceRegistry `json:"-"`
 	TargetTypeManager typex.TargetRegistry `json:"-"`
 	MetricStatistics  *typex.MetricStatistics
+	supervisions      *sync.Map      // 资源监控
+	lifecycle         *lifecycleLog  // 资源生命周期事件
+	events            *eventBus      // 事件总线
+	pluginEvents      *sync.Map      // 插件的事件订阅ID
+	shadows           *deviceShadows // 设备影子
 }
 
 func NewRuleEngine(config typex.RulexConfig) typex.RuleX {
@@ -54,7 +60,15 @@ func NewRuleEngine(config typex.RulexConfig) typex.RuleX {
 		Devices:           &sync.Map{},
 		Config:            &config,
 		MetricStatistics:  typex.NewMetricStatistics(),
+		supervisions:      &sync.Map{},
+		lifecycle:         &lifecycleLog{},
+		events:            newEventBus(),
+		pluginEvents:      &sync.Map{},
 	}
+	// 规则可以绑定事件
+	re.events.Subscribe(nil, re.runEventRules)
+	// 设备影子
+	re.shadows = newDeviceShadows(re)
 	// trailer
 	re.Trailer = trailer.NewTrailerManager(re)
 	// lua appstack manager
@@ -70,13 +84,50 @@ func (e *RuleEngine) GetAiBase() typex.XAiRuntime {
 	return e.AiBaseRuntime
 }
 func (e *RuleEngine) Start() *typex.RulexConfig {
-	typex.StartQueue(core.GlobalConfig.MaxQueueSize)
+	typex.StartQueue(typex.LaneConfig{
+		Size:           defaultLaneSize(core.GlobalConfig),
+		Concurrency:    core.GlobalConfig.LaneConcurrency,
+		OverflowPolicy: core.GlobalConfig.LaneOverflowPolicy,
+	})
 	e.InitDeviceTypeManager()
 	e.InitSourceTypeManager()
 	e.InitTargetTypeManager()
 	return e.Config
 }
 
+/*
+*
+* max_queue_size 已经废弃: 没配 lane_size 的老配置继续用它当通道容量,
+* 两个都配了的时候提示一下 max_queue_size 不生效, 免得以为它还在限流
+*
+ */
+func defaultLaneSize(config typex.RulexConfig) int {
+	if config.LaneSize > 0 {
+		if config.MaxQueueSize > 0 {
+			glogger.GLogger.Warnf("max_queue_size is deprecated and ignored, lane_size = %d is used",
+				config.LaneSize)
+		}
+		return config.LaneSize
+	}
+	if config.MaxQueueSize > 0 {
+		glogger.GLogger.Warnf("max_queue_size is deprecated, use lane_size instead, "+
+			"lane_size falls back to max_queue_size = %d", config.MaxQueueSize)
+		return config.MaxQueueSize
+	}
+	return 0
+}
+
+/*
+*
+* 资源删除以后, 它的通道也要删掉, 重新加载的时候会按最新的配置创建
+*
+ */
+func removeLane(uuid string) {
+	if typex.DefaultDataCacheQueue != nil {
+		typex.DefaultDataCacheQueue.RemoveLane(uuid)
+	}
+}
+
 func (e *RuleEngine) PushQueue(qd typex.QueueData) error {
 	err := typex.DefaultDataCacheQueue.Push(qd)
 	if err != nil {
@@ -190,7 +241,11 @@ func (e *RuleEngine) Stop() {
 	e.Plugins.Range(func(key, value interface{}) bool {
 		plugin := value.(typex.XPlugin)
 		glogger.GLogger.Info("Stop plugin:", plugin.PluginMetaInfo().Name)
+		if id, ok := e.pluginEvents.LoadAndDelete(key); ok {
+			e.events.Unsubscribe(id.(string))
+		}
 		plugin.Stop()
+		e.publishPluginEvent(typex.EVENT_PLUGIN_STOP, plugin)
 		glogger.GLogger.Info("Stop plugin:", plugin.PluginMetaInfo().Name, " Successfully")
 		return true
 	})
@@ -236,32 +291,11 @@ func (e *RuleEngine) WorkDevice(Device *typex.Device, data string) (bool, error)
  */
 func (e *RuleEngine) RunSourceCallbacks(in *typex.InEnd, callbackArgs string) {
 	// 执行来自资源的脚本
-	for _, rule := range in.BindRules {
+	// 用快照遍历, 规则增删的时候不会和这里冲突
+	for _, rule := range in.SnapshotRules() {
 		if rule.Status == typex.RULE_RUNNING {
-			if rule.Type == "expr" {
-				// 0.5 增加expr库
-				// Expr 不执行 lua 的回调脚本
-				// ENV 暂时不加库, 留到后期扩展
-				_, err := core.ExecuteExpression(&rule, map[string]interface{}{})
-				if err != nil {
-					glogger.GLogger.Error("RunLuaCallbacks error:", err)
-				}
-			}
-			if rule.Type == "lua" {
-				_, err := core.ExecuteActions(&rule, lua.LString(callbackArgs))
-				if err != nil {
-					glogger.GLogger.Error("RunLuaCallbacks error:", err)
-					_, err := core.ExecuteFailed(rule.LuaVM, lua.LString(err.Error()))
-					if err != nil {
-						glogger.GLogger.Error(err)
-					}
-				} else {
-					_, err := core.ExecuteSuccess(rule.LuaVM)
-					if err != nil {
-						glogger.GLogger.Error(err)
-						return // lua 是规则链，有短路原则，中途出错会中断
-					}
-				}
+			if !e.runRule(&rule, "INEND", in.UUID, callbackArgs, 0, false) {
+				return // lua 是规则链，有短路原则，中途出错会中断
 			}
 		}
 	}
@@ -273,30 +307,53 @@ func (e *RuleEngine) RunSourceCallbacks(in *typex.InEnd, callbackArgs string) {
 *
  */
 func (e *RuleEngine) RunDeviceCallbacks(Device *typex.Device, callbackArgs string) {
-	for _, rule := range Device.BindRules {
+	for _, rule := range Device.SnapshotRules() {
 		if rule.Status == typex.RULE_RUNNING {
-			if rule.Type == "expr" {
-				// 5.0 增加expr的库
-			}
-			if rule.Type == "lua" {
-				_, err := core.ExecuteActions(&rule, lua.LString(callbackArgs))
-				if err != nil {
-					glogger.GLogger.Error("RunLuaCallbacks error:", err)
-					_, err := core.ExecuteFailed(rule.LuaVM, lua.LString(err.Error()))
-					if err != nil {
-						glogger.GLogger.Error(err)
-					}
-				} else {
-					_, err := core.ExecuteSuccess(rule.LuaVM)
-					if err != nil {
-						glogger.GLogger.Error(err)
-						return
-					}
-				}
+			if !e.runRule(&rule, "DEVICE", Device.UUID, callbackArgs, 0, false) {
+				return
 			}
+		}
+	}
+}
 
+/*
+*
+* 执行一个 Lua 规则, 返回值:
+*   - output: Actions 最后的输出, 转换成字符串
+*   - routed: Actions 全部执行完了并且有输出, 需要往下游转发
+*   - next:   false 表示 Success 回调出错, 规则链需要中断
+*
+ */
+func (e *RuleEngine) runLuaRule(rule *typex.Rule, resType string, uuid string,
+	callbackArgs string, quiet bool) (output string, routed bool, next bool) {
+	// 同一个资源的通道可能是多协程并发处理的, Lua VM 需要串行
+	rule.AcquireVM()
+	defer rule.ReleaseVM()
+	value, completed, err := core.ExecuteActionsToEnd(rule, lua.LString(callbackArgs))
+	if err != nil {
+		glogger.GLogger.Error("RunLuaCallbacks error:", err)
+		e.publishRuleError(rule, resType, uuid, err, quiet)
+		_, err := core.ExecuteFailed(rule.LuaVM, lua.LString(err.Error()))
+		if err != nil {
+			glogger.GLogger.Error(err)
 		}
+		return "", false, true
+	}
+	_, err1 := core.ExecuteSuccess(rule.LuaVM)
+	if err1 != nil {
+		glogger.GLogger.Error(err1)
+		e.publishRuleError(rule, resType, uuid, err1, quiet)
+		return "", false, false
+	}
+	if !completed || value == nil || value == lua.LNil {
+		return "", false, true
 	}
+	output, err2 := rulexlib.LuaValueToString(value)
+	if err2 != nil {
+		glogger.GLogger.Errorf("Rule [%s] output encode error:%s", rule.UUID, err2)
+		return "", false, true
+	}
+	return output, true, true
 }
 
 // LoadHook
@@ -310,6 +367,11 @@ func (e *RuleEngine) LoadHook(h typex.XHook) error {
 
 }
 
+// RemoveHook
+func (e *RuleEngine) RemoveHook(name string) {
+	e.Hooks.Delete(name)
+}
+
 // RunHooks
 func (e *RuleEngine) RunHooks(data string) {
 	e.Hooks.Range(func(key, value interface{}) bool {
@@ -323,6 +385,34 @@ func runHook(h typex.XHook, data string) error {
 	return h.Work(data)
 }
 
+// RunSourceHooks: 输入资源的数据只交给实现了 XSourceHook 的 Hook
+func (e *RuleEngine) RunSourceHooks(in *typex.InEnd, data string) {
+	e.Hooks.Range(func(key, value interface{}) bool {
+		if h, ok := value.(typex.XSourceHook); ok {
+			if err := h.WorkInEnd(in, data); err != nil {
+				h.Error(err)
+			}
+		}
+		return true
+	})
+}
+
+// RunDeviceHooks: 设备数据, 关心数据来源的 Hook 走 WorkDevice
+func (e *RuleEngine) RunDeviceHooks(Device *typex.Device, data string) {
+	e.Hooks.Range(func(key, value interface{}) bool {
+		var err error
+		if h, ok := value.(typex.XDeviceHook); ok {
+			err = h.WorkDevice(Device, data)
+		} else {
+			err = runHook(value.(typex.XHook), data)
+		}
+		if err != nil {
+			value.(typex.XHook).Error(err)
+		}
+		return true
+	})
+}
+
 func (e *RuleEngine) GetInEnd(uuid string) *typex.InEnd {
 	v, ok := (e.InEnds).Load(uuid)
 	if ok {
@@ -336,9 +426,11 @@ func (e *RuleEngine) SaveInEnd(in *typex.InEnd) {
 }
 
 func (e *RuleEngine) RemoveInEnd(id string) {
+	e.unsupervise(id)
 	if inEnd := e.GetInEnd(id); inEnd != nil {
 		inEnd.Source.Stop()
 		e.InEnds.Delete(id)
+		removeLane(id)
 		inEnd = nil
 		glogger.GLogger.Infof("InEnd [%v] has been deleted", id)
 	}
@@ -364,12 +456,20 @@ func (e *RuleEngine) SaveOutEnd(out *typex.OutEnd) {
 }
 
 func (e *RuleEngine) RemoveOutEnd(uuid string) {
+	e.unsupervise(uuid)
 	if outEnd := e.GetOutEnd(uuid); outEnd != nil {
+		if outEnd.Cache != nil {
+			if err := outEnd.Cache.Close(); err != nil {
+				glogger.GLogger.Error(err)
+			}
+			outEnd.Cache = nil
+		}
 		if outEnd.Target != nil {
 			outEnd.Target.Stop()
 			e.OutEnds.Delete(uuid)
 			outEnd = nil
 		}
+		removeLane(uuid)
 		glogger.GLogger.Infof("OutEnd [%v] has been deleted", uuid)
 	}
 }
@@ -433,7 +533,7 @@ func (e *RuleEngine) SnapshotDump() string {
 		"outends":    outends,
 		"devices":    devices,
 		"drivers":    drivers,
-		"statistics": e.MetricStatistics,
+		"statistics": e.MetricStatistics.Snapshot(),
 		"system":     system,
 		"config":     core.GlobalConfig,
 	}
@@ -487,25 +587,25 @@ func (e *RuleEngine) PickUpProcess(uuid string) *typex.GoodsProcess {
 // 重启源
 func (e *RuleEngine) RestartInEnd(uuid string) error {
 	if _, ok := e.InEnds.Load(uuid); ok {
-		return nil
+		return e.restart(_RESOURCE_INEND, uuid)
 	}
-	return errors.New("InEnd:" + uuid + "not exists")
+	return errors.New("InEnd:" + uuid + " not exists")
 }
 
 // 重启目标
 func (e *RuleEngine) RestartOutEnd(uuid string) error {
 	if _, ok := e.OutEnds.Load(uuid); ok {
-		return nil
+		return e.restart(_RESOURCE_OUTEND, uuid)
 	}
-	return errors.New("OutEnd:" + uuid + "not exists")
+	return errors.New("OutEnd:" + uuid + " not exists")
 }
 
 // 重启设备
 func (e *RuleEngine) RestartDevice(uuid string) error {
 	if _, ok := e.Devices.Load(uuid); ok {
-		return nil
+		return e.restart(_RESOURCE_DEVICE, uuid)
 	}
-	return errors.New("Device:" + uuid + "not exists")
+	return errors.New("Device:" + uuid + " not exists")
 }
 
 /*
@@ -544,6 +644,12 @@ func (e *RuleEngine) InitDeviceTypeManager() error {
 			NewDevice: device.NewGenericModbusDevice,
 		},
 	)
+	e.DeviceTypeManager.Register(typex.GENERIC_MODBUS_SLAVER,
+		&typex.XConfig{
+			Engine:    e,
+			NewDevice: device.NewGenericModbusSlaver,
+		},
+	)
 	e.DeviceTypeManager.Register(typex.GENERIC_UART,
 		&typex.XConfig{
 			Engine:    e,
@@ -655,6 +761,18 @@ func (e *RuleEngine) InitSourceTypeManager() error {
 			NewSource: source.NewIThingsSource,
 		},
 	)
+	e.SourceTypeManager.Register(typex.SPARKPLUG_B,
+		&typex.XConfig{
+			Engine:    e,
+			NewSource: source.NewSparkplugBSource,
+		},
+	)
+	e.SourceTypeManager.Register(typex.KAFKA,
+		&typex.XConfig{
+			Engine:    e,
+			NewSource: source.NewKafkaSource,
+		},
+	)
 	return nil
 }
 
@@ -712,6 +830,24 @@ func (e *RuleEngine) InitTargetTypeManager() error {
 			NewTarget: target.NewSqliteTarget,
 		},
 	)
+	e.TargetTypeManager.Register(typex.SPARKPLUG_B_TARGET,
+		&typex.XConfig{
+			Engine:    e,
+			NewTarget: target.NewSparkplugBTarget,
+		},
+	)
+	e.TargetTypeManager.Register(typex.KAFKA_TARGET,
+		&typex.XConfig{
+			Engine:    e,
+			NewTarget: target.NewKafkaTarget,
+		},
+	)
+	e.TargetTypeManager.Register(typex.TIMESERIES_TARGET,
+		&typex.XConfig{
+			Engine:    e,
+			NewTarget: target.NewTimeSeriesTarget,
+		},
+	)
 	e.TargetTypeManager.Register(typex.USER_G776_TARGET,
 		&typex.XConfig{
 			Engine:    e,
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+)
+
+// 事件缓冲区大小, 订阅者处理不过来的时候超出的事件被丢弃
+const _EVENT_BUS_SIZE = 1024
+
+type eventSubscriber struct {
+	types   []typex.EventType
+	handler typex.EventHandler
+}
+
+func (s *eventSubscriber) match(t typex.EventType) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, eventType := range s.types {
+		if eventType == t {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+* 事件总线: 一个协程按顺序分发, 发布者不会被订阅者拖住
+*
+ */
+type eventBus struct {
+	subscribers sync.Map // id -> *eventSubscriber
+	queue       chan typex.Event
+	dropped     uint64
+}
+
+func newEventBus() *eventBus {
+	bus := &eventBus{queue: make(chan typex.Event, _EVENT_BUS_SIZE)}
+	go bus.dispatch()
+	return bus
+}
+
+func (bus *eventBus) Publish(event typex.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Data == nil {
+		event.Data = map[string]interface{}{}
+	}
+	select {
+	case bus.queue <- event:
+	default:
+		// 这里不能打错误日志, 否则日志钩子里面再发事件会一直循环
+		atomic.AddUint64(&bus.dropped, 1)
+	}
+}
+
+func (bus *eventBus) Subscribe(types []typex.EventType, handler typex.EventHandler) string {
+	id := utils.MakeUUID("SUB")
+	bus.subscribers.Store(id, &eventSubscriber{types: types, handler: handler})
+	return id
+}
+
+func (bus *eventBus) Unsubscribe(id string) {
+	bus.subscribers.Delete(id)
+}
+
+func (bus *eventBus) dispatch() {
+	for {
+		select {
+		case <-typex.GCTX.Done():
+			return
+		case event := <-bus.queue:
+			bus.subscribers.Range(func(key, value interface{}) bool {
+				subscriber := value.(*eventSubscriber)
+				if subscriber.match(event.Type) {
+					callEventHandler(key.(string), subscriber.handler, event)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// 订阅者出错不能影响别的订阅者
+func callEventHandler(id string, handler typex.EventHandler, event typex.Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			glogger.GLogger.Errorf("Event subscriber [%s] handle %s error: %v", id, event.Type, err)
+		}
+	}()
+	handler(event)
+}
+
+func (e *RuleEngine) GetEventBus() typex.XEventBus {
+	return e.events
+}
+
+/*
+*
+* 执行绑定了这个事件类型的规则, 事件的 JSON 就是规则的输入
+*
+ */
+func (e *RuleEngine) runEventRules(event typex.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		glogger.GLogger.Error("Event encode error:", err)
+		return
+	}
+	e.Rules.Range(func(key, value interface{}) bool {
+		rule := value.(*typex.Rule)
+		if rule.Status != typex.RULE_RUNNING {
+			return true
+		}
+		for _, eventType := range rule.FromEvent {
+			if eventType == string(event.Type) {
+				// 处理 RULE_ERROR 的规则出错的时候不再发 RULE_ERROR, 防止循环触发
+				e.runRule(rule, "EVENT", event.UUID, string(data), 0,
+					event.Type == typex.EVENT_RULE_ERROR)
+				break
+			}
+		}
+		return true
+	})
+}
+
+/*
+*
+* 插件启动以后订阅事件, 返回订阅ID; 没有实现 XEventPlugin 的插件返回空
+*
+ */
+func (e *RuleEngine) subscribePlugin(p typex.XPlugin) string {
+	eventPlugin, ok := p.(typex.XEventPlugin)
+	if !ok {
+		return ""
+	}
+	return e.events.Subscribe(eventPlugin.EventTypes(), eventPlugin.OnEvent)
+}
+
+func (e *RuleEngine) publishPluginEvent(eventType typex.EventType, p typex.XPlugin) {
+	e.events.Publish(typex.Event{
+		Type:     eventType,
+		Resource: "PLUGIN",
+		UUID:     p.PluginMetaInfo().UUID,
+		Name:     p.PluginMetaInfo().Name,
+	})
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+/*
+*
+* 构造 Expr 规则的执行环境:
+*   - 如果数据是 JSON 对象, 字段直接放在顶层, 例如: temp > 30
+*   - payload: 解码以后的数据, 不是 JSON 的时候就是原始字符串
+*   - raw: 原始字符串
+*   - meta: {uuid: 资源UUID, type: INEND | DEVICE | RULE | EVENT, ts: 毫秒时间戳}
+*     type 是 RULE 的时候数据来自上游规则, uuid 是上游规则的 UUID;
+*     type 是 EVENT 的时候数据是事件的 JSON, uuid 是产生事件的资源的 UUID
+* payload, raw, meta 是保留字段, 数据里面的同名字段会被覆盖
+*
+ */
+func buildExprEnv(resType string, uuid string, data string) map[string]interface{} {
+	env := map[string]interface{}{}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(data), &payload); err == nil {
+		if fields, ok := payload.(map[string]interface{}); ok {
+			for k, v := range fields {
+				env[k] = v
+			}
+		}
+	} else {
+		payload = data
+	}
+	env["payload"] = payload
+	env["raw"] = data
+	env["meta"] = map[string]interface{}{
+		"uuid": uuid,
+		"type": resType,
+		"ts":   time.Now().UnixMilli(),
+	}
+	return env
+}
+
+/*
+*
+* 执行 Expr 规则, 结果为真的时候原始数据需要往下游转发
+*
+ */
+func (e *RuleEngine) runExprRule(rule *typex.Rule, resType string, uuid string,
+	data string, quiet bool) bool {
+	result, err := core.ExecuteExpression(rule, buildExprEnv(resType, uuid, data))
+	if err != nil {
+		glogger.GLogger.Error("RunExprCallbacks error:", err)
+		e.publishRuleError(rule, resType, uuid, err, quiet)
+		return false
+	}
+	return isTruthy(result)
+}
+
+/*
+*
+* 和大部分脚本语言的习惯一致: nil, false, 0, 空串, 空集合都是假
+*
+ */
+func isTruthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case int:
+		return t != 0
+	case int64:
+		return t != 0
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
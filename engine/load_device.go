@@ -37,6 +37,7 @@ func (e *RuleEngine) AllDevices() *sync.Map {
 
 // 删除设备
 func (e *RuleEngine) RemoveDevice(uuid string) {
+	e.unsupervise(uuid)
 	if dev := e.GetDevice(uuid); dev != nil {
 		if dev.Device != nil {
 			glogger.GLogger.Infof("Device [%v] ready to stop", uuid)
@@ -45,6 +46,7 @@ func (e *RuleEngine) RemoveDevice(uuid string) {
 			}
 			glogger.GLogger.Infof("Device [%v] has been stopped", uuid)
 			e.Devices.Delete(uuid)
+			removeLane(uuid)
 			glogger.GLogger.Infof("Device [%v] has been deleted", uuid)
 		}
 
@@ -59,7 +61,11 @@ func (e *RuleEngine) RemoveDevice(uuid string) {
 func (e *RuleEngine) LoadDeviceWithCtx(deviceInfo *typex.Device,
 	ctx context.Context, cancelCTX context.CancelFunc) error {
 	if config := e.DeviceTypeManager.Find(deviceInfo.Type); config != nil {
-		return e.loadDevices(config.NewDevice(e), deviceInfo, ctx, cancelCTX)
+		if err := e.loadDevices(config.NewDevice(e), deviceInfo, ctx, cancelCTX); err != nil {
+			return err
+		}
+		e.supervise(_RESOURCE_DEVICE, deviceInfo.UUID, cancelCTX)
+		return nil
 	}
 	return fmt.Errorf("unsupported Device type:%s", deviceInfo.Type)
 
@@ -103,17 +109,9 @@ func startDevice(abstractDevice typex.XDevice, e *RuleEngine,
 	device := abstractDevice.Details()
 	if device != nil {
 		// bind 最新的规则 要从数据库拿刚更新的
-		for _, rule := range device.BindRules {
+		for _, rule := range device.SnapshotRules() {
 			glogger.GLogger.Debugf("Load rule:%s", rule.Name)
-			RuleInstance := typex.NewLuaRule(e,
-				rule.UUID,
-				rule.Name,
-				rule.Description,
-				rule.FromSource,
-				rule.FromDevice,
-				rule.Success,
-				rule.Actions,
-				rule.Failed)
+			RuleInstance := newRuleInstance(e, rule)
 			if err1 := e.LoadRule(RuleInstance); err1 != nil {
 				return err1
 			}
@@ -40,6 +40,10 @@ func (e *RuleEngine) LoadPlugin(sectionK string, p typex.XPlugin) error {
 	}
 
 	e.Plugins.Store(p.PluginMetaInfo().UUID, p)
+	if id := e.subscribePlugin(p); id != "" {
+		e.pluginEvents.Store(p.PluginMetaInfo().UUID, id)
+	}
+	e.publishPluginEvent(typex.EVENT_PLUGIN_START, p)
 	glogger.GLogger.Infof("Plugin start successfully:[%v]", p.PluginMetaInfo().Name)
 	return nil
 
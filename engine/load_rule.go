@@ -8,29 +8,38 @@ import (
 	"github.com/hootrhino/rulex/typex"
 )
 
-// LoadRule: 每个规则都绑定了资源(FromSource)或者设备(FromDevice)
+// LoadRule: 每个规则都绑定了资源(FromSource)或者设备(FromDevice), 绑定了事件(FromEvent)的规则
+// 在事件发生的时候从规则表里找
 // 使用MAP来记录RULE的绑定关系, KEY是UUID, Value是规则
 func (e *RuleEngine) LoadRule(r *typex.Rule) error {
-	// 前置语法验证
-	if err := core.VerifyLuaSyntax(r); err != nil {
-		return err
-	}
-	// 前置自定义库校验
-	if err := LoadExtLuaLib(e, r); err != nil {
-		return err
+	if r.Type == "expr" {
+		// Expr 规则只需要编译表达式
+		if err := core.VerifyExprSyntax(r); err != nil {
+			return err
+		}
+		e.SaveRule(r)
+	} else {
+		// 前置语法验证
+		if err := core.VerifyLuaSyntax(r); err != nil {
+			return err
+		}
+		// 前置自定义库校验
+		if err := LoadExtLuaLib(e, r); err != nil {
+			return err
+		}
+		e.SaveRule(r)
+		//--------------------------------------------------------------
+		// Load LoadBuildInLuaLib
+		//--------------------------------------------------------------
+		LoadBuildInLuaLib(e, r)
 	}
-	e.SaveRule(r)
-	//--------------------------------------------------------------
-	// Load LoadBuildInLuaLib
-	//--------------------------------------------------------------
-	LoadBuildInLuaLib(e, r)
 
 	glogger.GLogger.Infof("Rule [%v, %v] load successfully", r.Name, r.UUID)
 	// 绑定输入资源
 	for _, inUUId := range r.FromSource {
 		// 查找输入定义的资源是否存在
 		if in := e.GetInEnd(inUUId); in != nil {
-			(in.BindRules)[r.UUID] = *r
+			in.BindRule(*r)
 			return nil
 		}
 	}
@@ -39,13 +48,40 @@ func (e *RuleEngine) LoadRule(r *typex.Rule) error {
 		// 查找输入定义的资源是否存在
 		if Device := e.GetDevice(devUUId); Device != nil {
 			// 绑定资源和规则，建立关联关系
-			(Device.BindRules)[r.UUID] = *r
+			Device.BindRule(*r)
 		}
 	}
 	return nil
 
 }
 
+/*
+*
+* 重启资源的时候用已有的规则新建一个实例, 虚拟机是新的
+*
+ */
+func newRuleInstance(e typex.RuleX, rule typex.Rule) *typex.Rule {
+	RuleInstance := typex.NewLuaRule(e,
+		rule.UUID,
+		rule.Name,
+		rule.Description,
+		rule.FromSource,
+		rule.FromDevice,
+		rule.Success,
+		rule.Actions,
+		rule.Failed)
+	if rule.Type != "" {
+		RuleInstance.Type = rule.Type
+	}
+	RuleInstance.Expression = rule.Expression
+	RuleInstance.FromEvent = rule.FromEvent
+	RuleInstance.ToRules = rule.ToRules
+	RuleInstance.ToTargets = rule.ToTargets
+	RuleInstance.ToDevices = rule.ToDevices
+	RuleInstance.DeviceCmd = rule.DeviceCmd
+	return RuleInstance
+}
+
 // GetRule a rule
 func (e *RuleEngine) GetRule(id string) *typex.Rule {
 	v, ok := (e.Rules).Load(id)
@@ -66,22 +102,14 @@ func (e *RuleEngine) RemoveRule(ruleId string) {
 		// 清空 InEnd 的 bind 资源
 		e.AllInEnd().Range(func(key, value interface{}) bool {
 			inEnd := value.(*typex.InEnd)
-			for _, r := range inEnd.BindRules {
-				if rule.UUID == r.UUID {
-					delete(inEnd.BindRules, ruleId)
-				}
-			}
+			inEnd.UnbindRule(ruleId)
 			return true
 		})
 		// 清空Device的绑定
 		e.AllDevices().Range(func(key, value interface{}) bool {
 			Device := value.(*typex.Device)
-			for _, r := range Device.BindRules {
-				glogger.GLogger.Debugf("Unlink rule:%s", rule.Name)
-				if rule.UUID == r.UUID {
-					delete(Device.BindRules, ruleId)
-				}
-			}
+			glogger.GLogger.Debugf("Unlink rule:%s", rule.Name)
+			Device.UnbindRule(ruleId)
 			return true
 		})
 		e.Rules.Delete(ruleId)
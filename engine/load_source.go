@@ -34,7 +34,11 @@ func (e *RuleEngine) LoadBuiltInEnd(in *typex.InEnd) error {
 func (e *RuleEngine) LoadInEndWithCtx(in *typex.InEnd,
 	ctx context.Context, cancelCTX context.CancelFunc) error {
 	if config := e.SourceTypeManager.Find(in.Type); config != nil {
-		return e.loadSource(config.NewSource(e), in, ctx, cancelCTX)
+		if err := e.loadSource(config.NewSource(e), in, ctx, cancelCTX); err != nil {
+			return err
+		}
+		e.supervise(_RESOURCE_INEND, in.UUID, cancelCTX)
+		return nil
 	}
 	return fmt.Errorf("unsupported InEnd type:%s", in.Type)
 }
@@ -84,16 +88,8 @@ func (e *RuleEngine) startSource(source typex.XSource,
 	// 2023-06-14新增： 重启成功后数据会丢失,还得加载最新的Rule到设备中
 	Source := source.Details()
 	if Source != nil {
-		for _, rule := range Source.BindRules {
-			RuleInstance := typex.NewLuaRule(e,
-				rule.UUID,
-				rule.Name,
-				rule.Description,
-				rule.FromSource,
-				rule.FromDevice,
-				rule.Success,
-				rule.Actions,
-				rule.Failed)
+		for _, rule := range Source.SnapshotRules() {
+			RuleInstance := newRuleInstance(e, rule)
 			if err1 := e.LoadRule(RuleInstance); err1 != nil {
 				return err1
 			}
@@ -3,15 +3,24 @@ package engine
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"time"
 
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
 )
 
 func (e *RuleEngine) LoadOutEndWithCtx(in *typex.OutEnd, ctx context.Context,
 	cancelCTX context.CancelFunc) error {
 	if config := e.TargetTypeManager.Find(in.Type); config != nil {
-		return e.loadTarget(config.NewTarget(e), in, ctx, cancelCTX)
+		if err := e.loadTarget(config.NewTarget(e), in, ctx, cancelCTX); err != nil {
+			return err
+		}
+		e.supervise(_RESOURCE_OUTEND, in.UUID, cancelCTX)
+		return nil
 	}
 	return fmt.Errorf("unsupported Target type:%s", in.Type)
 }
@@ -35,7 +44,17 @@ func (e *RuleEngine) loadTarget(target typex.XTarget, out *typex.OutEnd,
 	}
 	if err := target.Init(out.UUID, config); err != nil {
 		glogger.GLogger.Error(err)
-		e.RemoveInEnd(out.UUID)
+		e.unloadFailedOutEnd(out)
+		return err
+	}
+	if err := loadOutEndQualityFilter(out); err != nil {
+		glogger.GLogger.Error(err)
+		e.unloadFailedOutEnd(out)
+		return err
+	}
+	if err := e.loadOutEndCache(out, ctx); err != nil {
+		glogger.GLogger.Error(err)
+		e.unloadFailedOutEnd(out)
 		return err
 	}
 	startTarget(target, e, ctx, cancelCTX)
@@ -43,6 +62,21 @@ func (e *RuleEngine) loadTarget(target typex.XTarget, out *typex.OutEnd,
 	return nil
 }
 
+/*
+*
+* 加载失败的时候清理: 已经打开的离线缓存要关掉, 不然文件句柄一直留着, 下次也打不开
+*
+ */
+func (e *RuleEngine) unloadFailedOutEnd(out *typex.OutEnd) {
+	if out.Cache != nil {
+		if err := out.Cache.Close(); err != nil {
+			glogger.GLogger.Error(err)
+		}
+		out.Cache = nil
+	}
+	e.OutEnds.Delete(out.UUID)
+}
+
 func startTarget(target typex.XTarget, e typex.RuleX,
 	ctx context.Context, cancelCTX context.CancelFunc) error {
 	if err := target.Start(typex.CCTX{Ctx: ctx, CancelCTX: cancelCTX}); err != nil {
@@ -51,3 +85,119 @@ func startTarget(target typex.XTarget, e typex.RuleX,
 	}
 	return nil
 }
+
+/*
+*
+* 数据质量过滤: 配置里面的 qualityFilter 是允许输出的质量列表, 比如 ["GOOD"]
+*
+ */
+func loadOutEndQualityFilter(out *typex.OutEnd) error {
+	out.QualityFilter = nil
+	v, ok := out.Config["qualityFilter"]
+	if !ok || v == nil {
+		return nil
+	}
+	list := []interface{}{}
+	switch t := v.(type) {
+	case []interface{}:
+		list = t
+	case []string:
+		for _, quality := range t {
+			list = append(list, quality)
+		}
+	default:
+		return fmt.Errorf("invalid qualityFilter:%v", v)
+	}
+	qualities := []string{}
+	for _, item := range list {
+		quality, ok := item.(string)
+		if !ok || !utils.SContains(common.DataQualities, quality) {
+			return fmt.Errorf("unsupported quality in qualityFilter:%v", item)
+		}
+		qualities = append(qualities, quality)
+	}
+	out.QualityFilter = qualities
+	return nil
+}
+
+/*
+*
+* 加载离线缓存: 配置里面的 cacheConfig 开启以后, 目标不可用时数据会落盘, 恢复以后补发
+*
+ */
+func (e *RuleEngine) loadOutEndCache(out *typex.OutEnd, ctx context.Context) error {
+	cacheConfig := common.OutEndCacheConfig{}
+	v, ok := out.Config["cacheConfig"]
+	if !ok {
+		return nil
+	}
+	configMap, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid cacheConfig:%v", v)
+	}
+	if err := utils.BindSourceConfig(configMap, &cacheConfig); err != nil {
+		return err
+	}
+	if !cacheConfig.Enable {
+		return nil
+	}
+	cachePath := core.GlobalConfig.OutEndCachePath
+	if cachePath == "" {
+		cachePath = "./cache"
+	}
+	// 重启的时候缓存还开着, 不用重新打开
+	if out.Cache == nil {
+		cache, err := core.NewDiskQueue(filepath.Join(cachePath, out.UUID), cacheConfig)
+		if err != nil {
+			return err
+		}
+		out.Cache = cache
+	}
+	interval := cacheConfig.ReplayInterval
+	if interval <= 0 {
+		interval = 5000
+	}
+	go e.replayOutEndCache(ctx, out, time.Duration(interval)*time.Millisecond)
+	glogger.GLogger.Infof("OutEnd [%v] cache loaded, %d data waiting to replay",
+		out.UUID, out.Cache.Count())
+	return nil
+}
+
+/*
+*
+* 定时检查目标状态, 恢复以后按顺序补发缓存的数据
+*
+ */
+func (e *RuleEngine) replayOutEndCache(ctx context.Context,
+	out *typex.OutEnd, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-typex.GCTX.Done():
+			return
+		case <-ticker.C:
+		}
+		if out.Target == nil || out.Cache == nil {
+			continue
+		}
+		if out.Target.Status() != typex.SOURCE_UP || out.Cache.Count() == 0 {
+			continue
+		}
+		n, err := out.Cache.Replay(func(data string) error {
+			if _, err := out.Target.To(data); err != nil {
+				return err
+			}
+			e.MetricStatistics.IncOut()
+			return nil
+		})
+		if err != nil {
+			glogger.GLogger.Warnf("OutEnd [%v] replay interrupted after %d data: %v",
+				out.UUID, n, err)
+			continue
+		}
+		glogger.GLogger.Infof("OutEnd [%v] replayed %d cached data", out.UUID, n)
+	}
+}
@@ -45,6 +45,9 @@ func LoadBuildInLuaLib(e typex.RuleX, r *typex.Rule) {
 	// 数据持久化
 	r.AddLib(e, "rulexlib", "DataToTdEngine", rulexlib.DataToTdEngine(e))
 	r.AddLib(e, "rulexlib", "DataToMongo", rulexlib.DataToMongo(e))
+	r.AddLib(e, "rulexlib", "DataToSparkplug", rulexlib.DataToSparkplug(e))
+	r.AddLib(e, "rulexlib", "DataToKafka", rulexlib.DataToKafka(e))
+	r.AddLib(e, "rulexlib", "DataToTimeSeries", rulexlib.DataToTimeSeries(e))
 	// 时间库
 	r.AddLib(e, "rulexlib", "Time", rulexlib.Time(e))
 	r.AddLib(e, "rulexlib", "TsUnix", rulexlib.TsUnix(e))
@@ -59,6 +62,8 @@ func LoadBuildInLuaLib(e typex.RuleX, r *typex.Rule) {
 	// JSON
 	r.AddLib(e, "rulexlib", "T2J", rulexlib.JSONE(e)) // Lua Table -> JSON
 	r.AddLib(e, "rulexlib", "J2T", rulexlib.JSOND(e)) // JSON -> Lua Table
+	// 数据质量
+	r.AddLib(e, "rulexlib", "FilterQuality", rulexlib.FilterQuality(e))
 	// Get Rule ID
 	r.AddLib(e, "rulexlib", "RUUID", rulexlib.SelfRuleUUID(e, r.UUID))
 	// Codec
@@ -67,6 +72,8 @@ func LoadBuildInLuaLib(e typex.RuleX, r *typex.Rule) {
 	// Device R/W
 	r.AddLib(e, "rulexlib", "ReadDevice", rulexlib.ReadDevice(e))
 	r.AddLib(e, "rulexlib", "WriteDevice", rulexlib.WriteDevice(e))
+	// Modbus 从机寄存器
+	r.AddLib(e, "rulexlib", "SetRegister", rulexlib.SetRegister(e))
 	// Source R/W
 	r.AddLib(e, "rulexlib", "ReadSource", rulexlib.ReadSource(e))
 	r.AddLib(e, "rulexlib", "WriteSource", rulexlib.WriteSource(e))
@@ -85,6 +92,8 @@ func LoadBuildInLuaLib(e typex.RuleX, r *typex.Rule) {
 	// 设备操作
 	//------------------------------------------------------------------------
 	r.AddLib(e, "device", "DCACall", rulexlib.DCACall(e))
+	r.AddLib(e, "device", "Get", rulexlib.GetShadowTag(e))
+	r.AddLib(e, "device", "Shadow", rulexlib.GetShadow(e))
 	//------------------------------------------------------------------------
 	// 十六进制编码处理
 	//------------------------------------------------------------------------
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 规则链的最大深度, 保存的时候已经检查过环了, 这里只是兜底
+const _MAX_RULE_CHAIN_DEPTH int = 16
+
+/*
+*
+* 执行一个规则, 然后把输出转发给下游规则, 目标和设备;
+* quiet 为真的时候规则链出错不发布 RULE_ERROR 事件;
+* 返回 false 表示规则链需要中断
+*
+ */
+func (e *RuleEngine) runRule(rule *typex.Rule, resType string, uuid string,
+	data string, depth int, quiet bool) bool {
+	if rule.Type == "expr" {
+		// Expr 不执行 lua 的回调脚本, 结果为真的时候直接转发
+		if e.runExprRule(rule, resType, uuid, data, quiet) {
+			e.routeRuleOutput(rule, data, depth, quiet)
+		}
+		return true
+	}
+	if rule.Type == "lua" {
+		output, routed, next := e.runLuaRule(rule, resType, uuid, data, quiet)
+		// 转发的时候虚拟机已经释放了, 下游规则不会和它抢锁
+		if routed {
+			e.routeRuleOutput(rule, output, depth, quiet)
+		}
+		return next
+	}
+	return true
+}
+
+/*
+*
+* 规则的输出: 交给下游规则, 转发到目标, 写入设备
+*
+ */
+func (e *RuleEngine) routeRuleOutput(rule *typex.Rule, data string, depth int, quiet bool) {
+	for _, uuid := range rule.ToRules {
+		if depth+1 >= _MAX_RULE_CHAIN_DEPTH {
+			glogger.GLogger.Errorf("Rule [%s] chain too deep, dropped:%s", rule.UUID, uuid)
+			break
+		}
+		next := e.GetRule(uuid)
+		if next == nil {
+			glogger.GLogger.Errorf("Rule [%s] next rule not found:%s", rule.UUID, uuid)
+			continue
+		}
+		if next.Status != typex.RULE_RUNNING {
+			continue
+		}
+		e.runRule(next, "RULE", rule.UUID, data, depth+1, quiet)
+	}
+	for _, uuid := range rule.ToTargets {
+		outEnd := e.GetOutEnd(uuid)
+		if outEnd == nil {
+			glogger.GLogger.Errorf("Rule [%s] target not found:%s", rule.UUID, uuid)
+			continue
+		}
+		if err := e.PushOutQueue(outEnd, data); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	}
+	for _, uuid := range rule.ToDevices {
+		Device := e.GetDevice(uuid)
+		if Device == nil {
+			glogger.GLogger.Errorf("Rule [%s] device not found:%s", rule.UUID, uuid)
+			continue
+		}
+		if Device.Device.Status() != typex.DEV_UP {
+			glogger.GLogger.Errorf("Rule [%s] device down:%s", rule.UUID, uuid)
+			continue
+		}
+		if _, err := Device.Device.OnWrite([]byte(rule.DeviceCmd), []byte(data)); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	}
+}
+
+/*
+*
+* 规则出错的时候发布 RULE_ERROR 事件, from 是触发规则的资源
+*
+ */
+func (e *RuleEngine) publishRuleError(rule *typex.Rule, resType string,
+	uuid string, err error, quiet bool) {
+	if quiet {
+		return
+	}
+	e.events.Publish(typex.Event{
+		Type:     typex.EVENT_RULE_ERROR,
+		Resource: "RULE",
+		UUID:     rule.UUID,
+		Name:     rule.Name,
+		Data: map[string]interface{}{
+			"fromType": resType,
+			"from":     uuid,
+			"error":    err.Error(),
+		},
+	})
+}
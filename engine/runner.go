@@ -3,6 +3,7 @@ package engine
 import (
 	mqttserver "github.com/hootrhino/rulex/plugin/mqtt_server"
 	netdiscover "github.com/hootrhino/rulex/plugin/net_discover"
+	opcuaserver "github.com/hootrhino/rulex/plugin/opcua_server"
 	ttyterminal "github.com/hootrhino/rulex/plugin/ttyd_terminal"
 	usbmonitor "github.com/hootrhino/rulex/plugin/usb_monitor"
 	"gopkg.in/ini.v1"
@@ -10,7 +11,9 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/hootrhino/rulex/configdir"
 	"github.com/hootrhino/rulex/core"
 	"github.com/hootrhino/rulex/glogger"
 	httpserver "github.com/hootrhino/rulex/plugin/http_server"
@@ -54,6 +57,14 @@ func RunRulex(iniPath string) {
 		return
 	}
 	//
+	// 目录模式: 先把配置目录同步到数据库
+	//
+	if mainConfig.ConfigMode == configdir.MODE {
+		if err := configdir.Sync(mainConfig.ConfigDir, httpServer); err != nil {
+			glogger.GLogger.Error("Config directory load failed:", err)
+		}
+	}
+	//
 	// Load inend from sqlite
 	//
 	for _, minEnd := range httpServer.AllMInEnd() {
@@ -78,6 +89,14 @@ func RunRulex(iniPath string) {
 		}
 
 	}
+	// 加载只被其他规则引用的规则, 绑定了资源的规则已经跟着资源加载了
+	for _, mRule := range httpServer.AllMRules() {
+		if len(mRule.FromSource) == 0 && len(mRule.FromDevice) == 0 {
+			if err := httpServer.LoadNewestRule(mRule.UUID); err != nil {
+				glogger.GLogger.Error("Rule load failed:", err)
+			}
+		}
+	}
 	// 加载外挂
 	for _, mGoods := range httpServer.AllGoods() {
 		newGoods := typex.Goods{
@@ -111,8 +130,19 @@ func RunRulex(iniPath string) {
 			}
 		}
 	}
+	var watcher *configdir.Watcher
+	if mainConfig.ConfigMode == configdir.MODE {
+		interval := mainConfig.ConfigWatchInterval
+		if interval <= 0 {
+			interval = 5
+		}
+		watcher = configdir.Watch(mainConfig.ConfigDir, time.Duration(interval)*time.Second, httpServer)
+	}
 	s := <-c
 	glogger.GLogger.Warn("Received stop signal:", s)
+	if watcher != nil {
+		watcher.Stop()
+	}
 	engine.Stop()
 	os.Exit(0)
 }
@@ -154,6 +184,10 @@ func loadPlugin(engine typex.RuleX) {
 			plugin = netdiscover.NewNetDiscover()
 			goto lab
 		}
+		if name == "opcua_server" {
+			plugin = opcuaserver.NewOpcuaServer()
+			goto lab
+		}
 		if name == "ttyd" {
 			plugin = ttyterminal.NewWebTTYPlugin()
 			goto lab
@@ -0,0 +1,456 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+)
+
+/*
+*
+* 资源监控: 输入资源, 输出资源和设备加载以后, 每个资源有一个协程检查状态, 挂了(DOWN)以后
+* 按指数退避重启, 超过最大次数放弃; 被停止(STOP)或者删除以后协程退出
+*
+ */
+const (
+	_RESOURCE_INEND  = "INEND"
+	_RESOURCE_OUTEND = "OUTEND"
+	_RESOURCE_DEVICE = "DEVICE"
+)
+
+// 最多保留的生命周期事件
+const _LIFECYCLE_EVENTS_SIZE = 1000
+
+type supervision struct {
+	sync.Mutex
+	resource  string
+	uuid      string
+	attempts  int                // 连续重启次数, 启动成功以后清零
+	running   bool               // 监控协程是否在运行
+	cancelCTX context.CancelFunc // 资源当前的 context
+	stop      context.CancelFunc // 监控协程的 context
+}
+
+type lifecycleLog struct {
+	sync.RWMutex
+	events []typex.LifecycleEvent
+}
+
+func (l *lifecycleLog) add(event typex.LifecycleEvent) {
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > _LIFECYCLE_EVENTS_SIZE {
+		l.events = l.events[len(l.events)-_LIFECYCLE_EVENTS_SIZE:]
+	}
+}
+
+/*
+*
+* 资源生命周期事件, 新的在前面
+*
+ */
+func (e *RuleEngine) LifecycleEvents(uuid string) []typex.LifecycleEvent {
+	e.lifecycle.RLock()
+	defer e.lifecycle.RUnlock()
+	events := []typex.LifecycleEvent{}
+	for i := len(e.lifecycle.events) - 1; i >= 0; i-- {
+		if uuid == "" || e.lifecycle.events[i].UUID == uuid {
+			events = append(events, e.lifecycle.events[i])
+		}
+	}
+	return events
+}
+
+func (e *RuleEngine) emitLifecycle(sup *supervision, event typex.LifecycleEventType,
+	attempt int, delay time.Duration, err error) {
+	_, name, _ := e.resourceState(sup.resource, sup.uuid)
+	lifecycleEvent := typex.LifecycleEvent{
+		Time:     time.Now(),
+		Resource: sup.resource,
+		UUID:     sup.uuid,
+		Name:     name,
+		Event:    event,
+		Attempt:  attempt,
+		Delay:    delay.Milliseconds(),
+	}
+	if err != nil {
+		lifecycleEvent.Error = err.Error()
+	}
+	e.lifecycle.add(lifecycleEvent)
+	e.events.Publish(typex.Event{
+		Type:     typex.EVENT_LIFECYCLE,
+		Time:     lifecycleEvent.Time,
+		Resource: sup.resource,
+		UUID:     sup.uuid,
+		Name:     name,
+		Data: map[string]interface{}{
+			"event":   string(event),
+			"attempt": attempt,
+			"delay":   lifecycleEvent.Delay,
+			"error":   lifecycleEvent.Error,
+		},
+	})
+	if event == typex.LIFECYCLE_STARTED {
+		glogger.GLogger.Infof("%s [%s] started", sup.resource, sup.uuid)
+		return
+	}
+	glogger.GLogger.Warnf("%s [%s] %s, attempt: %d, delay: %v, error: %v",
+		sup.resource, sup.uuid, event, attempt, delay, err)
+}
+
+/*
+*
+* 资源状态: UP DOWN PAUSE STOP, 资源不存在的时候 exists 是 false
+*
+ */
+func (e *RuleEngine) resourceState(resource, uuid string) (state string, name string, exists bool) {
+	switch resource {
+	case _RESOURCE_INEND:
+		if in := e.GetInEnd(uuid); in != nil && in.Source != nil {
+			return sourceStateName(in.Source.Status()), in.Name, true
+		}
+	case _RESOURCE_OUTEND:
+		if out := e.GetOutEnd(uuid); out != nil && out.Target != nil {
+			return sourceStateName(out.Target.Status()), out.Name, true
+		}
+	case _RESOURCE_DEVICE:
+		if dev := e.GetDevice(uuid); dev != nil && dev.Device != nil {
+			switch dev.Device.Status() {
+			case typex.DEV_UP:
+				return "UP", dev.Name, true
+			case typex.DEV_DOWN:
+				return "DOWN", dev.Name, true
+			default:
+				return "STOP", dev.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+/*
+*
+* 资源状态变化, 第一次检查的时候 from 是空串
+*
+ */
+func (e *RuleEngine) publishStateChange(sup *supervision, name, from, to string) {
+	e.events.Publish(typex.Event{
+		Type:     typex.EVENT_RESOURCE_STATE,
+		Resource: sup.resource,
+		UUID:     sup.uuid,
+		Name:     name,
+		Data: map[string]interface{}{
+			"from": from,
+			"to":   to,
+		},
+	})
+}
+
+func sourceStateName(state typex.SourceState) string {
+	switch state {
+	case typex.SOURCE_UP:
+		return "UP"
+	case typex.SOURCE_DOWN:
+		return "DOWN"
+	case typex.SOURCE_PAUSE:
+		return "PAUSE"
+	default:
+		return "STOP"
+	}
+}
+
+// 检查间隔, 也是第一次重启的等待时间
+func (e *RuleEngine) restartInterval() time.Duration {
+	interval := e.Config.SourceRestartInterval
+	if interval <= 0 {
+		interval = 5000
+	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+/*
+*
+* 第 attempt 次重启前等待的时间: interval * 2^(attempt-1), 不超过最大间隔, 再加上 ±20% 的随机抖动,
+* 防止很多资源同时挂了以后一起重启
+*
+ */
+func (e *RuleEngine) restartBackoff(attempt int) time.Duration {
+	interval := e.restartInterval()
+	maxInterval := time.Duration(e.Config.RestartMaxInterval) * time.Millisecond
+	if maxInterval <= 0 {
+		maxInterval = 60 * time.Second
+	}
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	delay := interval
+	for i := 1; i < attempt && delay < maxInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxInterval {
+		delay = maxInterval
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-typex.GCTX.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+/*
+*
+* 开始监控一个刚加载的资源, 同一个资源之前的监控会被替换掉
+*
+ */
+func (e *RuleEngine) supervise(resource, uuid string, cancelCTX context.CancelFunc) {
+	e.unsupervise(uuid)
+	sup := &supervision{resource: resource, uuid: uuid, cancelCTX: cancelCTX}
+	e.supervisions.Store(uuid, sup)
+	e.startSupervision(sup)
+}
+
+func (e *RuleEngine) startSupervision(sup *supervision) {
+	ctx, stop := context.WithCancel(typex.GCTX)
+	sup.Lock()
+	sup.running = true
+	sup.stop = stop
+	sup.Unlock()
+	go e.superviseLoop(ctx, sup)
+}
+
+// 资源删除的时候停止监控
+func (e *RuleEngine) unsupervise(uuid string) {
+	if v, ok := e.supervisions.LoadAndDelete(uuid); ok {
+		sup := v.(*supervision)
+		sup.Lock()
+		if sup.stop != nil {
+			sup.stop()
+		}
+		sup.Unlock()
+	}
+}
+
+func (e *RuleEngine) getSupervision(uuid string) *supervision {
+	if v, ok := e.supervisions.Load(uuid); ok {
+		return v.(*supervision)
+	}
+	return nil
+}
+
+func (e *RuleEngine) superviseLoop(ctx context.Context, sup *supervision) {
+	defer func() {
+		sup.Lock()
+		sup.running = false
+		sup.Unlock()
+	}()
+	healthy := false
+	lastState := ""
+	for {
+		if !sleepWithContext(ctx, e.restartInterval()) {
+			return
+		}
+		state, name, exists := e.resourceState(sup.resource, sup.uuid)
+		if !exists {
+			glogger.GLogger.Debugf("%s:%v deleted, supervisor exit", sup.resource, sup.uuid)
+			return
+		}
+		if state != lastState {
+			e.publishStateChange(sup, name, lastState, state)
+			lastState = state
+		}
+		switch state {
+		case "UP":
+			if !healthy {
+				healthy = true
+				sup.Lock()
+				attempt := sup.attempts
+				sup.attempts = 0
+				sup.Unlock()
+				e.emitLifecycle(sup, typex.LIFECYCLE_STARTED, attempt, 0, nil)
+			}
+			continue
+		case "STOP":
+			glogger.GLogger.Debugf("%s:%v stopped, supervisor exit", sup.resource, sup.uuid)
+			return
+		case "DOWN":
+		default:
+			continue
+		}
+		healthy = false
+		sup.Lock()
+		attempt := sup.attempts
+		sup.Unlock()
+		e.emitLifecycle(sup, typex.LIFECYCLE_FAILED, attempt, 0, errors.New("resource down"))
+		if !e.autoRestart(sup) {
+			glogger.GLogger.Warnf("%s:%v auto restart disabled, supervisor exit", sup.resource, sup.uuid)
+			return
+		}
+		// 一直重启到启动成功或者放弃
+		for {
+			sup.Lock()
+			sup.attempts++
+			attempt = sup.attempts
+			sup.Unlock()
+			if max := e.Config.RestartMaxAttempts; max > 0 && attempt > max {
+				e.emitLifecycle(sup, typex.LIFECYCLE_GIVEN_UP, attempt-1, 0,
+					fmt.Errorf("restart failed %d times", max))
+				return
+			}
+			delay := e.restartBackoff(attempt)
+			e.emitLifecycle(sup, typex.LIFECYCLE_RESTARTING, attempt, delay, nil)
+			if !sleepWithContext(ctx, delay) {
+				return
+			}
+			err := e.restartResource(sup)
+			if err == nil {
+				break
+			}
+			e.emitLifecycle(sup, typex.LIFECYCLE_FAILED, attempt, 0, err)
+		}
+	}
+}
+
+// 设备可以关掉自动重启
+func (e *RuleEngine) autoRestart(sup *supervision) bool {
+	if sup.resource == _RESOURCE_DEVICE {
+		if dev := e.GetDevice(sup.uuid); dev != nil {
+			return dev.AutoRestart
+		}
+	}
+	return true
+}
+
+// 停止资源, 有的资源重复停止会 panic
+func stopQuietly(uuid string, stop func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			glogger.GLogger.Warnf("Stop [%s] with recover error: %v", uuid, err)
+		}
+	}()
+	stop()
+}
+
+/*
+*
+* 重启: 停掉旧的实例, 取消它的 context, 按内存里的配置和规则新建一个实例启动
+*
+ */
+func (e *RuleEngine) restartResource(sup *supervision) error {
+	sup.Lock()
+	defer sup.Unlock()
+	// 取消旧实例的 context, 换成新的
+	switchContext := func() (context.Context, context.CancelFunc) {
+		if sup.cancelCTX != nil {
+			sup.cancelCTX()
+		}
+		ctx, cancelCTX := typex.NewCCTX()
+		sup.cancelCTX = cancelCTX
+		return ctx, cancelCTX
+	}
+	switch sup.resource {
+	case _RESOURCE_INEND:
+		in := e.GetInEnd(sup.uuid)
+		if in == nil {
+			return errors.New("InEnd:" + sup.uuid + " not exists")
+		}
+		config := e.SourceTypeManager.Find(in.Type)
+		if config == nil {
+			return fmt.Errorf("unsupported InEnd type:%s", in.Type)
+		}
+		if in.Source != nil {
+			stopQuietly(sup.uuid, in.Source.Stop)
+		}
+		ctx, cancelCTX := switchContext()
+		source := config.NewSource(e)
+		in.Source = source
+		if err := source.Init(in.UUID, in.Config); err != nil {
+			return err
+		}
+		return e.startSource(source, ctx, cancelCTX)
+	case _RESOURCE_OUTEND:
+		out := e.GetOutEnd(sup.uuid)
+		if out == nil {
+			return errors.New("OutEnd:" + sup.uuid + " not exists")
+		}
+		config := e.TargetTypeManager.Find(out.Type)
+		if config == nil {
+			return fmt.Errorf("unsupported Target type:%s", out.Type)
+		}
+		if out.Target != nil {
+			stopQuietly(sup.uuid, out.Target.Stop)
+		}
+		ctx, cancelCTX := switchContext()
+		target := config.NewTarget(e)
+		out.Target = target
+		if err := target.Init(out.UUID, out.Config); err != nil {
+			return err
+		}
+		if err := e.loadOutEndCache(out, ctx); err != nil {
+			return err
+		}
+		return startTarget(target, e, ctx, cancelCTX)
+	case _RESOURCE_DEVICE:
+		dev := e.GetDevice(sup.uuid)
+		if dev == nil {
+			return errors.New("Device:" + sup.uuid + " not exists")
+		}
+		config := e.DeviceTypeManager.Find(dev.Type)
+		if config == nil {
+			return fmt.Errorf("unsupported Device type:%s", dev.Type)
+		}
+		if dev.Device != nil {
+			stopQuietly(sup.uuid, dev.Device.Stop)
+		}
+		ctx, cancelCTX := switchContext()
+		abstractDevice := config.NewDevice(e)
+		dev.Device = abstractDevice
+		if err := abstractDevice.Init(dev.UUID, dev.Config); err != nil {
+			return err
+		}
+		return startDevice(abstractDevice, e, ctx, cancelCTX)
+	}
+	return fmt.Errorf("unsupported resource:%s", sup.resource)
+}
+
+/*
+*
+* 手动重启: 重启次数清零, 监控已经放弃的话重新开始监控
+*
+ */
+func (e *RuleEngine) restart(resource, uuid string) error {
+	sup := e.getSupervision(uuid)
+	if sup == nil {
+		sup = &supervision{resource: resource, uuid: uuid}
+		e.supervisions.Store(uuid, sup)
+	}
+	e.emitLifecycle(sup, typex.LIFECYCLE_RESTARTING, 0, 0, nil)
+	if err := e.restartResource(sup); err != nil {
+		e.emitLifecycle(sup, typex.LIFECYCLE_FAILED, 0, 0, err)
+		return err
+	}
+	sup.Lock()
+	sup.attempts = 0
+	running := sup.running
+	sup.Unlock()
+	if !running {
+		e.startSupervision(sup)
+	}
+	return nil
+}
@@ -33,3 +33,13 @@ protoc -I ./trailer --go_out ./trailer --go_opt paths=source_relative \
     --go-grpc_out=./trailer --go-grpc_opt paths=source_relative \
     ./trailer/trailer.proto
 echo ">>> Generate Trailer Proto OK."
+# Sparkplug B
+echo ">>> Generate Sparkplug B Proto."
+protoc -I ./source/sparkplugb --go_out ./source/sparkplugb --go_opt paths=source_relative \
+    ./source/sparkplugb/sparkplug_b.proto
+echo ">>> Generate Sparkplug B Proto OK."
+# Prometheus remote write
+echo ">>> Generate Prometheus Remote Write Proto."
+protoc -I ./common/prompb --go_out ./common/prompb --go_opt paths=source_relative \
+    ./common/prompb/types.proto ./common/prompb/remote.proto
+echo ">>> Generate Prometheus Remote Write Proto OK."
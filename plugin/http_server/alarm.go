@@ -0,0 +1,472 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+)
+
+// 报警条件
+const (
+	ALARM_HIGH  string = "HIGH"  // 值大于阈值
+	ALARM_LOW   string = "LOW"   // 值小于阈值
+	ALARM_RATE  string = "RATE"  // 每秒变化量的绝对值大于阈值
+	ALARM_STALE string = "STALE" // 超过阈值秒数没有新数据
+)
+
+// 报警级别
+const (
+	ALARM_CRITICAL string = "CRITICAL"
+	ALARM_MAJOR    string = "MAJOR"
+	ALARM_MINOR    string = "MINOR"
+	ALARM_WARNING  string = "WARNING"
+)
+
+// 报警状态
+const (
+	ALARM_ACTIVE  string = "ACTIVE"
+	ALARM_ACKED   string = "ACKED"
+	ALARM_CLEARED string = "CLEARED"
+)
+
+// 检查延时报警和数据超时的间隔
+const _ALARM_CHECK_INTERVAL = 500 * time.Millisecond
+
+const _ALARM_HOOK_NAME = "plugin.http_server.alarm"
+
+/*
+*
+* 一个报警规则的运行状态
+*
+ */
+type alarmState struct {
+	rule         model.MAlarmRule
+	hasValue     bool
+	value        float64
+	rate         float64   // 最近两次数据算出来的每秒变化量
+	hasRate      bool      //
+	updatedAt    time.Time // 最近一次数据的时间, 规则加载的时候从加载时间开始算超时
+	pendingSince time.Time // 报警条件开始满足的时间, 还没到延时; 零值表示条件不满足
+	alarm        *model.MAlarm
+}
+
+// 报警条件是否满足, 以及报警以后是否可以清除(回差)
+func (st *alarmState) evaluate(now time.Time) (raise bool, clear bool) {
+	rule := st.rule
+	switch rule.Condition {
+	case ALARM_STALE:
+		stale := now.Sub(st.updatedAt) > time.Duration(rule.Threshold*float64(time.Second))
+		return stale, !stale
+	case ALARM_HIGH:
+		if !st.hasValue {
+			return false, false
+		}
+		return st.value > rule.Threshold, st.value <= rule.Threshold-rule.Deadband
+	case ALARM_LOW:
+		if !st.hasValue {
+			return false, false
+		}
+		return st.value < rule.Threshold, st.value >= rule.Threshold+rule.Deadband
+	case ALARM_RATE:
+		if !st.hasRate {
+			return false, false
+		}
+		rate := math.Abs(st.rate)
+		return rate > rule.Threshold, rate <= rule.Threshold-rule.Deadband
+	}
+	return false, false
+}
+
+func (st *alarmState) shelved(now time.Time) bool {
+	return now.Before(st.rule.ShelvedUntil)
+}
+
+/*
+*
+* 报警引擎: 通过 Hook 拿到设备和输入资源的数据, 按报警规则判断点位, 报警和清除都入库,
+* 并且通知报警规则指定的 OutEnd
+*
+ */
+type alarmEngine struct {
+	sync.Mutex
+	hs     *HttpApiServer
+	states map[string]*alarmState // 报警规则 UUID -> 状态
+	cancel context.CancelFunc
+}
+
+func newAlarmEngine(hs *HttpApiServer) *alarmEngine {
+	return &alarmEngine{hs: hs, states: map[string]*alarmState{}}
+}
+
+func (ae *alarmEngine) Start() error {
+	ae.Lock()
+	now := time.Now()
+	for _, rule := range ae.hs.AllMAlarmRules() {
+		ae.states[rule.UUID] = &alarmState{rule: rule, updatedAt: now}
+	}
+	// 重启之前没有清除的报警, 继续跟踪
+	for _, alarm := range ae.hs.ActiveMAlarms() {
+		alarm := alarm
+		if st, ok := ae.states[alarm.RuleUUID]; ok {
+			st.alarm = &alarm
+		}
+	}
+	ae.Unlock()
+	if err := ae.hs.ruleEngine.LoadHook(ae); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(typex.GCTX)
+	ae.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(_ALARM_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ae.checkAll()
+			}
+		}
+	}()
+	return nil
+}
+
+func (ae *alarmEngine) Stop() {
+	if ae.cancel != nil {
+		ae.cancel()
+	}
+	ae.hs.ruleEngine.RemoveHook(_ALARM_HOOK_NAME)
+}
+
+/*
+*
+* 报警规则新建或者修改以后重新加载, 规则不存在的时候(删除了)清除它的报警
+*
+ */
+func (ae *alarmEngine) reload(uuid string) {
+	ae.Lock()
+	defer ae.Unlock()
+	old := ae.states[uuid]
+	rule, err := ae.hs.GetMAlarmRuleWithUUID(uuid)
+	if err != nil {
+		if old != nil && old.alarm != nil {
+			ae.clearAlarm(old, "alarm rule deleted")
+		}
+		delete(ae.states, uuid)
+		return
+	}
+	st := &alarmState{rule: *rule, updatedAt: time.Now()}
+	if old != nil {
+		st.alarm = old.alarm
+		// 还是同一个点位的话数据留着
+		if old.rule.ResourceUUID == rule.ResourceUUID && old.rule.Tag == rule.Tag {
+			st.hasValue, st.value = old.hasValue, old.value
+			st.hasRate, st.rate = old.hasRate, old.rate
+			st.updatedAt = old.updatedAt
+		}
+	}
+	ae.states[uuid] = st
+	ae.check(st, time.Now())
+}
+
+//--------------------------------------------------------------------------------------------------
+// Hook
+//--------------------------------------------------------------------------------------------------
+
+func (ae *alarmEngine) Name() string {
+	return _ALARM_HOOK_NAME
+}
+
+func (ae *alarmEngine) Work(data string) error {
+	return nil
+}
+
+func (ae *alarmEngine) Error(err error) {
+	glogger.GLogger.Error("Alarm hook error:", err)
+}
+
+func (ae *alarmEngine) WorkDevice(Device *typex.Device, data string) error {
+	ae.update(Device.UUID, data)
+	return nil
+}
+
+func (ae *alarmEngine) WorkInEnd(in *typex.InEnd, data string) error {
+	ae.update(in.UUID, data)
+	return nil
+}
+
+/*
+*
+* 从数据里取点位的数值: 数据是 {"tag": 点位} 格式, 点位是对象的时候取 dataValue 或者 value;
+* 字符串按数字解析, 布尔值是 1 和 0
+*
+ */
+func alarmTagValue(data string, tag string) (float64, bool) {
+	tags := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		return 0, false
+	}
+	value, ok := tags[tag]
+	if !ok {
+		return 0, false
+	}
+	return tagNumber(value)
+}
+
+// 点位的数值, 数据 JSON 顶层字段的值
+func tagNumber(value interface{}) (float64, bool) {
+	if object, ok := value.(map[string]interface{}); ok {
+		if v, ok := object["dataValue"]; ok {
+			value = v
+		} else {
+			value = object["value"]
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (ae *alarmEngine) update(resourceUUID string, data string) {
+	ae.Lock()
+	defer ae.Unlock()
+	now := time.Now()
+	for _, st := range ae.states {
+		if st.rule.ResourceUUID != resourceUUID {
+			continue
+		}
+		value, ok := alarmTagValue(data, st.rule.Tag)
+		if !ok {
+			continue
+		}
+		if st.hasValue {
+			if seconds := now.Sub(st.updatedAt).Seconds(); seconds > 0 {
+				st.rate = (value - st.value) / seconds
+				st.hasRate = true
+			}
+		}
+		st.value = value
+		st.hasValue = true
+		st.updatedAt = now
+		ae.check(st, now)
+	}
+}
+
+func (ae *alarmEngine) checkAll() {
+	ae.Lock()
+	defer ae.Unlock()
+	now := time.Now()
+	for _, st := range ae.states {
+		ae.check(st, now)
+	}
+}
+
+/*
+*
+* 条件满足并且持续了 Delay 毫秒以后报警; 报警以后要越过回差才清除, 防止在阈值附近来回报警
+*
+ */
+func (ae *alarmEngine) check(st *alarmState, now time.Time) {
+	raise, clear := st.evaluate(now)
+	if st.alarm != nil {
+		if clear {
+			ae.clearAlarm(st, "")
+		}
+		return
+	}
+	if !raise {
+		st.pendingSince = time.Time{}
+		return
+	}
+	if st.pendingSince.IsZero() {
+		st.pendingSince = now
+	}
+	if now.Sub(st.pendingSince) < time.Duration(st.rule.Delay)*time.Millisecond {
+		return
+	}
+	// 搁置期间不报警, 搁置结束以后条件还满足的话再报
+	if st.shelved(now) {
+		return
+	}
+	ae.raiseAlarm(st)
+}
+
+func alarmMessage(st *alarmState) string {
+	rule := st.rule
+	switch rule.Condition {
+	case ALARM_STALE:
+		return fmt.Sprintf("%s no data for %v seconds", rule.Tag, rule.Threshold)
+	case ALARM_RATE:
+		return fmt.Sprintf("%s rate %.3f/s exceeds %v", rule.Tag, st.rate, rule.Threshold)
+	case ALARM_LOW:
+		return fmt.Sprintf("%s value %v below %v", rule.Tag, st.value, rule.Threshold)
+	default:
+		return fmt.Sprintf("%s value %v above %v", rule.Tag, st.value, rule.Threshold)
+	}
+}
+
+func (ae *alarmEngine) raiseAlarm(st *alarmState) {
+	rule := st.rule
+	value := st.value
+	if rule.Condition == ALARM_RATE {
+		value = st.rate
+	}
+	alarm := &model.MAlarm{
+		UUID:         utils.MakeUUID("ALARM"),
+		RuleUUID:     rule.UUID,
+		Name:         rule.Name,
+		ResourceUUID: rule.ResourceUUID,
+		Tag:          rule.Tag,
+		Condition:    rule.Condition,
+		Severity:     rule.Severity,
+		State:        ALARM_ACTIVE,
+		Value:        value,
+		Message:      alarmMessage(st),
+	}
+	if err := ae.hs.InsertMAlarm(alarm); err != nil {
+		glogger.GLogger.Error("Insert alarm error:", err)
+		return
+	}
+	st.alarm = alarm
+	st.pendingSince = time.Time{}
+	glogger.GLogger.Warnf("Alarm [%s] raised: %s", rule.Name, alarm.Message)
+	ae.notify(st, alarm, "RAISED")
+}
+
+func (ae *alarmEngine) clearAlarm(st *alarmState, message string) {
+	alarm := st.alarm
+	now := time.Now()
+	alarm.State = ALARM_CLEARED
+	alarm.ClearedAt = &now
+	if message != "" {
+		alarm.Message = message
+	}
+	if err := ae.hs.SaveMAlarm(alarm); err != nil {
+		glogger.GLogger.Error("Save alarm error:", err)
+	}
+	st.alarm = nil
+	glogger.GLogger.Infof("Alarm [%s] cleared", st.rule.Name)
+	ae.notify(st, alarm, "CLEARED")
+}
+
+/*
+*
+* 确认报警, 已经清除的报警不能确认
+*
+ */
+func (ae *alarmEngine) ack(uuid string, username string) (*model.MAlarm, error) {
+	ae.Lock()
+	defer ae.Unlock()
+	alarm, err := ae.hs.GetMAlarmWithUUID(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("alarm not exists: %s", uuid)
+	}
+	if alarm.State != ALARM_ACTIVE {
+		return nil, fmt.Errorf("alarm is %s, only ACTIVE alarm can be acknowledged", alarm.State)
+	}
+	// 内存里的报警和数据库的是同一条, 以内存的为准
+	st := ae.states[alarm.RuleUUID]
+	if st != nil && st.alarm != nil && st.alarm.UUID == uuid {
+		alarm = st.alarm
+	}
+	now := time.Now()
+	alarm.State = ALARM_ACKED
+	alarm.AckedAt = &now
+	alarm.AckedBy = username
+	if err := ae.hs.SaveMAlarm(alarm); err != nil {
+		return nil, err
+	}
+	if st != nil {
+		ae.notify(st, alarm, "ACKED")
+	}
+	return alarm, nil
+}
+
+/*
+*
+* 搁置报警规则 duration 秒, 0 表示取消搁置
+*
+ */
+func (ae *alarmEngine) shelve(ruleUUID string, duration int) (time.Time, error) {
+	ae.Lock()
+	defer ae.Unlock()
+	rule, err := ae.hs.GetMAlarmRuleWithUUID(ruleUUID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("alarm rule not exists: %s", ruleUUID)
+	}
+	rule.ShelvedUntil = time.Time{}
+	if duration > 0 {
+		rule.ShelvedUntil = time.Now().Add(time.Duration(duration) * time.Second)
+	}
+	if err := ae.hs.UpdateMAlarmRule(ruleUUID, rule); err != nil {
+		return time.Time{}, err
+	}
+	if st, ok := ae.states[ruleUUID]; ok {
+		st.rule.ShelvedUntil = rule.ShelvedUntil
+	}
+	return rule.ShelvedUntil, nil
+}
+
+// 报警规则的搁置时间, 给查询接口用
+func (ae *alarmEngine) shelvedUntil(ruleUUID string) time.Time {
+	ae.Lock()
+	defer ae.Unlock()
+	if st, ok := ae.states[ruleUUID]; ok {
+		return st.rule.ShelvedUntil
+	}
+	return time.Time{}
+}
+
+/*
+*
+* 报警通知: 发布 ALARM 事件, 搁置的时候不发到 OutEnd
+*
+ */
+func (ae *alarmEngine) notify(st *alarmState, m *model.MAlarm, event string) {
+	alarm := toAlarmVo(*m, st.rule.ShelvedUntil)
+	data := map[string]interface{}{}
+	bytes, _ := json.Marshal(alarm)
+	json.Unmarshal(bytes, &data)
+	data["event"] = event
+	ae.hs.ruleEngine.GetEventBus().Publish(typex.Event{
+		Type:     typex.EVENT_ALARM,
+		Resource: "ALARM",
+		UUID:     alarm.UUID,
+		Name:     alarm.Name,
+		Data:     data,
+	})
+	if st.shelved(time.Now()) {
+		return
+	}
+	bytes, _ = json.Marshal(data)
+	for _, uuid := range st.rule.Targets {
+		outEnd := ae.hs.ruleEngine.GetOutEnd(uuid)
+		if outEnd == nil {
+			glogger.GLogger.Errorf("Alarm [%s] target not found:%s", st.rule.Name, uuid)
+			continue
+		}
+		if err := ae.hs.ruleEngine.PushOutQueue(outEnd, string(bytes)); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package httpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/utils"
+)
+
+type alarmRuleVo struct {
+	UUID         string    `json:"uuid"`
+	Name         string    `json:"name"`
+	ResourceUUID string    `json:"resourceUuid"`
+	Tag          string    `json:"tag"`
+	Condition    string    `json:"condition"`
+	Threshold    float64   `json:"threshold"`
+	Deadband     float64   `json:"deadband"`
+	Delay        int       `json:"delay"`
+	Severity     string    `json:"severity"`
+	Targets      []string  `json:"targets"`
+	ShelvedUntil time.Time `json:"shelvedUntil"`
+	Description  string    `json:"description"`
+}
+
+func toAlarmRuleVo(rule model.MAlarmRule) alarmRuleVo {
+	return alarmRuleVo{
+		UUID:         rule.UUID,
+		Name:         rule.Name,
+		ResourceUUID: rule.ResourceUUID,
+		Tag:          rule.Tag,
+		Condition:    rule.Condition,
+		Threshold:    rule.Threshold,
+		Deadband:     rule.Deadband,
+		Delay:        rule.Delay,
+		Severity:     rule.Severity,
+		Targets:      rule.Targets,
+		ShelvedUntil: rule.ShelvedUntil,
+		Description:  rule.Description,
+	}
+}
+
+type alarmVo struct {
+	UUID         string     `json:"uuid"`
+	RuleUUID     string     `json:"ruleUuid"`
+	Name         string     `json:"name"`
+	ResourceUUID string     `json:"resourceUuid"`
+	Tag          string     `json:"tag"`
+	Condition    string     `json:"condition"`
+	Severity     string     `json:"severity"`
+	State        string     `json:"state"`
+	Value        float64    `json:"value"`
+	Message      string     `json:"message"`
+	RaisedAt     time.Time  `json:"raisedAt"`
+	AckedAt      *time.Time `json:"ackedAt"`
+	AckedBy      string     `json:"ackedBy"`
+	ClearedAt    *time.Time `json:"clearedAt"`
+	Shelved      bool       `json:"shelved"`
+}
+
+func toAlarmVo(alarm model.MAlarm, shelvedUntil time.Time) alarmVo {
+	return alarmVo{
+		UUID:         alarm.UUID,
+		RuleUUID:     alarm.RuleUUID,
+		Name:         alarm.Name,
+		ResourceUUID: alarm.ResourceUUID,
+		Tag:          alarm.Tag,
+		Condition:    alarm.Condition,
+		Severity:     alarm.Severity,
+		State:        alarm.State,
+		Value:        alarm.Value,
+		Message:      alarm.Message,
+		RaisedAt:     alarm.CreatedAt,
+		AckedAt:      alarm.AckedAt,
+		AckedBy:      alarm.AckedBy,
+		ClearedAt:    alarm.ClearedAt,
+		Shelved:      time.Now().Before(shelvedUntil),
+	}
+}
+
+/*
+*
+* 检查报警规则: 条件, 级别, 监视的资源和通知的目标都要存在
+*
+ */
+func (hh *HttpApiServer) checkAlarmRule(rule *model.MAlarmRule) error {
+	if !utils.SContains([]string{ALARM_HIGH, ALARM_LOW, ALARM_RATE, ALARM_STALE}, rule.Condition) {
+		return fmt.Errorf("condition must one of 'HIGH', 'LOW', 'RATE' or 'STALE': %s", rule.Condition)
+	}
+	if !utils.SContains([]string{ALARM_CRITICAL, ALARM_MAJOR, ALARM_MINOR, ALARM_WARNING}, rule.Severity) {
+		return fmt.Errorf("severity must one of 'CRITICAL', 'MAJOR', 'MINOR' or 'WARNING': %s", rule.Severity)
+	}
+	if rule.Deadband < 0 || rule.Delay < 0 {
+		return fmt.Errorf("deadband and delay can not be negative")
+	}
+	if rule.Condition == ALARM_STALE && rule.Threshold <= 0 {
+		return fmt.Errorf("threshold of STALE must be greater than 0")
+	}
+	if hh.ruleEngine.GetDevice(rule.ResourceUUID) == nil && hh.ruleEngine.GetInEnd(rule.ResourceUUID) == nil {
+		return fmt.Errorf("device or inend not exists: %s", rule.ResourceUUID)
+	}
+	for _, uuid := range rule.Targets {
+		if out, _ := hh.GetMOutEndWithUUID(uuid); out == nil {
+			return fmt.Errorf("outend not exists: %s", uuid)
+		}
+	}
+	return nil
+}
+
+type alarmRuleForm struct {
+	UUID         string   `json:"uuid"`
+	Name         string   `json:"name" binding:"required"`
+	ResourceUUID string   `json:"resourceUuid" binding:"required"`
+	Tag          string   `json:"tag" binding:"required"`
+	Condition    string   `json:"condition" binding:"required"`
+	Threshold    float64  `json:"threshold"`
+	Deadband     float64  `json:"deadband"`
+	Delay        int      `json:"delay"`
+	Severity     string   `json:"severity"`
+	Targets      []string `json:"targets"`
+	Description  string   `json:"description"`
+}
+
+func (form alarmRuleForm) toModel() *model.MAlarmRule {
+	targets := form.Targets
+	if targets == nil {
+		targets = []string{}
+	}
+	return &model.MAlarmRule{
+		UUID:         form.UUID,
+		Name:         form.Name,
+		ResourceUUID: form.ResourceUUID,
+		Tag:          form.Tag,
+		Condition:    strings.ToUpper(form.Condition),
+		Threshold:    form.Threshold,
+		Deadband:     form.Deadband,
+		Delay:        form.Delay,
+		Severity:     strings.ToUpper(form.Severity),
+		Targets:      targets,
+		Description:  form.Description,
+	}
+}
+
+func AlarmRules(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if uuid == "" {
+		rules := []alarmRuleVo{}
+		for _, rule := range hh.AllMAlarmRules() {
+			rules = append(rules, toAlarmRuleVo(rule))
+		}
+		c.JSON(common.HTTP_OK, common.OkWithData(rules))
+		return
+	}
+	rule, err := hh.GetMAlarmRuleWithUUID(uuid)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400EmptyObj(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(toAlarmRuleVo(*rule)))
+}
+
+func CreateAlarmRule(c *gin.Context, hh *HttpApiServer) {
+	form := alarmRuleForm{Severity: ALARM_WARNING}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	rule := form.toModel()
+	rule.UUID = utils.MakeUUID("ALARMRULE")
+	if err := hh.checkAlarmRule(rule); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.InsertMAlarmRule(rule); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	auditUUID(c, rule.UUID)
+	hh.alarms.reload(rule.UUID)
+	c.JSON(common.HTTP_OK, common.OkWithData(rule.UUID))
+}
+
+func UpdateAlarmRule(c *gin.Context, hh *HttpApiServer) {
+	form := alarmRuleForm{Severity: ALARM_WARNING}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	old, err := hh.GetMAlarmRuleWithUUID(form.UUID)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	rule := form.toModel()
+	rule.ShelvedUntil = old.ShelvedUntil
+	if err := hh.checkAlarmRule(rule); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.UpdateMAlarmRule(form.UUID, rule); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	hh.alarms.reload(form.UUID)
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+func DeleteAlarmRule(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if _, err := hh.GetMAlarmRuleWithUUID(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.DeleteMAlarmRule(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	hh.alarms.reload(uuid)
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+/*
+*
+* 分页查询报警: state 可以是逗号分隔的多个状态, 不传的时候查所有的(包括历史);
+* page 从 1 开始, size 默认 20
+*
+ */
+func Alarms(c *gin.Context, hh *HttpApiServer) {
+	filter := alarmFilter{
+		RuleUUID:     c.Query("ruleUuid"),
+		ResourceUUID: c.Query("resourceUuid"),
+		Severity:     strings.ToUpper(c.Query("severity")),
+	}
+	if states := c.Query("state"); states != "" {
+		for _, state := range strings.Split(states, ",") {
+			filter.States = append(filter.States, strings.ToUpper(strings.TrimSpace(state)))
+		}
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 1000 {
+		size = 20
+	}
+	alarms, total := hh.PageMAlarm(filter, (page-1)*size, size)
+	records := []alarmVo{}
+	for _, alarm := range alarms {
+		records = append(records, toAlarmVo(alarm, hh.alarms.shelvedUntil(alarm.RuleUUID)))
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(map[string]interface{}{
+		"total":   total,
+		"page":    page,
+		"size":    size,
+		"records": records,
+	}))
+}
+
+// 确认报警, 记下确认人
+func AckAlarm(c *gin.Context, hh *HttpApiServer) {
+	type Form struct {
+		UUID string `json:"uuid" binding:"required"`
+	}
+	form := Form{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	username := ""
+	if u := currentUser(c); u != nil {
+		username = u.Username
+	}
+	alarm, err := hh.alarms.ack(form.UUID, username)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(toAlarmVo(*alarm, hh.alarms.shelvedUntil(alarm.RuleUUID))))
+}
+
+/*
+*
+* 搁置报警: uuid 是报警或者报警规则的 UUID, 搁置的是报警规则; duration 是秒数, 0 表示取消搁置
+*
+ */
+func ShelveAlarm(c *gin.Context, hh *HttpApiServer) {
+	type Form struct {
+		UUID     string `json:"uuid" binding:"required"`
+		Duration int    `json:"duration"`
+	}
+	form := Form{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if form.Duration < 0 {
+		c.JSON(common.HTTP_OK, common.Error("duration can not be negative"))
+		return
+	}
+	ruleUUID := form.UUID
+	if alarm, err := hh.GetMAlarmWithUUID(form.UUID); err == nil {
+		ruleUUID = alarm.RuleUUID
+	}
+	until, err := hh.alarms.shelve(ruleUUID, form.Duration)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(map[string]interface{}{
+		"ruleUuid":     ruleUUID,
+		"shelvedUntil": until,
+	}))
+}
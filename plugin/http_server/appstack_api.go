@@ -183,6 +183,7 @@ func CreateApp(c *gin.Context, hs *HttpApiServer) {
 		}
 	}
 	newUUID := utils.AppUuid()
+	auditUUID(c, newUUID)
 	// 开始在 ./apps目录下 新建文件
 	path := "./apps/" + newUUID + ".lua"
 	_, err := os.Create(path)
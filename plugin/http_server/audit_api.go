@@ -0,0 +1,437 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hootrhino/rulex/glogger"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/plugin/http_server/service"
+)
+
+/*
+*
+* 审计的资源: 按接口路径前缀匹配, load 用来拿修改前后的资源快照
+*
+ */
+type auditResource struct {
+	prefix   string
+	resource string
+	load     func(hs *HttpApiServer, uuid string) (interface{}, error)
+}
+
+var _AUDIT_RESOURCES = []auditResource{
+	{"inends", "INEND", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMInEndWithUUID(uuid)
+	}},
+	{"outends", "OUTEND", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMOutEndWithUUID(uuid)
+	}},
+	{"devices", "DEVICE", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMDeviceWithUUID(uuid)
+	}},
+	{"rules", "RULE", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMRuleWithUUID(uuid)
+	}},
+	{"app", "APP", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMAppWithUUID(uuid)
+	}},
+	{"goods", "GOODS", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetGoodsWithUUID(uuid)
+	}},
+	{"aibase", "AIBASE", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetAiBaseWithUUID(uuid)
+	}},
+	{"group", "GROUP", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return service.GetGenericGroupWithUUID(uuid)
+	}},
+	{"visual", "VISUAL", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return service.GetVisualWithUUID(uuid)
+	}},
+	{"alarms/rules", "ALARM_RULE", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMAlarmRuleWithUUID(uuid)
+	}},
+	{"alarms", "ALARM", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMAlarmWithUUID(uuid)
+	}},
+	{"history/tags", "HISTORY_TAG", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMHistoryTagWithUUID(uuid)
+	}},
+	{"shadows", "SHADOW", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		return hs.GetMDeviceShadowWithUUID(uuid)
+	}},
+	// 快照里不能有私钥
+	{"certs", "CERT", func(hs *HttpApiServer, uuid string) (interface{}, error) {
+		cert, err := hs.GetMCertificateWithUUID(uuid)
+		if err != nil {
+			return nil, err
+		}
+		return hs.toCertificateVo(*cert), nil
+	}},
+	// 用户没有 UUID, 用用户名; 快照里不能有密码
+	{"users", "USER", func(hs *HttpApiServer, username string) (interface{}, error) {
+		u, err := hs.GetMUserWithName(username)
+		if err != nil {
+			return nil, err
+		}
+		return user{Role: u.Role, Username: u.Username, Description: u.Description}, nil
+	}},
+}
+
+/*
+*
+* 不是修改配置的接口, 不记审计日志
+*
+ */
+var _AUDIT_IGNORE_ROUTES = map[string]bool{
+	url("login"):            true,
+	url("logout"):           true,
+	url("validateRule"):     true,
+	url("rules/testIn"):     true,
+	url("rules/testOut"):    true,
+	url("rules/testDevice"): true,
+}
+
+// 创建接口在处理完以后告诉审计新资源的 UUID
+const _AUDIT_UUID_KEY = "auditUUID"
+
+func auditUUID(c *gin.Context, uuid string) {
+	c.Set(_AUDIT_UUID_KEY, uuid)
+}
+
+func matchAuditResource(path string) *auditResource {
+	path = strings.TrimLeft(strings.TrimPrefix(path, _API_V1_ROOT), "/")
+	for i, resource := range _AUDIT_RESOURCES {
+		if path == resource.prefix || strings.HasPrefix(path, resource.prefix+"/") {
+			return &_AUDIT_RESOURCES[i]
+		}
+	}
+	return nil
+}
+
+// 把响应体留一份, 用来判断接口是否成功
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+/*
+*
+* 审计: 记录每个修改类请求的操作人, 时间, 接口, 资源 UUID 和修改前后的快照;
+* 失败的请求也记下来, Code 是接口返回的 code
+*
+ */
+func (hs *HttpApiServer) Audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if readOnlyRequest(c) || !strings.HasPrefix(path, _API_V1_ROOT) ||
+			_AUDIT_IGNORE_ROUTES[path] {
+			c.Next()
+			return
+		}
+		resource := matchAuditResource(path)
+		key := "uuid"
+		if resource != nil && resource.resource == "USER" {
+			key = "username"
+		}
+		uuid := c.Query(key)
+		if uuid == "" && strings.HasPrefix(c.ContentType(), "application/json") {
+			body, _ := io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			form := map[string]interface{}{}
+			if json.Unmarshal(body, &form) == nil {
+				if value, ok := form[key].(string); ok {
+					uuid = value
+				}
+			}
+		}
+		before := hs.auditSnapshot(resource, uuid)
+		writer := &auditResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		if uuid == "" {
+			uuid = c.GetString(_AUDIT_UUID_KEY)
+		}
+		after := hs.auditSnapshot(resource, uuid)
+		response := common.R{}
+		json.Unmarshal(writer.body.Bytes(), &response)
+		if response.Code == 0 {
+			response.Code = writer.Status()
+		}
+		log := &model.MAuditLog{
+			ClientIP:     c.ClientIP(),
+			Method:       c.Request.Method,
+			Endpoint:     path,
+			ResourceUUID: uuid,
+			Code:         response.Code,
+			Message:      response.Msg,
+			Before:       before,
+			After:        after,
+			Diff:         auditDiff(before, after),
+		}
+		if resource != nil {
+			log.Resource = resource.resource
+		}
+		if u := currentUser(c); u != nil {
+			log.Username = u.Username
+			log.Role = normalizeRole(u.Role)
+		}
+		if err := hs.InsertAuditLog(log); err != nil {
+			glogger.GLogger.Error("Insert audit log error:", err)
+		}
+	}
+}
+
+// 资源快照, 资源不存在的时候是空字符串
+func (hs *HttpApiServer) auditSnapshot(resource *auditResource, uuid string) string {
+	if resource == nil || uuid == "" {
+		return ""
+	}
+	value, err := resource.load(hs, uuid)
+	if err != nil {
+		return ""
+	}
+	bytes, _ := json.Marshal(value)
+	fields := map[string]interface{}{}
+	if json.Unmarshal(bytes, &fields) != nil {
+		return string(bytes)
+	}
+	bytes, _ = json.Marshal(redactAuditValue(fields))
+	return string(bytes)
+}
+
+// 字段名里带这些词的当成密钥, 快照里打码
+var _AUDIT_SECRET_KEYS = []string{"password", "token", "secret", "sasl", "key"}
+
+const _AUDIT_REDACTED = "******"
+
+func auditSecretKey(field string) bool {
+	field = strings.ToLower(field)
+	for _, key := range _AUDIT_SECRET_KEYS {
+		if strings.Contains(field, key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+* 快照打码: 密码, 令牌, 密钥这类字段在存进审计日志之前换成 ******;
+* 资源的 Config 是 JSON 字符串, 要解开了再打码
+*
+ */
+func redactAuditValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, item := range v {
+			if auditSecretKey(field) {
+				if item != nil && item != "" {
+					v[field] = _AUDIT_REDACTED
+				}
+				continue
+			}
+			v[field] = redactAuditValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactAuditValue(item)
+		}
+		return v
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+			return v
+		}
+		var inner interface{}
+		if json.Unmarshal([]byte(trimmed), &inner) != nil {
+			return v
+		}
+		bytes, _ := json.Marshal(redactAuditValue(inner))
+		return string(bytes)
+	}
+	return value
+}
+
+/*
+*
+* 对比修改前后的快照, 只保留有变化的字段; 创建的时候 before 为空, 删除的时候 after 为空
+*
+ */
+func auditDiff(before, after string) string {
+	if before == after {
+		return ""
+	}
+	beforeFields := map[string]interface{}{}
+	afterFields := map[string]interface{}{}
+	json.Unmarshal([]byte(before), &beforeFields)
+	json.Unmarshal([]byte(after), &afterFields)
+	diff := map[string]interface{}{}
+	for field, value := range beforeFields {
+		if newValue, ok := afterFields[field]; !ok || !reflect.DeepEqual(value, newValue) {
+			diff[field] = map[string]interface{}{"before": value, "after": afterFields[field]}
+		}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			diff[field] = map[string]interface{}{"before": nil, "after": value}
+		}
+	}
+	bytes, _ := json.Marshal(diff)
+	return string(bytes)
+}
+
+type auditLogVo struct {
+	Id           uint        `json:"id"`
+	Time         time.Time   `json:"time"`
+	Username     string      `json:"username"`
+	Role         string      `json:"role"`
+	ClientIP     string      `json:"clientIp"`
+	Method       string      `json:"method"`
+	Endpoint     string      `json:"endpoint"`
+	Resource     string      `json:"resource"`
+	ResourceUUID string      `json:"resourceUuid"`
+	Code         int         `json:"code"`
+	Message      string      `json:"message"`
+	Before       interface{} `json:"before"`
+	After        interface{} `json:"after"`
+	Diff         interface{} `json:"diff"`
+}
+
+func rawJson(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func toAuditLogVo(log model.MAuditLog) auditLogVo {
+	return auditLogVo{
+		Id:           log.ID,
+		Time:         log.CreatedAt,
+		Username:     log.Username,
+		Role:         log.Role,
+		ClientIP:     log.ClientIP,
+		Method:       log.Method,
+		Endpoint:     log.Endpoint,
+		Resource:     log.Resource,
+		ResourceUUID: log.ResourceUUID,
+		Code:         log.Code,
+		Message:      log.Message,
+		Before:       rawJson(log.Before),
+		After:        rawJson(log.After),
+		Diff:         rawJson(log.Diff),
+	}
+}
+
+// 查询参数: username resource uuid start end, 时间是 RFC3339 格式
+func parseAuditFilter(c *gin.Context) (auditFilter, error) {
+	filter := auditFilter{
+		Username:     c.Query("username"),
+		Resource:     c.Query("resource"),
+		ResourceUUID: c.Query("uuid"),
+	}
+	var err error
+	if start := c.Query("start"); start != "" {
+		if filter.Start, err = time.Parse(time.RFC3339, start); err != nil {
+			return filter, fmt.Errorf("invalid 'start': %s", err)
+		}
+	}
+	if end := c.Query("end"); end != "" {
+		if filter.End, err = time.Parse(time.RFC3339, end); err != nil {
+			return filter, fmt.Errorf("invalid 'end': %s", err)
+		}
+	}
+	return filter, nil
+}
+
+/*
+*
+* 分页查询审计日志: page 从 1 开始, size 默认 20
+*
+ */
+func AuditLogs(c *gin.Context, hh *HttpApiServer) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 1000 {
+		size = 20
+	}
+	logs, total := hh.PageAuditLog(filter, (page-1)*size, size)
+	records := []auditLogVo{}
+	for _, log := range logs {
+		records = append(records, toAuditLogVo(log))
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(map[string]interface{}{
+		"total":   total,
+		"page":    page,
+		"size":    size,
+		"records": records,
+	}))
+}
+
+/*
+*
+* 导出审计日志: format 是 csv(默认) 或者 json, 过滤条件和查询接口一样
+*
+ */
+func ExportAuditLogs(c *gin.Context, hh *HttpApiServer) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	logs := hh.AllAuditLog(filter)
+	fileName := "audit-" + time.Now().Format("20060102150405")
+	if c.Query("format") == "json" {
+		records := []auditLogVo{}
+		for _, log := range logs {
+			records = append(records, toAuditLogVo(log))
+		}
+		c.Header("Content-Disposition", "attachment; filename="+fileName+".json")
+		c.JSON(http.StatusOK, records)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+fileName+".csv")
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"id", "time", "username", "role", "clientIp", "method", "endpoint",
+		"resource", "resourceUuid", "code", "message", "before", "after", "diff"})
+	for _, log := range logs {
+		writer.Write([]string{
+			strconv.Itoa(int(log.ID)), log.CreatedAt.Format(time.RFC3339), log.Username,
+			log.Role, log.ClientIP, log.Method, log.Endpoint, log.Resource, log.ResourceUUID,
+			strconv.Itoa(log.Code), log.Message, log.Before, log.After, log.Diff,
+		})
+	}
+	writer.Flush()
+}
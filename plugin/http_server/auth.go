@@ -0,0 +1,250 @@
+package httpserver
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+*
+* 用户角色:
+*   - admin: 所有接口, 包括用户管理
+*   - operator: 除了用户管理以外的所有接口
+*   - viewer: 只能调用只读(GET)接口
+* 数据库里不认识的角色按 viewer 处理
+*
+ */
+const (
+	ROLE_ADMIN    string = "admin"
+	ROLE_OPERATOR string = "operator"
+	ROLE_VIEWER   string = "viewer"
+)
+
+// Token 有效期
+const _TOKEN_EXPIRE = 24 * time.Hour
+
+// 请求上下文里保存当前用户的 Key
+const _CONTEXT_USER_KEY = "user"
+
+func validRole(role string) bool {
+	return role == ROLE_ADMIN || role == ROLE_OPERATOR || role == ROLE_VIEWER
+}
+
+func normalizeRole(role string) string {
+	role = strings.ToLower(role)
+	if validRole(role) {
+		return role
+	}
+	return ROLE_VIEWER
+}
+
+/*
+*
+* 不需要登录就能访问的接口
+*
+ */
+var _ANONYMOUS_ROUTES = map[string]bool{
+	url("login"): true,
+	url("ping"):  true,
+}
+
+/*
+*
+* 只有管理员能访问的接口
+*
+ */
+var _ADMIN_ROUTES = map[string]bool{
+	url("users"):         true,
+	url("audit"):         true,
+	url("audit/export"):  true,
+	url("bundle/export"): true,
+	url("bundle/import"): true,
+}
+
+// 不修改数据的接口, viewer 也可以访问
+func readOnlyRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return c.Request.URL.Path == url("logout")
+}
+
+/*
+*
+* 鉴权: /api/v1 下面的接口和 /ws 日志都要带 Token, 静态页面不需要;
+* Token 可以放在 token 头, Authorization: Bearer 头, 或者 token 查询参数里(浏览器的
+* WebSocket 不能带自定义头); 配置里 auth = false 的时候不鉴权
+*
+ */
+func (hs *HttpApiServer) Authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hs.mainConfig.Auth {
+			c.Next()
+			return
+		}
+		path := c.Request.URL.Path
+		if !strings.HasPrefix(path, _API_V1_ROOT) && path != "/ws" {
+			c.Next()
+			return
+		}
+		if _ANONYMOUS_ROUTES[path] {
+			c.Next()
+			return
+		}
+		// 还没有任何用户的时候, 允许匿名创建第一个管理员, CreateUser 里面会加锁再检查一次
+		if path == url("users") && c.Request.Method == http.MethodPost && hs.CountMUser() == 0 {
+			c.Next()
+			return
+		}
+		claims, err := hs.parseToken(requestToken(c))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, common.Error400(err))
+			return
+		}
+		user, err := hs.GetMUserWithName(claims.Username)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized,
+				common.Error("user not exists:"+claims.Username))
+			return
+		}
+		if !allowed(normalizeRole(user.Role), path, readOnlyRequest(c)) {
+			c.AbortWithStatusJSON(http.StatusForbidden,
+				common.Error("permission denied:"+user.Username))
+			return
+		}
+		c.Set(_CONTEXT_USER_KEY, user)
+		c.Next()
+	}
+}
+
+func allowed(role string, path string, readOnly bool) bool {
+	if role == ROLE_ADMIN {
+		return true
+	}
+	if _ADMIN_ROUTES[path] {
+		return false
+	}
+	return readOnly || role == ROLE_OPERATOR
+}
+
+func requestToken(c *gin.Context) string {
+	if token := c.GetHeader("token"); token != "" {
+		return token
+	}
+	if authorization := c.GetHeader("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// 当前登录的用户, 只有鉴权通过的请求才有
+func currentUser(c *gin.Context) *model.MUser {
+	if value, ok := c.Get(_CONTEXT_USER_KEY); ok {
+		return value.(*model.MUser)
+	}
+	return nil
+}
+
+type JwtClaims struct {
+	Username string
+	jwt.StandardClaims
+}
+
+/*
+*
+* 生成Token
+*
+ */
+func (hs *HttpApiServer) generateToken(username string) (string, error) {
+	claims := &JwtClaims{
+		Username: username,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(_TOKEN_EXPIRE).Unix(),
+			Issuer:    username,
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(hs.jwtSecret)
+}
+
+/*
+*
+* 解析Token
+*
+ */
+func (hs *HttpApiServer) parseToken(tokenString string) (*JwtClaims, error) {
+	if tokenString == "" {
+		return nil, fmt.Errorf("expected token string on headers")
+	}
+	token, err := jwt.ParseWithClaims(tokenString, &JwtClaims{},
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return hs.jwtSecret, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := token.Claims.(*JwtClaims); ok && token.Valid {
+		return claims, nil
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+// 没有配置密钥的时候随机生成一个, 重启以后需要重新登录
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}
+
+/*
+*
+* 密码用 bcrypt 保存; 老版本保存的是不加盐的 md5, 登录成功的时候自动换成 bcrypt
+*
+ */
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+// 校验密码, 返回是否需要升级成 bcrypt
+func checkPassword(hash string, password string) (bool, error) {
+	if isBcryptHash(hash) {
+		return false, bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+	if hash != md5Hash(password) {
+		return false, fmt.Errorf("invalid username or password")
+	}
+	return true, nil
+}
+
+/*
+*
+* Md5 计算, 只用来校验老版本的密码
+*
+ */
+func md5Hash(str string) string {
+	h := md5.New()
+	h.Write([]byte(str))
+	return hex.EncodeToString(h.Sum(nil))
+}
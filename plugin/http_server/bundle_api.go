@@ -0,0 +1,792 @@
+package httpserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/device"
+	"github.com/hootrhino/rulex/glogger"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/plugin/http_server/service"
+	"github.com/hootrhino/rulex/source"
+	"github.com/hootrhino/rulex/target"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+	"gorm.io/gorm"
+)
+
+/*
+*
+* 配置包: 一个 zip 文件, 里面是 bundle.json 和 apps/<UUID>.lua;
+* 用来把一台网关的配置原样复制到另一台网关上
+*
+ */
+const _BUNDLE_VERSION = 1
+const _BUNDLE_FILE = "bundle.json"
+const _BUNDLE_APPS_DIR = "apps/"
+
+// 上传的配置包最大 32MB, 解压以后所有文件加起来最大 64MB
+const _BUNDLE_MAX_SIZE = 32 << 20
+const _BUNDLE_MAX_UNZIPPED_SIZE = 64 << 20
+
+// 资源的 UUID 会拼到应用脚本的路径里, 只允许生成出来的那种字母数字, 不能带路径分隔符和 ..
+var bundleUUIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+// 导入模式
+const (
+	_BUNDLE_MERGE   = "merge"   // 保留现有配置, UUID 相同的覆盖
+	_BUNDLE_REPLACE = "replace" // 先清空现有配置
+)
+
+type configBundle struct {
+	Version        int                           `json:"version"`
+	RulexVersion   string                        `json:"rulexVersion"`
+	ExportedAt     time.Time                     `json:"exportedAt"`
+	InEnds         []model.MInEnd                `json:"inends"`
+	OutEnds        []model.MOutEnd               `json:"outends"`
+	Devices        []model.MDevice               `json:"devices"`
+	ModbusPoints   []model.MModbusPointPosition  `json:"modbusPoints"`
+	Rules          []model.MRule                 `json:"rules"`
+	Apps           []model.MApp                  `json:"apps"`
+	Goods          []model.MGoods                `json:"goods"`
+	Visuals        []model.MVisual               `json:"visuals"`
+	Groups         []model.MGenericGroup         `json:"groups"`
+	GroupRelations []model.MGenericGroupRelation `json:"groupRelations"`
+	// 应用脚本, 不写进 bundle.json, 单独放在 apps 目录下
+	scripts map[string][]byte
+}
+
+/*
+*
+* 按资源类型列出配置包里所有资源的 UUID
+*
+ */
+func (b *configBundle) uuids() map[string][]string {
+	uuids := map[string][]string{}
+	for _, v := range b.InEnds {
+		uuids["INEND"] = append(uuids["INEND"], v.UUID)
+	}
+	for _, v := range b.OutEnds {
+		uuids["OUTEND"] = append(uuids["OUTEND"], v.UUID)
+	}
+	for _, v := range b.Devices {
+		uuids["DEVICE"] = append(uuids["DEVICE"], v.UUID)
+	}
+	for _, v := range b.Rules {
+		uuids["RULE"] = append(uuids["RULE"], v.UUID)
+	}
+	for _, v := range b.Apps {
+		uuids["APP"] = append(uuids["APP"], v.UUID)
+	}
+	for _, v := range b.Goods {
+		uuids["GOODS"] = append(uuids["GOODS"], v.UUID)
+	}
+	for _, v := range b.Visuals {
+		uuids["VISUAL"] = append(uuids["VISUAL"], v.UUID)
+	}
+	for _, v := range b.Groups {
+		uuids["GROUP"] = append(uuids["GROUP"], v.UUID)
+	}
+	return uuids
+}
+
+// 各类资源新 UUID 的生成方法
+var _BUNDLE_UUID_MAKERS = map[string]func() string{
+	"INEND":  utils.InUuid,
+	"OUTEND": utils.OutUuid,
+	"DEVICE": utils.DeviceUuid,
+	"RULE":   utils.RuleUuid,
+	"APP":    utils.AppUuid,
+	"GOODS":  utils.GoodsUuid,
+	"VISUAL": utils.VisualUuid,
+	"GROUP":  utils.GroupUuid,
+}
+
+/*
+*
+* 从数据库里导出当前的配置
+*
+ */
+func (hh *HttpApiServer) exportBundle() (*configBundle, error) {
+	bundle := &configBundle{
+		Version:        _BUNDLE_VERSION,
+		RulexVersion:   typex.DefaultVersion.Version,
+		ExportedAt:     time.Now(),
+		InEnds:         hh.AllMInEnd(),
+		OutEnds:        hh.AllMOutEnd(),
+		Devices:        hh.AllDevices(),
+		ModbusPoints:   []model.MModbusPointPosition{},
+		Rules:          hh.AllMRules(),
+		Apps:           hh.AllApp(),
+		Goods:          hh.AllGoods(),
+		Visuals:        service.AllVisual(),
+		Groups:         service.AllGenericGroup(),
+		GroupRelations: []model.MGenericGroupRelation{},
+		scripts:        map[string][]byte{},
+	}
+	sqlitedao.Sqlite.DB().Find(&bundle.ModbusPoints)
+	sqlitedao.Sqlite.DB().Find(&bundle.GroupRelations)
+	for _, app := range bundle.Apps {
+		script, err := os.ReadFile(app.Filepath)
+		if err != nil {
+			return nil, fmt.Errorf("read app [%s] script error: %s", app.UUID, err)
+		}
+		bundle.scripts[app.UUID] = script
+	}
+	return bundle, nil
+}
+
+func writeBundle(w io.Writer, bundle *configBundle) error {
+	archive := zip.NewWriter(w)
+	file, err := archive.Create(_BUNDLE_FILE)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(bundle); err != nil {
+		return err
+	}
+	for uuid, script := range bundle.scripts {
+		file, err := archive.Create(_BUNDLE_APPS_DIR + uuid + ".lua")
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(script); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func readBundle(data []byte) (*configBundle, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %s", err)
+	}
+	var bundle *configBundle
+	scripts := map[string][]byte{}
+	remain := int64(_BUNDLE_MAX_UNZIPPED_SIZE)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		// 不信任 zip 里面写的大小, 按实际解压出来的算, 防止压缩炸弹
+		content, err := io.ReadAll(io.LimitReader(reader, remain+1))
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		remain -= int64(len(content))
+		if remain < 0 {
+			return nil, fmt.Errorf("invalid bundle: unzipped size exceeds %d bytes",
+				_BUNDLE_MAX_UNZIPPED_SIZE)
+		}
+		if file.Name == _BUNDLE_FILE {
+			bundle = &configBundle{}
+			if err := json.Unmarshal(content, bundle); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", _BUNDLE_FILE, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(file.Name, _BUNDLE_APPS_DIR) && strings.HasSuffix(file.Name, ".lua") {
+			uuid := strings.TrimSuffix(strings.TrimPrefix(file.Name, _BUNDLE_APPS_DIR), ".lua")
+			if !bundleUUIDRegexp.MatchString(uuid) {
+				return nil, fmt.Errorf("invalid bundle: invalid app script name: %s", file.Name)
+			}
+			scripts[uuid] = content
+		}
+	}
+	if bundle == nil {
+		return nil, fmt.Errorf("invalid bundle: missing %s", _BUNDLE_FILE)
+	}
+	if bundle.Version < 1 || bundle.Version > _BUNDLE_VERSION {
+		return nil, fmt.Errorf("unsupported bundle version: %d", bundle.Version)
+	}
+	bundle.scripts = scripts
+	return bundle, nil
+}
+
+/*
+*
+* UUID 重映射: 给配置包里的每个资源换一个新的 UUID; 引用 UUID 的字段(绑定关系, 规则的
+* 上下游, 点位和分组关系)直接按表替换, 规则脚本, 资源配置, 大屏内容和应用脚本这些文本
+* 里面引用到的旧 UUID 也替换成新的
+*
+ */
+func remapBundle(bundle *configBundle) (*configBundle, map[string]string, error) {
+	mapping := map[string]string{}
+	oldUUIDs := []string{}
+	for resource, uuids := range bundle.uuids() {
+		for _, uuid := range uuids {
+			if !bundleUUIDRegexp.MatchString(uuid) {
+				return nil, nil, fmt.Errorf("invalid %s uuid: %s", resource, uuid)
+			}
+			mapping[uuid] = _BUNDLE_UUID_MAKERS[resource]()
+			oldUUIDs = append(oldUUIDs, uuid)
+		}
+	}
+	// 长的先替换, 防止一个 UUID 是另一个的前缀
+	sort.Slice(oldUUIDs, func(i, j int) bool { return len(oldUUIDs[i]) > len(oldUUIDs[j]) })
+	pairs := []string{}
+	for _, uuid := range oldUUIDs {
+		pairs = append(pairs, uuid, mapping[uuid])
+	}
+	replacer := strings.NewReplacer(pairs...)
+	id := func(uuid string) string {
+		if newUUID, ok := mapping[uuid]; ok {
+			return newUUID
+		}
+		return uuid
+	}
+	ids := func(uuids []string) []string {
+		result := make([]string, len(uuids))
+		for i, uuid := range uuids {
+			result[i] = id(uuid)
+		}
+		return result
+	}
+	remapped := *bundle
+	remapped.InEnds = make([]model.MInEnd, len(bundle.InEnds))
+	for i, in := range bundle.InEnds {
+		in.UUID = id(in.UUID)
+		in.BindRules = ids(in.BindRules)
+		in.Config = replacer.Replace(in.Config)
+		remapped.InEnds[i] = in
+	}
+	remapped.OutEnds = make([]model.MOutEnd, len(bundle.OutEnds))
+	for i, out := range bundle.OutEnds {
+		out.UUID = id(out.UUID)
+		out.Config = replacer.Replace(out.Config)
+		remapped.OutEnds[i] = out
+	}
+	remapped.Devices = make([]model.MDevice, len(bundle.Devices))
+	for i, dev := range bundle.Devices {
+		dev.UUID = id(dev.UUID)
+		dev.BindRules = ids(dev.BindRules)
+		dev.Config = replacer.Replace(dev.Config)
+		remapped.Devices[i] = dev
+	}
+	remapped.ModbusPoints = make([]model.MModbusPointPosition, len(bundle.ModbusPoints))
+	for i, point := range bundle.ModbusPoints {
+		point.DeviceUuid = id(point.DeviceUuid)
+		remapped.ModbusPoints[i] = point
+	}
+	remapped.Rules = make([]model.MRule, len(bundle.Rules))
+	for i, rule := range bundle.Rules {
+		rule.UUID = id(rule.UUID)
+		rule.FromSource = ids(rule.FromSource)
+		rule.FromDevice = ids(rule.FromDevice)
+		rule.ToRules = ids(rule.ToRules)
+		rule.ToTargets = ids(rule.ToTargets)
+		rule.ToDevices = ids(rule.ToDevices)
+		rule.Expression = replacer.Replace(rule.Expression)
+		rule.DeviceCmd = replacer.Replace(rule.DeviceCmd)
+		rule.Actions = replacer.Replace(rule.Actions)
+		rule.Success = replacer.Replace(rule.Success)
+		rule.Failed = replacer.Replace(rule.Failed)
+		remapped.Rules[i] = rule
+	}
+	remapped.Apps = make([]model.MApp, len(bundle.Apps))
+	for i, app := range bundle.Apps {
+		app.UUID = id(app.UUID)
+		remapped.Apps[i] = app
+	}
+	remapped.Goods = make([]model.MGoods, len(bundle.Goods))
+	for i, goods := range bundle.Goods {
+		goods.UUID = id(goods.UUID)
+		remapped.Goods[i] = goods
+	}
+	remapped.Visuals = make([]model.MVisual, len(bundle.Visuals))
+	for i, visual := range bundle.Visuals {
+		visual.UUID = id(visual.UUID)
+		visual.Content = replacer.Replace(visual.Content)
+		remapped.Visuals[i] = visual
+	}
+	remapped.Groups = make([]model.MGenericGroup, len(bundle.Groups))
+	for i, group := range bundle.Groups {
+		group.UUID = id(group.UUID)
+		group.Parent = id(group.Parent)
+		remapped.Groups[i] = group
+	}
+	remapped.GroupRelations = make([]model.MGenericGroupRelation, len(bundle.GroupRelations))
+	for i, relation := range bundle.GroupRelations {
+		relation.Gid = id(relation.Gid)
+		relation.Rid = id(relation.Rid)
+		remapped.GroupRelations[i] = relation
+	}
+	remapped.scripts = map[string][]byte{}
+	for uuid, script := range bundle.scripts {
+		remapped.scripts[id(uuid)] = []byte(replacer.Replace(string(script)))
+	}
+	return &remapped, mapping, nil
+}
+
+/*
+*
+* 导入报告
+*
+ */
+type bundleImportReport struct {
+	Mode       string              `json:"mode"`
+	DryRun     bool                `json:"dryRun"`
+	Valid      bool                `json:"valid"`
+	Errors     []string            `json:"errors"`
+	Warnings   []string            `json:"warnings"`
+	Created    map[string][]string `json:"created"`
+	Updated    map[string][]string `json:"updated"`
+	Deleted    map[string][]string `json:"deleted"`
+	UUIDMap    map[string]string   `json:"uuidMap"`
+	LoadErrors []string            `json:"loadErrors"`
+}
+
+func newBundleImportReport(mode string, dryRun bool) *bundleImportReport {
+	return &bundleImportReport{
+		Mode:       mode,
+		DryRun:     dryRun,
+		Errors:     []string{},
+		Warnings:   []string{},
+		Created:    map[string][]string{},
+		Updated:    map[string][]string{},
+		Deleted:    map[string][]string{},
+		UUIDMap:    map[string]string{},
+		LoadErrors: []string{},
+	}
+}
+
+func (r *bundleImportReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// 当前数据库里的资源
+func (hh *HttpApiServer) currentUUIDs() map[string][]string {
+	current := &configBundle{
+		InEnds:  hh.AllMInEnd(),
+		OutEnds: hh.AllMOutEnd(),
+		Devices: hh.AllDevices(),
+		Rules:   hh.AllMRules(),
+		Apps:    hh.AllApp(),
+		Goods:   hh.AllGoods(),
+		Visuals: service.AllVisual(),
+		Groups:  service.AllGenericGroup(),
+	}
+	return current.uuids()
+}
+
+/*
+*
+* 检查配置包: 资源类型是否支持, 规则脚本语法, 引用的资源是否存在, 应用脚本是否齐全;
+* 同时算出要新建, 覆盖和删除的资源
+*
+ */
+func (hh *HttpApiServer) validateBundle(bundle *configBundle, mode string, report *bundleImportReport) {
+	current := hh.currentUUIDs()
+	existing := map[string]bool{}
+	for _, uuids := range current {
+		for _, uuid := range uuids {
+			existing[uuid] = true
+		}
+	}
+	incoming := map[string]bool{}
+	for resource, uuids := range bundle.uuids() {
+		for _, uuid := range uuids {
+			if !bundleUUIDRegexp.MatchString(uuid) {
+				report.errorf("invalid %s uuid: %s", resource, uuid)
+			}
+			if incoming[uuid] {
+				report.errorf("duplicate %s uuid: %s", resource, uuid)
+			}
+			incoming[uuid] = true
+			if existing[uuid] {
+				report.Updated[resource] = append(report.Updated[resource], uuid)
+			} else {
+				report.Created[resource] = append(report.Created[resource], uuid)
+			}
+		}
+	}
+	if mode == _BUNDLE_REPLACE {
+		for resource, uuids := range current {
+			for _, uuid := range uuids {
+				if !incoming[uuid] {
+					report.Deleted[resource] = append(report.Deleted[resource], uuid)
+				}
+			}
+		}
+	}
+	// 合并模式下可以引用现有的资源
+	exists := func(uuid string) bool {
+		return incoming[uuid] || (mode == _BUNDLE_MERGE && existing[uuid])
+	}
+	for _, in := range bundle.InEnds {
+		if source.SM.Find(typex.InEndType(in.Type)) == nil {
+			report.errorf("inend [%s] unsupported type: %s", in.UUID, in.Type)
+		}
+		if !json.Valid([]byte(in.Config)) {
+			report.errorf("inend [%s] invalid config", in.UUID)
+		}
+		for _, ruleId := range in.BindRules {
+			if ruleId != "" && !exists(ruleId) {
+				report.errorf("inend [%s] bind rule not exists: %s", in.UUID, ruleId)
+			}
+		}
+	}
+	for _, out := range bundle.OutEnds {
+		if target.TM.Find(typex.TargetType(out.Type)) == nil {
+			report.errorf("outend [%s] unsupported type: %s", out.UUID, out.Type)
+		}
+		if !json.Valid([]byte(out.Config)) {
+			report.errorf("outend [%s] invalid config", out.UUID)
+		}
+	}
+	for _, dev := range bundle.Devices {
+		if device.DM.Find(typex.DeviceType(dev.Type)) == nil {
+			report.errorf("device [%s] unsupported type: %s", dev.UUID, dev.Type)
+		}
+		if !json.Valid([]byte(dev.Config)) {
+			report.errorf("device [%s] invalid config", dev.UUID)
+		}
+		for _, ruleId := range dev.BindRules {
+			if ruleId != "" && !exists(ruleId) {
+				report.errorf("device [%s] bind rule not exists: %s", dev.UUID, ruleId)
+			}
+		}
+	}
+	for _, point := range bundle.ModbusPoints {
+		if !exists(point.DeviceUuid) {
+			report.errorf("modbus point [%s] device not exists: %s", point.Tag, point.DeviceUuid)
+		}
+	}
+	for _, rule := range bundle.Rules {
+		for _, ids := range [][]string{rule.FromSource, rule.FromDevice, rule.ToRules,
+			rule.ToTargets, rule.ToDevices} {
+			for _, id := range ids {
+				if id != "" && !exists(id) {
+					report.errorf("rule [%s] reference not exists: %s", rule.UUID, id)
+				}
+			}
+		}
+		if err := checkRuleEvents(rule.FromEvent); err != nil {
+			report.errorf("rule [%s] %s", rule.UUID, err)
+		}
+		tmpRule := typex.NewRule(nil, "_", "_", "_", []string{}, []string{},
+			rule.Success, rule.Actions, rule.Failed)
+		tmpRule.Expression = rule.Expression
+		var err error
+		if rule.Type == "expr" {
+			err = core.VerifyExprSyntax(tmpRule)
+		} else {
+			err = core.VerifyLuaSyntax(tmpRule)
+		}
+		if err != nil {
+			report.errorf("rule [%s] invalid script: %s", rule.UUID, err)
+		}
+	}
+	for _, app := range bundle.Apps {
+		if _, ok := bundle.scripts[app.UUID]; !ok {
+			report.errorf("app [%s] missing script", app.UUID)
+		}
+	}
+	for _, relation := range bundle.GroupRelations {
+		if !exists(relation.Gid) {
+			report.errorf("group relation group not exists: %s", relation.Gid)
+		}
+		if !exists(relation.Rid) {
+			report.Warnings = append(report.Warnings,
+				"group relation resource not exists: "+relation.Rid)
+		}
+	}
+	report.Valid = len(report.Errors) == 0
+}
+
+/*
+*
+* 停掉并卸载运行中的资源
+*
+ */
+func (hh *HttpApiServer) unloadBundleResources(uuids map[string][]string) {
+	for _, uuid := range uuids["APP"] {
+		if hh.ruleEngine.GetApp(uuid) != nil {
+			hh.ruleEngine.RemoveApp(uuid)
+		}
+	}
+	for _, uuid := range uuids["GOODS"] {
+		hh.ruleEngine.RemoveGoods(uuid)
+	}
+	for _, uuid := range uuids["INEND"] {
+		hh.ruleEngine.RemoveInEnd(uuid)
+	}
+	for _, uuid := range uuids["DEVICE"] {
+		hh.ruleEngine.RemoveDevice(uuid)
+	}
+	for _, uuid := range uuids["OUTEND"] {
+		hh.ruleEngine.RemoveOutEnd(uuid)
+	}
+	for _, uuid := range uuids["RULE"] {
+		hh.ruleEngine.RemoveRule(uuid)
+	}
+}
+
+/*
+*
+* 写数据库: 替换模式先清空, 合并模式先删掉 UUID 相同的, 然后全部插入
+*
+ */
+func saveBundle(tx *gorm.DB, bundle *configBundle, mode string) error {
+	all := func(m interface{}) error {
+		return tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(m).Error
+	}
+	byUUID := func(m interface{}, uuid string) error {
+		return tx.Where("uuid=?", uuid).Delete(m).Error
+	}
+	if mode == _BUNDLE_REPLACE {
+		for _, m := range []interface{}{&model.MInEnd{}, &model.MOutEnd{}, &model.MDevice{},
+			&model.MModbusPointPosition{}, &model.MRule{}, &model.MApp{}, &model.MGoods{},
+			&model.MVisual{}, &model.MGenericGroup{}, &model.MGenericGroupRelation{}} {
+			if err := all(m); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, uuids := range []struct {
+			m     interface{}
+			uuids []string
+		}{
+			{&model.MInEnd{}, bundle.uuids()["INEND"]},
+			{&model.MOutEnd{}, bundle.uuids()["OUTEND"]},
+			{&model.MDevice{}, bundle.uuids()["DEVICE"]},
+			{&model.MRule{}, bundle.uuids()["RULE"]},
+			{&model.MApp{}, bundle.uuids()["APP"]},
+			{&model.MGoods{}, bundle.uuids()["GOODS"]},
+			{&model.MVisual{}, bundle.uuids()["VISUAL"]},
+			{&model.MGenericGroup{}, bundle.uuids()["GROUP"]},
+		} {
+			for _, uuid := range uuids.uuids {
+				if err := byUUID(uuids.m, uuid); err != nil {
+					return err
+				}
+			}
+		}
+		for _, uuid := range bundle.uuids()["DEVICE"] {
+			if err := tx.Where("device_uuid=?", uuid).Delete(&model.MModbusPointPosition{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, relation := range bundle.GroupRelations {
+			if err := tx.Where("gid=? AND rid=?", relation.Gid, relation.Rid).
+				Delete(&model.MGenericGroupRelation{}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for i := range bundle.Apps {
+		bundle.Apps[i].Filepath = "./apps/" + bundle.Apps[i].UUID + ".lua"
+	}
+	for _, records := range []interface{}{bundle.InEnds, bundle.OutEnds, bundle.Devices,
+		bundle.ModbusPoints, bundle.Rules, bundle.Apps, bundle.Goods, bundle.Visuals,
+		bundle.Groups, bundle.GroupRelations} {
+		if err := insertBundleRecords(tx, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 主键和创建时间用新的
+func insertBundleRecords(tx *gorm.DB, records interface{}) error {
+	value := reflect.ValueOf(records)
+	if value.Len() == 0 {
+		return nil
+	}
+	for i := 0; i < value.Len(); i++ {
+		value.Index(i).FieldByName("RulexModel").Set(reflect.ValueOf(model.RulexModel{}))
+	}
+	return tx.Create(records).Error
+}
+
+/*
+*
+* 热加载: 和启动的时候从数据库加载的顺序一样
+*
+ */
+func (hh *HttpApiServer) loadBundle(bundle *configBundle, report *bundleImportReport) {
+	loadError := func(resource string, uuid string, err error) {
+		glogger.GLogger.Error("Bundle load failed:", resource, uuid, err)
+		report.LoadErrors = append(report.LoadErrors, fmt.Sprintf("%s [%s]: %s", resource, uuid, err))
+	}
+	for _, in := range bundle.InEnds {
+		if err := hh.LoadNewestInEnd(in.UUID); err != nil {
+			loadError("INEND", in.UUID, err)
+		}
+	}
+	for _, out := range bundle.OutEnds {
+		if err := hh.LoadNewestOutEnd(out.UUID); err != nil {
+			loadError("OUTEND", out.UUID, err)
+		}
+	}
+	for _, dev := range bundle.Devices {
+		if err := hh.LoadNewestDevice(dev.UUID); err != nil {
+			loadError("DEVICE", dev.UUID, err)
+		}
+	}
+	for _, rule := range bundle.Rules {
+		if len(rule.FromSource) == 0 && len(rule.FromDevice) == 0 {
+			if err := hh.LoadNewestRule(rule.UUID); err != nil {
+				loadError("RULE", rule.UUID, err)
+			}
+		}
+	}
+	for _, goods := range bundle.Goods {
+		if err := hh.ruleEngine.LoadGoods(typex.Goods{
+			UUID:        goods.UUID,
+			Addr:        goods.Addr,
+			Description: goods.Description,
+			Args:        goods.Args,
+		}); err != nil {
+			loadError("GOODS", goods.UUID, err)
+		}
+	}
+	for _, mApp := range bundle.Apps {
+		app := typex.NewApplication(mApp.UUID, mApp.Name, mApp.Version, mApp.Filepath)
+		if err := hh.ruleEngine.LoadApp(app); err != nil {
+			loadError("APP", mApp.UUID, err)
+			continue
+		}
+		if mApp.AutoStart != nil && *mApp.AutoStart {
+			if err := hh.ruleEngine.StartApp(app.UUID); err != nil {
+				loadError("APP", mApp.UUID, err)
+			}
+		}
+	}
+}
+
+/*
+*
+* 导入配置包
+*
+ */
+func (hh *HttpApiServer) importBundle(bundle *configBundle, mode string, remap bool,
+	dryRun bool) *bundleImportReport {
+	report := newBundleImportReport(mode, dryRun)
+	if remap {
+		remapped, mapping, err := remapBundle(bundle)
+		if err != nil {
+			report.errorf("remap uuid error: %s", err)
+			return report
+		}
+		bundle, report.UUIDMap = remapped, mapping
+	}
+	hh.bundleLocker.Lock()
+	defer hh.bundleLocker.Unlock()
+	hh.validateBundle(bundle, mode, report)
+	if !report.Valid || dryRun {
+		return report
+	}
+	// 先把要被覆盖和删除的资源停掉
+	unload := map[string][]string{}
+	for _, resources := range []map[string][]string{report.Updated, report.Deleted} {
+		for resource, uuids := range resources {
+			unload[resource] = append(unload[resource], uuids...)
+		}
+	}
+	hh.unloadBundleResources(unload)
+	if err := sqlitedao.Sqlite.DB().Transaction(func(tx *gorm.DB) error {
+		return saveBundle(tx, bundle, mode)
+	}); err != nil {
+		report.errorf("save bundle error: %s", err)
+		report.Valid = false
+		return report
+	}
+	if err := os.MkdirAll("./apps/", 0755); err != nil {
+		report.errorf("create apps directory error: %s", err)
+	}
+	for _, uuid := range report.Deleted["APP"] {
+		os.Remove(filepath.Join("./apps/", uuid+".lua"))
+	}
+	for _, app := range bundle.Apps {
+		if err := os.WriteFile(app.Filepath, bundle.scripts[app.UUID], 0644); err != nil {
+			report.errorf("write app [%s] script error: %s", app.UUID, err)
+		}
+	}
+	hh.loadBundle(bundle, report)
+	return report
+}
+
+/*
+*
+* 导出配置包
+*
+ */
+func ExportBundle(c *gin.Context, hh *HttpApiServer) {
+	bundle, err := hh.exportBundle()
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	buffer := bytes.Buffer{}
+	if err := writeBundle(&buffer, bundle); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	fileName := "rulex-bundle-" + time.Now().Format("20060102150405") + ".zip"
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, "application/zip", buffer.Bytes())
+}
+
+/*
+*
+* 导入配置包: 表单文件字段是 file, 或者直接把 zip 放在请求体里;
+* 参数: mode=merge|replace(默认 merge), remap=true 重新生成 UUID, dryRun=true 只检查不导入
+*
+ */
+func ImportBundle(c *gin.Context, hh *HttpApiServer) {
+	mode := c.DefaultQuery("mode", _BUNDLE_MERGE)
+	if mode != _BUNDLE_MERGE && mode != _BUNDLE_REPLACE {
+		c.JSON(common.HTTP_OK, common.Error("mode must one of 'merge' or 'replace':"+mode))
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, _BUNDLE_MAX_SIZE)
+	var data []byte
+	var err error
+	if file, err1 := c.FormFile("file"); err1 == nil {
+		reader, err2 := file.Open()
+		if err2 != nil {
+			c.JSON(common.HTTP_OK, common.Error400(err2))
+			return
+		}
+		defer reader.Close()
+		data, err = io.ReadAll(io.LimitReader(reader, _BUNDLE_MAX_SIZE))
+	} else {
+		data, err = io.ReadAll(c.Request.Body)
+	}
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	bundle, err := readBundle(data)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	report := hh.importBundle(bundle, mode, c.Query("remap") == "true", c.Query("dryRun") == "true")
+	if !report.Valid {
+		c.JSON(common.HTTP_OK, common.R{Code: 4001, Msg: "invalid bundle", Data: report})
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(report))
+}
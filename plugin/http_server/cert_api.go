@@ -0,0 +1,226 @@
+package httpserver
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hootrhino/rulex/glogger"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/utils"
+)
+
+const _DEFAULT_CERT_PATH string = "./certs"
+
+// 证书文件最大 1MB
+const _MAX_CERT_SIZE = 1024 * 1024
+
+// 证书类型
+const (
+	_CERT_TYPE_CERT string = "CERT"
+	_CERT_TYPE_KEY  string = "KEY"
+)
+
+type certificateVo struct {
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Path        string `json:"path"` // 资源配置里填这个路径
+	Subject     string `json:"subject,omitempty"`
+	NotAfter    string `json:"notAfter,omitempty"`
+	Description string `json:"description"`
+}
+
+func (hs *HttpApiServer) certPath() string {
+	if hs.mainConfig.CertPath == "" {
+		return _DEFAULT_CERT_PATH
+	}
+	return hs.mainConfig.CertPath
+}
+
+func (hs *HttpApiServer) certFile(uuid string) string {
+	return filepath.Join(hs.certPath(), uuid+".pem")
+}
+
+func (hs *HttpApiServer) toCertificateVo(m model.MCertificate) certificateVo {
+	vo := certificateVo{
+		UUID:        m.UUID,
+		Name:        m.Name,
+		Type:        m.Type,
+		Path:        hs.certFile(m.UUID),
+		Description: m.Description,
+	}
+	if m.Type == _CERT_TYPE_CERT {
+		if block, _ := pem.Decode([]byte(m.Content)); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				vo.Subject = cert.Subject.String()
+				vo.NotAfter = cert.NotAfter.Format(time.RFC3339)
+			}
+		}
+	}
+	return vo
+}
+
+/*
+*
+* 检查 PEM: 证书(可以是证书链)或者私钥, 返回类型
+*
+ */
+func certificateType(content []byte) (string, error) {
+	block, rest := pem.Decode(content)
+	if block == nil {
+		return "", fmt.Errorf("invalid PEM")
+	}
+	if block.Type == "CERTIFICATE" {
+		for block != nil {
+			if block.Type != "CERTIFICATE" {
+				return "", fmt.Errorf("certificate and private key must be uploaded separately")
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				return "", err
+			}
+			block, rest = pem.Decode(rest)
+		}
+		return _CERT_TYPE_CERT, nil
+	}
+	if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return _CERT_TYPE_KEY, nil
+	}
+	return "", fmt.Errorf("unsupported PEM type: %s", block.Type)
+}
+
+// 私钥也在里面, 只能自己读
+func (hs *HttpApiServer) writeCertFile(m *model.MCertificate) error {
+	if err := os.MkdirAll(hs.certPath(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(hs.certFile(m.UUID), []byte(m.Content), 0600)
+}
+
+/*
+*
+* 数据库里的证书写到证书目录, 文件丢了或者换了目录也能恢复
+*
+ */
+func (hs *HttpApiServer) restoreCertificates() {
+	for _, m := range hs.AllMCertificates() {
+		if err := hs.writeCertFile(&m); err != nil {
+			glogger.GLogger.Errorf("Certificate [%s] restore failed: %v", m.UUID, err)
+		}
+	}
+}
+
+func Certificates(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if uuid == "" {
+		certs := []certificateVo{}
+		for _, m := range hh.AllMCertificates() {
+			certs = append(certs, hh.toCertificateVo(m))
+		}
+		c.JSON(common.HTTP_OK, common.OkWithData(certs))
+		return
+	}
+	m, err := hh.GetMCertificateWithUUID(uuid)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400EmptyObj(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(hh.toCertificateVo(*m)))
+}
+
+/*
+*
+* 上传证书: 表单文件字段是 file, name 和 description 是表单字段;
+* 或者 JSON: {"name":"", "content":"PEM", "description":""}
+*
+ */
+func UploadCertificate(c *gin.Context, hh *HttpApiServer) {
+	type Form struct {
+		Name        string `json:"name" form:"name"`
+		Content     string `json:"content" form:"content"`
+		Description string `json:"description" form:"description"`
+	}
+	form := Form{}
+	if file, err := c.FormFile("file"); err == nil {
+		if file.Size > _MAX_CERT_SIZE {
+			c.JSON(common.HTTP_OK, common.Error("certificate file size cannot be greater than 1MB"))
+			return
+		}
+		reader, err := file.Open()
+		if err != nil {
+			c.JSON(common.HTTP_OK, common.Error400(err))
+			return
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			c.JSON(common.HTTP_OK, common.Error400(err))
+			return
+		}
+		form.Name = c.PostForm("name")
+		form.Description = c.PostForm("description")
+		form.Content = string(content)
+		if form.Name == "" {
+			form.Name = file.Filename
+		}
+	} else if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if form.Name == "" {
+		c.JSON(common.HTTP_OK, common.Error("name is required"))
+		return
+	}
+	if len(form.Content) > _MAX_CERT_SIZE {
+		c.JSON(common.HTTP_OK, common.Error("certificate file size cannot be greater than 1MB"))
+		return
+	}
+	certType, err := certificateType([]byte(form.Content))
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	m := &model.MCertificate{
+		UUID:        utils.MakeUUID("CERT"),
+		Name:        form.Name,
+		Type:        certType,
+		Content:     form.Content,
+		Description: form.Description,
+	}
+	if err := hh.writeCertFile(m); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.InsertMCertificate(m); err != nil {
+		os.Remove(hh.certFile(m.UUID))
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	auditUUID(c, m.UUID)
+	c.JSON(common.HTTP_OK, common.OkWithData(hh.toCertificateVo(*m)))
+}
+
+// 删除证书, 用到它的资源下次重启的时候会失败
+func DeleteCertificate(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if _, err := hh.GetMCertificateWithUUID(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.DeleteMCertificate(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := os.Remove(hh.certFile(uuid)); err != nil && !os.IsNotExist(err) {
+		glogger.GLogger.Error(err)
+	}
+	auditUUID(c, uuid)
+	c.JSON(common.HTTP_OK, common.Ok())
+}
@@ -0,0 +1,286 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/hootrhino/rulex/configdir"
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/utils"
+	"gorm.io/gorm"
+)
+
+func configDirJson(config map[string]interface{}) string {
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	bytes, _ := json.Marshal(config)
+	return string(bytes)
+}
+
+/*
+*
+* 把配置目录的内容转成配置包, 后面和导入配置包走同样的校验
+*
+ */
+func configDirBundle(config *configdir.Config) *configBundle {
+	bundle := &configBundle{
+		InEnds:  []model.MInEnd{},
+		OutEnds: []model.MOutEnd{},
+		Devices: []model.MDevice{},
+		Rules:   []model.MRule{},
+		Apps:    []model.MApp{},
+		scripts: config.Scripts,
+	}
+	for _, in := range config.InEnds {
+		bundle.InEnds = append(bundle.InEnds, model.MInEnd{
+			UUID:        in.UUID,
+			Type:        in.Type,
+			Name:        in.Name,
+			BindRules:   in.BindRules,
+			Description: in.Description,
+			Config:      configDirJson(in.Config),
+			XDataModels: "[]",
+		})
+	}
+	for _, out := range config.OutEnds {
+		bundle.OutEnds = append(bundle.OutEnds, model.MOutEnd{
+			UUID:        out.UUID,
+			Type:        out.Type,
+			Name:        out.Name,
+			Description: out.Description,
+			Config:      configDirJson(out.Config),
+		})
+	}
+	for _, dev := range config.Devices {
+		bundle.Devices = append(bundle.Devices, model.MDevice{
+			UUID:        dev.UUID,
+			Type:        dev.Type,
+			Name:        dev.Name,
+			BindRules:   dev.BindRules,
+			Description: dev.Description,
+			Config:      configDirJson(dev.Config),
+		})
+	}
+	for _, rule := range config.Rules {
+		bundle.Rules = append(bundle.Rules, model.MRule{
+			UUID:        rule.UUID,
+			Name:        rule.Name,
+			Type:        rule.Type,
+			FromSource:  rule.FromSource,
+			FromDevice:  rule.FromDevice,
+			FromEvent:   rule.FromEvent,
+			Expression:  rule.Expression,
+			ToRules:     rule.ToRules,
+			ToTargets:   rule.ToTargets,
+			ToDevices:   rule.ToDevices,
+			DeviceCmd:   rule.DeviceCmd,
+			Actions:     rule.Actions,
+			Success:     rule.Success,
+			Failed:      rule.Failed,
+			Description: rule.Description,
+		})
+	}
+	for _, app := range config.Apps {
+		autoStart := app.AutoStart
+		bundle.Apps = append(bundle.Apps, model.MApp{
+			UUID:        app.UUID,
+			Name:        app.Name,
+			Version:     app.Version,
+			AutoStart:   &autoStart,
+			Filepath:    "./apps/" + app.UUID + ".lua",
+			Description: app.Description,
+		})
+	}
+	return bundle
+}
+
+// 去掉主键和创建时间以后的内容, 用来判断资源有没有变化
+func configRecordKey(record interface{}) string {
+	value := reflect.New(reflect.TypeOf(record)).Elem()
+	value.Set(reflect.ValueOf(record))
+	value.FieldByName("RulexModel").Set(reflect.ValueOf(model.RulexModel{}))
+	bytes, _ := json.Marshal(value.Interface())
+	return string(bytes)
+}
+
+func configRecordKeys(records interface{}) map[string]string {
+	keys := map[string]string{}
+	value := reflect.ValueOf(records)
+	for i := 0; i < value.Len(); i++ {
+		record := value.Index(i)
+		keys[record.FieldByName("UUID").String()] = configRecordKey(record.Interface())
+	}
+	return keys
+}
+
+/*
+*
+* 把配置目录同步到数据库和运行中的规则引擎: 只动有变化的资源, 没变化的资源不会重启;
+* load 为 false 的时候只写数据库, 启动的时候用, 后面按正常流程从数据库加载
+*
+ */
+func (hh *HttpApiServer) ApplyConfigDir(config *configdir.Config, load bool) (*configdir.Report, error) {
+	hh.bundleLocker.Lock()
+	defer hh.bundleLocker.Unlock()
+	report := newBundleImportReport(configdir.MODE, false)
+	desired := configDirBundle(config)
+	hh.validateBundle(desired, _BUNDLE_REPLACE, report)
+	if !report.Valid {
+		return nil, fmt.Errorf("invalid config directory: %s", strings.Join(report.Errors, "; "))
+	}
+	// 别的资源类型不归配置目录管
+	for resource := range report.Deleted {
+		if !utils.SContains(configdir.RESOURCES, resource) {
+			delete(report.Deleted, resource)
+		}
+	}
+	// 内容没变的资源不算更新
+	current := map[string]map[string]string{
+		"INEND":  configRecordKeys(hh.AllMInEnd()),
+		"OUTEND": configRecordKeys(hh.AllMOutEnd()),
+		"DEVICE": configRecordKeys(hh.AllDevices()),
+		"RULE":   configRecordKeys(hh.AllMRules()),
+		"APP":    configRecordKeys(hh.AllApp()),
+	}
+	wanted := map[string]map[string]string{
+		"INEND":  configRecordKeys(desired.InEnds),
+		"OUTEND": configRecordKeys(desired.OutEnds),
+		"DEVICE": configRecordKeys(desired.Devices),
+		"RULE":   configRecordKeys(desired.Rules),
+		"APP":    configRecordKeys(desired.Apps),
+	}
+	for resource, uuids := range report.Updated {
+		changed := []string{}
+		for _, uuid := range uuids {
+			if current[resource][uuid] != wanted[resource][uuid] {
+				changed = append(changed, uuid)
+				continue
+			}
+			if resource == "APP" {
+				script, _ := os.ReadFile("./apps/" + uuid + ".lua")
+				if !bytes.Equal(script, desired.scripts[uuid]) {
+					changed = append(changed, uuid)
+				}
+			}
+		}
+		if len(changed) == 0 {
+			delete(report.Updated, resource)
+		} else {
+			report.Updated[resource] = changed
+		}
+	}
+	// 规则变了, 绑定它的输入资源和设备也要重新加载
+	reload := map[string]bool{}
+	for _, resources := range []map[string][]string{report.Created, report.Updated} {
+		for _, uuids := range resources {
+			for _, uuid := range uuids {
+				reload[uuid] = true
+			}
+		}
+	}
+	changedRules := append(append([]string{}, report.Updated["RULE"]...), report.Deleted["RULE"]...)
+	for _, ruleId := range changedRules {
+		for _, in := range desired.InEnds {
+			if !reload[in.UUID] && utils.SContains(in.BindRules, ruleId) {
+				reload[in.UUID] = true
+			}
+		}
+		for _, dev := range desired.Devices {
+			if !reload[dev.UUID] && utils.SContains(dev.BindRules, ruleId) {
+				reload[dev.UUID] = true
+			}
+		}
+	}
+	if len(reload) == 0 && len(report.Deleted) == 0 {
+		return configDirReport(report), nil
+	}
+	changed := &configBundle{scripts: desired.scripts}
+	for _, in := range desired.InEnds {
+		if reload[in.UUID] {
+			changed.InEnds = append(changed.InEnds, in)
+		}
+	}
+	for _, out := range desired.OutEnds {
+		if reload[out.UUID] {
+			changed.OutEnds = append(changed.OutEnds, out)
+		}
+	}
+	for _, dev := range desired.Devices {
+		if reload[dev.UUID] {
+			changed.Devices = append(changed.Devices, dev)
+		}
+	}
+	for _, rule := range desired.Rules {
+		if reload[rule.UUID] {
+			changed.Rules = append(changed.Rules, rule)
+		}
+	}
+	for _, app := range desired.Apps {
+		if reload[app.UUID] {
+			changed.Apps = append(changed.Apps, app)
+		}
+	}
+	unload := changed.uuids()
+	for resource, uuids := range report.Deleted {
+		unload[resource] = append(unload[resource], uuids...)
+	}
+	hh.unloadBundleResources(unload)
+	if err := sqlitedao.Sqlite.DB().Transaction(func(tx *gorm.DB) error {
+		for _, m := range []struct {
+			resource string
+			model    interface{}
+		}{
+			{"INEND", &model.MInEnd{}},
+			{"OUTEND", &model.MOutEnd{}},
+			{"DEVICE", &model.MDevice{}},
+			{"RULE", &model.MRule{}},
+			{"APP", &model.MApp{}},
+		} {
+			for _, uuid := range unload[m.resource] {
+				if err := tx.Where("uuid=?", uuid).Delete(m.model).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for _, records := range []interface{}{changed.InEnds, changed.OutEnds, changed.Devices,
+			changed.Rules, changed.Apps} {
+			if err := insertBundleRecords(tx, records); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		report.errorf("save config error: %s", err)
+		return nil, err
+	}
+	if err := os.MkdirAll("./apps/", 0755); err != nil {
+		report.errorf("create apps directory error: %s", err)
+	}
+	for _, uuid := range report.Deleted["APP"] {
+		os.Remove("./apps/" + uuid + ".lua")
+	}
+	for _, app := range changed.Apps {
+		if err := os.WriteFile(app.Filepath, desired.scripts[app.UUID], 0644); err != nil {
+			report.errorf("write app [%s] script error: %s", app.UUID, err)
+		}
+	}
+	if load {
+		hh.loadBundle(changed, report)
+	}
+	return configDirReport(report), nil
+}
+
+func configDirReport(report *bundleImportReport) *configdir.Report {
+	return &configdir.Report{
+		Created:    report.Created,
+		Updated:    report.Updated,
+		Deleted:    report.Deleted,
+		LoadErrors: append(report.LoadErrors, report.Errors...),
+	}
+}
@@ -2,11 +2,13 @@ package httpserver
 
 import (
 	"errors"
+	"time"
 
 	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
 	"github.com/hootrhino/rulex/plugin/http_server/model"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // -----------------------------------------------------------------------------------
@@ -148,8 +150,28 @@ func (s *HttpApiServer) GetMUser(username string, password string) (*model.MUser
 	}
 }
 
-func (s *HttpApiServer) InsertMUser(o *model.MUser) {
-	sqlitedao.Sqlite.DB().Table("m_users").Create(o)
+func (s *HttpApiServer) GetMUserWithName(username string) (*model.MUser, error) {
+	m := new(model.MUser)
+	if err := sqlitedao.Sqlite.DB().Where("Username=?", username).First(m).Error; err != nil {
+		return nil, err
+	} else {
+		return m, nil
+	}
+}
+
+func (s *HttpApiServer) CountMUser() int64 {
+	var count int64
+	sqlitedao.Sqlite.DB().Model(&model.MUser{}).Count(&count)
+	return count
+}
+
+func (s *HttpApiServer) UpdateMUserPassword(id uint, password string) error {
+	return sqlitedao.Sqlite.DB().Model(&model.MUser{}).Where("id=?", id).
+		Update("password", password).Error
+}
+
+func (s *HttpApiServer) InsertMUser(o *model.MUser) error {
+	return sqlitedao.Sqlite.DB().Table("m_users").Create(o).Error
 }
 
 func (s *HttpApiServer) UpdateMUser(uuid string, o *model.MUser) error {
@@ -395,3 +417,295 @@ func (s *HttpApiServer) UpdateAiBase(AiBase *model.MAiBase) error {
 		return nil
 	}
 }
+
+// -------------------------------------------------------------------------------------
+// Audit Dao
+// -------------------------------------------------------------------------------------
+
+// 审计日志查询条件, 空的条件不过滤
+type auditFilter struct {
+	Username     string
+	Resource     string
+	ResourceUUID string
+	Start        time.Time
+	End          time.Time
+}
+
+func (f auditFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.Username != "" {
+		db = db.Where("username=?", f.Username)
+	}
+	if f.Resource != "" {
+		db = db.Where("resource=?", f.Resource)
+	}
+	if f.ResourceUUID != "" {
+		db = db.Where("resource_uuid=?", f.ResourceUUID)
+	}
+	if !f.Start.IsZero() {
+		db = db.Where("created_at>=?", f.Start)
+	}
+	if !f.End.IsZero() {
+		db = db.Where("created_at<?", f.End)
+	}
+	return db
+}
+
+func (s *HttpApiServer) InsertAuditLog(log *model.MAuditLog) error {
+	return sqlitedao.Sqlite.DB().Create(log).Error
+}
+
+// 分页查询审计日志, 新的在前面
+func (s *HttpApiServer) PageAuditLog(filter auditFilter, offset, limit int) ([]model.MAuditLog, int64) {
+	logs := []model.MAuditLog{}
+	var total int64
+	filter.apply(sqlitedao.Sqlite.DB().Model(&model.MAuditLog{})).Count(&total)
+	filter.apply(sqlitedao.Sqlite.DB()).Order("id desc").Offset(offset).Limit(limit).Find(&logs)
+	return logs, total
+}
+
+// 导出用, 按时间顺序
+func (s *HttpApiServer) AllAuditLog(filter auditFilter) []model.MAuditLog {
+	logs := []model.MAuditLog{}
+	filter.apply(sqlitedao.Sqlite.DB()).Order("id asc").Find(&logs)
+	return logs
+}
+
+// -------------------------------------------------------------------------------------
+// Alarm Dao
+// -------------------------------------------------------------------------------------
+
+func (s *HttpApiServer) GetMAlarmRuleWithUUID(uuid string) (*model.MAlarmRule, error) {
+	m := new(model.MAlarmRule)
+	return m, sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(m).Error
+}
+
+func (s *HttpApiServer) AllMAlarmRules() []model.MAlarmRule {
+	rules := []model.MAlarmRule{}
+	sqlitedao.Sqlite.DB().Find(&rules)
+	return rules
+}
+
+func (s *HttpApiServer) InsertMAlarmRule(r *model.MAlarmRule) error {
+	return sqlitedao.Sqlite.DB().Create(r).Error
+}
+
+// 所有字段都更新, 阈值和回差可以改成 0
+func (s *HttpApiServer) UpdateMAlarmRule(uuid string, r *model.MAlarmRule) error {
+	m := model.MAlarmRule{}
+	if err := sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(&m).Error; err != nil {
+		return err
+	}
+	r.ID = m.ID
+	r.CreatedAt = m.CreatedAt
+	r.UUID = m.UUID
+	return sqlitedao.Sqlite.DB().Save(r).Error
+}
+
+func (s *HttpApiServer) DeleteMAlarmRule(uuid string) error {
+	return sqlitedao.Sqlite.DB().Where("uuid=?", uuid).Delete(&model.MAlarmRule{}).Error
+}
+
+func (s *HttpApiServer) GetMAlarmWithUUID(uuid string) (*model.MAlarm, error) {
+	m := new(model.MAlarm)
+	return m, sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(m).Error
+}
+
+// 没有清除的报警
+func (s *HttpApiServer) ActiveMAlarms() []model.MAlarm {
+	alarms := []model.MAlarm{}
+	sqlitedao.Sqlite.DB().Where("state<>?", "CLEARED").Order("id asc").Find(&alarms)
+	return alarms
+}
+
+func (s *HttpApiServer) InsertMAlarm(m *model.MAlarm) error {
+	return sqlitedao.Sqlite.DB().Create(m).Error
+}
+
+func (s *HttpApiServer) SaveMAlarm(m *model.MAlarm) error {
+	return sqlitedao.Sqlite.DB().Save(m).Error
+}
+
+// 报警查询条件, 空的条件不过滤
+type alarmFilter struct {
+	States       []string
+	RuleUUID     string
+	ResourceUUID string
+	Severity     string
+}
+
+func (f alarmFilter) apply(db *gorm.DB) *gorm.DB {
+	if len(f.States) > 0 {
+		db = db.Where("state IN ?", f.States)
+	}
+	if f.RuleUUID != "" {
+		db = db.Where("rule_uuid=?", f.RuleUUID)
+	}
+	if f.ResourceUUID != "" {
+		db = db.Where("resource_uuid=?", f.ResourceUUID)
+	}
+	if f.Severity != "" {
+		db = db.Where("severity=?", f.Severity)
+	}
+	return db
+}
+
+// 分页查询报警, 新的在前面
+func (s *HttpApiServer) PageMAlarm(filter alarmFilter, offset, limit int) ([]model.MAlarm, int64) {
+	alarms := []model.MAlarm{}
+	var total int64
+	filter.apply(sqlitedao.Sqlite.DB().Model(&model.MAlarm{})).Count(&total)
+	filter.apply(sqlitedao.Sqlite.DB()).Order("id desc").Offset(offset).Limit(limit).Find(&alarms)
+	return alarms, total
+}
+
+// -------------------------------------------------------------------------------------
+// History Dao
+// -------------------------------------------------------------------------------------
+
+func (s *HttpApiServer) GetMHistoryTagWithUUID(uuid string) (*model.MHistoryTag, error) {
+	m := new(model.MHistoryTag)
+	return m, sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(m).Error
+}
+
+func (s *HttpApiServer) AllMHistoryTags() []model.MHistoryTag {
+	tags := []model.MHistoryTag{}
+	sqlitedao.Sqlite.DB().Find(&tags)
+	return tags
+}
+
+func (s *HttpApiServer) InsertMHistoryTag(m *model.MHistoryTag) error {
+	return sqlitedao.Sqlite.DB().Create(m).Error
+}
+
+func (s *HttpApiServer) UpdateMHistoryTag(uuid string, m *model.MHistoryTag) error {
+	old := model.MHistoryTag{}
+	if err := sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(&old).Error; err != nil {
+		return err
+	}
+	m.ID = old.ID
+	m.CreatedAt = old.CreatedAt
+	m.UUID = old.UUID
+	return sqlitedao.Sqlite.DB().Save(m).Error
+}
+
+func (s *HttpApiServer) DeleteMHistoryTag(uuid string) error {
+	return sqlitedao.Sqlite.DB().Where("uuid=?", uuid).Delete(&model.MHistoryTag{}).Error
+}
+
+/*
+*
+* 原始数据和统计一起入库; 统计是增量, 和库里同一个时间段的合并
+*
+ */
+func (s *HttpApiServer) SaveMHistory(points []model.MHistoryPoint, rollups []model.MHistoryRollup) error {
+	return sqlitedao.Sqlite.DB().Transaction(func(tx *gorm.DB) error {
+		if len(points) > 0 {
+			if err := tx.CreateInBatches(points, 500).Error; err != nil {
+				return err
+			}
+		}
+		if len(rollups) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "resource_uuid"}, {Name: "tag"}, {Name: "period"}, {Name: "ts"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"min_value": gorm.Expr("MIN(min_value, excluded.min_value)"),
+				"max_value": gorm.Expr("MAX(max_value, excluded.max_value)"),
+				"sum_value": gorm.Expr("sum_value + excluded.sum_value"),
+				"count":     gorm.Expr("count + excluded.count"),
+			}),
+		}).CreateInBatches(rollups, 500).Error
+	})
+}
+
+// 时间范围内的原始数据, 包括 from 和 to
+func (s *HttpApiServer) MHistoryPoints(resourceUUID, tag string, from, to int64, limit int) []model.MHistoryPoint {
+	points := []model.MHistoryPoint{}
+	sqlitedao.Sqlite.DB().
+		Where("resource_uuid=? AND tag=? AND ts>=? AND ts<=?", resourceUUID, tag, from, to).
+		Order("ts asc").Limit(limit).Find(&points)
+	return points
+}
+
+// 时间范围内开始的统计
+func (s *HttpApiServer) MHistoryRollups(resourceUUID, tag, period string, from, to int64) []model.MHistoryRollup {
+	rollups := []model.MHistoryRollup{}
+	sqlitedao.Sqlite.DB().
+		Where("resource_uuid=? AND tag=? AND period=? AND ts>=? AND ts<=?", resourceUUID, tag, period, from, to).
+		Order("ts asc").Find(&rollups)
+	return rollups
+}
+
+// 库里所有的点位, 每个点位都有小时统计, 从统计表查比原始数据快
+func (s *HttpApiServer) MHistorySeries() []model.MHistoryRollup {
+	series := []model.MHistoryRollup{}
+	sqlitedao.Sqlite.DB().Model(&model.MHistoryRollup{}).
+		Distinct("resource_uuid", "tag").Where("period=?", "1h").Find(&series)
+	return series
+}
+
+// 删除一个点位 pointTs 之前的原始数据和 rollupTs 之前的统计
+func (s *HttpApiServer) DeleteMHistoryBefore(resourceUUID, tag string, pointTs, rollupTs int64) error {
+	db := sqlitedao.Sqlite.DB()
+	if err := db.Where("resource_uuid=? AND tag=? AND ts<?", resourceUUID, tag, pointTs).
+		Delete(&model.MHistoryPoint{}).Error; err != nil {
+		return err
+	}
+	return db.Where("resource_uuid=? AND tag=? AND ts<?", resourceUUID, tag, rollupTs).
+		Delete(&model.MHistoryRollup{}).Error
+}
+
+// -------------------------------------------------------------------------------------
+// Shadow Dao
+// -------------------------------------------------------------------------------------
+
+func (s *HttpApiServer) GetMDeviceShadowWithUUID(uuid string) (*model.MDeviceShadow, error) {
+	m := new(model.MDeviceShadow)
+	return m, sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(m).Error
+}
+
+func (s *HttpApiServer) AllMDeviceShadows() []model.MDeviceShadow {
+	shadows := []model.MDeviceShadow{}
+	sqlitedao.Sqlite.DB().Find(&shadows)
+	return shadows
+}
+
+// 没有的时候新建
+func (s *HttpApiServer) SaveMDeviceShadow(uuid string, desired string) error {
+	m := model.MDeviceShadow{}
+	err := sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(&m).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	m.UUID = uuid
+	m.Desired = desired
+	return sqlitedao.Sqlite.DB().Save(&m).Error
+}
+
+func (s *HttpApiServer) DeleteMDeviceShadow(uuid string) error {
+	return sqlitedao.Sqlite.DB().Where("uuid=?", uuid).Delete(&model.MDeviceShadow{}).Error
+}
+
+// -------------------------------------------------------------------------------------
+// Certificate Dao
+// -------------------------------------------------------------------------------------
+
+func (s *HttpApiServer) GetMCertificateWithUUID(uuid string) (*model.MCertificate, error) {
+	m := new(model.MCertificate)
+	return m, sqlitedao.Sqlite.DB().Where("uuid=?", uuid).First(m).Error
+}
+
+func (s *HttpApiServer) AllMCertificates() []model.MCertificate {
+	certs := []model.MCertificate{}
+	sqlitedao.Sqlite.DB().Find(&certs)
+	return certs
+}
+
+func (s *HttpApiServer) InsertMCertificate(m *model.MCertificate) error {
+	return sqlitedao.Sqlite.DB().Create(m).Error
+}
+
+func (s *HttpApiServer) DeleteMCertificate(uuid string) error {
+	return sqlitedao.Sqlite.DB().Where("uuid=?", uuid).Delete(&model.MCertificate{}).Error
+}
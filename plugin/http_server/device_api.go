@@ -2,9 +2,12 @@ package httpserver
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
+	"github.com/hootrhino/rulex/glogger"
 	common "github.com/hootrhino/rulex/plugin/http_server/common"
 	"github.com/hootrhino/rulex/plugin/http_server/model"
 
@@ -141,6 +144,11 @@ func DeleteDevice(c *gin.Context, hs *HttpApiServer) {
 	}
 
 	hs.ruleEngine.RemoveDevice(uuid)
+	// 设备影子也删掉
+	if err := hs.DeleteMDeviceShadow(uuid); err != nil {
+		glogger.GLogger.Error(err)
+	}
+	hs.ruleEngine.GetDeviceShadow().Delete(uuid)
 	c.JSON(common.HTTP_OK, common.Ok())
 
 }
@@ -166,6 +174,7 @@ func CreateDevice(c *gin.Context, hs *HttpApiServer) {
 		return
 	}
 	newUUID := utils.DeviceUuid()
+	auditUUID(c, newUUID)
 	if err := hs.InsertDevice(&model.MDevice{
 		UUID:        newUUID,
 		Type:        form.Type,
@@ -248,12 +257,16 @@ func ModbusPoints(c *gin.Context, hs *HttpApiServer) {
 func UpdateModbusPoint(c *gin.Context, hs *HttpApiServer) {
 	type Form struct {
 		Id           uint
-		DeviceUuid   string `json:"deviceUuid"    gorm:"not null"`
-		Tag          string `json:"tag"           gorm:"not null"`
-		Function     int    `json:"function"      gorm:"not null"`
-		SlaverId     byte   `json:"slaverId"      gorm:"not null"`
-		StartAddress uint16 `json:"startAddress"  gorm:"not null"`
-		Quality      uint16 `json:"quality"       gorm:"not null"`
+		DeviceUuid   string  `json:"deviceUuid"    gorm:"not null"`
+		Tag          string  `json:"tag"           gorm:"not null"`
+		Function     int     `json:"function"      gorm:"not null"`
+		SlaverId     byte    `json:"slaverId"      gorm:"not null"`
+		StartAddress uint16  `json:"startAddress"  gorm:"not null"`
+		Quality      uint16  `json:"quality"       gorm:"not null"`
+		DataType     string  `json:"dataType"`
+		DataOrder    string  `json:"dataOrder"`
+		Weight       float64 `json:"weight"`
+		InitValue    float64 `json:"initValue"`
 	}
 
 	form := Form{}
@@ -272,6 +285,10 @@ func UpdateModbusPoint(c *gin.Context, hs *HttpApiServer) {
 		SlaverId:     form.SlaverId,
 		StartAddress: form.StartAddress,
 		Quality:      form.Quality,
+		DataType:     form.DataType,
+		DataOrder:    form.DataOrder,
+		Weight:       form.Weight,
+		InitValue:    form.InitValue,
 	})
 
 	if err != nil {
@@ -346,7 +363,11 @@ func parseModbusPointExcel(r io.Reader,
 		return nil, err
 	}
 	// 判断首行标头
-	// |Tag|Function|SlaverId|StartAddress|Quality|
+	// |Tag|Function|SlaverId|StartAddress|Quality|DataType|DataOrder|Weight|InitValue|
+	// 后面四列是可选的, 没有的时候只输出原始十六进制
+	if len(rows) < 1 || len(rows[0]) < 5 {
+		return nil, errors.New("表头不符合要求")
+	}
 	if rows[0][0] != "Tag" || rows[0][1] != "Function" || rows[0][2] != "SlaverId" || rows[0][3] != "StartAddress" || rows[0][4] != "Quality" {
 		return nil, errors.New("表头不符合要求")
 	}
@@ -358,7 +379,7 @@ func parseModbusPointExcel(r io.Reader,
 		function, _ := strconv.Atoi(row[1])
 		slaverId, _ := strconv.ParseInt(row[2], 10, 8)
 		address, _ := strconv.ParseUint(row[3], 10, 16)
-		quantity, _ := strconv.ParseUint(row[3], 10, 16)
+		quantity, _ := strconv.ParseUint(row[4], 10, 16)
 		model := model.MModbusPointPosition{
 			DeviceUuid:   deviceUuid,
 			Tag:          row[0],
@@ -367,6 +388,22 @@ func parseModbusPointExcel(r io.Reader,
 			StartAddress: uint16(address),
 			Quality:      uint16(quantity),
 		}
+		if len(row) > 5 {
+			model.DataType = strings.ToUpper(strings.TrimSpace(row[5]))
+		}
+		if len(row) > 6 {
+			model.DataOrder = strings.ToUpper(strings.TrimSpace(row[6]))
+		}
+		if len(row) > 7 && row[7] != "" {
+			if model.Weight, err = strconv.ParseFloat(row[7], 64); err != nil {
+				return nil, fmt.Errorf("第%d行权重系数错误:%s", i+1, row[7])
+			}
+		}
+		if len(row) > 8 && row[8] != "" {
+			if model.InitValue, err = strconv.ParseFloat(row[8], 64); err != nil {
+				return nil, fmt.Errorf("第%d行权重初始值错误:%s", i+1, row[8])
+			}
+		}
 		list = append(list, model)
 	}
 	return list, nil
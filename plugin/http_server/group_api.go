@@ -41,6 +41,7 @@ func CreateGroup(c *gin.Context, hh *HttpApiServer) {
 		Type:   vvo.Type,
 		Parent: "0",
 	}
+	auditUUID(c, Model.UUID)
 	if err := service.InsertGenericGroup(&Model); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
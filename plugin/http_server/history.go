@@ -0,0 +1,275 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 查询的聚合方式
+const (
+	HISTORY_RAW  string = "raw"  // 原始数据
+	HISTORY_1M   string = "1m"   // 每分钟统计
+	HISTORY_1H   string = "1h"   // 每小时统计
+	HISTORY_AUTO string = "auto" // 按时间范围自动选
+)
+
+// 统计的时间段长度, 毫秒
+var historyPeriods = map[string]int64{
+	HISTORY_1M: int64(time.Minute / time.Millisecond),
+	HISTORY_1H: int64(time.Hour / time.Millisecond),
+}
+
+// 所有点位
+const _HISTORY_ALL_TAGS = "*"
+
+// 默认保留天数
+const _HISTORY_DEFAULT_RETENTION = 7
+const _HISTORY_DEFAULT_ROLLUP_RETENTION = 90
+
+// 批量入库的间隔; 入库跟不上的时候缓冲区满了, 新数据丢弃
+const _HISTORY_FLUSH_INTERVAL = time.Second
+const _HISTORY_BUFFER_SIZE = 100000
+
+// 清理过期数据的间隔
+const _HISTORY_CLEAN_INTERVAL = 10 * time.Minute
+
+const _HISTORY_HOOK_NAME = "plugin.http_server.history"
+
+/*
+*
+* 历史数据: 通过 Hook 拿到设备和输入资源的数据, 配置了的点位的数值攒起来每秒入库一次,
+* 入库的时候顺便算每分钟和每小时的统计; 过期的数据定时清理
+*
+ */
+type historyStore struct {
+	sync.Mutex
+	hs      *HttpApiServer
+	tags    map[string]map[string]model.MHistoryTag // 资源 UUID -> 点位 -> 配置
+	buffer  []model.MHistoryPoint
+	dropped uint64
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newHistoryStore(hs *HttpApiServer) *historyStore {
+	return &historyStore{hs: hs, tags: map[string]map[string]model.MHistoryTag{}}
+}
+
+func (h *historyStore) Start() error {
+	h.reload()
+	if err := h.hs.ruleEngine.LoadHook(h); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(typex.GCTX)
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		flush := time.NewTicker(_HISTORY_FLUSH_INTERVAL)
+		defer flush.Stop()
+		clean := time.NewTicker(_HISTORY_CLEAN_INTERVAL)
+		defer clean.Stop()
+		h.clean()
+		for {
+			select {
+			case <-ctx.Done():
+				h.flush()
+				return
+			case <-flush.C:
+				h.flush()
+			case <-clean.C:
+				h.clean()
+			}
+		}
+	}()
+	return nil
+}
+
+// 停止之前把缓冲区里的数据入库
+func (h *historyStore) Stop() {
+	h.hs.ruleEngine.RemoveHook(_HISTORY_HOOK_NAME)
+	if h.cancel != nil {
+		h.cancel()
+		<-h.done
+	}
+}
+
+// 点位配置修改以后重新加载
+func (h *historyStore) reload() {
+	tags := map[string]map[string]model.MHistoryTag{}
+	for _, tag := range h.hs.AllMHistoryTags() {
+		if tags[tag.ResourceUUID] == nil {
+			tags[tag.ResourceUUID] = map[string]model.MHistoryTag{}
+		}
+		tags[tag.ResourceUUID][tag.Tag] = tag
+	}
+	h.Lock()
+	h.tags = tags
+	h.Unlock()
+}
+
+// 点位的保留天数: 单独配置的优先, 然后是 *, 都没有的时候用默认的
+func (h *historyStore) retention(resourceUUID, tag string) (int, int) {
+	h.Lock()
+	defer h.Unlock()
+	retention, rollupRetention := _HISTORY_DEFAULT_RETENTION, _HISTORY_DEFAULT_ROLLUP_RETENTION
+	config, ok := h.tags[resourceUUID][tag]
+	if !ok {
+		config, ok = h.tags[resourceUUID][_HISTORY_ALL_TAGS]
+	}
+	if ok {
+		if config.Retention > 0 {
+			retention = config.Retention
+		}
+		if config.RollupRetention > 0 {
+			rollupRetention = config.RollupRetention
+		}
+	}
+	return retention, rollupRetention
+}
+
+//--------------------------------------------------------------------------------------------------
+// Hook
+//--------------------------------------------------------------------------------------------------
+
+func (h *historyStore) Name() string {
+	return _HISTORY_HOOK_NAME
+}
+
+func (h *historyStore) Work(data string) error {
+	return nil
+}
+
+func (h *historyStore) Error(err error) {
+	glogger.GLogger.Error("History hook error:", err)
+}
+
+func (h *historyStore) WorkDevice(Device *typex.Device, data string) error {
+	h.record(Device.UUID, data)
+	return nil
+}
+
+func (h *historyStore) WorkInEnd(in *typex.InEnd, data string) error {
+	h.record(in.UUID, data)
+	return nil
+}
+
+/*
+*
+* 记下配置了的点位的数值, 这里在数据通道上, 只放进缓冲区, 不入库
+*
+ */
+func (h *historyStore) record(resourceUUID string, data string) {
+	h.Lock()
+	configs := h.tags[resourceUUID]
+	h.Unlock()
+	if len(configs) == 0 {
+		return
+	}
+	tags := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		return
+	}
+	_, allTags := configs[_HISTORY_ALL_TAGS]
+	ts := time.Now().UnixMilli()
+	h.Lock()
+	defer h.Unlock()
+	for tag, value := range tags {
+		if _, ok := configs[tag]; !ok && !allTags {
+			continue
+		}
+		number, ok := tagNumber(value)
+		if !ok {
+			continue
+		}
+		if len(h.buffer) >= _HISTORY_BUFFER_SIZE {
+			h.dropped++
+			continue
+		}
+		h.buffer = append(h.buffer, model.MHistoryPoint{
+			ResourceUUID: resourceUUID,
+			Tag:          tag,
+			Ts:           ts,
+			Value:        number,
+		})
+	}
+}
+
+type historyRollupKey struct {
+	resourceUUID string
+	tag          string
+	period       string
+	ts           int64
+}
+
+// 一批原始数据按分钟和小时合并成统计
+func historyRollups(points []model.MHistoryPoint) []model.MHistoryRollup {
+	rollups := map[historyRollupKey]*model.MHistoryRollup{}
+	keys := []historyRollupKey{}
+	for _, point := range points {
+		for period, length := range historyPeriods {
+			key := historyRollupKey{point.ResourceUUID, point.Tag, period, point.Ts - point.Ts%length}
+			rollup, ok := rollups[key]
+			if !ok {
+				rollup = &model.MHistoryRollup{
+					ResourceUUID: key.resourceUUID,
+					Tag:          key.tag,
+					Period:       key.period,
+					Ts:           key.ts,
+					MinValue:     point.Value,
+					MaxValue:     point.Value,
+				}
+				rollups[key] = rollup
+				keys = append(keys, key)
+			}
+			if point.Value < rollup.MinValue {
+				rollup.MinValue = point.Value
+			}
+			if point.Value > rollup.MaxValue {
+				rollup.MaxValue = point.Value
+			}
+			rollup.SumValue += point.Value
+			rollup.Count++
+		}
+	}
+	result := make([]model.MHistoryRollup, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *rollups[key])
+	}
+	return result
+}
+
+func (h *historyStore) flush() {
+	h.Lock()
+	points, dropped := h.buffer, h.dropped
+	h.buffer, h.dropped = nil, 0
+	h.Unlock()
+	if dropped > 0 {
+		glogger.GLogger.Warnf("History buffer full, %d points dropped", dropped)
+	}
+	if len(points) == 0 {
+		return
+	}
+	if err := h.hs.SaveMHistory(points, historyRollups(points)); err != nil {
+		glogger.GLogger.Error("Save history error:", err)
+	}
+}
+
+// 清理过期的原始数据和统计
+func (h *historyStore) clean() {
+	now := time.Now()
+	for _, series := range h.hs.MHistorySeries() {
+		retention, rollupRetention := h.retention(series.ResourceUUID, series.Tag)
+		pointTs := now.AddDate(0, 0, -retention).UnixMilli()
+		rollupTs := now.AddDate(0, 0, -rollupRetention).UnixMilli()
+		if err := h.hs.DeleteMHistoryBefore(series.ResourceUUID, series.Tag, pointTs, rollupTs); err != nil {
+			glogger.GLogger.Error("Clean history error:", err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package httpserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/utils"
+)
+
+// 一次最多返回多少个原始数据, 多了要用统计
+const _HISTORY_MAX_POINTS = 10000
+
+type historyTagVo struct {
+	UUID            string `json:"uuid"`
+	ResourceUUID    string `json:"resourceUuid"`
+	Tag             string `json:"tag"`
+	Retention       int    `json:"retention"`
+	RollupRetention int    `json:"rollupRetention"`
+	Description     string `json:"description"`
+}
+
+func toHistoryTagVo(tag model.MHistoryTag) historyTagVo {
+	return historyTagVo{
+		UUID:            tag.UUID,
+		ResourceUUID:    tag.ResourceUUID,
+		Tag:             tag.Tag,
+		Retention:       tag.Retention,
+		RollupRetention: tag.RollupRetention,
+		Description:     tag.Description,
+	}
+}
+
+type historyTagForm struct {
+	UUID            string `json:"uuid"`
+	ResourceUUID    string `json:"resourceUuid" binding:"required"`
+	Tag             string `json:"tag" binding:"required"`
+	Retention       int    `json:"retention"`
+	RollupRetention int    `json:"rollupRetention"`
+	Description     string `json:"description"`
+}
+
+func (form historyTagForm) toModel() *model.MHistoryTag {
+	tag := &model.MHistoryTag{
+		UUID:            form.UUID,
+		ResourceUUID:    form.ResourceUUID,
+		Tag:             form.Tag,
+		Retention:       form.Retention,
+		RollupRetention: form.RollupRetention,
+		Description:     form.Description,
+	}
+	if tag.Retention == 0 {
+		tag.Retention = _HISTORY_DEFAULT_RETENTION
+	}
+	if tag.RollupRetention == 0 {
+		tag.RollupRetention = _HISTORY_DEFAULT_ROLLUP_RETENTION
+	}
+	return tag
+}
+
+/*
+*
+* 检查点位配置: 资源要存在, 同一个资源的同一个点位只能配置一次
+*
+ */
+func (hh *HttpApiServer) checkHistoryTag(tag *model.MHistoryTag) error {
+	if tag.Retention < 0 || tag.RollupRetention < 0 {
+		return fmt.Errorf("retention can not be negative")
+	}
+	if hh.ruleEngine.GetDevice(tag.ResourceUUID) == nil && hh.ruleEngine.GetInEnd(tag.ResourceUUID) == nil {
+		return fmt.Errorf("device or inend not exists: %s", tag.ResourceUUID)
+	}
+	for _, old := range hh.AllMHistoryTags() {
+		if old.UUID != tag.UUID && old.ResourceUUID == tag.ResourceUUID && old.Tag == tag.Tag {
+			return fmt.Errorf("tag already recorded: %s", tag.Tag)
+		}
+	}
+	return nil
+}
+
+func HistoryTags(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if uuid == "" {
+		tags := []historyTagVo{}
+		for _, tag := range hh.AllMHistoryTags() {
+			tags = append(tags, toHistoryTagVo(tag))
+		}
+		c.JSON(common.HTTP_OK, common.OkWithData(tags))
+		return
+	}
+	tag, err := hh.GetMHistoryTagWithUUID(uuid)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400EmptyObj(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(toHistoryTagVo(*tag)))
+}
+
+func CreateHistoryTag(c *gin.Context, hh *HttpApiServer) {
+	form := historyTagForm{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	tag := form.toModel()
+	tag.UUID = utils.MakeUUID("HISTAG")
+	if err := hh.checkHistoryTag(tag); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.InsertMHistoryTag(tag); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	auditUUID(c, tag.UUID)
+	hh.history.reload()
+	c.JSON(common.HTTP_OK, common.OkWithData(tag.UUID))
+}
+
+func UpdateHistoryTag(c *gin.Context, hh *HttpApiServer) {
+	form := historyTagForm{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if _, err := hh.GetMHistoryTagWithUUID(form.UUID); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	tag := form.toModel()
+	if err := hh.checkHistoryTag(tag); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.UpdateMHistoryTag(form.UUID, tag); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	hh.history.reload()
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+// 删除以后不再记录, 已经记录的数据按默认的保留天数过期
+func DeleteHistoryTag(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if _, err := hh.GetMHistoryTagWithUUID(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if err := hh.DeleteMHistoryTag(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	hh.history.reload()
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+// 时间参数: 毫秒时间戳或者 RFC3339
+func parseHistoryTime(value string, defaultTime time.Time) (int64, error) {
+	if value == "" {
+		return defaultTime.UnixMilli(), nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time, must be milliseconds or RFC3339: %s", value)
+	}
+	return t.UnixMilli(), nil
+}
+
+// 自动选聚合方式: 1 小时以内原始数据, 2 天以内每分钟, 再长每小时
+func autoHistoryAgg(from, to int64) string {
+	length := time.Duration(to-from) * time.Millisecond
+	if length <= time.Hour {
+		return HISTORY_RAW
+	}
+	if length <= 48*time.Hour {
+		return HISTORY_1M
+	}
+	return HISTORY_1H
+}
+
+/*
+*
+* 查询历史数据: device 是设备或者输入资源的 UUID; from 和 to 是毫秒时间戳或者 RFC3339,
+* 默认最近 1 小时; agg 是 raw 1m 1h auto, 默认 auto
+*
+ */
+func History(c *gin.Context, hh *HttpApiServer) {
+	device := c.Query("device")
+	tag := c.Query("tag")
+	if device == "" || tag == "" {
+		c.JSON(common.HTTP_OK, common.Error("device and tag are required"))
+		return
+	}
+	now := time.Now()
+	to, err := parseHistoryTime(c.Query("to"), now)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	from, err := parseHistoryTime(c.Query("from"), time.UnixMilli(to).Add(-time.Hour))
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if from > to {
+		c.JSON(common.HTTP_OK, common.Error("from can not be later than to"))
+		return
+	}
+	agg := c.DefaultQuery("agg", HISTORY_AUTO)
+	if agg == HISTORY_AUTO {
+		agg = autoHistoryAgg(from, to)
+	}
+	result := map[string]interface{}{
+		"device": device,
+		"tag":    tag,
+		"agg":    agg,
+		"from":   from,
+		"to":     to,
+	}
+	if agg == HISTORY_RAW {
+		points := []map[string]interface{}{}
+		records := hh.MHistoryPoints(device, tag, from, to, _HISTORY_MAX_POINTS+1)
+		result["truncated"] = len(records) > _HISTORY_MAX_POINTS
+		for i, point := range records {
+			if i == _HISTORY_MAX_POINTS {
+				break
+			}
+			points = append(points, map[string]interface{}{"time": point.Ts, "value": point.Value})
+		}
+		result["points"] = points
+		c.JSON(common.HTTP_OK, common.OkWithData(result))
+		return
+	}
+	length, ok := historyPeriods[agg]
+	if !ok {
+		c.JSON(common.HTTP_OK, common.Error("agg must one of 'raw', '1m', '1h' or 'auto': "+agg))
+		return
+	}
+	points := []map[string]interface{}{}
+	// 包含 from 的那个时间段也要
+	for _, rollup := range hh.MHistoryRollups(device, tag, agg, from-from%length, to) {
+		points = append(points, map[string]interface{}{
+			"time":  rollup.Ts,
+			"min":   rollup.MinValue,
+			"max":   rollup.MaxValue,
+			"avg":   rollup.SumValue / float64(rollup.Count),
+			"count": rollup.Count,
+		})
+	}
+	result["points"] = points
+	c.JSON(common.HTTP_OK, common.OkWithData(result))
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	common "github.com/hootrhino/rulex/plugin/http_server/common"
@@ -33,16 +34,26 @@ const _DEFAULT_DB_PATH string = "./rulex.db"
 var StartedTime = time.Unix(time.Now().Unix(), 0).Format("2006-01-02 15:04:05")
 
 type _serverConfig struct {
-	Enable bool   `ini:"enable"`
-	Host   string `ini:"host"`
-	DbPath string `ini:"dbpath"`
-	Port   int    `ini:"port"`
+	Enable    bool   `ini:"enable"`
+	Host      string `ini:"host"`
+	DbPath    string `ini:"dbpath"`
+	Port      int    `ini:"port"`
+	JwtSecret string `ini:"jwtsecret"`
+	CertPath  string `ini:"certpath"`
+	Auth      bool   `ini:"auth"` // 关掉以后接口不鉴权, 只能在测试或者内网调试的时候用
 }
 type HttpApiServer struct {
 	uuid       string
 	ginEngine  *gin.Engine
 	ruleEngine typex.RuleX
 	mainConfig _serverConfig
+	jwtSecret  []byte
+	alarms     *alarmEngine
+	history    *historyStore
+	// 创建用户的时候检查和插入要一起做, 防止同时创建出两个"第一个管理员"
+	userLocker sync.Mutex
+	// 配置目录同步和配置包导入都会整批替换资源, 不能同时跑
+	bundleLocker sync.Mutex
 }
 
 /*
@@ -65,6 +76,14 @@ func (s *HttpApiServer) registerModel() {
 		&model.MGenericGroup{},
 		&model.MGenericGroupRelation{},
 		&model.MProtocolApp{},
+		&model.MAuditLog{},
+		&model.MAlarmRule{},
+		&model.MAlarm{},
+		&model.MHistoryTag{},
+		&model.MHistoryPoint{},
+		&model.MHistoryRollup{},
+		&model.MDeviceShadow{},
+		&model.MCertificate{},
 	)
 }
 
@@ -81,9 +100,19 @@ var err1crash = errors.New("http server crash, try to recovery")
 func (hs *HttpApiServer) Init(config *ini.Section) error {
 	gin.SetMode(gin.ReleaseMode)
 	hs.ginEngine = gin.New()
+	// 没有配置的时候默认开启鉴权
+	hs.mainConfig.Auth = true
 	if err := utils.InIMapToStruct(config, &hs.mainConfig); err != nil {
 		return err
 	}
+	if !hs.mainConfig.Auth {
+		glogger.GLogger.Warn("Http server authorization disabled, all api can be called without token")
+	}
+	if hs.mainConfig.JwtSecret == "" {
+		hs.jwtSecret = randomSecret()
+	} else {
+		hs.jwtSecret = []byte(hs.mainConfig.JwtSecret)
+	}
 	if hs.mainConfig.DbPath == "" {
 		sqlitedao.Load(_DEFAULT_DB_PATH)
 
@@ -91,6 +120,8 @@ func (hs *HttpApiServer) Init(config *ini.Section) error {
 		sqlitedao.Load(hs.mainConfig.DbPath)
 	}
 	hs.registerModel()
+	// 资源加载之前把证书文件准备好
+	hs.restoreCertificates()
 	hs.configHttpServer()
 	//
 	// WebSocket server
@@ -160,6 +191,16 @@ func (hs *HttpApiServer) LoadRoute() {
 	hs.ginEngine.GET(url("users/detail"), hs.addRoute(UserDetail))
 	hs.ginEngine.POST(url("users"), hs.addRoute(CreateUser))
 	//
+	// 审计日志
+	//
+	hs.ginEngine.GET(url("audit"), hs.addRoute(AuditLogs))
+	hs.ginEngine.GET(url("audit/export"), hs.addRoute(ExportAuditLogs))
+	//
+	// 配置包导出导入
+	//
+	hs.ginEngine.GET(url("bundle/export"), hs.addRoute(ExportBundle))
+	hs.ginEngine.POST(url("bundle/import"), hs.addRoute(ImportBundle))
+	//
 	//
 	//
 	hs.ginEngine.POST(url("login"), hs.addRoute(Login))
@@ -217,6 +258,41 @@ func (hs *HttpApiServer) LoadRoute() {
 	// Delete outEnd by UUID
 	//
 	hs.ginEngine.DELETE(url("outends"), hs.addRoute(DeleteOutEnd))
+	//
+	// 重启资源, 查看资源的生命周期事件
+	//
+	hs.ginEngine.PUT(url("inends/restart"), hs.addRoute(RestartInEnd))
+	hs.ginEngine.PUT(url("outends/restart"), hs.addRoute(RestartOutEnd))
+	hs.ginEngine.GET(url("lifecycle"), hs.addRoute(LifecycleEvents))
+	//
+	// 报警
+	//
+	hs.ginEngine.GET(url("alarms/rules"), hs.addRoute(AlarmRules))
+	hs.ginEngine.POST(url("alarms/rules"), hs.addRoute(CreateAlarmRule))
+	hs.ginEngine.PUT(url("alarms/rules"), hs.addRoute(UpdateAlarmRule))
+	hs.ginEngine.DELETE(url("alarms/rules"), hs.addRoute(DeleteAlarmRule))
+	hs.ginEngine.GET(url("alarms"), hs.addRoute(Alarms))
+	hs.ginEngine.PUT(url("alarms/ack"), hs.addRoute(AckAlarm))
+	hs.ginEngine.PUT(url("alarms/shelve"), hs.addRoute(ShelveAlarm))
+	//
+	// 历史数据
+	//
+	hs.ginEngine.GET(url("history/tags"), hs.addRoute(HistoryTags))
+	hs.ginEngine.POST(url("history/tags"), hs.addRoute(CreateHistoryTag))
+	hs.ginEngine.PUT(url("history/tags"), hs.addRoute(UpdateHistoryTag))
+	hs.ginEngine.DELETE(url("history/tags"), hs.addRoute(DeleteHistoryTag))
+	hs.ginEngine.GET(url("history"), hs.addRoute(History))
+	//
+	// 设备影子
+	//
+	hs.ginEngine.GET(url("shadows"), hs.addRoute(Shadows))
+	hs.ginEngine.PUT(url("shadows/desired"), hs.addRoute(SetShadowDesired))
+	//
+	// 证书
+	//
+	hs.ginEngine.GET(url("certs"), hs.addRoute(Certificates))
+	hs.ginEngine.POST(url("certs"), hs.addRoute(UploadCertificate))
+	hs.ginEngine.DELETE(url("certs"), hs.addRoute(DeleteCertificate))
 
 	//
 	// 验证 lua 语法
@@ -248,6 +324,7 @@ func (hs *HttpApiServer) LoadRoute() {
 	hs.ginEngine.POST(url("devices"), hs.addRoute(CreateDevice))
 	hs.ginEngine.PUT(url("devices"), hs.addRoute(UpdateDevice))
 	hs.ginEngine.DELETE(url("devices"), hs.addRoute(DeleteDevice))
+	hs.ginEngine.PUT(url("devices/restart"), hs.addRoute(RestartDevice))
 	hs.ginEngine.POST(url("devices/modbus/sheetImport"), hs.addRoute(ModbusSheetImport))
 	hs.ginEngine.PUT(url("devices/modbus/point"), hs.addRoute(UpdateModbusPoint))
 	hs.ginEngine.GET(url("devices/modbus"), hs.addRoute(ModbusPoints))
@@ -332,12 +409,27 @@ func (hs *HttpApiServer) LoadRoute() {
 // HttpApiServer Start
 func (hs *HttpApiServer) Start(r typex.RuleX) error {
 	hs.ruleEngine = r
+	hs.alarms = newAlarmEngine(hs)
+	if err := hs.alarms.Start(); err != nil {
+		return err
+	}
+	hs.history = newHistoryStore(hs)
+	if err := hs.history.Start(); err != nil {
+		return err
+	}
+	hs.loadShadows()
 	hs.LoadRoute()
 	glogger.GLogger.Infof("Http server started on :%v", hs.mainConfig.Port)
 	return nil
 }
 
 func (hs *HttpApiServer) Stop() error {
+	if hs.alarms != nil {
+		hs.alarms.Stop()
+	}
+	if hs.history != nil {
+		hs.history.Stop()
+	}
 	return nil
 }
 
@@ -369,15 +461,11 @@ func (hs *HttpApiServer) addRoute(f func(*gin.Context, *HttpApiServer)) func(*gi
 		f(c, hs)
 	}
 }
-func (hs *HttpApiServer) Authorize() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Next()
-	}
-}
-
 func (hs *HttpApiServer) configHttpServer() {
-	hs.ginEngine.Use(hs.Authorize())
+	// 跨域的预检请求不带 Token, 所以鉴权要放在后面
 	hs.ginEngine.Use(common.Cros())
+	hs.ginEngine.Use(hs.Authorize())
+	hs.ginEngine.Use(hs.Audit())
 	hs.ginEngine.Use(static.Serve("/", WWWRoot("")))
 	hs.ginEngine.Use(gin.CustomRecovery(func(c *gin.Context, err any) {
 		glogger.GLogger.Error(err)
@@ -27,7 +27,7 @@ func InEndDetail(c *gin.Context, hs *HttpApiServer) {
 			Config:      Model.GetConfig(),
 			State:       typex.SOURCE_STOP,
 		}
-		c.JSON(common.HTTP_OK, common.OkWithData(tmpInEnd))
+		c.JSON(common.HTTP_OK, common.OkWithData(&tmpInEnd))
 		return
 	}
 	inEnd.State = inEnd.Source.Status()
@@ -38,7 +38,7 @@ func InEndDetail(c *gin.Context, hs *HttpApiServer) {
 func InEnds(c *gin.Context, hs *HttpApiServer) {
 	uuid, _ := c.GetQuery("uuid")
 	if uuid == "" {
-		inEnds := []typex.InEnd{}
+		inEnds := []*typex.InEnd{}
 		for _, v := range hs.AllMInEnd() {
 			var inEnd *typex.InEnd
 			if inEnd = hs.ruleEngine.GetInEnd(v.UUID); inEnd == nil {
@@ -51,11 +51,11 @@ func InEnds(c *gin.Context, hs *HttpApiServer) {
 					Config:      v.GetConfig(),
 					State:       typex.SOURCE_STOP,
 				}
-				inEnds = append(inEnds, tmpInEnd)
+				inEnds = append(inEnds, &tmpInEnd)
 			}
 			if inEnd != nil {
 				inEnd.State = inEnd.Source.Status()
-				inEnds = append(inEnds, *inEnd)
+				inEnds = append(inEnds, inEnd)
 			}
 		}
 		c.JSON(common.HTTP_OK, common.OkWithData(inEnds))
@@ -77,7 +77,7 @@ func InEnds(c *gin.Context, hs *HttpApiServer) {
 			Config:      Model.GetConfig(),
 			State:       typex.SOURCE_STOP,
 		}
-		c.JSON(common.HTTP_OK, common.OkWithData(tmpInEnd))
+		c.JSON(common.HTTP_OK, common.OkWithData(&tmpInEnd))
 		return
 	}
 	inEnd.State = inEnd.Source.Status()
@@ -107,6 +107,7 @@ func CreateInend(c *gin.Context, hh *HttpApiServer) {
 	}
 
 	newUUID := utils.InUuid()
+	auditUUID(c, newUUID)
 
 	if err := hh.InsertMInEnd(&model.MInEnd{
 		UUID:        newUUID,
@@ -0,0 +1,57 @@
+package httpserver
+
+import (
+	"github.com/gin-gonic/gin"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+)
+
+/*
+*
+* 重启输入资源
+*
+ */
+func RestartInEnd(c *gin.Context, hs *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if err := hs.ruleEngine.RestartInEnd(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+/*
+*
+* 重启输出资源
+*
+ */
+func RestartOutEnd(c *gin.Context, hs *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if err := hs.ruleEngine.RestartOutEnd(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+/*
+*
+* 重启设备
+*
+ */
+func RestartDevice(c *gin.Context, hs *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if err := hs.ruleEngine.RestartDevice(uuid); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.Ok())
+}
+
+/*
+*
+* 资源生命周期事件(启动, 失败, 重启, 放弃重启), 新的在前面; uuid 为空的时候返回所有资源的
+*
+ */
+func LifecycleEvents(c *gin.Context, hs *HttpApiServer) {
+	c.JSON(common.HTTP_OK, common.OkWithData(hs.ruleEngine.LifecycleEvents(c.Query("uuid"))))
+}
@@ -29,7 +29,16 @@ func (f stringList) Value() (driver.Value, error) {
 *
  */
 func (f *stringList) Scan(data interface{}) error {
-	return json.Unmarshal([]byte(data.(string)), f)
+	switch v := data.(type) {
+	case nil:
+		// 后来新增的字段, 旧数据是 NULL
+		*f = stringList{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, f)
+	default:
+		return json.Unmarshal([]byte(data.(string)), f)
+	}
 }
 
 func (f stringList) String() string {
@@ -47,7 +56,12 @@ type MRule struct {
 	Type        string     // 脚本类型，目前支持"lua"和"expr"两种
 	FromSource  stringList `gorm:"not null type:string[]"`
 	FromDevice  stringList `gorm:"not null type:string[]"`
+	FromEvent   stringList // 绑定的事件类型
 	Expression  string     `gorm:"not null"` // Expr脚本
+	ToRules     stringList // 规则输出交给的下游规则
+	ToTargets   stringList // 规则输出转发的目标
+	ToDevices   stringList // 规则输出写入的设备
+	DeviceCmd   string     // 写设备的指令
 	Actions     string     `gorm:"not null"`
 	Success     string     `gorm:"not null"`
 	Failed      string     `gorm:"not null"`
@@ -169,12 +183,16 @@ type MAiBase struct {
 // MModbusPointPosition modbus数据点位
 type MModbusPointPosition struct {
 	RulexModel
-	DeviceUuid   string `json:"deviceUuid"    gorm:"not null"`
-	Tag          string `json:"tag"           gorm:"not null"`
-	Function     int    `json:"function"      gorm:"not null"`
-	SlaverId     byte   `json:"slaverId"      gorm:"not null"`
-	StartAddress uint16 `json:"startAddress"  gorm:"not null"`
-	Quality      uint16 `json:"quality"       gorm:"not null"`
+	DeviceUuid   string  `json:"deviceUuid"    gorm:"not null"`
+	Tag          string  `json:"tag"           gorm:"not null"`
+	Function     int     `json:"function"      gorm:"not null"`
+	SlaverId     byte    `json:"slaverId"      gorm:"not null"`
+	StartAddress uint16  `json:"startAddress"  gorm:"not null"`
+	Quality      uint16  `json:"quality"       gorm:"not null"`
+	DataType     string  `json:"dataType"`  // 数据类型, 为空只输出原始十六进制
+	DataOrder    string  `json:"dataOrder"` // 字节序: ABCD/BADC/CDAB/DCBA
+	Weight       float64 `json:"weight"`    // 权重系数
+	InitValue    float64 `json:"initValue"` // 权重初始值
 }
 
 //--------------------------------------------------------------------------------------------------
@@ -230,3 +248,122 @@ type MProtocolApp struct {
 	Type    string `gorm:"not null"` // 类型: IN OUT DEVICE APP
 	Content string `gorm:"not null"` // 协议包的内容
 }
+
+/*
+*
+* 审计日志: 通过接口做的每一次修改
+*
+ */
+type MAuditLog struct {
+	RulexModel
+	Username     string // 操作人
+	Role         string // 操作人的角色
+	ClientIP     string // 来源地址
+	Method       string `gorm:"not null"` // HTTP 方法
+	Endpoint     string `gorm:"not null"` // 接口路径
+	Resource     string // 资源类型: INEND OUTEND DEVICE RULE APP GOODS ...
+	ResourceUUID string `gorm:"index"` // 资源 UUID
+	Code         int    // 接口返回的 code, 200 表示成功
+	Message      string // 接口返回的 msg
+	Before       string // 修改前的资源 JSON
+	After        string // 修改后的资源 JSON
+	Diff         string // 有变化的字段: {"字段": {"before": 旧值, "after": 新值}}
+}
+
+/*
+*
+* 报警规则: 监视某个设备或者输入资源上报数据里的一个点位
+*
+ */
+type MAlarmRule struct {
+	RulexModel
+	UUID         string     `gorm:"not null"`
+	Name         string     `gorm:"not null"`
+	ResourceUUID string     `gorm:"not null"` // 设备或者输入资源的 UUID
+	Tag          string     `gorm:"not null"` // 点位, 数据 JSON 顶层的字段
+	Condition    string     `gorm:"not null"` // HIGH LOW RATE STALE
+	Threshold    float64    // 阈值, RATE 是每秒的变化量, STALE 是多少秒没有数据
+	Deadband     float64    // 回差, 报警以后越过阈值再回退这么多才清除
+	Delay        int        // 条件持续多少毫秒以后才报警
+	Severity     string     `gorm:"not null"` // CRITICAL MAJOR MINOR WARNING
+	Targets      stringList // 报警通知发到这些 OutEnd
+	ShelvedUntil time.Time  // 搁置到什么时候, 搁置期间不产生新报警, 也不发通知
+	Description  string
+}
+
+/*
+*
+* 报警: ACTIVE -> ACKED -> CLEARED, 没有确认也可以直接清除; 清除以后就是历史记录
+*
+ */
+type MAlarm struct {
+	RulexModel
+	UUID         string  `gorm:"not null"`
+	RuleUUID     string  `gorm:"index"`
+	Name         string  // 报警规则的名称
+	ResourceUUID string  `gorm:"index"`
+	Tag          string  //
+	Condition    string  //
+	Severity     string  //
+	State        string  `gorm:"index"` // ACTIVE ACKED CLEARED
+	Value        float64 // 报警的时候的值
+	Message      string  //
+	AckedAt      *time.Time
+	AckedBy      string
+	ClearedAt    *time.Time
+}
+
+/*
+*
+* 历史数据点位: 记录设备或者输入资源上报的一个点位, Tag 是 * 的时候记录这个资源所有的数值点位,
+* 单独配置的点位优先
+*
+ */
+type MHistoryTag struct {
+	RulexModel
+	UUID            string `gorm:"not null"`
+	ResourceUUID    string `gorm:"not null"` // 设备或者输入资源的 UUID
+	Tag             string `gorm:"not null"` // 点位, 数据 JSON 顶层的字段; * 表示所有点位
+	Retention       int    // 原始数据保留天数
+	RollupRetention int    // 分钟和小时统计保留天数
+	Description     string
+}
+
+// 历史数据原始值, 时间是毫秒时间戳
+type MHistoryPoint struct {
+	ID           uint    `gorm:"primarykey"`
+	ResourceUUID string  `gorm:"not null;index:idx_history_point,priority:1"`
+	Tag          string  `gorm:"not null;index:idx_history_point,priority:2"`
+	Ts           int64   `gorm:"not null;index:idx_history_point,priority:3"`
+	Value        float64 //
+}
+
+// 历史数据统计: 每分钟(1m)和每小时(1h)的最小, 最大, 总和和个数, Ts 是时间段开始的毫秒时间戳
+type MHistoryRollup struct {
+	ID           uint    `gorm:"primarykey"`
+	ResourceUUID string  `gorm:"not null;uniqueIndex:idx_history_rollup,priority:1"`
+	Tag          string  `gorm:"not null;uniqueIndex:idx_history_rollup,priority:2"`
+	Period       string  `gorm:"not null;uniqueIndex:idx_history_rollup,priority:3"`
+	Ts           int64   `gorm:"not null;uniqueIndex:idx_history_rollup,priority:4"`
+	MinValue     float64 //
+	MaxValue     float64 //
+	SumValue     float64 //
+	Count        int64   //
+}
+
+// 设备影子的期望值, 重启以后恢复
+type MDeviceShadow struct {
+	RulexModel
+	UUID    string `gorm:"not null"` // 设备 UUID
+	Desired string // 期望值 JSON: {"点位": 值}
+}
+
+// 上传的证书和私钥(PEM), 同时写到证书目录下 UUID.pem, 资源配置里填文件路径
+type MCertificate struct {
+	RulexModel
+	UUID        string `gorm:"not null"`
+	Name        string `gorm:"not null"`
+	Type        string `gorm:"not null"` // CERT: 证书, KEY: 私钥
+	Content     string `gorm:"not null"` // PEM
+	Description string
+}
@@ -126,6 +126,7 @@ func CreateOutEnd(c *gin.Context, hh *HttpApiServer) {
 		return
 	}
 	newUUID := utils.OutUuid()
+	auditUUID(c, newUUID)
 	if err := hh.InsertMOutEnd(&model.MOutEnd{
 		UUID:        newUUID,
 		Type:        form.Type,
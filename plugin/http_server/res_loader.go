@@ -4,10 +4,51 @@ import (
 	"errors"
 
 	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
 	"github.com/hootrhino/rulex/typex"
 	"gopkg.in/square/go-jose.v2/json"
 )
 
+/*
+*
+* 根据数据库里的规则新建规则实例, lua 和 expr 两种规则都在这里处理
+*
+ */
+func newRuleFromModel(e typex.RuleX, mRule *model.MRule) *typex.Rule {
+	rule := typex.NewLuaRule(e,
+		mRule.UUID,
+		mRule.Name,
+		mRule.Description,
+		mRule.FromSource,
+		mRule.FromDevice,
+		mRule.Success,
+		mRule.Actions,
+		mRule.Failed)
+	if mRule.Type == "expr" {
+		rule.Type = "expr"
+	}
+	rule.Expression = mRule.Expression
+	rule.FromEvent = mRule.FromEvent
+	rule.ToRules = mRule.ToRules
+	rule.ToTargets = mRule.ToTargets
+	rule.ToDevices = mRule.ToDevices
+	rule.DeviceCmd = mRule.DeviceCmd
+	return rule
+}
+
+/*
+*
+* 加载没有绑定资源的规则, 这种规则只接收上游规则的输出
+*
+ */
+func (hh *HttpApiServer) LoadNewestRule(uuid string) error {
+	mRule, err := hh.GetMRuleWithUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return hh.ruleEngine.LoadRule(newRuleFromModel(hh.ruleEngine, mRule))
+}
+
 /*
 *
 * 当资源重启加载的时候，内存里面的数据会丢失，需要重新从数据库加载规则到资源，建立绑定关联。
@@ -50,16 +91,7 @@ func (hh *HttpApiServer) LoadNewestInEnd(uuid string) error {
 			return err1
 		}
 		glogger.GLogger.Debugf("Load rule:%s", mRule.Name)
-		RuleInstance := typex.NewLuaRule(
-			hh.ruleEngine,
-			mRule.UUID,
-			mRule.Name,
-			mRule.Description,
-			mRule.FromSource,
-			mRule.FromDevice,
-			mRule.Success,
-			mRule.Actions,
-			mRule.Failed)
+		RuleInstance := newRuleFromModel(hh.ruleEngine, mRule)
 		BindRules[mRule.UUID] = *RuleInstance
 	}
 	// 最新的规则
@@ -71,7 +103,6 @@ func (hh *HttpApiServer) LoadNewestInEnd(uuid string) error {
 		glogger.GLogger.Error(err2)
 		return err2
 	}
-	go hh.StartInSupervisor(ctx, in)
 	return nil
 }
 
@@ -101,7 +132,6 @@ func (hh *HttpApiServer) LoadNewestOutEnd(uuid string) error {
 	if err := hh.ruleEngine.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
 		return err
 	}
-	go hh.StartOutSupervisor(ctx, out)
 	return nil
 
 }
@@ -132,6 +162,10 @@ func (hh *HttpApiServer) LoadNewestDevice(uuid string) error {
 		mDevice.Description, mDevice.GetConfig())
 	// Important !!!!!!!!
 	dev.UUID = mDevice.UUID // 本质上是配置和内存的数据映射起来
+	// 配置里可以关掉自动重启
+	if autoRestart, ok := config["autoRestart"].(bool); ok {
+		dev.AutoRestart = autoRestart
+	}
 	BindRules := map[string]typex.Rule{}
 	for _, ruleId := range mDevice.BindRules {
 		if ruleId == "" {
@@ -142,16 +176,7 @@ func (hh *HttpApiServer) LoadNewestDevice(uuid string) error {
 			return err1
 		}
 		glogger.GLogger.Debugf("Load rule:%s", mRule.Name)
-		RuleInstance := typex.NewLuaRule(
-			hh.ruleEngine,
-			mRule.UUID,
-			mRule.Name,
-			mRule.Description,
-			mRule.FromSource,
-			mRule.FromDevice,
-			mRule.Success,
-			mRule.Actions,
-			mRule.Failed)
+		RuleInstance := newRuleFromModel(hh.ruleEngine, mRule)
 		BindRules[mRule.UUID] = *RuleInstance
 	}
 	// 最新的规则
@@ -163,7 +188,6 @@ func (hh *HttpApiServer) LoadNewestDevice(uuid string) error {
 	if err := hh.ruleEngine.LoadDeviceWithCtx(dev, ctx, cancelCTX); err != nil {
 		return err
 	}
-	go hh.StartDeviceSupervisor(ctx, dev)
 	return nil
 
 }
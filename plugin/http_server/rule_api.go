@@ -19,36 +19,50 @@ type ruleVo struct {
 	UUID        string   `json:"uuid"`
 	FromSource  []string `json:"fromSource"`
 	FromDevice  []string `json:"fromDevice"`
+	FromEvent   []string `json:"fromEvent"`
 	Name        string   `json:"name"`
 	Type        string   `json:"type"`
 	Status      int      `json:"status"`
 	Expression  string   `json:"expression"`
+	ToRules     []string `json:"toRules"`
+	ToTargets   []string `json:"toTargets"`
+	ToDevices   []string `json:"toDevices"`
+	DeviceCmd   string   `json:"deviceCmd"`
 	Description string   `json:"description"`
 	Actions     string   `json:"actions"`
 	Success     string   `json:"success"`
 	Failed      string   `json:"failed"`
 }
 
-func RuleDetail(c *gin.Context, hh *HttpApiServer) {
-	uuid, _ := c.GetQuery("uuid")
-	rule, err := hh.GetMRuleWithUUID(uuid)
-	if err != nil {
-		c.JSON(common.HTTP_OK, common.Error400EmptyObj(err))
-		return
-	}
-	c.JSON(common.HTTP_OK, common.OkWithData(ruleVo{
+func toRuleVo(rule *model.MRule) ruleVo {
+	return ruleVo{
 		UUID:        rule.UUID,
 		Name:        rule.Name,
 		Type:        rule.Type,
 		Status:      1,
 		Expression:  rule.Expression,
+		ToRules:     rule.ToRules,
+		ToTargets:   rule.ToTargets,
+		ToDevices:   rule.ToDevices,
+		DeviceCmd:   rule.DeviceCmd,
 		Description: rule.Description,
 		FromSource:  rule.FromSource,
 		FromDevice:  rule.FromDevice,
+		FromEvent:   rule.FromEvent,
 		Success:     rule.Success,
 		Failed:      rule.Failed,
 		Actions:     rule.Actions,
-	}))
+	}
+}
+
+func RuleDetail(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	rule, err := hh.GetMRuleWithUUID(uuid)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error400EmptyObj(err))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(toRuleVo(rule)))
 }
 
 // Get all rules
@@ -58,19 +72,7 @@ func Rules(c *gin.Context, hh *HttpApiServer) {
 		DataList := []ruleVo{}
 		allRules, _ := hh.GetAllMRule()
 		for _, rule := range allRules {
-			DataList = append(DataList, ruleVo{
-				UUID:        rule.UUID,
-				Name:        rule.Name,
-				Type:        rule.Type,
-				Status:      1,
-				Expression:  rule.Expression,
-				Description: rule.Description,
-				FromSource:  rule.FromSource,
-				FromDevice:  rule.FromDevice,
-				Success:     rule.Success,
-				Failed:      rule.Failed,
-				Actions:     rule.Actions,
-			})
+			DataList = append(DataList, toRuleVo(&rule))
 		}
 		c.JSON(common.HTTP_OK, common.OkWithData(DataList))
 	} else {
@@ -79,19 +81,7 @@ func Rules(c *gin.Context, hh *HttpApiServer) {
 			c.JSON(common.HTTP_OK, common.Error400(err))
 			return
 		}
-		c.JSON(common.HTTP_OK, common.OkWithData(ruleVo{
-			UUID:        rule.UUID,
-			Name:        rule.Name,
-			Type:        rule.Type,
-			Status:      1,
-			Expression:  rule.Expression,
-			Description: rule.Description,
-			FromSource:  rule.FromSource,
-			FromDevice:  rule.FromDevice,
-			Success:     rule.Success,
-			Failed:      rule.Failed,
-			Actions:     rule.Actions,
-		}))
+		c.JSON(common.HTTP_OK, common.OkWithData(toRuleVo(rule)))
 	}
 }
 
@@ -100,9 +90,14 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 	type Form struct {
 		FromSource  []string `json:"fromSource" binding:"required"`
 		FromDevice  []string `json:"fromDevice" binding:"required"`
+		FromEvent   []string `json:"fromEvent"`
 		Name        string   `json:"name" binding:"required"`
 		Type        string   `json:"type"`
 		Expression  string   `json:"expression"`
+		ToRules     []string `json:"toRules"`
+		ToTargets   []string `json:"toTargets"`
+		ToDevices   []string `json:"toDevices"`
+		DeviceCmd   string   `json:"deviceCmd"`
 		Description string   `json:"description"`
 		Actions     string   `json:"actions"`
 		Success     string   `json:"success"`
@@ -139,9 +134,21 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 			}
 		}
 	}
+	if err := checkRuleEvents(form.FromEvent); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
 	// tmpRule 是一个一次性的临时rule，用来验证规则，这么做主要是为了防止真实Lua Vm 被污染
 	tmpRule := typex.NewRule(nil, "_", "_", "_", []string{}, []string{},
 		form.Success, form.Actions, form.Failed)
+	tmpRule.Expression = form.Expression
+	newUUID := utils.RuleUuid()
+	auditUUID(c, newUUID)
+	if err := hh.checkRuleOutputs(newUUID, form.ToRules,
+		form.ToTargets, form.ToDevices); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
 	if form.Type == "lua" {
 		if err := core.VerifyLuaSyntax(tmpRule); err != nil {
 			c.JSON(common.HTTP_OK, common.Error400(err))
@@ -158,33 +165,31 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 	mRule := &model.MRule{
 		Name:        form.Name,
 		Type:        form.Type,
-		UUID:        utils.RuleUuid(),
+		UUID:        newUUID,
 		Expression:  form.Expression,
+		ToRules:     form.ToRules,
+		ToTargets:   form.ToTargets,
+		ToDevices:   form.ToDevices,
+		DeviceCmd:   form.DeviceCmd,
 		Description: form.Description,
 		FromSource:  form.FromSource,
 		FromDevice:  form.FromDevice,
+		FromEvent:   form.FromEvent,
 		Success:     form.Success,
 		Failed:      form.Failed,
 		Actions:     form.Actions,
 	}
-
-	if form.Type != "lua" {
-		// 未来可能支持别的脚本
-	}
-	rule := typex.NewLuaRule(hh.ruleEngine,
-		mRule.UUID,
-		mRule.Name,
-		mRule.Description,
-		mRule.FromSource,
-		mRule.FromDevice,
-		mRule.Success,
-		mRule.Actions,
-		mRule.Failed)
+	rule := newRuleFromModel(hh.ruleEngine, mRule)
 	hh.ruleEngine.RemoveRule(rule.UUID)
 	if err := hh.ruleEngine.LoadRule(rule); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
 	}
+	// SaveDB, 只被其他规则引用的规则没有绑定资源, 也要入库
+	if err := hh.InsertMRule(mRule); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
 	// 更新FromSource RULE到Device表中
 	for _, inId := range form.FromSource {
 		InEnd, _ := hh.GetMInEndWithUUID(inId)
@@ -211,11 +216,6 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 			c.JSON(common.HTTP_OK, common.Error400(err))
 			return
 		}
-		// SaveDB
-		if err := hh.InsertMRule(mRule); err != nil {
-			c.JSON(common.HTTP_OK, common.Error400(err))
-			return
-		}
 		// LoadNewest!!!
 		if err := hh.LoadNewestInEnd(inId); err != nil {
 			c.JSON(common.HTTP_OK, common.Error400(err))
@@ -250,11 +250,6 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 			c.JSON(common.HTTP_OK, common.Error400(err))
 			return
 		}
-		// SaveDB
-		if err := hh.InsertMRule(mRule); err != nil {
-			c.JSON(common.HTTP_OK, common.Error400(err))
-			return
-		}
 		// LoadNewest!!!
 		if err := hh.LoadNewestDevice(devId); err != nil {
 			c.JSON(common.HTTP_OK, common.Error400(err))
@@ -265,6 +260,53 @@ func CreateRule(c *gin.Context, hh *HttpApiServer) {
 	c.JSON(common.HTTP_OK, common.Ok())
 }
 
+/*
+*
+* 规则绑定的事件类型必须是引擎支持的
+*
+ */
+func checkRuleEvents(events []string) error {
+	for _, eventType := range events {
+		if !typex.IsEventType(eventType) {
+			return fmt.Errorf("event type not exists: %s", eventType)
+		}
+	}
+	return nil
+}
+
+/*
+*
+* 检查规则的下游规则, 目标和设备是否存在, 下游规则不能成环
+*
+ */
+func (hh *HttpApiServer) checkRuleOutputs(uuid string, toRules []string,
+	toTargets []string, toDevices []string) error {
+	graph := map[string][]string{}
+	for _, mRule := range hh.AllMRules() {
+		graph[mRule.UUID] = mRule.ToRules
+	}
+	for _, id := range toRules {
+		if _, ok := graph[id]; !ok {
+			return fmt.Errorf("rule not exists: %s", id)
+		}
+	}
+	graph[uuid] = toRules
+	if err := core.VerifyRuleChain(uuid, graph); err != nil {
+		return err
+	}
+	for _, id := range toTargets {
+		if out, _ := hh.GetMOutEndWithUUID(id); out == nil {
+			return fmt.Errorf("outend not exists: %s", id)
+		}
+	}
+	for _, id := range toDevices {
+		if dev, _ := hh.GetMDeviceWithUUID(id); dev == nil {
+			return fmt.Errorf("device not exists: %s", id)
+		}
+	}
+	return nil
+}
+
 /*
 *
 * Update
@@ -275,9 +317,14 @@ func UpdateRule(c *gin.Context, hh *HttpApiServer) {
 		UUID        string   `json:"uuid" binding:"required"` // 如果空串就是新建，非空就是更新
 		FromSource  []string `json:"fromSource" binding:"required"`
 		FromDevice  []string `json:"fromDevice" binding:"required"`
+		FromEvent   []string `json:"fromEvent"`
 		Name        string   `json:"name" binding:"required"`
 		Type        string   `json:"type"`
 		Expression  string   `json:"expression"`
+		ToRules     []string `json:"toRules"`
+		ToTargets   []string `json:"toTargets"`
+		ToDevices   []string `json:"toDevices"`
+		DeviceCmd   string   `json:"deviceCmd"`
 		Description string   `json:"description"`
 		Actions     string   `json:"actions"`
 		Success     string   `json:"success"`
@@ -314,9 +361,19 @@ func UpdateRule(c *gin.Context, hh *HttpApiServer) {
 			}
 		}
 	}
+	if err := checkRuleEvents(form.FromEvent); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
 	// tmpRule 是一个一次性的临时rule，用来验证规则，这么做主要是为了防止真实Lua Vm 被污染
 	tmpRule := typex.NewRule(nil, "_", "_", "_", []string{}, []string{},
 		form.Success, form.Actions, form.Failed)
+	tmpRule.Expression = form.Expression
+	if err := hh.checkRuleOutputs(form.UUID, form.ToRules,
+		form.ToTargets, form.ToDevices); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
 
 	if form.Type == "lua" {
 		if err := core.VerifyLuaSyntax(tmpRule); err != nil {
@@ -331,21 +388,29 @@ func UpdateRule(c *gin.Context, hh *HttpApiServer) {
 		}
 	}
 
-	if form.Type == "lua" {
+	if form.Type == "lua" || form.Type == "expr" {
 		mRule, err := hh.GetMRuleWithUUID(form.UUID)
 		if err != nil {
 			c.JSON(common.HTTP_OK, common.Error400(err))
 			return
 		}
-		rule := typex.NewLuaRule(hh.ruleEngine,
-			mRule.UUID,
-			mRule.Name,
-			mRule.Description,
-			mRule.FromSource,
-			mRule.FromDevice,
-			mRule.Success,
-			mRule.Actions,
-			mRule.Failed)
+		rule := newRuleFromModel(hh.ruleEngine, &model.MRule{
+			UUID:        mRule.UUID,
+			Name:        form.Name,
+			Type:        form.Type,
+			Expression:  form.Expression,
+			ToRules:     form.ToRules,
+			ToTargets:   form.ToTargets,
+			ToDevices:   form.ToDevices,
+			DeviceCmd:   form.DeviceCmd,
+			Description: form.Description,
+			FromSource:  form.FromSource,
+			FromDevice:  form.FromDevice,
+			FromEvent:   form.FromEvent,
+			Success:     form.Success,
+			Failed:      form.Failed,
+			Actions:     form.Actions,
+		})
 		hh.ruleEngine.RemoveRule(rule.UUID)
 		if err := hh.ruleEngine.LoadRule(rule); err != nil {
 			c.JSON(common.HTTP_OK, common.Error400(err))
@@ -357,9 +422,14 @@ func UpdateRule(c *gin.Context, hh *HttpApiServer) {
 			Name:        form.Name,
 			Type:        form.Type,
 			Expression:  form.Expression,
+			ToRules:     form.ToRules,
+			ToTargets:   form.ToTargets,
+			ToDevices:   form.ToDevices,
+			DeviceCmd:   form.DeviceCmd,
 			Description: form.Description,
 			FromSource:  form.FromSource,
 			FromDevice:  form.FromDevice,
+			FromEvent:   form.FromEvent,
 			Success:     form.Success,
 			Failed:      form.Failed,
 			Actions:     form.Actions,
@@ -452,6 +522,13 @@ func DeleteRule(c *gin.Context, hh *HttpApiServer) {
 		c.JSON(common.HTTP_OK, common.Error400(err0))
 		return
 	}
+	// 还被其他规则引用的时候不能删
+	for _, upstream := range hh.AllMRules() {
+		if utils.SContains(upstream.ToRules, uuid) {
+			c.JSON(common.HTTP_OK, common.Error(`rule is used by: `+upstream.UUID))
+			return
+		}
+	}
 	// 更新FromSource RULE到Device表中
 	for _, id := range mRule.FromSource {
 		InEnd, _ := hh.GetMInEndWithUUID(id)
@@ -0,0 +1,93 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hootrhino/rulex/glogger"
+	common "github.com/hootrhino/rulex/plugin/http_server/common"
+	"github.com/hootrhino/rulex/typex"
+)
+
+/*
+*
+* 恢复设备影子的期望值, 设备还没加载也没关系, 上线以后再写
+*
+ */
+func (hs *HttpApiServer) loadShadows() {
+	for _, m := range hs.AllMDeviceShadows() {
+		desired := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(m.Desired), &desired); err != nil {
+			glogger.GLogger.Errorf("Device [%s] shadow desired invalid: %v", m.UUID, err)
+			continue
+		}
+		if err := hs.ruleEngine.GetDeviceShadow().SetDesired(m.UUID, desired); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	}
+}
+
+func (hh *HttpApiServer) deviceExists(uuid string) bool {
+	if hh.ruleEngine.GetDevice(uuid) != nil {
+		return true
+	}
+	_, err := hh.GetMDeviceWithUUID(uuid)
+	return err == nil
+}
+
+// 设备影子, 带 uuid 查询单个, 设备还没有上报过数据的时候是空的
+func Shadows(c *gin.Context, hh *HttpApiServer) {
+	uuid, _ := c.GetQuery("uuid")
+	if uuid == "" {
+		c.JSON(common.HTTP_OK, common.OkWithData(hh.ruleEngine.GetDeviceShadow().All()))
+		return
+	}
+	if !hh.deviceExists(uuid) {
+		c.JSON(common.HTTP_OK, common.Error400EmptyObj(fmt.Errorf("device not exists: %s", uuid)))
+		return
+	}
+	shadow := hh.ruleEngine.GetDeviceShadow().Get(uuid)
+	if shadow == nil {
+		shadow = &typex.DeviceShadow{
+			UUID:     uuid,
+			Reported: map[string]typex.ShadowValue{},
+			Desired:  map[string]interface{}{},
+			Delta:    map[string]interface{}{},
+		}
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(shadow))
+}
+
+/*
+*
+* 设置期望值: 和已有的合并, 值是 null 表示删除; 设备在线的时候马上写, 写失败的留在 delta 里
+*
+ */
+func SetShadowDesired(c *gin.Context, hh *HttpApiServer) {
+	type Form struct {
+		UUID    string                 `json:"uuid" binding:"required"`
+		Desired map[string]interface{} `json:"desired" binding:"required"`
+	}
+	form := Form{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if !hh.deviceExists(form.UUID) {
+		c.JSON(common.HTTP_OK, common.Error400(fmt.Errorf("device not exists: %s", form.UUID)))
+		return
+	}
+	shadows := hh.ruleEngine.GetDeviceShadow()
+	syncErr := shadows.SetDesired(form.UUID, form.Desired)
+	desired, _ := json.Marshal(shadows.Get(form.UUID).Desired)
+	if err := hh.SaveMDeviceShadow(form.UUID, string(desired)); err != nil {
+		c.JSON(common.HTTP_OK, common.Error400(err))
+		return
+	}
+	if syncErr != nil {
+		c.JSON(common.HTTP_OK, common.Error400(syncErr))
+		return
+	}
+	c.JSON(common.HTTP_OK, common.OkWithData(shadows.Get(form.UUID)))
+}
@@ -69,7 +69,7 @@ func CreateGoods(c *gin.Context, hh *HttpApiServer) {
 		Description: form.Description,
 		Args:        form.Args,
 	}
-
+	auditUUID(c, mGoods.UUID)
 	if err := hh.InsertGoods(&mGoods); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
@@ -120,7 +120,7 @@ func System(c *gin.Context, hh *HttpApiServer) {
 	}
 	c.JSON(common.HTTP_OK, common.OkWithData(gin.H{
 		"hardWareInfo": hardWareInfo,
-		"statistic":    hh.ruleEngine.GetMetricStatistics(),
+		"statistic":    hh.ruleEngine.GetMetricStatistics().Snapshot(),
 		"sourceCount":  source_count(hh.ruleEngine),
 	}))
 }
@@ -163,7 +163,7 @@ func Drivers(c *gin.Context, hh *HttpApiServer) {
 
 // Get statistics data
 func Statistics(c *gin.Context, hh *HttpApiServer) {
-	c.JSON(common.HTTP_OK, common.OkWithData(hh.ruleEngine.GetMetricStatistics()))
+	c.JSON(common.HTTP_OK, common.OkWithData(hh.ruleEngine.GetMetricStatistics().Snapshot()))
 }
 
 // Get statistics data
@@ -1,22 +1,14 @@
 package httpserver
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"fmt"
-	"time"
+	"net/http"
 
 	common "github.com/hootrhino/rulex/plugin/http_server/common"
 	"github.com/hootrhino/rulex/plugin/http_server/model"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	SECRETKEY = "you-can-not-get-this-secret"
-)
-
 // All Users
 type user struct {
 	Role        string `json:"role"`
@@ -40,6 +32,7 @@ func Users(c *gin.Context, hh *HttpApiServer) {
 }
 
 // CreateUser
+// 还没有任何用户的时候创建的第一个用户固定是管理员
 func CreateUser(c *gin.Context, hh *HttpApiServer) {
 	type Form struct {
 		Role        string `json:"role" binding:"required"`
@@ -52,33 +45,43 @@ func CreateUser(c *gin.Context, hh *HttpApiServer) {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
 	}
-
-	if _, err := hh.GetMUser(form.Username, md5Hash(form.Password)); err != nil {
-		hh.InsertMUser(&model.MUser{
-			Role:        form.Role,
-			Username:    form.Username,
-			Password:    md5Hash(form.Password),
-			Description: form.Description,
-		})
+	hh.userLocker.Lock()
+	defer hh.userLocker.Unlock()
+	first := hh.CountMUser() == 0
+	// 匿名请求只能创建第一个管理员, 鉴权的时候没有加锁, 这里再检查一次
+	if hh.mainConfig.Auth && currentUser(c) == nil && !first {
+		c.JSON(http.StatusUnauthorized, common.Error("admin already exists, login required"))
+		return
+	}
+	if first {
+		form.Role = ROLE_ADMIN
+	}
+	if !validRole(form.Role) {
+		c.JSON(common.HTTP_OK, common.Error("invalid role:"+form.Role))
+		return
+	}
+	if _, err := hh.GetMUserWithName(form.Username); err == nil {
+		c.JSON(common.HTTP_OK, common.Error("user already exists:"+form.Username))
+		return
+	}
+	password, err := hashPassword(form.Password)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error500(err))
+		return
+	}
+	if err := hh.InsertMUser(&model.MUser{
+		Role:        form.Role,
+		Username:    form.Username,
+		Password:    password,
+		Description: form.Description,
+	}); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
 	}
-	c.JSON(common.HTTP_OK, common.Error("user already exists:"+form.Username))
-}
-
-/*
-*
-* Md5 计算
-*
- */
-func md5Hash(str string) string {
-	h := md5.New()
-	h.Write([]byte(str))
-	return hex.EncodeToString(h.Sum(nil))
+	c.JSON(common.HTTP_OK, common.Ok())
 }
 
 // Login
-// TODO: 下个版本实现用户基础管理
 func Login(c *gin.Context, hh *HttpApiServer) {
 	type _user struct {
 		Username string `json:"username" binding:"required"`
@@ -89,11 +92,23 @@ func Login(c *gin.Context, hh *HttpApiServer) {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
 	}
-	if _, err := hh.GetMUser(u.Username, md5Hash(u.Password)); err != nil {
-		c.JSON(common.HTTP_OK, common.Error400(err))
+	user, err := hh.GetMUserWithName(u.Username)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error("invalid username or password"))
+		return
+	}
+	upgrade, err := checkPassword(user.Password, u.Password)
+	if err != nil {
+		c.JSON(common.HTTP_OK, common.Error("invalid username or password"))
 		return
 	}
-	if token, err := generateToken(u.Username); err != nil {
+	// 老版本的 md5 密码换成 bcrypt
+	if upgrade {
+		if password, err := hashPassword(u.Password); err == nil {
+			hh.UpdateMUserPassword(user.ID, password)
+		}
+	}
+	if token, err := hh.generateToken(u.Username); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
 	} else {
@@ -122,66 +137,19 @@ func LogOut(c *gin.Context, hh *HttpApiServer) {
 
 /*
 *
-* TODO：用户信息, 当前版本写死 下个版本实现数据库查找
+* 当前登录用户的信息
 *
  */
 func Info(c *gin.Context, hh *HttpApiServer) {
-	token := c.GetHeader("token")
-	if claims, err := parseToken(token); err != nil {
-		c.JSON(common.HTTP_OK, common.Error400(err))
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(common.HTTP_OK, common.Error("user not login"))
 		return
-	} else {
-		c.JSON(common.HTTP_OK, common.OkWithData(map[string]interface{}{
-			"token":  token,
-			"avatar": "rulex",
-			"name":   claims.Username,
-		}))
-	}
-
-}
-
-type JwtClaims struct {
-	Username string
-	jwt.StandardClaims
-}
-
-/*
-*
-* 生成Token
-*
- */
-func generateToken(username string) (string, error) {
-	claims := &JwtClaims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Duration(60*60*24) * time.Second).Unix(),
-			Issuer:    username,
-		},
-	}
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRETKEY))
-	return token, err
-}
-
-/*
-*
-* 解析Token
-*
- */
-func parseToken(tokenString string) (*JwtClaims, error) {
-	if tokenString == "" {
-		return nil, fmt.Errorf("expected token string on headers")
-	}
-
-	token, err := jwt.ParseWithClaims(tokenString, &JwtClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(SECRETKEY), nil
-		})
-	if claims, ok := token.Claims.(*JwtClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, err
 	}
+	c.JSON(common.HTTP_OK, common.OkWithData(map[string]interface{}{
+		"token":  requestToken(c),
+		"avatar": "rulex",
+		"name":   user.Username,
+		"role":   normalizeRole(user.Role),
+	}))
 }
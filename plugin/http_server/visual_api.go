@@ -33,6 +33,7 @@ func CreateVisual(c *gin.Context, hh *HttpApiServer) {
 		Type:    vvo.Type,
 		Content: vvo.Content,
 	}
+	auditUUID(c, MVisual.UUID)
 	if err := service.InsertVisual(MVisual); err != nil {
 		c.JSON(common.HTTP_OK, common.Error400(err))
 		return
@@ -1,9 +1,11 @@
 package mqttserver
 
 import (
+	"crypto/tls"
 	"fmt"
 	"sync"
 
+	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
 	"github.com/hootrhino/rulex/utils"
@@ -18,6 +20,11 @@ type _serverConfig struct {
 	Enable bool   `ini:"enable"`
 	Host   string `ini:"host"`
 	Port   int    `ini:"port"`
+	// TLS 端口, 0 表示不开启; 配置了 ca_file 的时候要求客户端证书
+	TlsPort  int    `ini:"tls_port"`
+	CertFile string `ini:"cert_file"`
+	KeyFile  string `ini:"key_file"`
+	CaFile   string `ini:"ca_file"`
 }
 type _topic struct {
 	Topic string
@@ -26,6 +33,8 @@ type MqttServer struct {
 	Enable     bool
 	Host       string
 	Port       int
+	TlsPort    int
+	tlsConfig  *tls.Config
 	mqttServer *mqtt.Server
 	clients    map[string]*mqtt.Client
 	topics     map[string][]_topic // Topic 订阅表
@@ -50,6 +59,15 @@ func (s *MqttServer) Init(config *ini.Section) error {
 	}
 	s.Host = mainConfig.Host
 	s.Port = mainConfig.Port
+	s.TlsPort = mainConfig.TlsPort
+	if s.TlsPort > 0 {
+		tlsConfig, err := common.NewServerTlsConfig(mainConfig.CertFile,
+			mainConfig.KeyFile, mainConfig.CaFile)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = tlsConfig
+	}
 	return nil
 }
 
@@ -62,6 +80,13 @@ func (s *MqttServer) Start(r typex.RuleX) error {
 	if err := server.AddListener(tcp); err != nil {
 		return err
 	}
+	if s.tlsConfig != nil {
+		tlsListener := listeners.NewTCP("node1-tls", fmt.Sprintf("%v:%v", s.Host, s.TlsPort),
+			&listeners.Config{TLSConfig: s.tlsConfig})
+		if err := server.AddListener(tlsListener); err != nil {
+			return err
+		}
+	}
 	if err := server.Serve(); err != nil {
 		return err
 	}
@@ -72,6 +97,9 @@ func (s *MqttServer) Start(r typex.RuleX) error {
 	server.AddHook(&ahooks{s: s}, nil)
 	server.AddHook(&mhooks{s: s, locker: sync.Mutex{}}, nil)
 	glogger.GLogger.Infof("MqttServer start at [%s:%v] successfully", s.Host, s.Port)
+	if s.tlsConfig != nil {
+		glogger.GLogger.Infof("MqttServer TLS start at [%s:%v] successfully", s.Host, s.TlsPort)
+	}
 	return nil
 }
 
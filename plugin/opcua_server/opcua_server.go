@@ -0,0 +1,297 @@
+package opcuaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+	"gopkg.in/ini.v1"
+)
+
+/*
+*
+* 配置信息,从ini文件里面读取出来的
+*
+ */
+type _serverConfig struct {
+	Enable       bool   `ini:"enable"`
+	Host         string `ini:"host"`
+	Port         int    `ini:"port"`
+	Writable     bool   `ini:"writable"`
+	Username     string `ini:"username"`
+	Password     string `ini:"password"`
+	SecurityNone bool   `ini:"security_none"`
+	PkiDir       string `ini:"pki_dir"`
+	CertFile     string `ini:"cert_file"`
+	KeyFile      string `ini:"key_file"`
+	TrustedCerts string `ini:"trusted_certs"`
+}
+
+/*
+*
+* OPCUA 服务端: 把网关上的设备暴露成 OPCUA 的地址空间, 每个设备是 Objects 下面的一个目录,
+* 设备最近一次上报的每个点位是目录下面的一个变量; 开启 writable 以后, 用用户名密码或者
+* 证书登录的客户端写变量会调用设备的 OnWrite(tag, value), 匿名用户只能读。
+* 协议栈用的是 github.com/awcullen/opcua 的服务端, 支持 Basic256Sha256 等安全策略的
+* Sign/SignAndEncrypt 通道和订阅, 客户端证书要在 trusted_certs 里才能建立安全通道。
+*
+ */
+type OpcuaServer struct {
+	Host         string
+	Port         int
+	Writable     bool // 默认不允许写
+	Username     string
+	Password     string
+	SecurityNone bool // 默认不开放不加密的通道
+	ruleEngine   typex.RuleX
+	// 证书: 服务端证书和私钥的文件, 信任的客户端证书, 被拒绝的客户端证书保存的目录
+	certFile     string
+	keyFile      string
+	trustedPath  string
+	trustedCerts [][]byte
+	rejectedDir  string
+	server       *server.Server
+	namespace    uint16
+	uuid         string
+	// 已经创建的设备目录和点位变量
+	locker  sync.Mutex
+	devices map[string]*server.ObjectNode
+	tags    map[string]*server.VariableNode
+}
+
+func NewOpcuaServer() typex.XPlugin {
+	return &OpcuaServer{
+		Host:    "0.0.0.0",
+		Port:    4840,
+		uuid:    "RULEX-OpcuaServer",
+		devices: map[string]*server.ObjectNode{},
+		tags:    map[string]*server.VariableNode{},
+	}
+}
+
+func (s *OpcuaServer) Init(config *ini.Section) error {
+	var mainConfig _serverConfig
+	if err := utils.InIMapToStruct(config, &mainConfig); err != nil {
+		return err
+	}
+	if mainConfig.Host != "" {
+		s.Host = mainConfig.Host
+	}
+	if mainConfig.Port != 0 {
+		s.Port = mainConfig.Port
+	}
+	s.Writable = mainConfig.Writable
+	s.Username = mainConfig.Username
+	s.Password = mainConfig.Password
+	s.SecurityNone = mainConfig.SecurityNone
+	if err := s.loadCertificate(mainConfig.PkiDir, mainConfig.CertFile, mainConfig.KeyFile); err != nil {
+		return err
+	}
+	return s.loadTrustedCerts(mainConfig.TrustedCerts)
+}
+
+func (s *OpcuaServer) Start(r typex.RuleX) error {
+	s.ruleEngine = r
+	cert, err := parseCertificateFile(s.certFile)
+	if err != nil {
+		return err
+	}
+	// 客户端连接用的主机名不在证书里的时候创建会话会被拒绝
+	if err := cert.VerifyHostname(s.endpointHost()); err != nil {
+		glogger.GLogger.Warnf("OpcuaServer certificate does not contain host [%s], clients connecting "+
+			"with it will be rejected, remove %s to regenerate the certificate", s.endpointHost(), s.certFile)
+	}
+	endpointURL := fmt.Sprintf("opc.tcp://%s:%d", s.endpointHost(), s.Port)
+	srv, err := server.New(
+		ua.ApplicationDescription{
+			ApplicationURI:  certificateURI(cert),
+			ProductURI:      "https://github.com/hootrhino/rulex",
+			ApplicationName: ua.LocalizedText{Text: "RULEX OPCUA Server"},
+			ApplicationType: ua.ApplicationTypeServer,
+			DiscoveryURLs:   []string{endpointURL},
+		},
+		s.certFile, s.keyFile, endpointURL,
+		s.options()...,
+	)
+	if err != nil {
+		return err
+	}
+	s.server = srv
+	s.namespace = srv.NamespaceManager().Add(_OPCUA_NAMESPACE_URI)
+	r.AllDevices().Range(func(key, value interface{}) bool {
+		s.deviceFolder(value.(*typex.Device))
+		return true
+	})
+	if err := r.LoadHook(&opcuaHook{s: s}); err != nil {
+		return err
+	}
+	if err := s.serve(srv); err != nil {
+		r.RemoveHook(_OPCUA_HOOK_NAME)
+		return err
+	}
+	if s.Writable && !s.secured() {
+		glogger.GLogger.Warn("OpcuaServer writable is enabled without username/password or " +
+			"trusted certificate, all writes will be rejected")
+	}
+	if s.SecurityNone {
+		glogger.GLogger.Warn("OpcuaServer SecurityPolicy None is enabled, data on that endpoint is not encrypted")
+	}
+	glogger.GLogger.Infof("OpcuaServer start at [%s:%v] successfully", s.Host, s.Port)
+	return nil
+}
+
+func (s *OpcuaServer) Stop() error {
+	if s.ruleEngine != nil {
+		s.ruleEngine.RemoveHook(_OPCUA_HOOK_NAME)
+	}
+	if s.server != nil {
+		return s.server.Close()
+	}
+	return nil
+}
+
+func (s *OpcuaServer) PluginMetaInfo() typex.XPluginMetaInfo {
+	return typex.XPluginMetaInfo{
+		UUID:     s.uuid,
+		Name:     "OPCUA Server",
+		Version:  "0.0.1",
+		Homepage: "https://hootrhino.github.io",
+		HelpLink: "https://hootrhino.github.io",
+		Author:   "wwhai",
+		Email:    "cnwwhai@gmail.com",
+		License:  "MIT",
+	}
+}
+
+/*
+*
+* 服务调用接口
+*
+ */
+func (s *OpcuaServer) Service(arg typex.ServiceArg) typex.ServiceResult {
+	return typex.ServiceResult{}
+}
+
+/*
+*
+* ListenAndServe 是阻塞的, 放到协程里面跑; 等端口能连上了再返回, 监听失败的时候返回错误
+*
+ */
+func (s *OpcuaServer) serve(srv *server.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	address := fmt.Sprintf("127.0.0.1:%d", s.Port)
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("OpcuaServer listen error: %v", err)
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond); err == nil {
+			conn.Close()
+			go func() {
+				if err := <-errCh; err != nil && err != ua.BadServerHalted {
+					glogger.GLogger.Error("OpcuaServer stopped with error:", err)
+				}
+			}()
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.Close()
+	return fmt.Errorf("OpcuaServer listen timeout")
+}
+
+// 服务端的参数: 安全策略, 信任的证书, 登录方式和权限
+func (s *OpcuaServer) options() []server.Option {
+	options := []server.Option{
+		server.WithSecurityPolicyNone(s.SecurityNone),
+		server.WithTrustedCertificatesPaths(s.trustedPath, ""),
+		server.WithRejectedCertificatesPath(s.rejectedDir),
+		server.WithAnonymousIdentity(true),
+		server.WithGetRolesFunc(s.roles),
+		server.WithServerDiagnostics(false),
+		server.WithBuildInfo(ua.BuildInfo{
+			ProductURI:       "https://github.com/hootrhino/rulex",
+			ManufacturerName: "hootrhino",
+			ProductName:      "RULEX OPCUA Server",
+			SoftwareVersion:  typex.DefaultVersion.Version,
+		}),
+	}
+	if s.Username != "" {
+		options = append(options, server.WithAuthenticateUserNameIdentityFunc(s.authenticateUserName))
+	}
+	if len(s.trustedCerts) > 0 {
+		options = append(options, server.WithAuthenticateX509IdentityFunc(s.authenticateX509))
+	}
+	return options
+}
+
+// 终端地址里的主机名, 监听所有地址的时候用本机的主机名
+func (s *OpcuaServer) endpointHost() string {
+	if s.Host == "" || s.Host == "0.0.0.0" {
+		return localHostname()
+	}
+	return s.Host
+}
+
+/*
+*
+* 更新设备的点位: 设备数据是 {"tag": 点位} 格式的时候, 点位是对象的优先取 dataValue,
+* 没有的话取 value; 不是 JSON 对象的数据整体放到 "data" 这个点位里。
+* 只上报变化点位的设备每次只带一部分点位, 所以这里是合并而不是替换
+*
+ */
+func (s *OpcuaServer) updateValues(device *typex.Device, data string) {
+	tags := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		tags = map[string]interface{}{"data": data}
+	}
+	for tag, value := range tags {
+		if object, ok := value.(map[string]interface{}); ok {
+			if v, ok := object["dataValue"]; ok {
+				value = v
+			} else if v, ok := object["value"]; ok {
+				value = v
+			}
+		}
+		tags[tag] = value
+	}
+	s.setTags(device, tags)
+}
+
+/*
+*
+* 拿设备数据的 Hook
+*
+ */
+const _OPCUA_HOOK_NAME = "plugin.opcua_server"
+
+type opcuaHook struct {
+	s *OpcuaServer
+}
+
+func (h *opcuaHook) Work(data string) error {
+	return nil
+}
+func (h *opcuaHook) WorkDevice(Device *typex.Device, data string) error {
+	if Device != nil {
+		h.s.updateValues(Device, data)
+	}
+	return nil
+}
+func (h *opcuaHook) Error(err error) {
+	glogger.GLogger.Error("OpcuaServer hook error:", err)
+}
+func (h *opcuaHook) Name() string {
+	return _OPCUA_HOOK_NAME
+}
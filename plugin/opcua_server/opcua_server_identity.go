@@ -0,0 +1,229 @@
+package opcuaserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/awcullen/opcua/ua"
+)
+
+const _OPCUA_DEFAULT_PKI_DIR = "./opcua_pki"
+
+/*
+*
+* 加载服务端证书: 没有配置的时候在 pki_dir 下面生成一个自签名证书, 以后启动继续用这个证书,
+* 客户端信任过一次就不用再重新信任; 校验失败的客户端证书保存在 pki_dir/rejected 下面,
+* 确认以后加到 trusted_certs 里就可以连接了
+*
+ */
+func (s *OpcuaServer) loadCertificate(pkiDir, certFile, keyFile string) error {
+	if pkiDir == "" {
+		pkiDir = _OPCUA_DEFAULT_PKI_DIR
+	}
+	s.rejectedDir = filepath.Join(pkiDir, "rejected")
+	if certFile == "" && keyFile == "" {
+		certFile = filepath.Join(pkiDir, "server.crt")
+		keyFile = filepath.Join(pkiDir, "server.key")
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := createCertificate(certFile, keyFile, s.Host); err != nil {
+				return fmt.Errorf("create server certificate error: %s", err)
+			}
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load server certificate error: %s", err)
+	}
+	if _, ok := pair.PrivateKey.(*rsa.PrivateKey); !ok {
+		return fmt.Errorf("server certificate key must be RSA")
+	}
+	s.certFile, s.keyFile = certFile, keyFile
+	return nil
+}
+
+/*
+*
+* 生成自签名的服务端证书, 证书和私钥都是 PEM 格式; 客户端连接用的主机名要在证书里,
+* 所以证书里带上主机名, localhost, 本机所有网卡的 IP 和配置的 host
+*
+ */
+func createCertificate(certFile, keyFile string, host string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	dnsNames := []string{localHostname(), "localhost"}
+	ips := []net.IP{}
+	if addresses, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips = append(ips, net.ParseIP("127.0.0.1"))
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = append(ips, ip)
+	} else if ip == nil && host != "" {
+		dnsNames = append(dnsNames, host)
+	}
+	applicationURI, _ := url.Parse(_OPCUA_NAMESPACE_URI)
+	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "RULEX OPCUA Server", Organization: []string{"hootrhino"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment |
+			x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		URIs:                  []*url.URL{applicationURI},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func parseCertificateFile(certFile string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	der := content
+	if block, _ := pem.Decode(content); block != nil {
+		der = block.Bytes
+	}
+	return x509.ParseCertificate(der)
+}
+
+// 服务端的 ApplicationURI 必须和证书里的 URI 一致
+func certificateURI(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return _OPCUA_NAMESPACE_URI
+}
+
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+/*
+*
+* 加载信任的客户端证书: 可以是一个目录, 也可以是逗号隔开的多个文件, PEM 和 DER 格式都可以;
+* 建立 Sign/SignAndEncrypt 通道的客户端应用证书和证书身份登录的用户证书都要在这里面
+*
+ */
+func (s *OpcuaServer) loadTrustedCerts(path string) error {
+	s.trustedPath, s.trustedCerts = "", [][]byte{}
+	files := []string{}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("load trusted certificate error: %s", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	} else {
+		for _, file := range strings.Split(path, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("load trusted certificate error: %s", err)
+		}
+		der := content
+		if block, _ := pem.Decode(content); block != nil {
+			der = block.Bytes
+		}
+		if _, err := x509.ParseCertificate(der); err != nil {
+			return fmt.Errorf("invalid trusted certificate %s: %s", file, err)
+		}
+		s.trustedCerts = append(s.trustedCerts, der)
+	}
+	s.trustedPath = strings.Join(files, ",")
+	return nil
+}
+
+// 有没有配置用户名密码或者证书身份
+func (s *OpcuaServer) secured() bool {
+	return s.Username != "" || len(s.trustedCerts) > 0
+}
+
+/*
+*
+* 用户角色: 匿名用户只有 Anonymous 角色, 只能浏览和读; 用户名密码或者证书登录的用户
+* 在开启 writable 的时候多一个 Operator 角色, 可以写点位
+*
+ */
+func (s *OpcuaServer) roles(identity any, applicationURI string, endpointURL string) ([]ua.NodeID, error) {
+	switch identity.(type) {
+	case ua.UserNameIdentity, ua.X509Identity:
+		if s.Writable {
+			return []ua.NodeID{ua.ObjectIDWellKnownRoleAuthenticatedUser,
+				ua.ObjectIDWellKnownRoleOperator}, nil
+		}
+		return []ua.NodeID{ua.ObjectIDWellKnownRoleAuthenticatedUser}, nil
+	}
+	return []ua.NodeID{ua.ObjectIDWellKnownRoleAnonymous}, nil
+}
+
+// 用户名密码登录, 密码由协议栈按安全策略解密
+func (s *OpcuaServer) authenticateUserName(identity ua.UserNameIdentity,
+	applicationURI string, endpointURL string) error {
+	if subtle.ConstantTimeCompare([]byte(identity.UserName), []byte(s.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(identity.Password), []byte(s.Password)) != 1 {
+		return ua.BadUserAccessDenied
+	}
+	return nil
+}
+
+// 证书身份登录, 私钥签名由协议栈校验, 这里只检查证书是不是信任的
+func (s *OpcuaServer) authenticateX509(identity ua.X509Identity,
+	applicationURI string, endpointURL string) error {
+	for _, trusted := range s.trustedCerts {
+		if bytes.Equal(trusted, []byte(identity.Certificate)) {
+			return nil
+		}
+	}
+	return ua.BadIdentityTokenRejected
+}
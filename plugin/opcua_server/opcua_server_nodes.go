@@ -0,0 +1,145 @@
+package opcuaserver
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+	"github.com/hootrhino/rulex/typex"
+)
+
+const _OPCUA_NAMESPACE_URI = "urn:rulex:opcua-server"
+
+/*
+*
+* 地址空间: 标准节点由协议栈生成, 这里只加设备和点位:
+*   Objects(i=85) -> 设备目录(ns=1;s=<设备UUID>) -> 点位(ns=1;s=<设备UUID>/<Tag>)
+* ns 是 urn:rulex:opcua-server 的命名空间索引, 用自动生成的证书的时候是 1
+*
+ */
+func (s *OpcuaServer) deviceFolder(device *typex.Device) *server.ObjectNode {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if folder, ok := s.devices[device.UUID]; ok {
+		return folder
+	}
+	folder := server.NewObjectNode(s.server,
+		ua.NewNodeIDString(s.namespace, device.UUID),
+		ua.NewQualifiedName(s.namespace, device.Name),
+		ua.NewLocalizedText(device.Name, ""),
+		ua.NewLocalizedText(device.Description, ""),
+		nil,
+		[]ua.Reference{
+			ua.NewReference(ua.ReferenceTypeIDHasTypeDefinition, false,
+				ua.NewExpandedNodeID(ua.ObjectTypeIDFolderType)),
+			ua.NewReference(ua.ReferenceTypeIDOrganizes, true,
+				ua.NewExpandedNodeID(ua.ObjectIDObjectsFolder)),
+		},
+		0,
+	)
+	s.server.NamespaceManager().AddNode(folder)
+	s.devices[device.UUID] = folder
+	return folder
+}
+
+/*
+*
+* 更新点位变量的值, 第一次出现的点位按名字排序以后加到设备目录下面;
+* 订阅由协议栈按采样间隔读变量的值, 值变了就通知客户端
+*
+ */
+func (s *OpcuaServer) setTags(device *typex.Device, tags map[string]interface{}) {
+	folder := s.deviceFolder(device)
+	names := []string{}
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, tag := range names {
+		value := ua.NewDataValue(tagVariant(tags[tag]), ua.Good, now, 0, now, 0)
+		if node, ok := s.tags[device.UUID+"/"+tag]; ok {
+			node.SetValue(value)
+			continue
+		}
+		accessLevel := ua.AccessLevelsCurrentRead
+		if s.Writable {
+			accessLevel |= ua.AccessLevelsCurrentWrite
+		}
+		node := server.NewVariableNode(s.server,
+			ua.NewNodeIDString(s.namespace, device.UUID+"/"+tag),
+			ua.NewQualifiedName(s.namespace, tag),
+			ua.NewLocalizedText(tag, ""),
+			ua.NewLocalizedText("", ""),
+			nil,
+			[]ua.Reference{
+				ua.NewReference(ua.ReferenceTypeIDHasTypeDefinition, false,
+					ua.NewExpandedNodeID(ua.VariableTypeIDBaseDataVariableType)),
+				ua.NewReference(ua.ReferenceTypeIDOrganizes, true,
+					ua.NewExpandedNodeID(folder.NodeID())),
+			},
+			value,
+			ua.DataTypeIDBaseDataType,
+			ua.ValueRankScalar,
+			[]uint32{},
+			accessLevel,
+			250.0,
+			false,
+			nil,
+		)
+		node.SetWriteValueHandler(s.writeHandler(device.UUID, tag, node))
+		s.server.NamespaceManager().AddNode(node)
+		s.tags[device.UUID+"/"+tag] = node
+	}
+}
+
+/*
+*
+* 点位值是 JSON 解出来的, 只会有数字, 布尔, 字符串, null, 数组和对象;
+* 数字是 Double, 数组和对象用 JSON 字符串表示
+*
+ */
+func tagVariant(value interface{}) ua.Variant {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case float64, bool, string:
+		return v
+	}
+	bytes, _ := json.Marshal(value)
+	return string(bytes)
+}
+
+/*
+*
+* 写点位: 调用设备的 OnWrite(tag, JSON 值), 由设备驱动自己解析; 权限由协议栈先检查,
+* 匿名用户返回 BadUserAccessDenied。写成功以后变量还是设备最近一次上报的值
+*
+ */
+func (s *OpcuaServer) writeHandler(deviceId string, tag string,
+	node *server.VariableNode) func(*server.Session, ua.WriteValue) (ua.DataValue, ua.StatusCode) {
+	return func(session *server.Session, item ua.WriteValue) (ua.DataValue, ua.StatusCode) {
+		if item.IndexRange != "" {
+			return node.Value(), ua.BadIndexRangeInvalid
+		}
+		if item.Value.Value == nil {
+			return node.Value(), ua.BadTypeMismatch
+		}
+		device := s.ruleEngine.GetDevice(deviceId)
+		if device == nil || device.Device == nil {
+			return node.Value(), ua.BadNodeIDUnknown
+		}
+		data, err := json.Marshal(item.Value.Value)
+		if err != nil {
+			return node.Value(), ua.BadTypeMismatch
+		}
+		if _, err := device.Device.OnWrite([]byte(tag), data); err != nil {
+			return node.Value(), ua.BadCommunicationError
+		}
+		return node.Value(), ua.Good
+	}
+}
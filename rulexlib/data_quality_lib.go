@@ -0,0 +1,44 @@
+package rulexlib
+
+import (
+	"strings"
+
+	lua "github.com/hootrhino/gopher-lua"
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+)
+
+/*
+*
+* 按数据质量过滤: rulexlib:FilterQuality(data, "GOOD,UNCERTAIN_STALE") -> 过滤后的数据, err;
+* 过滤完没有剩下数据的时候返回 nil
+*
+ */
+func FilterQuality(rx typex.RuleX) func(*lua.LState) int {
+	return func(l *lua.LState) int {
+		data := l.ToString(2)
+		qualities := []string{}
+		for _, quality := range strings.Split(l.ToString(3), ",") {
+			quality = strings.TrimSpace(quality)
+			if quality == "" {
+				continue
+			}
+			if !utils.SContains(common.DataQualities, quality) {
+				l.Push(lua.LNil)
+				l.Push(lua.LString("unsupported quality:" + quality))
+				return 2
+			}
+			qualities = append(qualities, quality)
+		}
+		filtered, ok := common.FilterQuality(data, qualities)
+		if !ok {
+			l.Push(lua.LNil)
+			l.Push(lua.LNil)
+			return 2
+		}
+		l.Push(lua.LString(filtered))
+		l.Push(lua.LNil)
+		return 2
+	}
+}
@@ -0,0 +1,26 @@
+package rulexlib
+
+import (
+	"github.com/hootrhino/rulex/typex"
+
+	lua "github.com/hootrhino/gopher-lua"
+)
+
+/*
+*
+* 数据写到 Kafka: local err = rulexlib:DataToKafka(uuid, data)
+*
+ */
+func DataToKafka(rx typex.RuleX) func(*lua.LState) int {
+	return func(l *lua.LState) int {
+		id := l.ToString(2)
+		data := l.ToString(3)
+		err := handleDataFormat(rx, id, data)
+		if err != nil {
+			l.Push(lua.LString(err.Error()))
+			return 1
+		}
+		l.Push(lua.LNil)
+		return 1
+	}
+}
@@ -0,0 +1,37 @@
+package rulexlib
+
+import (
+	"encoding/json"
+
+	"github.com/hootrhino/rulex/typex"
+
+	lua "github.com/hootrhino/gopher-lua"
+)
+
+/*
+*
+* 设备数据发到 Sparkplug B 输出: local err = rulexlib:DataToSparkplug(uuid, deviceUUID, data),
+* data 是 {"点位": 值} 格式的 JSON
+*
+ */
+func DataToSparkplug(rx typex.RuleX) func(*lua.LState) int {
+	return func(l *lua.LState) int {
+		id := l.ToString(2)
+		device := l.ToString(3)
+		data := l.ToString(4)
+		metrics := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(data), &metrics); err != nil {
+			l.Push(lua.LString(err.Error()))
+			return 1
+		}
+		bytes, _ := json.Marshal(map[string]interface{}{
+			"device": device, "metrics": metrics,
+		})
+		if err := handleDataFormat(rx, id, string(bytes)); err != nil {
+			l.Push(lua.LString(err.Error()))
+			return 1
+		}
+		l.Push(lua.LNil)
+		return 1
+	}
+}
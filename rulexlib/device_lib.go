@@ -1,6 +1,8 @@
 package rulexlib
 
 import (
+	"encoding/json"
+
 	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
@@ -123,3 +125,51 @@ func CtrlDevice(rx typex.RuleX) func(*lua.LState) int {
 		return 2
 	}
 }
+
+/*
+*
+* 设备影子: device:Get(uuid, tag) -> 点位最后一次上报的值, err
+*
+ */
+func GetShadowTag(rx typex.RuleX) func(*lua.LState) int {
+	return func(l *lua.LState) int {
+		devUUID := l.ToString(2)
+		tag := l.ToString(3)
+		value, ok := rx.GetDeviceShadow().GetTag(devUUID, tag)
+		if !ok {
+			l.Push(lua.LNil)
+			l.Push(lua.LString("tag not reported:" + tag))
+			return 2
+		}
+		l.Push(DecodeValue(l, value.Value))
+		l.Push(lua.LNil)
+		return 2
+	}
+}
+
+/*
+*
+* 设备影子: device:Shadow(uuid) -> {uuid, reported, desired, delta}, err
+*
+ */
+func GetShadow(rx typex.RuleX) func(*lua.LState) int {
+	return func(l *lua.LState) int {
+		devUUID := l.ToString(2)
+		shadow := rx.GetDeviceShadow().Get(devUUID)
+		if shadow == nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString("shadow not exists:" + devUUID))
+			return 2
+		}
+		bytes, _ := json.Marshal(shadow)
+		value, err := _Decode(l, bytes)
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(value)
+		l.Push(lua.LNil)
+		return 2
+	}
+}
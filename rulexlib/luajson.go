@@ -205,3 +205,19 @@ func DecodeValue(L *lua.LState, value interface{}) lua.LValue {
 
 	return lua.LNil
 }
+
+/*
+*
+* 把 Lua 的值转成字符串, 字符串原样返回, 其他的值编码成 JSON
+*
+ */
+func LuaValueToString(value lua.LValue) (string, error) {
+	if s, ok := value.(lua.LString); ok {
+		return string(s), nil
+	}
+	data, err := _Encode(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -1,6 +1,9 @@
 package rulexlib
 
 import (
+	"encoding/json"
+	"errors"
+
 	lua "github.com/hootrhino/gopher-lua"
 	"github.com/hootrhino/rulex/typex"
 )
@@ -64,3 +67,61 @@ func F4(rx typex.RuleX) func(l *lua.LState) int {
 		return 1
 	}
 }
+
+/*
+*
+* 更新 Modbus 从机的寄存器:
+*   local err = rulexlib:SetRegister(uuid, tag, value)
+* value 可以是数字, 布尔值, 或者数字数组(一个 Tag 占多个寄存器的时候)
+*
+ */
+func SetRegister(rx typex.RuleX) func(l *lua.LState) int {
+	return func(l *lua.LState) int {
+		devUUID := l.ToString(2)
+		tag := l.ToString(3)
+		values, err := luaRegisterValues(l.Get(4))
+		if err != nil {
+			l.Push(lua.LString(err.Error()))
+			return 1
+		}
+		Device := rx.GetDevice(devUUID)
+		if Device == nil {
+			l.Push(lua.LString("device not exists:" + devUUID))
+			return 1
+		}
+		if Device.Type != typex.GENERIC_MODBUS_SLAVER {
+			l.Push(lua.LString("device is not a modbus slaver:" + devUUID))
+			return 1
+		}
+		bytes, _ := json.Marshal(values)
+		if _, err := Device.Device.OnWrite([]byte(tag), bytes); err != nil {
+			l.Push(lua.LString(err.Error()))
+			return 1
+		}
+		l.Push(lua.LNil)
+		return 1
+	}
+}
+
+func luaRegisterValues(value lua.LValue) ([]int, error) {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return []int{int(v)}, nil
+	case lua.LBool:
+		if v {
+			return []int{1}, nil
+		}
+		return []int{0}, nil
+	case *lua.LTable:
+		values := []int{}
+		for i := 1; i <= v.Len(); i++ {
+			item, err := luaRegisterValues(v.RawGetInt(i))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item...)
+		}
+		return values, nil
+	}
+	return nil, errors.New("register value must be number, bool or number array")
+}
@@ -182,8 +182,15 @@ func (tc *iothub) Start(cctx typex.CCTX) error {
 		glogger.GLogger.Warnf("IOTHUB Disconnect: %v, %v try to reconnect", err, tc.status)
 	}
 
+	broker, tlsConfig, err := tc.mainConfig.TlsConfig.Broker(tc.mainConfig.Host, tc.mainConfig.Port)
+	if err != nil {
+		return err
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%v", tc.mainConfig.Host, tc.mainConfig.Port))
+	opts.AddBroker(broker)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetClientID(tc.mainConfig.ClientId)
 	opts.SetUsername(tc.mainConfig.Username)
 	opts.SetPassword(tc.mainConfig.Password)
@@ -153,8 +153,15 @@ func (tc *ithings) Start(cctx typex.CCTX) error {
 		glogger.GLogger.Warnf("IThings IOTHUB Disconnect: %v, try to reconnect", err)
 	}
 
+	broker, tlsConfig, err := tc.mainConfig.TlsConfig.Broker(tc.mainConfig.Host, tc.mainConfig.Port)
+	if err != nil {
+		return err
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%v", tc.mainConfig.Host, tc.mainConfig.Port))
+	opts.AddBroker(broker)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetClientID(tc.mainConfig.ClientId)
 	opts.SetUsername(tc.mainConfig.Username)
 	opts.SetPassword(tc.mainConfig.Password)
@@ -0,0 +1,41 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+/*
+*
+* 转成 franz-go 客户端的连接选项: 地址, 客户端ID, SASL 和 TLS; Kafka 输入和输出共用
+*
+ */
+func ClientOpts(c common.KafkaConfig) ([]kgo.Opt, error) {
+	opts := []kgo.Opt{kgo.SeedBrokers(c.Brokers...)}
+	if c.ClientId != "" {
+		opts = append(opts, kgo.ClientID(c.ClientId))
+	}
+	switch c.Sasl.Mechanism {
+	case "":
+	case "PLAIN":
+		opts = append(opts, kgo.SASL(plain.Auth{User: c.Sasl.Username, Pass: c.Sasl.Password}.AsMechanism()))
+	case "SCRAM-SHA-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: c.Sasl.Username, Pass: c.Sasl.Password}.AsSha256Mechanism()))
+	case "SCRAM-SHA-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: c.Sasl.Username, Pass: c.Sasl.Password}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism: %s", c.Sasl.Mechanism)
+	}
+	if c.Tls.Enable {
+		tlsConfig, err := common.NewClientTlsConfig(c.Tls.CaCert, c.Tls.ClientCert, c.Tls.ClientKey, c.Tls.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	return opts, nil
+}
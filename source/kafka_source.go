@@ -0,0 +1,205 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/source/kafka"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// 一次 Fetch 最多等多久, 和 Java 客户端的默认值一样
+const kafkaFetchMaxWait = 500 * time.Millisecond
+
+/*
+*
+* Kafka 输入: 用 franz-go 的消费组消费 topics, 每条消息的内容交给规则; 处理完的位置定时提交到 Kafka
+*
+ */
+type kafkaSource struct {
+	typex.XStatus
+	lock       sync.Mutex
+	mainConfig common.KafkaSourceConfig
+	client     *kgo.Client
+	groupErr   error // 最近一次加入消费组的错误, 分到分区以后清掉
+	status     typex.SourceState
+	done       chan struct{}
+}
+
+func NewKafkaSource(e typex.RuleX) typex.XSource {
+	ks := new(kafkaSource)
+	ks.RuleEngine = e
+	ks.status = typex.SOURCE_DOWN
+	return ks
+}
+
+func (ks *kafkaSource) Init(inEndId string, configMap map[string]interface{}) error {
+	ks.PointId = inEndId
+	if err := utils.BindSourceConfig(configMap, &ks.mainConfig); err != nil {
+		return err
+	}
+	if ks.mainConfig.StartOffset == "" {
+		ks.mainConfig.StartOffset = "latest"
+	}
+	return nil
+}
+
+func (ks *kafkaSource) Start(cctx typex.CCTX) error {
+	ks.Ctx = cctx.Ctx
+	ks.CancelCTX = cctx.CancelCTX
+	opts, err := kafka.ClientOpts(ks.mainConfig.KafkaConfig)
+	if err != nil {
+		return err
+	}
+	startOffset := kgo.NewOffset().AtEnd()
+	if ks.mainConfig.StartOffset == "earliest" {
+		startOffset = kgo.NewOffset().AtStart()
+	}
+	// 只提交处理过的记录
+	opts = append(opts,
+		kgo.ConsumerGroup(ks.mainConfig.GroupId),
+		kgo.ConsumeTopics(ks.mainConfig.Topics...),
+		kgo.ConsumeResetOffset(startOffset),
+		kgo.AutoCommitMarks(),
+		kgo.FetchMaxWait(kafkaFetchMaxWait),
+		kgo.OnPartitionsAssigned(ks.onAssigned),
+		kgo.WithHooks(ks),
+	)
+	if ks.mainConfig.SessionTimeoutMs > 0 {
+		opts = append(opts, kgo.SessionTimeout(time.Duration(ks.mainConfig.SessionTimeoutMs)*time.Millisecond))
+	}
+	if ks.mainConfig.CommitIntervalMs > 0 {
+		opts = append(opts, kgo.AutoCommitInterval(time.Duration(ks.mainConfig.CommitIntervalMs)*time.Millisecond))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+	// 地址、证书或者账户不对的时候返回错误
+	ctx, cancel := context.WithTimeout(ks.Ctx, 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		client.Close()
+		return err
+	}
+	ks.lock.Lock()
+	ks.client = client
+	ks.groupErr = nil
+	ks.status = typex.SOURCE_UP
+	ks.done = make(chan struct{})
+	ks.lock.Unlock()
+	go ks.consume(client, ks.done)
+	return nil
+}
+
+// 拉到的记录交给规则, 处理完以后标记, 下次自动提交的时候提交
+func (ks *kafkaSource) consume(client *kgo.Client, done chan struct{}) {
+	defer close(done)
+	for {
+		fetches := client.PollFetches(ks.Ctx)
+		if fetches.IsClientClosed() || ks.Ctx.Err() != nil {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			glogger.GLogger.Errorf("KafkaSource fetch %s[%d] error: %v", topic, partition, err)
+		})
+		fetches.EachRecord(func(record *kgo.Record) {
+			work, err := ks.RuleEngine.WorkInEnd(ks.RuleEngine.GetInEnd(ks.PointId), string(record.Value))
+			if !work {
+				glogger.GLogger.Error("KafkaSource PushQueue error: ", err)
+			}
+			client.MarkCommitRecords(record)
+		})
+	}
+}
+
+// kgo.HookGroupManageError: 加入消费组失败
+func (ks *kafkaSource) OnGroupManageError(err error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.groupErr = err
+}
+
+func (ks *kafkaSource) onAssigned(_ context.Context, _ *kgo.Client, _ map[string][]int32) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.groupErr = nil
+}
+
+func (ks *kafkaSource) Test(inEndId string) bool {
+	return ks.Status() == typex.SOURCE_UP
+}
+
+func (ks *kafkaSource) Enabled() bool {
+	return ks.Enable
+}
+
+func (ks *kafkaSource) Reload() {
+
+}
+
+func (ks *kafkaSource) Pause() {
+
+}
+
+// 消费组一直加入不了或者连不上的时候是 DOWN
+func (ks *kafkaSource) Status() typex.SourceState {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if ks.status == typex.SOURCE_UP && ks.groupErr != nil {
+		return typex.SOURCE_DOWN
+	}
+	return ks.status
+}
+
+func (ks *kafkaSource) Details() *typex.InEnd {
+	return ks.RuleEngine.GetInEnd(ks.PointId)
+}
+
+func (ks *kafkaSource) Stop() {
+	ks.lock.Lock()
+	ks.status = typex.SOURCE_STOP
+	client, done := ks.client, ks.done
+	ks.client, ks.done = nil, nil
+	ks.lock.Unlock()
+	if ks.CancelCTX != nil {
+		ks.CancelCTX()
+	}
+	// 等正在处理的记录标记完, Close 的时候提交位置并且离开消费组
+	if done != nil {
+		<-done
+	}
+	if client != nil {
+		client.Close()
+	}
+}
+
+func (ks *kafkaSource) Configs() *typex.XConfig {
+	return &typex.XConfig{}
+}
+
+func (ks *kafkaSource) DataModels() []typex.XDataModel {
+	return ks.XDataModels
+}
+
+func (ks *kafkaSource) Driver() typex.XExternalDriver {
+	return nil
+}
+
+func (*kafkaSource) Topology() []typex.TopologyPoint {
+	return []typex.TopologyPoint{}
+}
+
+func (*kafkaSource) DownStream([]byte) (int, error) {
+	return 0, errors.New("kafka source not support downstream")
+}
+
+func (*kafkaSource) UpStream([]byte) (int, error) {
+	return 0, nil
+}
@@ -1,7 +1,6 @@
 package source
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/hootrhino/rulex/common"
@@ -64,8 +63,15 @@ func (mm *mqttInEndSource) Start(cctx typex.CCTX) error {
 		glogger.GLogger.Warnf("Connect lost: %v, try to reconnect\n", err)
 	}
 
+	broker, tlsConfig, err := mm.mainConfig.TlsConfig.Broker(mm.mainConfig.Host, mm.mainConfig.Port)
+	if err != nil {
+		return err
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%v", mm.mainConfig.Host, mm.mainConfig.Port))
+	opts.AddBroker(broker)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetClientID(mm.mainConfig.ClientId)
 	opts.SetUsername(mm.mainConfig.Username)
 	opts.SetPassword(mm.mainConfig.Password)
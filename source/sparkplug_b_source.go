@@ -0,0 +1,555 @@
+package source
+
+/*
+*
+* Sparkplug B 边缘节点: 连接以后发布 NBIRTH 和在线设备的 DBIRTH, 设备数据通过 DownStream
+* (Sparkplug B 输出资源) 发布成 DDATA, 设备离线发布 DDEATH; NCMD 和 DCMD 进规则,
+* DCMD 的每个指标通过 OnWrite(指标名, JSON 值) 写到设备
+*
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/source/sparkplugb"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/proto"
+)
+
+// 已经发布了 DBIRTH 的设备, metrics 是指标的数据类型
+type sparkplugDevice struct {
+	deviceId string
+	metrics  map[string]uint32
+}
+
+// DownStream 的数据格式
+type sparkplugDeviceData struct {
+	Device  string                 `json:"device"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+type sparkplugB struct {
+	typex.XStatus
+	lock         sync.Mutex
+	client       mqtt.Client
+	mainConfig   common.SparkplugBConfig
+	status       typex.SourceState
+	bdSeq        uint64
+	seq          uint64
+	births       map[string]*sparkplugDevice // 设备 UUID
+	subscription string
+}
+
+func NewSparkplugBSource(e typex.RuleX) typex.XSource {
+	s := new(sparkplugB)
+	s.RuleEngine = e
+	s.births = map[string]*sparkplugDevice{}
+	s.status = typex.SOURCE_DOWN
+	return s
+}
+
+func (s *sparkplugB) Init(inEndId string, configMap map[string]interface{}) error {
+	s.PointId = inEndId
+	if err := utils.BindSourceConfig(configMap, &s.mainConfig); err != nil {
+		return err
+	}
+	for _, id := range []string{s.mainConfig.GroupId, s.mainConfig.EdgeNodeId} {
+		if strings.ContainsAny(id, "/+#") {
+			return fmt.Errorf("invalid sparkplug id: %s", id)
+		}
+	}
+	return nil
+}
+
+func (s *sparkplugB) Start(cctx typex.CCTX) error {
+	s.Ctx = cctx.Ctx
+	s.CancelCTX = cctx.CancelCTX
+	broker, tlsConfig, err := s.mainConfig.TlsConfig.Broker(s.mainConfig.Host, s.mainConfig.Port)
+	if err != nil {
+		return err
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetClientID(s.mainConfig.ClientId)
+	opts.SetUsername(s.mainConfig.Username)
+	opts.SetPassword(s.mainConfig.Password)
+	opts.SetCleanSession(true)
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetConnectTimeout(30 * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(5 * time.Second)
+	// 每次连接的 bdSeq 加一, 遗嘱 NDEATH 和 NBIRTH 里的 bdSeq 一样
+	s.setDeathWill(opts)
+	opts.SetReconnectingHandler(func(c mqtt.Client, o *mqtt.ClientOptions) {
+		s.lock.Lock()
+		s.bdSeq = (s.bdSeq + 1) % 256
+		s.lock.Unlock()
+		s.setDeathWill(o)
+	})
+	opts.OnConnect = func(client mqtt.Client) {
+		glogger.GLogger.Infof("Sparkplug B edge node [%s/%s] connected",
+			s.mainConfig.GroupId, s.mainConfig.EdgeNodeId)
+		for _, messageType := range []string{common.SPARKPLUG_NCMD, common.SPARKPLUG_DCMD} {
+			topic := common.SparkplugTopic(s.mainConfig.GroupId, messageType, s.mainConfig.EdgeNodeId, "")
+			if messageType == common.SPARKPLUG_DCMD {
+				topic += "/+"
+			}
+			if token := client.Subscribe(topic, 1, s.onCommand); token.Wait() && token.Error() != nil {
+				glogger.GLogger.Error(token.Error())
+			}
+		}
+		if err := s.birthNode(); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		glogger.GLogger.Warnf("Sparkplug B edge node connect lost: %v, try to reconnect", err)
+	}
+	if s.RuleEngine.GetEventBus() != nil {
+		s.subscription = s.RuleEngine.GetEventBus().Subscribe(
+			[]typex.EventType{typex.EVENT_RESOURCE_STATE}, s.onStateChange)
+	}
+	client := mqtt.NewClient(opts)
+	s.lock.Lock()
+	s.client = client
+	s.lock.Unlock()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		s.unsubscribeEvents()
+		return token.Error()
+	}
+	s.lock.Lock()
+	s.status = typex.SOURCE_UP
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *sparkplugB) deathPayload() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	payload := &sparkplugb.Payload{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Metrics:   []*sparkplugb.Payload_Metric{bdSeqMetric(s.bdSeq, 0)},
+	}
+	bytes, _ := proto.Marshal(payload)
+	return bytes
+}
+
+func (s *sparkplugB) setDeathWill(opts *mqtt.ClientOptions) {
+	topic := common.SparkplugTopic(s.mainConfig.GroupId, common.SPARKPLUG_NDEATH, s.mainConfig.EdgeNodeId, "")
+	opts.SetBinaryWill(topic, s.deathPayload(), 1, false)
+}
+
+// 遗嘱和 NBIRTH 里的 bdSeq 是 Int64
+func bdSeqMetric(bdSeq, timestamp uint64) *sparkplugb.Payload_Metric {
+	metric := &sparkplugb.Payload_Metric{
+		Name:     proto.String(common.SPARKPLUG_BDSEQ),
+		Datatype: proto.Uint32(uint32(sparkplugb.DataType_Int64)),
+		Value:    &sparkplugb.Payload_Metric_LongValue{LongValue: bdSeq},
+	}
+	if timestamp > 0 {
+		metric.Timestamp = proto.Uint64(timestamp)
+	}
+	return metric
+}
+
+// 调用的时候要持有锁; NBIRTH 的序号是 0, 后面的消息依次加一, 255 以后回到 0
+func (s *sparkplugB) nextSeq() *uint64 {
+	s.seq = (s.seq + 1) % 256
+	return proto.Uint64(s.seq)
+}
+
+// 调用的时候要持有锁
+func (s *sparkplugB) publish(messageType, deviceId string, payload *sparkplugb.Payload) mqtt.Token {
+	topic := common.SparkplugTopic(s.mainConfig.GroupId, messageType, s.mainConfig.EdgeNodeId, deviceId)
+	bytes, _ := proto.Marshal(payload)
+	return s.client.Publish(topic, 0, false, bytes)
+}
+
+func waitSparkplugToken(token mqtt.Token) error {
+	if !token.WaitTimeout(5 * time.Second) {
+		return errors.New("sparkplug publish timeout")
+	}
+	return token.Error()
+}
+
+/*
+*
+* 节点上线或者收到 Rebirth 命令: NBIRTH 以后每个在线的设备发 DBIRTH
+*
+ */
+func (s *sparkplugB) birthNode() error {
+	s.lock.Lock()
+	if s.client == nil {
+		s.lock.Unlock()
+		return errors.New("sparkplug client is nil")
+	}
+	s.seq = 0
+	s.births = map[string]*sparkplugDevice{}
+	now := uint64(time.Now().UnixMilli())
+	token := s.publish(common.SPARKPLUG_NBIRTH, "", &sparkplugb.Payload{
+		Timestamp: proto.Uint64(now),
+		Seq:       proto.Uint64(0),
+		Metrics: []*sparkplugb.Payload_Metric{
+			bdSeqMetric(s.bdSeq, now),
+			sparkplugb.NewMetric(common.SPARKPLUG_REBIRTH, false, now),
+		},
+	})
+	s.RuleEngine.AllDevices().Range(func(key, value interface{}) bool {
+		dev := value.(*typex.Device)
+		if s.deviceEnabled(dev.UUID) && dev.Device != nil && dev.Device.Status() == typex.DEV_UP {
+			s.birthDevice(dev, nil)
+		}
+		return true
+	})
+	s.lock.Unlock()
+	return waitSparkplugToken(token)
+}
+
+func (s *sparkplugB) deviceEnabled(uuid string) bool {
+	if len(s.mainConfig.Devices) == 0 {
+		return true
+	}
+	for _, device := range s.mainConfig.Devices {
+		if device == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// Sparkplug 的设备ID 用设备名, 去掉 Topic 里不能用的字符; 没有名字的时候用 UUID
+func sparkplugDeviceId(dev *typex.Device) string {
+	id := strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(strings.TrimSpace(dev.Name))
+	if id == "" {
+		return dev.UUID
+	}
+	return id
+}
+
+/*
+*
+* 点位转成指标: 点位是对象的时候取 value 或者 dataValue, 有 sourceTs 的时候用它做时间戳
+*
+ */
+func sparkplugMetrics(values map[string]interface{}, now uint64) []*sparkplugb.Payload_Metric {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*sparkplugb.Payload_Metric, 0, len(values))
+	for _, name := range names {
+		value := values[name]
+		timestamp := now
+		if object, ok := value.(map[string]interface{}); ok {
+			if v, ok := object["dataValue"]; ok {
+				value = v
+			} else if v, ok := object["value"]; ok {
+				value = v
+			}
+			if ts, ok := object["sourceTs"].(float64); ok && ts > 0 {
+				timestamp = uint64(ts)
+			}
+		}
+		metrics = append(metrics, sparkplugb.NewMetric(name, value, timestamp))
+	}
+	return metrics
+}
+
+/*
+*
+* 发布 DBIRTH, 指标是设备影子里的值加上这次的值; 调用的时候要持有锁
+*
+ */
+func (s *sparkplugB) birthDevice(dev *typex.Device, metrics []*sparkplugb.Payload_Metric) mqtt.Token {
+	now := uint64(time.Now().UnixMilli())
+	all := map[string]*sparkplugb.Payload_Metric{}
+	if shadow := s.RuleEngine.GetDeviceShadow(); shadow != nil {
+		if reported := shadow.Get(dev.UUID); reported != nil {
+			for tag, value := range reported.Reported {
+				all[tag] = sparkplugb.NewMetric(tag, value.Value, uint64(value.Time.UnixMilli()))
+			}
+		}
+	}
+	for _, metric := range metrics {
+		all[metric.GetName()] = metric
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	birth := &sparkplugDevice{deviceId: sparkplugDeviceId(dev), metrics: map[string]uint32{}}
+	payload := &sparkplugb.Payload{Timestamp: proto.Uint64(now), Seq: s.nextSeq()}
+	for _, name := range names {
+		payload.Metrics = append(payload.Metrics, all[name])
+		birth.metrics[name] = all[name].GetDatatype()
+	}
+	s.births[dev.UUID] = birth
+	return s.publish(common.SPARKPLUG_DBIRTH, birth.deviceId, payload)
+}
+
+/*
+*
+* 发布设备数据: 设备还没有 DBIRTH, 有新的指标或者指标类型变了的时候重新发 DBIRTH, 否则发 DDATA
+*
+ */
+func (s *sparkplugB) publishDeviceData(uuid string, values map[string]interface{}) error {
+	dev := s.RuleEngine.GetDevice(uuid)
+	if dev == nil {
+		return fmt.Errorf("device not exists: %s", uuid)
+	}
+	if !s.deviceEnabled(uuid) {
+		return fmt.Errorf("device not published by sparkplug edge node: %s", uuid)
+	}
+	metrics := sparkplugMetrics(values, uint64(time.Now().UnixMilli()))
+	s.lock.Lock()
+	if s.client == nil || !s.client.IsConnected() {
+		s.lock.Unlock()
+		return errors.New("sparkplug edge node not connected")
+	}
+	birth, rebirth := s.births[uuid], false
+	if birth == nil {
+		rebirth = true
+	} else {
+		for _, metric := range metrics {
+			dataType, ok := birth.metrics[metric.GetName()]
+			if ok && metric.GetIsNull() {
+				metric.Datatype = proto.Uint32(dataType)
+				continue
+			}
+			if !ok || dataType != metric.GetDatatype() {
+				rebirth = true
+			}
+		}
+	}
+	var token mqtt.Token
+	if rebirth {
+		token = s.birthDevice(dev, metrics)
+	} else {
+		token = s.publish(common.SPARKPLUG_DDATA, birth.deviceId, &sparkplugb.Payload{
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+			Seq:       s.nextSeq(),
+			Metrics:   metrics,
+		})
+	}
+	s.lock.Unlock()
+	return waitSparkplugToken(token)
+}
+
+func (s *sparkplugB) deathDevice(uuid string) {
+	s.lock.Lock()
+	birth, ok := s.births[uuid]
+	if !ok || s.client == nil {
+		s.lock.Unlock()
+		return
+	}
+	delete(s.births, uuid)
+	token := s.publish(common.SPARKPLUG_DDEATH, birth.deviceId, &sparkplugb.Payload{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Seq:       s.nextSeq(),
+	})
+	s.lock.Unlock()
+	if err := waitSparkplugToken(token); err != nil {
+		glogger.GLogger.Error(err)
+	}
+}
+
+// 设备上线发 DBIRTH, 离线发 DDEATH
+func (s *sparkplugB) onStateChange(event typex.Event) {
+	if event.Resource != "DEVICE" || !s.deviceEnabled(event.UUID) {
+		return
+	}
+	switch event.Data["to"] {
+	case "UP":
+		dev := s.RuleEngine.GetDevice(event.UUID)
+		if dev == nil {
+			return
+		}
+		s.lock.Lock()
+		if _, ok := s.births[event.UUID]; ok || s.client == nil || !s.client.IsConnected() {
+			s.lock.Unlock()
+			return
+		}
+		token := s.birthDevice(dev, nil)
+		s.lock.Unlock()
+		if err := waitSparkplugToken(token); err != nil {
+			glogger.GLogger.Error(err)
+		}
+	case "DOWN", "STOP":
+		s.deathDevice(event.UUID)
+	}
+}
+
+// Sparkplug 设备ID 对应的设备
+func (s *sparkplugB) findDevice(deviceId string) *typex.Device {
+	var found *typex.Device
+	s.RuleEngine.AllDevices().Range(func(key, value interface{}) bool {
+		dev := value.(*typex.Device)
+		if s.deviceEnabled(dev.UUID) && sparkplugDeviceId(dev) == deviceId {
+			found = dev
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+/*
+*
+* NCMD: Rebirth 重新发布所有 BIRTH; DCMD: 指标写到设备。命令以
+* {"type": "NCMD|DCMD", "device": "设备UUID", "metrics": {...}} 的格式进规则
+*
+ */
+func (s *sparkplugB) onCommand(client mqtt.Client, msg mqtt.Message) {
+	_, messageType, _, deviceId, err := common.ParseSparkplugTopic(msg.Topic())
+	if err != nil {
+		glogger.GLogger.Error(err)
+		return
+	}
+	payload := &sparkplugb.Payload{}
+	if err := proto.Unmarshal(msg.Payload(), payload); err != nil {
+		glogger.GLogger.Errorf("Sparkplug %s payload invalid: %v", messageType, err)
+		return
+	}
+	values := sparkplugb.MetricValues(payload)
+	command := map[string]interface{}{"type": messageType, "metrics": values}
+	switch messageType {
+	case common.SPARKPLUG_NCMD:
+		if values[common.SPARKPLUG_REBIRTH] == true {
+			delete(values, common.SPARKPLUG_REBIRTH)
+			// 回调里不能等待发布完成
+			go func() {
+				if err := s.birthNode(); err != nil {
+					glogger.GLogger.Error(err)
+				}
+			}()
+		}
+		if len(values) == 0 {
+			return
+		}
+	case common.SPARKPLUG_DCMD:
+		dev := s.findDevice(deviceId)
+		if dev == nil || dev.Device == nil {
+			glogger.GLogger.Errorf("Sparkplug DCMD device not exists: %s", deviceId)
+			return
+		}
+		command["device"] = dev.UUID
+		for name, value := range values {
+			data, _ := json.Marshal(value)
+			if _, err := dev.Device.OnWrite([]byte(name), data); err != nil {
+				glogger.GLogger.Errorf("Sparkplug DCMD write [%s] %s error: %v", dev.UUID, name, err)
+			}
+		}
+	default:
+		return
+	}
+	data, _ := json.Marshal(command)
+	if in := s.RuleEngine.GetInEnd(s.PointId); in != nil {
+		if work, err := s.RuleEngine.WorkInEnd(in, string(data)); !work {
+			glogger.GLogger.Error(err)
+		}
+	}
+}
+
+func (s *sparkplugB) DataModels() []typex.XDataModel {
+	return s.XDataModels
+}
+
+func (s *sparkplugB) unsubscribeEvents() {
+	if s.subscription != "" && s.RuleEngine.GetEventBus() != nil {
+		s.RuleEngine.GetEventBus().Unsubscribe(s.subscription)
+		s.subscription = ""
+	}
+}
+
+// 正常停止的时候主动发 NDEATH
+func (s *sparkplugB) Stop() {
+	if s.CancelCTX != nil {
+		s.CancelCTX()
+	}
+	s.unsubscribeEvents()
+	s.lock.Lock()
+	s.status = typex.SOURCE_STOP
+	client := s.client
+	s.client = nil
+	s.births = map[string]*sparkplugDevice{}
+	s.lock.Unlock()
+	if client != nil {
+		if client.IsConnected() {
+			topic := common.SparkplugTopic(s.mainConfig.GroupId, common.SPARKPLUG_NDEATH, s.mainConfig.EdgeNodeId, "")
+			client.Publish(topic, 1, false, s.deathPayload()).WaitTimeout(time.Second)
+		}
+		client.Disconnect(250)
+	}
+}
+func (s *sparkplugB) Reload() {
+
+}
+func (s *sparkplugB) Pause() {
+
+}
+func (s *sparkplugB) Status() typex.SourceState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status == typex.SOURCE_UP && (s.client == nil || !s.client.IsConnected()) {
+		return typex.SOURCE_DOWN
+	}
+	return s.status
+}
+
+func (s *sparkplugB) Test(inEndId string) bool {
+	return s.Status() == typex.SOURCE_UP
+}
+
+func (s *sparkplugB) Enabled() bool {
+	return s.Enable
+}
+func (s *sparkplugB) Details() *typex.InEnd {
+	return s.RuleEngine.GetInEnd(s.PointId)
+}
+func (*sparkplugB) Driver() typex.XExternalDriver {
+	return nil
+}
+func (*sparkplugB) Configs() *typex.XConfig {
+	return &typex.XConfig{}
+}
+
+// 拓扑
+func (*sparkplugB) Topology() []typex.TopologyPoint {
+	return []typex.TopologyPoint{}
+}
+
+// 设备数据: {"device": "设备UUID", "metrics": {"点位": 值}}
+func (s *sparkplugB) DownStream(bytes []byte) (int, error) {
+	data := sparkplugDeviceData{}
+	if err := json.Unmarshal(bytes, &data); err != nil {
+		return 0, err
+	}
+	if data.Device == "" || len(data.Metrics) == 0 {
+		return 0, errors.New("sparkplug device data need device and metrics")
+	}
+	if err := s.publishDeviceData(data.Device, data.Metrics); err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
+}
+
+// 上行数据
+func (*sparkplugB) UpStream([]byte) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,96 @@
+package sparkplugb
+
+import (
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+*
+* 从 JSON 值推断指标: 布尔是 Boolean, 数字是 Double, 字符串是 String, 其他的转成 JSON 字符串
+*
+ */
+func NewMetric(name string, value interface{}, timestamp uint64) *Payload_Metric {
+	metric := &Payload_Metric{Name: proto.String(name), Timestamp: proto.Uint64(timestamp)}
+	switch v := value.(type) {
+	case nil:
+		metric.Datatype = proto.Uint32(uint32(DataType_String))
+		metric.IsNull = proto.Bool(true)
+	case bool:
+		metric.Datatype = proto.Uint32(uint32(DataType_Boolean))
+		metric.Value = &Payload_Metric_BooleanValue{BooleanValue: v}
+	case float64, float32, int, int64, uint64:
+		metric.Datatype = proto.Uint32(uint32(DataType_Double))
+		metric.Value = &Payload_Metric_DoubleValue{DoubleValue: toFloat(v)}
+	case string:
+		metric.Datatype = proto.Uint32(uint32(DataType_String))
+		metric.Value = &Payload_Metric_StringValue{StringValue: v}
+	default:
+		bytes, _ := json.Marshal(value)
+		metric.Datatype = proto.Uint32(uint32(DataType_String))
+		metric.Value = &Payload_Metric_StringValue{StringValue: string(bytes)}
+	}
+	return metric
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return 0
+}
+
+/*
+*
+* 指标的值: 有符号整数是 int64, 无符号整数是 uint64, Float 和 Double 是 float64,
+* 还有 bool, string 和 []byte; 空值和不支持的类型(DataSet, Template)是 nil
+*
+ */
+func MetricValue(metric *Payload_Metric) interface{} {
+	if metric.GetIsNull() {
+		return nil
+	}
+	switch v := metric.GetValue().(type) {
+	case *Payload_Metric_IntValue:
+		switch DataType(metric.GetDatatype()) {
+		case DataType_Int8, DataType_Int16, DataType_Int32:
+			return int64(int32(v.IntValue))
+		}
+		return uint64(v.IntValue)
+	case *Payload_Metric_LongValue:
+		if DataType(metric.GetDatatype()) == DataType_Int64 {
+			return int64(v.LongValue)
+		}
+		return v.LongValue
+	case *Payload_Metric_FloatValue:
+		return float64(v.FloatValue)
+	case *Payload_Metric_DoubleValue:
+		return v.DoubleValue
+	case *Payload_Metric_BooleanValue:
+		return v.BooleanValue
+	case *Payload_Metric_StringValue:
+		return v.StringValue
+	case *Payload_Metric_BytesValue:
+		return v.BytesValue
+	}
+	return nil
+}
+
+// 指标转成 {"名字": 值}
+func MetricValues(payload *Payload) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, metric := range payload.GetMetrics() {
+		values[metric.GetName()] = MetricValue(metric)
+	}
+	return values
+}
@@ -22,4 +22,6 @@ func LoadSt() {
 	SM.Register(typex.RULEX_UDP, &typex.XConfig{})
 	SM.Register(typex.NATS_SERVER, &typex.XConfig{})
 	SM.Register(typex.MQTT, &typex.XConfig{})
+	SM.Register(typex.SPARKPLUG_B, &typex.XConfig{})
+	SM.Register(typex.KAFKA, &typex.XConfig{})
 }
@@ -34,27 +34,27 @@ func (u *udpSource) Start(cctx typex.CCTX) error {
 		return err
 	}
 	u.status = typex.SOURCE_UP
-	go func(ctx context.Context, u1 *udpSource) {
-		if u.mainConfig.MaxDataLength == 0 {
-			u.mainConfig.MaxDataLength = 4096
-		}
+	if u.mainConfig.MaxDataLength == 0 {
+		u.mainConfig.MaxDataLength = 4096
+	}
+	// 连接直接传进去, Stop 的时候会把 u.uDPConn 置空
+	go func(ctx context.Context, uDPConn *net.UDPConn) {
 		data := make([]byte, u.mainConfig.MaxDataLength)
 		for {
 			select {
 			case <-ctx.Done():
 				{
-					u.status = typex.SOURCE_STOP
 					return
 				}
 			default:
 				{
 				}
 			}
-			n, remoteAddr, err := u1.uDPConn.ReadFromUDP(data)
+			n, remoteAddr, err := uDPConn.ReadFromUDP(data)
 			if err != nil {
 				glogger.GLogger.Error(err.Error())
 				// return ok
-				_, err = u1.uDPConn.WriteToUDP([]byte("err"), remoteAddr)
+				_, err = uDPConn.WriteToUDP([]byte("err"), remoteAddr)
 				if err != nil {
 					glogger.GLogger.Error(err)
 				}
@@ -67,12 +67,12 @@ func (u *udpSource) Start(cctx typex.CCTX) error {
 				continue
 			}
 			// return ok
-			_, err = u1.uDPConn.WriteToUDP([]byte("ok"), remoteAddr)
+			_, err = uDPConn.WriteToUDP([]byte("ok"), remoteAddr)
 			if err != nil {
 				glogger.GLogger.Error(err)
 			}
 		}
-	}(u.Ctx, u)
+	}(u.Ctx, u.uDPConn)
 	u.status = typex.SOURCE_UP
 	glogger.GLogger.Infof("UDP source started on [%v]:%v", u.mainConfig.Host, u.mainConfig.Port)
 	return nil
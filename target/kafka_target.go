@@ -0,0 +1,276 @@
+package target
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/source/kafka"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+/*
+*
+* Kafka 输出: topic 和 key 可以是模板, 字段从消息 JSON 里取; 用 franz-go 的客户端按分区攒批发送,
+* To 把记录放进发送缓冲就返回, 发送结果在回调里处理, 不会一条一条地等 Broker 确认
+*
+ */
+type kafkaTarget struct {
+	typex.XStatus
+	lock       sync.Mutex
+	mainConfig common.KafkaTargetConfig
+	acks       kgo.Acks
+	client     *kgo.Client
+	dialErr    error // 最近一次连接 Broker 的错误, 连上以后清掉
+	status     typex.SourceState
+}
+
+func NewKafkaTarget(e typex.RuleX) typex.XTarget {
+	kt := new(kafkaTarget)
+	kt.RuleEngine = e
+	kt.status = typex.SOURCE_DOWN
+	return kt
+}
+
+func (kt *kafkaTarget) Init(outEndId string, configMap map[string]interface{}) error {
+	kt.PointId = outEndId
+	if err := utils.BindSourceConfig(configMap, &kt.mainConfig); err != nil {
+		return err
+	}
+	kt.acks = kgo.AllISRAcks()
+	if kt.mainConfig.Acks != nil {
+		switch *kt.mainConfig.Acks {
+		case -1:
+		case 0:
+			kt.acks = kgo.NoAck()
+		case 1:
+			kt.acks = kgo.LeaderAck()
+		default:
+			return fmt.Errorf("invalid acks: %d", *kt.mainConfig.Acks)
+		}
+	}
+	if kt.mainConfig.Idempotent && kt.acks != kgo.AllISRAcks() {
+		return errors.New("idempotent producer need acks -1")
+	}
+	if kt.mainConfig.LingerMs <= 0 {
+		kt.mainConfig.LingerMs = 5
+	}
+	if kt.mainConfig.TimeoutMs <= 0 {
+		kt.mainConfig.TimeoutMs = 10000
+	}
+	return nil
+}
+
+func (kt *kafkaTarget) Start(cctx typex.CCTX) error {
+	kt.Ctx = cctx.Ctx
+	kt.CancelCTX = cctx.CancelCTX
+	opts, err := kafka.ClientOpts(kt.mainConfig.KafkaConfig)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(kt.mainConfig.TimeoutMs) * time.Millisecond
+	opts = append(opts,
+		kgo.RequiredAcks(kt.acks),
+		kgo.ProducerLinger(time.Duration(kt.mainConfig.LingerMs)*time.Millisecond),
+		kgo.RecordDeliveryTimeout(timeout),
+		kgo.WithHooks(kt),
+	)
+	if !kt.mainConfig.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if kt.mainConfig.BatchBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(int32(kt.mainConfig.BatchBytes)))
+	}
+	switch kt.mainConfig.Compression {
+	case "gzip":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	case "snappy":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.SnappyCompression()))
+	case "zstd":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.ZstdCompression()))
+	default:
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+	// 地址、证书或者账户不对的时候返回错误
+	ctx, cancel := context.WithTimeout(kt.Ctx, timeout)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		client.Close()
+		return err
+	}
+	kt.lock.Lock()
+	kt.client = client
+	kt.status = typex.SOURCE_UP
+	kt.lock.Unlock()
+	return nil
+}
+
+// kgo.HookBrokerConnect: 记下最近一次连接 Broker 有没有成功
+func (kt *kafkaTarget) OnBrokerConnect(_ kgo.BrokerMetadata, _ time.Duration, _ net.Conn, err error) {
+	kt.lock.Lock()
+	defer kt.lock.Unlock()
+	kt.dialErr = err
+}
+
+func (kt *kafkaTarget) To(data interface{}) (interface{}, error) {
+	kt.lock.Lock()
+	client := kt.client
+	kt.lock.Unlock()
+	if client == nil {
+		return nil, errors.New("kafka client is nil")
+	}
+	payload := ""
+	switch v := data.(type) {
+	case string:
+		payload = v
+	case []byte:
+		payload = string(v)
+	default:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(bytes)
+	}
+	records, err := kt.records(payload)
+	if err != nil {
+		return nil, err
+	}
+	// 一次 To 在统计里只算一条, 里面有多条记录失败也只改一次
+	failed := new(int32)
+	for _, record := range records {
+		client.Produce(kt.Ctx, record, func(record *kgo.Record, err error) {
+			kt.onProduced(record, err, failed)
+		})
+	}
+	return nil, nil
+}
+
+/*
+*
+* 发送结果回调: 重试完了还是失败的记录记日志, 统计里从成功挪到失败;
+* 开了离线缓存的话放进缓存, 等恢复以后补发
+*
+ */
+func (kt *kafkaTarget) onProduced(record *kgo.Record, err error, failed *int32) {
+	if err == nil {
+		return
+	}
+	glogger.GLogger.Errorf("Kafka target [%s] produce to topic [%s] error: %s", kt.PointId, record.Topic, err)
+	if atomic.CompareAndSwapInt32(failed, 0, 1) {
+		kt.RuleEngine.GetMetricStatistics().DecOut()
+		kt.RuleEngine.GetMetricStatistics().IncOutFailed()
+	}
+	if out := kt.Details(); out != nil && out.Cache != nil {
+		if err := out.Cache.Push(string(record.Value)); err != nil {
+			glogger.GLogger.Error("OutEnd cache push error:", kt.PointId, ", ", err)
+		}
+	}
+}
+
+// 没有模板的时候整个消息是一条记录, 有模板的时候 JSON 数组的每个元素是一条记录
+func (kt *kafkaTarget) records(payload string) ([]*kgo.Record, error) {
+	topic, key := kt.mainConfig.Topic, kt.mainConfig.Key
+	if len(utils.TopicTemplateFields(topic)) == 0 && len(utils.TopicTemplateFields(key)) == 0 {
+		return []*kgo.Record{kafkaRecord(topic, key, payload)}, nil
+	}
+	messages, payloads, err := utils.SplitTemplateMessages(payload)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*kgo.Record, 0, len(messages))
+	for i, message := range messages {
+		renderedTopic, err := utils.RenderTemplate(topic, message)
+		if err != nil {
+			return nil, err
+		}
+		renderedKey, err := utils.RenderTemplate(key, message)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, kafkaRecord(renderedTopic, renderedKey, payloads[i]))
+	}
+	return records, nil
+}
+
+func kafkaRecord(topic, key, payload string) *kgo.Record {
+	record := &kgo.Record{Topic: topic, Value: []byte(payload)}
+	if key != "" {
+		record.Key = []byte(key)
+	}
+	return record
+}
+
+func (kt *kafkaTarget) Test(outEndId string) bool {
+	return kt.Status() == typex.SOURCE_UP
+}
+
+func (kt *kafkaTarget) Enabled() bool {
+	return kt.Enable
+}
+
+func (kt *kafkaTarget) Reload() {
+
+}
+
+func (kt *kafkaTarget) Pause() {
+
+}
+
+// 连不上 Broker 的时候是 DOWN
+func (kt *kafkaTarget) Status() typex.SourceState {
+	kt.lock.Lock()
+	defer kt.lock.Unlock()
+	if kt.status == typex.SOURCE_UP && kt.dialErr != nil {
+		return typex.SOURCE_DOWN
+	}
+	return kt.status
+}
+
+func (kt *kafkaTarget) Details() *typex.OutEnd {
+	return kt.RuleEngine.GetOutEnd(kt.PointId)
+}
+
+func (kt *kafkaTarget) Configs() *typex.XConfig {
+	return &typex.XConfig{}
+}
+
+func (kt *kafkaTarget) Stop() {
+	kt.lock.Lock()
+	kt.status = typex.SOURCE_STOP
+	client := kt.client
+	kt.client = nil
+	kt.lock.Unlock()
+	// 缓冲里还没发出去的记录先发完, 最多等一个发送超时
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(kt.mainConfig.TimeoutMs)*time.Millisecond)
+		if err := client.Flush(ctx); err != nil {
+			glogger.GLogger.Error("Kafka target flush error:", kt.PointId, ", ", err)
+		}
+		cancel()
+	}
+	if kt.CancelCTX != nil {
+		kt.CancelCTX()
+	}
+	if client != nil {
+		client.Close()
+	}
+}
+
+func (*kafkaTarget) Driver() typex.XExternalDriver {
+	return nil
+}
@@ -1,30 +1,49 @@
 package target
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
 	"github.com/hootrhino/rulex/typex"
 	"github.com/hootrhino/rulex/utils"
 
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-//
+const (
+	// 发布等待确认的超时时间
+	mqttPublishTimeout = 5 * time.Second
+	// 连接超时, 也是启动的时候等第一次连接成功的时间
+	mqttConnectTimeout = 10 * time.Second
+	// MQTT5 断线以后重连的间隔
+	mqttReconnectInterval = 5 * time.Second
+)
 
 type mqttOutEndTarget struct {
 	typex.XStatus
 	client     mqtt.Client
-	mainConfig common.MqttConfig
+	client5    *autopaho.ConnectionManager // protocolVersion 是 5 的时候用
+	mainConfig common.MqttTargetConfig
+	qos        byte
 	status     typex.SourceState
+	// MQTT5 的连接状态, autopaho 没有提供, 在连接和断开的回调里面维护
+	locker     sync.Mutex
+	connected5 bool
 }
 
 func NewMqttTarget(e typex.RuleX) typex.XTarget {
 	m := new(mqttOutEndTarget)
 	m.RuleEngine = e
-	m.mainConfig = common.MqttConfig{}
+	m.mainConfig = common.MqttTargetConfig{}
 	m.status = typex.SOURCE_DOWN
 	return m
 }
@@ -36,11 +55,30 @@ func (mm *mqttOutEndTarget) Init(outEndId string, configMap map[string]interface
 	if err := utils.BindSourceConfig(configMap, &mm.mainConfig); err != nil {
 		return err
 	}
+	if mm.mainConfig.PubTopic == "" {
+		return errors.New("pubTopic is required")
+	}
+	mm.qos = 1
+	if mm.mainConfig.Qos != nil {
+		if *mm.mainConfig.Qos < 0 || *mm.mainConfig.Qos > 2 {
+			return fmt.Errorf("invalid qos: %d", *mm.mainConfig.Qos)
+		}
+		mm.qos = byte(*mm.mainConfig.Qos)
+	}
+	if mm.mainConfig.PersistSession && mm.mainConfig.SessionExpiry == 0 {
+		mm.mainConfig.SessionExpiry = 3600
+	}
+	if mm.mainConfig.Keepalive == 0 {
+		mm.mainConfig.Keepalive = 30
+	}
 	return nil
 }
 func (mm *mqttOutEndTarget) Start(cctx typex.CCTX) error {
 	mm.Ctx = cctx.Ctx
 	mm.CancelCTX = cctx.CancelCTX
+	if mm.mainConfig.ProtocolVersion == 5 {
+		return mm.startMqtt5()
+	}
 	//
 	//
 	var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
@@ -50,15 +88,25 @@ func (mm *mqttOutEndTarget) Start(cctx typex.CCTX) error {
 	var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 		glogger.GLogger.Warnf("Connect lost: %v, try to reconnect\n", err)
 	}
+	broker, tlsConfig, err := mm.mainConfig.TlsConfig.Broker(mm.mainConfig.Host, mm.mainConfig.Port)
+	if err != nil {
+		return err
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%v", mm.mainConfig.Host, mm.mainConfig.Port))
+	opts.AddBroker(broker)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetClientID(mm.mainConfig.ClientId)
 	opts.SetUsername(mm.mainConfig.Username)
 	opts.SetPassword(mm.mainConfig.Password)
 	opts.OnConnect = connectHandler
 	opts.OnConnectionLost = connectLostHandler
-	opts.SetAutoReconnect(false)
-	opts.SetMaxReconnectInterval(0)
+	// 保持会话的时候服务端保留会话, 重连以后客户端重发没有确认的消息
+	opts.SetCleanSession(!mm.mainConfig.PersistSession)
+	opts.SetKeepAlive(time.Duration(mm.mainConfig.Keepalive) * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(10 * time.Second)
 	mm.client = mqtt.NewClient(opts)
 	token := mm.client.Connect()
 	if token.Wait() && token.Error() != nil {
@@ -70,6 +118,87 @@ func (mm *mqttOutEndTarget) Start(cctx typex.CCTX) error {
 
 }
 
+/*
+*
+* MQTT5 用 autopaho: 心跳由 paho 维护, 断线以后按固定间隔重连;
+* 启动的时候等第一次连接成功, 连不上就返回错误
+*
+ */
+func (mm *mqttOutEndTarget) startMqtt5() error {
+	broker, tlsConfig, err := mm.mainConfig.TlsConfig.Broker(mm.mainConfig.Host, mm.mainConfig.Port)
+	if err != nil {
+		return err
+	}
+	brokerUrl, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	config := autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{brokerUrl},
+		TlsCfg:            tlsConfig,
+		KeepAlive:         mm.mainConfig.Keepalive,
+		ConnectRetryDelay: mqttReconnectInterval,
+		ConnectTimeout:    mqttConnectTimeout,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			mm.setConnected5(true)
+			glogger.GLogger.Infof("Mqtt5 OutEnd Connected Success")
+		},
+		OnConnectError: func(err error) {
+			mm.locker.Lock()
+			lastErr = err
+			mm.locker.Unlock()
+			glogger.GLogger.Warnf("Mqtt5 connect error: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: mm.mainConfig.ClientId,
+			OnClientError: func(err error) {
+				mm.setConnected5(false)
+				glogger.GLogger.Warnf("Connect lost: %v, try to reconnect", err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				mm.setConnected5(false)
+				glogger.GLogger.Warnf("Disconnected by server, reason code: 0x%02x, try to reconnect",
+					disconnect.ReasonCode)
+			},
+		},
+	}
+	config.SetUsernamePassword(mm.mainConfig.Username, []byte(mm.mainConfig.Password))
+	// 保持会话的时候服务端按 sessionExpiry 保留会话
+	config.SetConnectPacketConfigurator(func(connect *paho.Connect) *paho.Connect {
+		connect.CleanStart = !mm.mainConfig.PersistSession
+		if mm.mainConfig.SessionExpiry > 0 {
+			expiry := mm.mainConfig.SessionExpiry
+			connect.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+		}
+		return connect
+	})
+	client, err := autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(mm.Ctx, mqttConnectTimeout)
+	defer cancel()
+	if err := client.AwaitConnection(ctx); err != nil {
+		client.Disconnect(context.Background())
+		mm.locker.Lock()
+		defer mm.locker.Unlock()
+		if lastErr != nil {
+			return lastErr
+		}
+		return err
+	}
+	mm.client5 = client
+	mm.status = typex.SOURCE_UP
+	return nil
+}
+
+func (mm *mqttOutEndTarget) setConnected5(connected bool) {
+	mm.locker.Lock()
+	mm.connected5 = connected
+	mm.locker.Unlock()
+}
+
 func (mm *mqttOutEndTarget) DataModels() []typex.XDataModel {
 	return mm.XDataModels
 }
@@ -81,6 +210,13 @@ func (mm *mqttOutEndTarget) Stop() {
 		mm.client.Disconnect(0)
 		mm.client = nil
 	}
+	if mm.client5 != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttConnectTimeout)
+		mm.client5.Disconnect(ctx)
+		cancel()
+		mm.client5 = nil
+		mm.setConnected5(false)
+	}
 }
 func (mm *mqttOutEndTarget) Reload() {
 
@@ -89,14 +225,24 @@ func (mm *mqttOutEndTarget) Pause() {
 
 }
 func (mm *mqttOutEndTarget) Status() typex.SourceState {
+	// 断线以后要反映出来, 否则离线缓存永远不会生效
+	if mm.status == typex.SOURCE_UP && !mm.connected() {
+		return typex.SOURCE_DOWN
+	}
 	return mm.status
 }
 
-func (mm *mqttOutEndTarget) Test(outEndId string) bool {
-	if mm.client != nil {
-		return mm.client.IsConnected()
+func (mm *mqttOutEndTarget) connected() bool {
+	if mm.client5 != nil {
+		mm.locker.Lock()
+		defer mm.locker.Unlock()
+		return mm.connected5
 	}
-	return false
+	return mm.client != nil && mm.client.IsConnected()
+}
+
+func (mm *mqttOutEndTarget) Test(outEndId string) bool {
+	return mm.connected()
 }
 
 func (mm *mqttOutEndTarget) Enabled() bool {
@@ -106,12 +252,109 @@ func (mm *mqttOutEndTarget) Details() *typex.OutEnd {
 	return mm.RuleEngine.GetOutEnd(mm.PointId)
 }
 
+/*
+*
+* 发布数据: Topic 模板里有字段的时候数据必须是 JSON, 数组的每个元素单独发布到自己的 Topic;
+* 有一条发布失败就返回错误
+*
+ */
 func (mm *mqttOutEndTarget) To(data interface{}) (interface{}, error) {
-	if mm.client != nil {
-		token := mm.client.Publish(mm.mainConfig.PubTopic, 1, false, data)
-		return token.Error(), nil
+	if mm.client == nil && mm.client5 == nil {
+		return nil, errors.New("mqtt client is nil")
+	}
+	payload := ""
+	switch v := data.(type) {
+	case string:
+		payload = v
+	case []byte:
+		payload = string(v)
+	default:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(bytes)
+	}
+	if !mm.isTemplate() {
+		return nil, mm.publish(mm.mainConfig.PubTopic, payload, nil)
+	}
+	messages, payloads, err := utils.SplitTemplateMessages(payload)
+	if err != nil {
+		return nil, err
+	}
+	for i, message := range messages {
+		topic, err := utils.RenderTopicTemplate(mm.mainConfig.PubTopic, message)
+		if err != nil {
+			return nil, err
+		}
+		if err := mm.publish(topic, payloads[i], message); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Topic, 响应 Topic 和用户属性里有没有模板字段
+func (mm *mqttOutEndTarget) isTemplate() bool {
+	templates := []string{mm.mainConfig.PubTopic}
+	if mm.mainConfig.ProtocolVersion == 5 {
+		templates = append(templates, mm.mainConfig.ResponseTopic)
+		for _, value := range mm.mainConfig.UserProperties {
+			templates = append(templates, value)
+		}
+	}
+	for _, template := range templates {
+		if len(utils.TopicTemplateFields(template)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (mm *mqttOutEndTarget) publish(topic string, payload string, message map[string]interface{}) error {
+	if mm.client5 == nil {
+		token := mm.client.Publish(topic, mm.qos, mm.mainConfig.Retain, payload)
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			return fmt.Errorf("mqtt publish timeout: %s", topic)
+		}
+		return token.Error()
 	}
-	return nil, errors.New("mqtt client is nil")
+	properties := &paho.PublishProperties{}
+	if mm.mainConfig.MessageExpiry > 0 {
+		expiry := mm.mainConfig.MessageExpiry
+		properties.MessageExpiry = &expiry
+	}
+	if mm.mainConfig.ResponseTopic != "" {
+		responseTopic, err := utils.RenderTopicTemplate(mm.mainConfig.ResponseTopic, message)
+		if err != nil {
+			return err
+		}
+		properties.ResponseTopic = responseTopic
+	}
+	for key, value := range mm.mainConfig.UserProperties {
+		value, err := utils.RenderTopicTemplate(value, message)
+		if err != nil {
+			return err
+		}
+		properties.User.Add(key, value)
+	}
+	ctx, cancel := context.WithTimeout(mm.Ctx, mqttPublishTimeout)
+	defer cancel()
+	response, err := mm.client5.Publish(ctx, &paho.Publish{
+		QoS:        mm.qos,
+		Retain:     mm.mainConfig.Retain,
+		Topic:      topic,
+		Payload:    []byte(payload),
+		Properties: properties,
+	})
+	if err != nil {
+		return err
+	}
+	// QoS2 收到的 PUBREC 带错误码的时候 paho 不返回错误
+	if response != nil && response.ReasonCode >= 0x80 {
+		return fmt.Errorf("mqtt5 publish failed, reason code: 0x%02x", response.ReasonCode)
+	}
+	return nil
 }
 
 /*
@@ -0,0 +1,134 @@
+package target
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+)
+
+/*
+*
+* Sparkplug B 输出: 数据格式是 {"device": "设备UUID", "metrics": {"点位": 值}},
+* 交给 sourceId 指定的 Sparkplug B 边缘节点发布 DBIRTH 或者 DDATA
+*
+ */
+type sparkplugBTarget struct {
+	typex.XStatus
+	lock       sync.Mutex
+	mainConfig common.SparkplugBTargetConfig
+	status     typex.SourceState
+}
+
+func NewSparkplugBTarget(e typex.RuleX) typex.XTarget {
+	st := new(sparkplugBTarget)
+	st.RuleEngine = e
+	st.status = typex.SOURCE_DOWN
+	return st
+}
+
+func (st *sparkplugBTarget) Init(outEndId string, configMap map[string]interface{}) error {
+	st.PointId = outEndId
+	if err := utils.BindSourceConfig(configMap, &st.mainConfig); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (st *sparkplugBTarget) Start(cctx typex.CCTX) error {
+	st.Ctx = cctx.Ctx
+	st.CancelCTX = cctx.CancelCTX
+	if _, err := st.edgeNode(); err != nil {
+		return err
+	}
+	st.setStatus(typex.SOURCE_UP)
+	return nil
+}
+
+func (st *sparkplugBTarget) edgeNode() (*typex.InEnd, error) {
+	in := st.RuleEngine.GetInEnd(st.mainConfig.SourceId)
+	if in == nil || in.Source == nil {
+		return nil, fmt.Errorf("sparkplug source not exists: %s", st.mainConfig.SourceId)
+	}
+	if in.Type != typex.SPARKPLUG_B {
+		return nil, fmt.Errorf("source is not sparkplug edge node: %s", st.mainConfig.SourceId)
+	}
+	return in, nil
+}
+
+func (st *sparkplugBTarget) setStatus(status typex.SourceState) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.status = status
+}
+
+func (st *sparkplugBTarget) Status() typex.SourceState {
+	st.lock.Lock()
+	status := st.status
+	st.lock.Unlock()
+	// 边缘节点断线的时候也是 DOWN, 离线缓存才会生效
+	if status == typex.SOURCE_UP {
+		if in, err := st.edgeNode(); err != nil || in.Source.Status() != typex.SOURCE_UP {
+			return typex.SOURCE_DOWN
+		}
+	}
+	return status
+}
+
+func (st *sparkplugBTarget) To(data interface{}) (interface{}, error) {
+	in, err := st.edgeNode()
+	if err != nil {
+		return nil, err
+	}
+	switch v := data.(type) {
+	case string:
+		_, err = in.Source.DownStream([]byte(v))
+	case []byte:
+		_, err = in.Source.DownStream(v)
+	default:
+		bytes, err1 := json.Marshal(v)
+		if err1 != nil {
+			return nil, err1
+		}
+		_, err = in.Source.DownStream(bytes)
+	}
+	return nil, err
+}
+
+func (st *sparkplugBTarget) Test(outEndId string) bool {
+	return st.Status() == typex.SOURCE_UP
+}
+
+func (st *sparkplugBTarget) Enabled() bool {
+	return st.Enable
+}
+
+func (st *sparkplugBTarget) Reload() {
+
+}
+
+func (st *sparkplugBTarget) Pause() {
+
+}
+
+func (st *sparkplugBTarget) Details() *typex.OutEnd {
+	return st.RuleEngine.GetOutEnd(st.PointId)
+}
+
+func (st *sparkplugBTarget) Configs() *typex.XConfig {
+	return &typex.XConfig{}
+}
+
+func (st *sparkplugBTarget) Stop() {
+	st.setStatus(typex.SOURCE_STOP)
+	if st.CancelCTX != nil {
+		st.CancelCTX()
+	}
+}
+
+func (*sparkplugBTarget) Driver() typex.XExternalDriver {
+	return nil
+}
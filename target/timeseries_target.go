@@ -0,0 +1,498 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/hootrhino/rulex/utils"
+)
+
+const (
+	_timeseries_INFLUXDB_V1 = "INFLUXDB_V1"
+	_timeseries_INFLUXDB_V2 = "INFLUXDB_V2"
+	_timeseries_PROMETHEUS  = "PROMETHEUS"
+)
+
+// InfluxDB v1 的时间精度写法和 v2 不一样
+var influxV1Precisions = map[string]string{"ns": "n", "us": "u", "ms": "ms", "s": "s"}
+
+/*
+*
+* 时序数据库输出: 消息按 mapping 转成数据点放进缓存, 攒够 batchSize 或者到了 flushIntervalMs
+* 以后写到 InfluxDB(行协议) 或者 Prometheus(remote write); 网络错误、429 和 5xx 重试,
+* 其它错误丢掉这一批
+*
+ */
+type timeSeriesTarget struct {
+	typex.XStatus
+	lock       sync.Mutex
+	mainConfig common.TimeSeriesTargetConfig
+	client     http.Client
+	buffer     []common.TimeSeriesPoint
+	flushing   chan struct{}
+	done       chan struct{}
+	status     typex.SourceState
+}
+
+type timeSeriesWriteError struct {
+	statusCode int
+	body       string
+}
+
+func (e *timeSeriesWriteError) Error() string {
+	return fmt.Sprintf("timeseries write error, status: %d, body: %s", e.statusCode, e.body)
+}
+
+func NewTimeSeriesTarget(e typex.RuleX) typex.XTarget {
+	ts := new(timeSeriesTarget)
+	ts.RuleEngine = e
+	ts.status = typex.SOURCE_DOWN
+	return ts
+}
+
+func (ts *timeSeriesTarget) Init(outEndId string, configMap map[string]interface{}) error {
+	ts.PointId = outEndId
+	if err := utils.BindSourceConfig(configMap, &ts.mainConfig); err != nil {
+		return err
+	}
+	switch ts.mainConfig.Protocol {
+	case _timeseries_INFLUXDB_V1:
+		if ts.mainConfig.Database == "" {
+			return errors.New("influxdb v1 need database")
+		}
+	case _timeseries_INFLUXDB_V2:
+		if ts.mainConfig.Org == "" || ts.mainConfig.Bucket == "" {
+			return errors.New("influxdb v2 need org and bucket")
+		}
+	}
+	if ts.mainConfig.Precision == "" {
+		ts.mainConfig.Precision = "ms"
+	}
+	if ts.mainConfig.BatchSize <= 0 {
+		ts.mainConfig.BatchSize = 500
+	}
+	if ts.mainConfig.FlushIntervalMs <= 0 {
+		ts.mainConfig.FlushIntervalMs = 1000
+	}
+	if ts.mainConfig.MaxRetries == 0 {
+		ts.mainConfig.MaxRetries = 3
+	}
+	if ts.mainConfig.RetryIntervalMs <= 0 {
+		ts.mainConfig.RetryIntervalMs = 500
+	}
+	if ts.mainConfig.MaxBufferSize <= 0 {
+		ts.mainConfig.MaxBufferSize = 10000
+	}
+	if ts.mainConfig.TimeoutMs <= 0 {
+		ts.mainConfig.TimeoutMs = 5000
+	}
+	ts.client = http.Client{Timeout: time.Duration(ts.mainConfig.TimeoutMs) * time.Millisecond}
+	return nil
+}
+
+func (ts *timeSeriesTarget) Start(cctx typex.CCTX) error {
+	ts.Ctx = cctx.Ctx
+	ts.CancelCTX = cctx.CancelCTX
+	if err := ts.ping(); err != nil {
+		return err
+	}
+	ts.lock.Lock()
+	ts.flushing = make(chan struct{}, 1)
+	ts.done = make(chan struct{})
+	ts.status = typex.SOURCE_UP
+	ts.lock.Unlock()
+	go ts.flushLoop(ts.Ctx, ts.flushing, ts.done)
+	return nil
+}
+
+// InfluxDB 用 /ping 检查能不能连上; Prometheus remote write 没有检查的接口
+func (ts *timeSeriesTarget) ping() error {
+	if ts.mainConfig.Protocol == _timeseries_PROMETHEUS {
+		return nil
+	}
+	request, err := http.NewRequest("GET", strings.TrimRight(ts.mainConfig.Url, "/")+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	ts.authorize(request)
+	response, err := ts.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(response.Body)
+		return &timeSeriesWriteError{statusCode: response.StatusCode, body: string(body)}
+	}
+	return nil
+}
+
+/*
+*
+* 数据转成数据点放进缓存, 转换失败的时候返回错误; 写入是异步的
+*
+ */
+func (ts *timeSeriesTarget) To(data interface{}) (interface{}, error) {
+	payload := ""
+	switch v := data.(type) {
+	case string:
+		payload = v
+	case []byte:
+		payload = string(v)
+	default:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(bytes)
+	}
+	points, err := timeSeriesPoints(ts.mainConfig.Mapping, payload, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.status != typex.SOURCE_UP {
+		return nil, errors.New("timeseries target is not running")
+	}
+	ts.buffer = append(ts.buffer, points...)
+	if overflow := len(ts.buffer) - ts.mainConfig.MaxBufferSize; overflow > 0 {
+		glogger.GLogger.Warnf("TimeSeries buffer full, drop %d oldest points", overflow)
+		ts.buffer = append([]common.TimeSeriesPoint{}, ts.buffer[overflow:]...)
+	}
+	if len(ts.buffer) >= ts.mainConfig.BatchSize {
+		select {
+		case ts.flushing <- struct{}{}:
+		default:
+		}
+	}
+	return nil, nil
+}
+
+func (ts *timeSeriesTarget) flushLoop(ctx context.Context, flushing chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Duration(ts.mainConfig.FlushIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// 停止的时候把缓存里的数据写完, 不再重试
+			final, cancel := context.WithTimeout(context.Background(),
+				time.Duration(ts.mainConfig.TimeoutMs)*time.Millisecond)
+			ts.flush(final, false)
+			cancel()
+			return
+		case <-ticker.C:
+			ts.flush(ctx, true)
+		case <-flushing:
+			ts.flush(ctx, true)
+		}
+	}
+}
+
+// 每次取出 batchSize 个数据点写入, 直到缓存空了
+func (ts *timeSeriesTarget) flush(ctx context.Context, retry bool) {
+	for {
+		ts.lock.Lock()
+		size := len(ts.buffer)
+		if size > ts.mainConfig.BatchSize {
+			size = ts.mainConfig.BatchSize
+		}
+		batch := ts.buffer[:size]
+		ts.buffer = ts.buffer[size:]
+		ts.lock.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := ts.write(ctx, batch, retry); err != nil {
+			glogger.GLogger.Errorf("TimeSeries write %d points failed: %v", len(batch), err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (ts *timeSeriesTarget) write(ctx context.Context, points []common.TimeSeriesPoint, retry bool) error {
+	retries := ts.mainConfig.MaxRetries
+	if !retry || retries < 0 {
+		retries = 0
+	}
+	interval := time.Duration(ts.mainConfig.RetryIntervalMs) * time.Millisecond
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = ts.post(ctx, points); err == nil {
+			return nil
+		}
+		var writeErr *timeSeriesWriteError
+		if errors.As(err, &writeErr) && writeErr.statusCode != http.StatusTooManyRequests &&
+			writeErr.statusCode/100 != 5 {
+			return err
+		}
+		if attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+func (ts *timeSeriesTarget) post(ctx context.Context, points []common.TimeSeriesPoint) error {
+	address := strings.TrimRight(ts.mainConfig.Url, "/")
+	query := url.Values{}
+	var body []byte
+	switch ts.mainConfig.Protocol {
+	case _timeseries_INFLUXDB_V1:
+		address += "/write"
+		query.Set("db", ts.mainConfig.Database)
+		if ts.mainConfig.RetentionPolicy != "" {
+			query.Set("rp", ts.mainConfig.RetentionPolicy)
+		}
+		query.Set("precision", influxV1Precisions[ts.mainConfig.Precision])
+		body = common.EncodeLineProtocol(points, ts.mainConfig.Precision)
+	case _timeseries_INFLUXDB_V2:
+		address += "/api/v2/write"
+		query.Set("org", ts.mainConfig.Org)
+		query.Set("bucket", ts.mainConfig.Bucket)
+		query.Set("precision", ts.mainConfig.Precision)
+		body = common.EncodeLineProtocol(points, ts.mainConfig.Precision)
+	case _timeseries_PROMETHEUS:
+		address = ts.mainConfig.Url
+		var err error
+		if body, err = common.EncodeRemoteWrite(points); err != nil {
+			return err
+		}
+	}
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if ts.mainConfig.Protocol == _timeseries_PROMETHEUS {
+		request.Header.Set("Content-Type", "application/x-protobuf")
+		request.Header.Set("Content-Encoding", "snappy")
+		request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	} else {
+		request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	ts.authorize(request)
+	response, err := ts.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		responseBody, _ := io.ReadAll(response.Body)
+		return &timeSeriesWriteError{statusCode: response.StatusCode, body: string(responseBody)}
+	}
+	return nil
+}
+
+func (ts *timeSeriesTarget) authorize(request *http.Request) {
+	if ts.mainConfig.Username != "" {
+		request.SetBasicAuth(ts.mainConfig.Username, ts.mainConfig.Password)
+		return
+	}
+	if ts.mainConfig.Token == "" {
+		return
+	}
+	if ts.mainConfig.Protocol == _timeseries_PROMETHEUS {
+		request.Header.Set("Authorization", "Bearer "+ts.mainConfig.Token)
+	} else {
+		request.Header.Set("Authorization", "Token "+ts.mainConfig.Token)
+	}
+}
+
+/*
+*
+* 消息转成数据点: JSON 对象是一个数据点, JSON 数组的每个对象是一个数据点;
+* 没有配置 fields 的时候消息里除了标签、measurement 和时间用到的字段以外的简单值都是字段
+*
+ */
+func timeSeriesPoints(mapping common.TimeSeriesMapping, payload string, now time.Time) ([]common.TimeSeriesPoint, error) {
+	messages, _, err := utils.SplitTemplateMessages(payload)
+	if err != nil {
+		return nil, err
+	}
+	// 模板和时间用到的顶层字段不当作数据字段
+	used := map[string]bool{}
+	templates := []string{mapping.Measurement}
+	for _, tag := range mapping.Tags {
+		templates = append(templates, tag)
+	}
+	for _, template := range templates {
+		for _, field := range utils.TopicTemplateFields(template) {
+			used[strings.Split(field, ".")[0]] = true
+		}
+	}
+	if mapping.Timestamp != "" {
+		used[strings.Split(mapping.Timestamp, ".")[0]] = true
+	}
+	points := make([]common.TimeSeriesPoint, 0, len(messages))
+	for _, message := range messages {
+		point := common.TimeSeriesPoint{
+			Tags:   map[string]string{},
+			Fields: map[string]interface{}{},
+			Time:   now,
+		}
+		if point.Measurement, err = utils.RenderTemplate(mapping.Measurement, message); err != nil {
+			return nil, err
+		}
+		for name, template := range mapping.Tags {
+			if point.Tags[name], err = utils.RenderTemplate(template, message); err != nil {
+				return nil, err
+			}
+		}
+		if len(mapping.Fields) > 0 {
+			// 设备不一定每次都上报所有的点位, 没有的字段跳过
+			for name, path := range mapping.Fields {
+				if value, ok := lookupTimeSeriesField(message, path); ok {
+					if value, ok = timeSeriesValue(value); ok {
+						point.Fields[name] = value
+					}
+				}
+			}
+		} else {
+			for name, value := range message {
+				if used[name] {
+					continue
+				}
+				if value, ok := timeSeriesValue(value); ok {
+					point.Fields[name] = value
+				}
+			}
+		}
+		if len(point.Fields) == 0 {
+			return nil, fmt.Errorf("timeseries point has no field: %s", point.Measurement)
+		}
+		if mapping.Timestamp != "" {
+			if point.Time, err = timeSeriesTimestamp(message, mapping.Timestamp, mapping.TimestampUnit); err != nil {
+				return nil, err
+			}
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func lookupTimeSeriesField(message map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = message
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// 数字转成 float64; 带数据质量的点位 {"value": 1, "quality": "GOOD"} 取 value
+func timeSeriesValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case bool, string:
+		return v, true
+	case map[string]interface{}:
+		if inner, ok := v["value"]; ok {
+			if _, ok := v["quality"]; ok {
+				return timeSeriesValue(inner)
+			}
+		}
+	}
+	return nil, false
+}
+
+// 时间字段可以是数字(单位是 timestampUnit)或者 RFC3339 格式的字符串
+func timeSeriesTimestamp(message map[string]interface{}, path, unit string) (time.Time, error) {
+	value, ok := lookupTimeSeriesField(message, path)
+	if !ok {
+		return time.Time{}, fmt.Errorf("timestamp field not found: %s", path)
+	}
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return time.Unix(0, i*int64(common.TimeSeriesPrecision(unit))), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(common.TimeSeriesPrecision(unit)))), nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp field: %s=%v", path, value)
+}
+
+func (ts *timeSeriesTarget) Test(outEndId string) bool {
+	return ts.Status() == typex.SOURCE_UP
+}
+
+func (ts *timeSeriesTarget) Enabled() bool {
+	return ts.Enable
+}
+
+func (ts *timeSeriesTarget) Reload() {
+
+}
+
+func (ts *timeSeriesTarget) Pause() {
+
+}
+
+func (ts *timeSeriesTarget) Status() typex.SourceState {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.status
+}
+
+func (ts *timeSeriesTarget) Details() *typex.OutEnd {
+	return ts.RuleEngine.GetOutEnd(ts.PointId)
+}
+
+func (ts *timeSeriesTarget) Configs() *typex.XConfig {
+	return &typex.XConfig{}
+}
+
+// 停止以后等缓存里的数据写完
+func (ts *timeSeriesTarget) Stop() {
+	ts.lock.Lock()
+	ts.status = typex.SOURCE_STOP
+	done := ts.done
+	ts.lock.Unlock()
+	if ts.CancelCTX != nil {
+		ts.CancelCTX()
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+func (*timeSeriesTarget) Driver() typex.XExternalDriver {
+	return nil
+}
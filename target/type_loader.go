@@ -21,4 +21,7 @@ func LoadTt() {
 	TM.Register(typex.MQTT_TARGET, &typex.XConfig{})
 	TM.Register(typex.NATS_TARGET, &typex.XConfig{})
 	TM.Register(typex.TDENGINE_TARGET, &typex.XConfig{})
+	TM.Register(typex.SPARKPLUG_B_TARGET, &typex.XConfig{})
+	TM.Register(typex.KAFKA_TARGET, &typex.XConfig{})
+	TM.Register(typex.TIMESERIES_TARGET, &typex.XConfig{})
 }
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/configdir"
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+)
+
+const configDirTestTemplate = `
+inends:
+  - uuid: INEND_CONFIG_DIR
+    name: udp
+    type: RULEX_UDP
+    config:
+      host: 127.0.0.1
+      port: %d
+      maxDataLength: 1024
+rules:
+  - uuid: RULE_CONFIG_DIR_BOUND
+    name: bound
+    fromSource: [INEND_CONFIG_DIR]
+    actions: |
+      Actions = {function(args) return true, args end} -- %s
+%s
+`
+
+const configDirTestUnboundRule = `
+  - uuid: RULE_CONFIG_DIR_UNBOUND
+    name: unbound
+    actions: |
+      Actions = {function(args) return true, args end}
+`
+
+func Test_Config_Dir(t *testing.T) {
+	engine, server, _, _ := newHttpApiTestServer(t, "./config-dir-unitest.db")
+	dir := t.TempDir()
+	port := freeTcpPort(t)
+	writeConfig := func(comment string, extra string) {
+		content := fmt.Sprintf(configDirTestTemplate, port, comment, extra)
+		if err := os.WriteFile(filepath.Join(dir, "gateway.yaml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("v1", configDirTestUnboundRule)
+	report, err := configdir.Reconcile(dir, server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.LoadErrors) != 0 {
+		t.Fatal("load failed:", report.LoadErrors)
+	}
+	inEnd := engine.GetInEnd("INEND_CONFIG_DIR")
+	if inEnd == nil || engine.GetRule("RULE_CONFIG_DIR_UNBOUND") == nil {
+		t.Fatal("resources should be loaded")
+	}
+	if _, ok := inEnd.BindRules["RULE_CONFIG_DIR_BOUND"]; !ok {
+		t.Fatal("rule should bind to inend:", inEnd.BindRules)
+	}
+	// 没有变化的时候什么都不做
+	report, _ = configdir.Reconcile(dir, server, true)
+	if len(report.Created) != 0 || len(report.Updated) != 0 || len(report.Deleted) != 0 {
+		t.Fatal("unchanged directory should not change anything:", report)
+	}
+	// 修改规则, 删掉没有绑定的规则
+	writeConfig("v2", "")
+	report, err = configdir.Reconcile(dir, server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Updated["RULE"]) != 1 || len(report.Deleted["RULE"]) != 1 {
+		t.Fatal("unexpected report:", report)
+	}
+	if engine.GetRule("RULE_CONFIG_DIR_UNBOUND") != nil {
+		t.Fatal("deleted rule should be removed")
+	}
+	rule := engine.GetInEnd("INEND_CONFIG_DIR").BindRules["RULE_CONFIG_DIR_BOUND"]
+	if !strings.Contains(rule.Actions, "v2") {
+		t.Fatal("inend should reload the updated rule:", rule.Actions)
+	}
+	// 引用不存在的资源, 保持现有配置
+	os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte(`
+rules:
+  - uuid: RULE_CONFIG_DIR_BROKEN
+    fromSource: [INEND_NOT_EXISTS]
+    actions: "Actions = {}"
+`), 0644)
+	if _, err := configdir.Reconcile(dir, server, true); err == nil {
+		t.Fatal("invalid directory should be rejected")
+	}
+	var total int64
+	sqlitedao.Sqlite.DB().Model(&model.MRule{}).Count(&total)
+	if total != 1 {
+		t.Fatal("invalid directory should not change database:", total)
+	}
+	os.Remove(filepath.Join(dir, "broken.yaml"))
+	// 监听目录变化
+	t.Cleanup(func() { os.Remove("./apps/APP_CONFIG_DIR.lua") })
+	watcher := configdir.Watch(dir, 100*time.Millisecond, server)
+	writeConfig("v2", `
+apps:
+  - uuid: APP_CONFIG_DIR
+    name: app
+    version: 1.0.0
+    luaSource: |
+      AppNAME = "app"
+      AppVERSION = "1.0.0"
+      function Main(arg) return 0 end
+`)
+	loaded := false
+	for i := 0; i < 30 && !loaded; i++ {
+		loaded = engine.GetApp("APP_CONFIG_DIR") != nil
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !loaded {
+		t.Fatal("app should be loaded after directory changed")
+	}
+	// 停止以后不再监听
+	watcher.Stop()
+	writeConfig("v3", configDirTestUnboundRule)
+	time.Sleep(300 * time.Millisecond)
+	if engine.GetRule("RULE_CONFIG_DIR_UNBOUND") != nil {
+		t.Fatal("stopped watcher should not watch directory")
+	}
+}
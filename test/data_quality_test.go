@@ -0,0 +1,112 @@
+package test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+func Test_Filter_Quality(t *testing.T) {
+	data := `{"a":{"value":1,"quality":"GOOD"},"b":{"value":2,"quality":"BAD_COMM"},"c":3}`
+	// 不过滤
+	if filtered, ok := common.FilterQuality(data, nil); !ok || filtered != data {
+		t.Fatal("empty filter should pass:", filtered)
+	}
+	filtered, ok := common.FilterQuality(data, []string{common.QUALITY_GOOD})
+	if !ok {
+		t.Fatal("good tags should pass")
+	}
+	tags := map[string]interface{}{}
+	json.Unmarshal([]byte(filtered), &tags)
+	if _, ok := tags["b"]; ok || len(tags) != 2 {
+		t.Fatal("bad tag should be dropped:", filtered)
+	}
+	// 数组, 比如 S1200 的块
+	filtered, ok = common.FilterQuality(`[{"tag":"a","quality":"BAD_CONFIG"},{"tag":"b","quality":"GOOD"}]`,
+		[]string{common.QUALITY_GOOD})
+	if !ok || filtered != `[{"quality":"GOOD","tag":"b"}]` {
+		t.Fatal("unexpected array filter:", filtered)
+	}
+	// 顶层有 quality 的整条判断
+	if _, ok := common.FilterQuality(`{"PCHost":"127.0.0.1","quality":"BAD_COMM"}`,
+		[]string{common.QUALITY_GOOD}); ok {
+		t.Fatal("bad record should be dropped")
+	}
+	if _, ok := common.FilterQuality(`{"b":{"quality":"BAD_COMM"}}`, []string{common.QUALITY_GOOD}); ok {
+		t.Fatal("nothing left should be dropped")
+	}
+	if filtered, ok := common.FilterQuality("hello", []string{common.QUALITY_GOOD}); !ok || filtered != "hello" {
+		t.Fatal("not json data should pass")
+	}
+}
+
+// 记录收到的数据
+type qualityTarget struct {
+	sync.Mutex
+	received []string
+}
+
+func (q *qualityTarget) Test(outEndId string) bool                                    { return true }
+func (q *qualityTarget) Init(outEndId string, configMap map[string]interface{}) error { return nil }
+func (q *qualityTarget) Start(typex.CCTX) error                                       { return nil }
+func (q *qualityTarget) Enabled() bool                                                { return true }
+func (q *qualityTarget) Reload()                                                      {}
+func (q *qualityTarget) Pause()                                                       {}
+func (q *qualityTarget) Status() typex.SourceState                                    { return typex.SOURCE_UP }
+func (q *qualityTarget) Details() *typex.OutEnd                                       { return nil }
+func (q *qualityTarget) Configs() *typex.XConfig                                      { return &typex.XConfig{} }
+func (q *qualityTarget) Stop()                                                        {}
+func (q *qualityTarget) To(data interface{}) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	q.received = append(q.received, data.(string))
+	return nil, nil
+}
+func (q *qualityTarget) data() []string {
+	q.Lock()
+	defer q.Unlock()
+	return append([]string{}, q.received...)
+}
+
+func Test_OutEnd_Quality_Filter(t *testing.T) {
+	e := RunTestEngine()
+	e.Start()
+	ruleEngine := e.(*engine.RuleEngine)
+	target := &qualityTarget{}
+	ruleEngine.TargetTypeManager.Register("QUALITY", &typex.XConfig{
+		NewTarget: func(typex.RuleX) typex.XTarget { return target },
+	})
+	invalid := typex.NewOutEnd("QUALITY", "invalid", "",
+		map[string]interface{}{"qualityFilter": []interface{}{"NOT_A_QUALITY"}})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(invalid, ctx, cancelCTX); err == nil {
+		t.Fatal("invalid qualityFilter should fail")
+	}
+	cancelCTX()
+
+	out := typex.NewOutEnd("QUALITY", "quality", "",
+		map[string]interface{}{"qualityFilter": []interface{}{"GOOD", "UNCERTAIN_STALE"}})
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveOutEnd(out.UUID)
+	// 全是坏值的不发, 部分坏值的去掉坏的点位
+	e.PushOutQueue(out, `{"a":{"value":1,"quality":"BAD_COMM"}}`)
+	e.PushOutQueue(out, `{"a":{"value":1,"quality":"BAD_COMM"},"b":{"value":2,"quality":"GOOD"}}`)
+	for i := 0; len(target.data()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("good data should be sent")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if data := target.data(); len(data) != 1 || data[0] != `{"b":{"quality":"GOOD","value":2}}` {
+		t.Fatal("unexpected data:", data)
+	}
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 记录写入的设备, 写 fail 点位的时候出错
+type shadowDevice struct {
+	sync.Mutex
+	e      typex.RuleX
+	uuid   string
+	state  typex.DeviceState
+	writes map[string]string
+}
+
+func (d *shadowDevice) Init(devId string, configMap map[string]interface{}) error {
+	d.uuid = devId
+	return nil
+}
+func (d *shadowDevice) Start(typex.CCTX) error {
+	d.SetState(typex.DEV_UP)
+	return nil
+}
+func (d *shadowDevice) OnRead(cmd []byte, data []byte) (int, error) { return 0, nil }
+func (d *shadowDevice) OnWrite(cmd []byte, data []byte) (int, error) {
+	if string(cmd) == "fail" {
+		return 0, errors.New("write failed")
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.writes[string(cmd)] = string(data)
+	return len(data), nil
+}
+func (d *shadowDevice) OnCtrl(cmd []byte, args []byte) ([]byte, error) { return nil, nil }
+func (d *shadowDevice) Status() typex.DeviceState {
+	d.Lock()
+	defer d.Unlock()
+	return d.state
+}
+func (d *shadowDevice) Stop()                            { d.SetState(typex.DEV_STOP) }
+func (d *shadowDevice) Property() []typex.DeviceProperty { return nil }
+func (d *shadowDevice) Details() *typex.Device           { return d.e.GetDevice(d.uuid) }
+func (d *shadowDevice) SetState(state typex.DeviceState) {
+	d.Lock()
+	defer d.Unlock()
+	d.state = state
+}
+func (d *shadowDevice) Driver() typex.XExternalDriver { return nil }
+func (d *shadowDevice) OnDCACall(UUID string, Command string, Args interface{}) typex.DCAResult {
+	return typex.DCAResult{}
+}
+func (d *shadowDevice) written() map[string]string {
+	d.Lock()
+	defer d.Unlock()
+	writes := map[string]string{}
+	for k, v := range d.writes {
+		writes[k] = v
+	}
+	return writes
+}
+
+func Test_Device_Shadow(t *testing.T) {
+	e := RunTestEngine()
+	e.Start()
+	ruleEngine := e.(*engine.RuleEngine)
+	ruleEngine.Config.SourceRestartInterval = 20
+	device := &shadowDevice{e: e, writes: map[string]string{}}
+	ruleEngine.DeviceTypeManager.Register("SHADOW", &typex.XConfig{
+		NewDevice: func(typex.RuleX) typex.XDevice { return device },
+	})
+	dev := typex.NewDevice("SHADOW", "shadow", "", map[string]interface{}{})
+	shadows := e.GetDeviceShadow()
+
+	// 设备还没上线的时候只记下期望值, 上线以后写到设备
+	if err := shadows.SetDesired(dev.UUID, map[string]interface{}{"switch": true, "speed": 10.0}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadDeviceWithCtx(dev, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveDevice(dev.UUID)
+	for i := 0; len(device.written()) != 2; i++ {
+		if i == 100 {
+			t.Fatal("desired should be written when device online:", device.written())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if writes := device.written(); writes["switch"] != "true" || writes["speed"] != "10" {
+		t.Fatal("unexpected writes:", writes)
+	}
+
+	// 上报的值更新 reported, 和期望值一样的点位不在 delta 里; Lua 可以读影子
+	rule := typex.NewLuaRule(e, "RULE_SHADOW", "shadow", "", []string{}, []string{dev.UUID},
+		`function Success() end`,
+		`Actions = {
+			function(args)
+				local temp, err = device:Get("`+dev.UUID+`", "temp")
+				rulexlib:VSet("shadow_temp", temp)
+				return true, args
+			end
+		}`,
+		`function Failed(error) end`)
+	if err := e.LoadRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveRule(rule.UUID)
+	e.PushDeviceQueue(e.GetDevice(dev.UUID),
+		`{"temp":{"value":21.5,"quality":"GOOD"},"speed":10,"mode":{"dataValue":"auto","quality":"BAD_COMM"}}`)
+	for i := 0; core.GlobalStore.Get("shadow_temp") == ""; i++ {
+		if i == 100 {
+			t.Fatal("lua should read shadow")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if core.GlobalStore.Get("shadow_temp") != "21.5" {
+		t.Fatal("unexpected shadow value in lua:", core.GlobalStore.Get("shadow_temp"))
+	}
+	shadow := shadows.Get(dev.UUID)
+	if len(shadow.Delta) != 1 || shadow.Delta["switch"] != true {
+		t.Fatal("unexpected delta:", shadow.Delta)
+	}
+	if mode, _ := shadows.GetTag(dev.UUID, "mode"); mode.Value != "auto" || mode.Quality != common.QUALITY_BAD_COMM {
+		t.Fatal("unexpected reported value:", mode)
+	}
+
+	// 写失败的点位留在 delta 里, nil 删除期望值
+	if err := shadows.SetDesired(dev.UUID, map[string]interface{}{"fail": 1.0}); err == nil {
+		t.Fatal("write error should be returned")
+	}
+	if _, ok := shadows.Get(dev.UUID).Delta["fail"]; !ok {
+		t.Fatal("failed write should stay in delta")
+	}
+	shadows.SetDesired(dev.UUID, map[string]interface{}{"fail": nil, "switch": nil})
+	if delta := shadows.Get(dev.UUID).Delta; len(delta) != 0 {
+		t.Fatal("delta should be empty:", delta)
+	}
+
+	// 设备离线以后值不确定
+	device.SetState(typex.DEV_STOP)
+	for i := 0; ; i++ {
+		temp, _ := shadows.GetTag(dev.UUID, "temp")
+		if temp.Quality == common.QUALITY_UNCERTAIN_STALE {
+			break
+		}
+		if i == 100 {
+			t.Fatal("quality should be uncertain when device offline:", temp)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if mode, _ := shadows.GetTag(dev.UUID, "mode"); mode.Quality != common.QUALITY_BAD_COMM {
+		t.Fatal("bad quality should be kept:", mode)
+	}
+}
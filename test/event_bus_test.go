@@ -0,0 +1,143 @@
+package test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+	"gopkg.in/ini.v1"
+)
+
+// 订阅事件的插件
+type eventPlugin struct {
+	sync.Mutex
+	events []typex.Event
+}
+
+func (p *eventPlugin) Init(*ini.Section) error { return nil }
+func (p *eventPlugin) Start(typex.RuleX) error { return nil }
+func (p *eventPlugin) Stop() error             { return nil }
+func (p *eventPlugin) Service(typex.ServiceArg) typex.ServiceResult {
+	return typex.ServiceResult{}
+}
+func (p *eventPlugin) PluginMetaInfo() typex.XPluginMetaInfo {
+	return typex.XPluginMetaInfo{UUID: "EVENT_PLUGIN", Name: "event"}
+}
+func (p *eventPlugin) EventTypes() []typex.EventType {
+	return []typex.EventType{typex.EVENT_RESOURCE_STATE, typex.EVENT_RULE_ERROR}
+}
+func (p *eventPlugin) OnEvent(event typex.Event) {
+	p.Lock()
+	defer p.Unlock()
+	p.events = append(p.events, event)
+}
+
+// 等待满足条件的事件
+func (p *eventPlugin) wait(t *testing.T, match func(typex.Event) bool) typex.Event {
+	for i := 0; i < 100; i++ {
+		p.Lock()
+		for _, event := range p.events {
+			if match(event) {
+				p.Unlock()
+				return event
+			}
+		}
+		p.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("wait event timeout")
+	return typex.Event{}
+}
+
+func Test_Event_Bus(t *testing.T) {
+	e := RunTestEngine()
+	e.Start()
+	ruleEngine := e.(*engine.RuleEngine)
+	ruleEngine.Config.SourceRestartInterval = 20
+	controller := &flakyController{}
+	ruleEngine.SourceTypeManager.Register("FLAKY", &typex.XConfig{NewSource: controller.newSource})
+	plugin := &eventPlugin{}
+	if err := e.LoadPlugin("plugin.event", plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	// 订阅和取消订阅
+	received := make(chan typex.Event, 10)
+	id := e.GetEventBus().Subscribe([]typex.EventType{typex.EVENT_APP_EXIT},
+		func(event typex.Event) { received <- event })
+	e.GetEventBus().Publish(typex.Event{Type: typex.EVENT_GOODS_EXIT, UUID: "GOODS"})
+	e.GetEventBus().Publish(typex.Event{Type: typex.EVENT_APP_EXIT, UUID: "APP"})
+	select {
+	case event := <-received:
+		if event.UUID != "APP" || event.Time.IsZero() {
+			t.Fatal("unexpected event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber should receive event")
+	}
+	e.GetEventBus().Unsubscribe(id)
+	e.GetEventBus().Publish(typex.Event{Type: typex.EVENT_APP_EXIT, UUID: "APP"})
+	select {
+	case event := <-received:
+		t.Fatal("unsubscribed handler should not receive event:", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 设备掉线的时候触发规则, 规则出错产生 RULE_ERROR;
+	// 处理 RULE_ERROR 的规则出错不会再产生 RULE_ERROR
+	rule := typex.NewLuaRule(e, "RULE_ON_STATE", "on-state", "", []string{}, []string{},
+		`function Success() end`,
+		`Actions = {
+			function(args)
+				local event = rulexlib:J2T(args)
+				-- 第一个返回值不是 bool 的时候规则出错
+				if event.data.to == "DOWN" then return "offline", args end
+				return true, args
+			end,
+			function(args) return true, args end
+		}`,
+		`function Failed(error) end`)
+	rule.FromEvent = []string{string(typex.EVENT_RESOURCE_STATE)}
+	onError := typex.NewLuaRule(e, "RULE_ON_ERROR", "on-error", "", []string{}, []string{},
+		`function Success() end`,
+		`Actions = {
+			function(args) return "always fail", args end,
+			function(args) return true, args end
+		}`,
+		`function Failed(error) end`)
+	onError.FromEvent = []string{string(typex.EVENT_RULE_ERROR)}
+	for _, r := range []*typex.Rule{rule, onError} {
+		if err := e.LoadRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := typex.NewInEnd("FLAKY", "flaky", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveInEnd(in.UUID)
+	plugin.wait(t, func(event typex.Event) bool {
+		return event.Type == typex.EVENT_RESOURCE_STATE && event.UUID == in.UUID &&
+			event.Data["to"] == "UP"
+	})
+	controller.down()
+	event := plugin.wait(t, func(event typex.Event) bool {
+		return event.Type == typex.EVENT_RULE_ERROR && event.UUID == rule.UUID
+	})
+	if event.Data["fromType"] != "EVENT" || event.Data["from"] != in.UUID ||
+		!strings.Contains(event.Data["error"].(string), "must be bool") {
+		t.Fatal("unexpected rule error event:", event)
+	}
+	time.Sleep(100 * time.Millisecond)
+	plugin.Lock()
+	defer plugin.Unlock()
+	for _, event := range plugin.events {
+		if event.Type == typex.EVENT_RULE_ERROR && event.UUID == onError.UUID {
+			t.Fatal("rule triggered by RULE_ERROR should not publish RULE_ERROR")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 把收到的数据放进 channel 的测试目标
+type chanTarget struct {
+	typex.XStatus
+	received chan string
+}
+
+func (t *chanTarget) Test(string) bool                          { return true }
+func (t *chanTarget) Init(string, map[string]interface{}) error { return nil }
+func (t *chanTarget) Start(typex.CCTX) error                    { return nil }
+func (t *chanTarget) Enabled() bool                             { return true }
+func (t *chanTarget) Reload()                                   {}
+func (t *chanTarget) Pause()                                    {}
+func (t *chanTarget) Status() typex.SourceState                 { return typex.SOURCE_UP }
+func (t *chanTarget) Details() *typex.OutEnd                    { return nil }
+func (t *chanTarget) Configs() *typex.XConfig                   { return &typex.XConfig{} }
+func (t *chanTarget) Stop()                                     {}
+func (t *chanTarget) To(data interface{}) (interface{}, error) {
+	t.received <- data.(string)
+	return nil, nil
+}
+
+func newChanOutEnd(engine typex.RuleX) (*typex.OutEnd, chan string) {
+	received := make(chan string, 16)
+	out := typex.NewOutEnd(typex.HTTP_TARGET, "chan", "chan", map[string]interface{}{})
+	out.Target = &chanTarget{received: received}
+	engine.SaveOutEnd(out)
+	return out, received
+}
+
+func Test_Expr_Rule_Forward(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	out, received := newChanOutEnd(engine)
+	in := typex.NewInEnd(typex.HTTP, "in", "in", map[string]interface{}{})
+	engine.SaveInEnd(in)
+	rule := typex.NewExprRule(engine, "RULE_EXPR", "expr", "expr",
+		`temp > 30 && meta.type == "INEND" && meta.uuid == "`+in.UUID+`"`, "",
+		[]string{in.UUID}, []string{}, "", "", "")
+	rule.ToTargets = []string{out.UUID}
+	if err := engine.LoadRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	engine.WorkInEnd(in, `{"temp": 20}`)
+	engine.WorkInEnd(in, `{"temp": 31.5}`)
+	engine.WorkInEnd(in, `not json`)
+	select {
+	case data := <-received:
+		if data != `{"temp": 31.5}` {
+			t.Fatal("unexpected data:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expr rule not forward data")
+	}
+	select {
+	case data := <-received:
+		t.Fatal("data should be filtered:", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_Expr_Rule_Invalid_Expression(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	rule := typex.NewExprRule(engine, "RULE_EXPR", "expr", "expr",
+		`temp >`, "", []string{}, []string{}, "", "", "")
+	if err := engine.LoadRule(rule); err == nil {
+		t.Fatal("invalid expression should not be loaded")
+	}
+}
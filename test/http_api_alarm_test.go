@@ -0,0 +1,142 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 查询报警, 返回记录
+func queryAlarms(t *testing.T, root string, token string, query string) []interface{} {
+	_, result := authRequest(t, "GET", root+"alarms?"+query, token, nil)
+	if result["code"].(float64) != 200 {
+		t.Fatal("query alarms failed:", result)
+	}
+	return result["data"].(map[string]interface{})["records"].([]interface{})
+}
+
+func Test_HttpApi_Alarm(t *testing.T) {
+	e, _, root, _ := newHttpApiTestServer(t, "./alarm-unitest.db")
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	controller := &flakyController{}
+	e.(*engine.RuleEngine).SourceTypeManager.Register("FLAKY", &typex.XConfig{NewSource: controller.newSource})
+	in := typex.NewInEnd("FLAKY", "flaky", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveInEnd(in.UUID)
+	events := make(chan typex.Event, 100)
+	e.GetEventBus().Subscribe([]typex.EventType{typex.EVENT_ALARM},
+		func(event typex.Event) { events <- event })
+
+	rule := map[string]interface{}{
+		"name": "temp-high", "resourceUuid": in.UUID, "tag": "temp",
+		"condition": "HIGH", "threshold": 80, "deadband": 5, "severity": "MAJOR",
+	}
+	_, result := authRequest(t, "POST", root+"alarms/rules", token, map[string]interface{}{
+		"name": "bad", "resourceUuid": in.UUID, "tag": "temp", "condition": "EQUAL",
+	})
+	if result["code"].(float64) == 200 {
+		t.Fatal("invalid condition should be rejected")
+	}
+	_, result = authRequest(t, "POST", root+"alarms/rules", token, rule)
+	if result["code"].(float64) != 200 {
+		t.Fatal("create alarm rule failed:", result)
+	}
+	ruleUUID := result["data"].(string)
+
+	push := func(temp float64) {
+		e.RunSourceHooks(in, fmt.Sprintf(`{"temp":{"value":%v}}`, temp))
+	}
+	// 超过阈值报警, 回到阈值以下但是没有越过回差不清除
+	push(85)
+	alarms := queryAlarms(t, root, token, "state=ACTIVE")
+	if len(alarms) != 1 {
+		t.Fatal("alarm should be raised:", alarms)
+	}
+	alarmUUID := alarms[0].(map[string]interface{})["uuid"].(string)
+	push(78)
+	if len(queryAlarms(t, root, token, "state=ACTIVE")) != 1 {
+		t.Fatal("alarm should not be cleared inside deadband")
+	}
+	push(74)
+	alarms = queryAlarms(t, root, token, "state=CLEARED")
+	if len(alarms) != 1 || alarms[0].(map[string]interface{})["uuid"] != alarmUUID {
+		t.Fatal("alarm should be cleared:", alarms)
+	}
+
+	// 确认
+	push(90)
+	alarms = queryAlarms(t, root, token, "state=ACTIVE,ACKED")
+	alarmUUID = alarms[0].(map[string]interface{})["uuid"].(string)
+	_, result = authRequest(t, "PUT", root+"alarms/ack", token, map[string]string{"uuid": alarmUUID})
+	if result["code"].(float64) != 200 ||
+		result["data"].(map[string]interface{})["ackedBy"] != "admin" {
+		t.Fatal("ack alarm failed:", result)
+	}
+	_, result = authRequest(t, "PUT", root+"alarms/ack", token, map[string]string{"uuid": alarmUUID})
+	if result["code"].(float64) == 200 {
+		t.Fatal("acked alarm should not be acked again")
+	}
+	push(70)
+
+	// 搁置期间不产生新报警
+	_, result = authRequest(t, "PUT", root+"alarms/shelve", token,
+		map[string]interface{}{"uuid": alarmUUID, "duration": 60})
+	if result["code"].(float64) != 200 {
+		t.Fatal("shelve alarm failed:", result)
+	}
+	push(95)
+	if len(queryAlarms(t, root, token, "state=ACTIVE,ACKED")) != 0 {
+		t.Fatal("shelved rule should not raise alarm")
+	}
+	authRequest(t, "PUT", root+"alarms/shelve", token,
+		map[string]interface{}{"uuid": ruleUUID, "duration": 0})
+	push(96)
+	if len(queryAlarms(t, root, token, "state=ACTIVE&ruleUuid="+ruleUUID)) != 1 {
+		t.Fatal("unshelved rule should raise alarm")
+	}
+	// 删除规则以后报警清除
+	authRequest(t, "DELETE", root+"alarms/rules?uuid="+ruleUUID, token, nil)
+	if len(queryAlarms(t, root, token, "state=ACTIVE,ACKED")) != 0 {
+		t.Fatal("alarm should be cleared after rule deleted")
+	}
+
+	// 超时没有数据报警, 延时以后才报
+	rule = map[string]interface{}{
+		"name": "temp-stale", "resourceUuid": in.UUID, "tag": "temp",
+		"condition": "STALE", "threshold": 0.2, "delay": 300, "severity": "CRITICAL",
+	}
+	authRequest(t, "POST", root+"alarms/rules", token, rule)
+	time.Sleep(300 * time.Millisecond)
+	if len(queryAlarms(t, root, token, "state=ACTIVE&severity=CRITICAL")) != 0 {
+		t.Fatal("stale alarm should wait for delay")
+	}
+	for i := 0; len(queryAlarms(t, root, token, "state=ACTIVE&severity=CRITICAL")) != 1; i++ {
+		if i == 30 {
+			t.Fatal("stale alarm should be raised")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	push(20)
+	if len(queryAlarms(t, root, token, "state=ACTIVE")) != 0 {
+		t.Fatal("stale alarm should be cleared by new data")
+	}
+
+	// 报警的产生, 确认和清除都有事件
+	time.Sleep(100 * time.Millisecond)
+	counts := map[string]int{}
+	for len(events) > 0 {
+		event := <-events
+		counts[event.Data["event"].(string)]++
+	}
+	if counts["RAISED"] != 4 || counts["ACKED"] != 1 || counts["CLEARED"] != 4 {
+		t.Fatal("unexpected alarm events:", counts)
+	}
+}
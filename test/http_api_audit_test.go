@@ -0,0 +1,87 @@
+package test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+)
+
+func Test_HttpApi_Audit(t *testing.T) {
+	root, _ := startHttpApiTestServer(t, "./audit-unitest.db")
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	authRequest(t, "POST", root+"group/create", token,
+		map[string]string{"name": "line-1", "type": "DEVICE"})
+	_, result := authRequest(t, "GET", root+"audit?resource=GROUP", token, nil)
+	data := result["data"].(map[string]interface{})
+	records := data["records"].([]interface{})
+	if data["total"].(float64) != 1 {
+		t.Fatal("unexpected audit logs:", result)
+	}
+	created := records[0].(map[string]interface{})
+	uuid := created["resourceUuid"].(string)
+	if created["username"] != "admin" || created["method"] != "POST" || uuid == "" ||
+		created["before"] != nil || created["after"] == nil || created["code"].(float64) != 200 {
+		t.Fatal("unexpected create audit log:", created)
+	}
+	authRequest(t, "PUT", root+"group/update", token,
+		map[string]string{"uuid": uuid, "name": "line-2", "type": "DEVICE"})
+	authRequest(t, "DELETE", root+"group/delete?uuid="+uuid, token, nil)
+
+	_, result = authRequest(t, "GET", root+"audit?uuid="+uuid, token, nil)
+	records = result["data"].(map[string]interface{})["records"].([]interface{})
+	if len(records) != 3 {
+		t.Fatal("unexpected audit logs:", records)
+	}
+	// 新的在前面
+	deleted := records[0].(map[string]interface{})
+	if deleted["method"] != "DELETE" || deleted["before"] == nil || deleted["after"] != nil {
+		t.Fatal("unexpected delete audit log:", deleted)
+	}
+	updated := records[1].(map[string]interface{})
+	diff := updated["diff"].(map[string]interface{})
+	name := diff["Name"].(map[string]interface{})
+	if len(diff) != 1 || name["before"] != "line-1" || name["after"] != "line-2" {
+		t.Fatal("unexpected update diff:", diff)
+	}
+
+	request, _ := http.NewRequest("GET", root+"audit/export?uuid="+uuid, nil)
+	request.Header.Set("token", token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	lines, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 || lines[1][5] != "POST" || lines[3][5] != "DELETE" {
+		t.Fatal("unexpected export:", lines)
+	}
+	// 只读接口不记录
+	_, result = authRequest(t, "GET", root+"audit", token, nil)
+	if result["data"].(map[string]interface{})["total"].(float64) != 4 {
+		t.Fatal("unexpected audit total:", result)
+	}
+	// 快照里的密钥要打码
+	sqlitedao.Sqlite.DB().Create(&model.MOutEnd{UUID: "OUTEND_AUDIT", Type: "MQTT", Name: "mqtt",
+		Config: `{"host":"127.0.0.1","password":"mqtt-secret",` +
+			`"sasl":{"user":"u","password":"sasl-secret"},"accessToken":"token-secret"}`})
+	authRequest(t, "DELETE", root+"outends?uuid=OUTEND_AUDIT", token, nil)
+	_, result = authRequest(t, "GET", root+"audit?uuid=OUTEND_AUDIT", token, nil)
+	records = result["data"].(map[string]interface{})["records"].([]interface{})
+	if len(records) != 1 {
+		t.Fatal("unexpected audit logs:", records)
+	}
+	before, _ := json.Marshal(records[0].(map[string]interface{})["before"])
+	if strings.Contains(string(before), "secret") || !strings.Contains(string(before), "127.0.0.1") {
+		t.Fatal("secrets should be redacted:", string(before))
+	}
+}
@@ -0,0 +1,172 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	httpserver "github.com/hootrhino/rulex/plugin/http_server"
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+	"github.com/hootrhino/rulex/typex"
+	"gopkg.in/ini.v1"
+)
+
+// 调用接口, 返回 HTTP 状态码和响应
+func authRequest(t *testing.T, method string, api string, token string, body interface{}) (int, map[string]interface{}) {
+	bytesBody, _ := json.Marshal(body)
+	request, _ := http.NewRequest(method, api, bytes.NewReader(bytesBody))
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	result := map[string]interface{}{}
+	json.NewDecoder(response.Body).Decode(&result)
+	return response.StatusCode, result
+}
+
+func authLogin(t *testing.T, root string, username string, password string) string {
+	_, result := authRequest(t, "POST", root+"login", "",
+		map[string]string{"username": username, "password": password})
+	token, ok := result["data"].(string)
+	if !ok {
+		t.Fatal("login failed:", result)
+	}
+	return token
+}
+
+// 在随机端口上启动一个使用独立数据库的 HTTP 接口服务, 返回接口根路径
+func startHttpApiTestServer(t *testing.T, dbPath string) (string, int) {
+	_, _, root, port := newHttpApiTestServer(t, dbPath)
+	return root, port
+}
+
+func newHttpApiTestServer(t *testing.T, dbPath string) (typex.RuleX, *httpserver.HttpApiServer, string, int) {
+	os.Remove(dbPath)
+	t.Cleanup(func() { os.Remove(dbPath) })
+	engine := RunTestEngine()
+	engine.Start()
+	port := freeTcpPort(t)
+	section := ini.Empty().Section("plugin.http_server")
+	section.NewKey("port", fmt.Sprintf("%d", port))
+	section.NewKey("dbpath", dbPath)
+	section.NewKey("jwtsecret", "unit-test-secret")
+	server := httpserver.NewHttpApiServer()
+	if err := server.Init(section); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(engine); err != nil {
+		t.Fatal(err)
+	}
+	root := fmt.Sprintf("http://127.0.0.1:%d/api/v1/", port)
+	for i := 0; i < 20; i++ {
+		if _, err := http.Get(root + "ping"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return engine, server, root, port
+}
+
+func Test_HttpApi_Auth(t *testing.T) {
+	root, port := startHttpApiTestServer(t, "./auth-unitest.db")
+	// 没有用户的时候可以匿名创建第一个用户, 并且固定是管理员
+	_, result := authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "viewer"})
+	if result["code"].(float64) != 200 {
+		t.Fatal("create first user failed:", result)
+	}
+	if status, _ := authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "other", "password": "other", "role": "admin"}); status != http.StatusUnauthorized {
+		t.Fatal("anonymous user should be rejected after bootstrap:", status)
+	}
+	if status, _ := authRequest(t, "GET", root+"devices", "", nil); status != http.StatusUnauthorized {
+		t.Fatal("request without token should be rejected:", status)
+	}
+	if status, _ := authRequest(t, "GET", root+"devices", "bad-token", nil); status != http.StatusUnauthorized {
+		t.Fatal("request with bad token should be rejected:", status)
+	}
+	if response, _ := http.Get(fmt.Sprintf("http://127.0.0.1:%d/ws", port)); response.StatusCode != http.StatusUnauthorized {
+		t.Fatal("websocket without token should be rejected:", response.StatusCode)
+	}
+	adminToken := authLogin(t, root, "admin", "admin123")
+	_, info := authRequest(t, "GET", root+"info", adminToken, nil)
+	if info["data"].(map[string]interface{})["role"] != "admin" {
+		t.Fatal("unexpected info:", info)
+	}
+	if status, _ := authRequest(t, "GET", root+"devices", adminToken, nil); status != http.StatusOK {
+		t.Fatal("admin should read devices:", status)
+	}
+	_, result = authRequest(t, "POST", root+"users", adminToken,
+		map[string]string{"username": "viewer", "password": "viewer123", "role": "viewer"})
+	if result["code"].(float64) != 200 {
+		t.Fatal("create viewer failed:", result)
+	}
+	// 只读用户只能调用 GET 接口, 不能管理用户
+	viewerToken := authLogin(t, root, "viewer", "viewer123")
+	if status, _ := authRequest(t, "GET", root+"devices", viewerToken, nil); status != http.StatusOK {
+		t.Fatal("viewer should read devices:", status)
+	}
+	if status, _ := authRequest(t, "DELETE", root+"devices?uuid=x", viewerToken, nil); status != http.StatusForbidden {
+		t.Fatal("viewer should not delete devices:", status)
+	}
+	if status, _ := authRequest(t, "GET", root+"users", viewerToken, nil); status != http.StatusForbidden {
+		t.Fatal("viewer should not list users:", status)
+	}
+	// 老版本的 md5 密码登录以后换成 bcrypt
+	h := md5.Sum([]byte("operator123"))
+	sqlitedao.Sqlite.DB().Create(&model.MUser{Role: "operator", Username: "operator",
+		Password: hex.EncodeToString(h[:])})
+	operatorToken := authLogin(t, root, "operator", "operator123")
+	user := model.MUser{}
+	sqlitedao.Sqlite.DB().Where("username=?", "operator").First(&user)
+	if !strings.HasPrefix(user.Password, "$2") {
+		t.Fatal("password should be migrated to bcrypt:", user.Password)
+	}
+	authLogin(t, root, "operator", "operator123")
+	if status, _ := authRequest(t, "POST", root+"users", operatorToken,
+		map[string]string{"username": "x", "password": "x", "role": "admin"}); status != http.StatusForbidden {
+		t.Fatal("operator should not create users:", status)
+	}
+	if _, result := authRequest(t, "POST", root+"login", "",
+		map[string]string{"username": "operator", "password": "wrong"}); result["code"].(float64) == 200 {
+		t.Fatal("wrong password should be rejected")
+	}
+}
+
+// 同时匿名创建第一个管理员, 只能成功一个
+func Test_HttpApi_First_Admin_Race(t *testing.T) {
+	root, _ := startHttpApiTestServer(t, "./auth-race-unitest.db")
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			_, result := authRequest(t, "POST", root+"users", "", map[string]string{
+				"username": fmt.Sprintf("admin%d", i), "password": "admin123", "role": "admin"})
+			code, _ := result["code"].(float64)
+			results <- code == 200
+		}(i)
+	}
+	created := 0
+	for i := 0; i < 10; i++ {
+		if <-results {
+			created++
+		}
+	}
+	var total int64
+	sqlitedao.Sqlite.DB().Model(&model.MUser{}).Count(&total)
+	if created != 1 || total != 1 {
+		t.Fatal("only one first admin should be created:", created, total)
+	}
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	sqlitedao "github.com/hootrhino/rulex/plugin/http_server/dao/sqlite"
+	"github.com/hootrhino/rulex/plugin/http_server/model"
+)
+
+func exportBundle(t *testing.T, root string, token string) []byte {
+	request, _ := http.NewRequest("GET", root+"bundle/export", nil)
+	request.Header.Set("token", token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	if response.Header.Get("Content-Type") != "application/zip" {
+		t.Fatal("unexpected export response:", string(data))
+	}
+	return data
+}
+
+func importBundle(t *testing.T, root string, token string, query string, bundle []byte) map[string]interface{} {
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+	file, _ := writer.CreateFormFile("file", "bundle.zip")
+	file.Write(bundle)
+	writer.Close()
+	request, _ := http.NewRequest("POST", root+"bundle/import?"+query, &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("token", token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	result := map[string]interface{}{}
+	json.NewDecoder(response.Body).Decode(&result)
+	return result
+}
+
+// 改掉配置包里 bundle.json 的内容
+func editBundle(t *testing.T, bundle []byte, edit func(map[string]interface{})) []byte {
+	archive, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := bytes.Buffer{}
+	writer := zip.NewWriter(&output)
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		if file.Name == "bundle.json" {
+			config := map[string]interface{}{}
+			json.Unmarshal(content, &config)
+			edit(config)
+			content, _ = json.Marshal(config)
+		}
+		w, _ := writer.Create(file.Name)
+		w.Write(content)
+	}
+	writer.Close()
+	return output.Bytes()
+}
+
+func Test_HttpApi_Bundle(t *testing.T) {
+	root, _ := startHttpApiTestServer(t, "./bundle-unitest.db")
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	authRequest(t, "POST", root+"group/create", token,
+		map[string]string{"name": "screens", "type": "VISUAL"})
+	authRequest(t, "POST", root+"visual/create", token,
+		map[string]string{"name": "screen-1", "type": "BUILDIN", "content": "{}"})
+	group := model.MGenericGroup{}
+	visual := model.MVisual{}
+	sqlitedao.Sqlite.DB().First(&group)
+	sqlitedao.Sqlite.DB().First(&visual)
+	authRequest(t, "POST", root+"group/bind", token,
+		map[string]string{"gid": group.UUID, "rid": visual.UUID})
+	sqlitedao.Sqlite.DB().Create(&model.MRule{UUID: "RULE_BUNDLE", Name: "rule", Type: "lua",
+		FromSource: []string{}, FromDevice: []string{},
+		Actions: `Actions = {function(args) return true, args end}`,
+		Success: `function Success() end`, Failed: `function Failed(error) end`})
+	bundle := exportBundle(t, root, token)
+
+	count := func(m interface{}) int64 {
+		var total int64
+		sqlitedao.Sqlite.DB().Model(m).Count(&total)
+		return total
+	}
+	// 只检查, 不导入
+	result := importBundle(t, root, token, "mode=merge&remap=true&dryRun=true", bundle)
+	if result["code"].(float64) != 200 {
+		t.Fatal("dry run failed:", result)
+	}
+	report := result["data"].(map[string]interface{})
+	if len(report["uuidMap"].(map[string]interface{})) != 3 ||
+		len(report["created"].(map[string]interface{})["GROUP"].([]interface{})) != 1 {
+		t.Fatal("unexpected dry run report:", report)
+	}
+	if count(&model.MGenericGroup{}) != 1 || count(&model.MVisual{}) != 1 {
+		t.Fatal("dry run should not change database")
+	}
+	// 重新生成 UUID 合并进来, 分组关系跟着换成新的 UUID
+	result = importBundle(t, root, token, "mode=merge&remap=true", bundle)
+	if result["code"].(float64) != 200 {
+		t.Fatal("merge import failed:", result)
+	}
+	uuidMap := result["data"].(map[string]interface{})["uuidMap"].(map[string]interface{})
+	if count(&model.MGenericGroup{}) != 2 || count(&model.MVisual{}) != 2 || count(&model.MRule{}) != 2 {
+		t.Fatal("merge import should add resources")
+	}
+	relation := model.MGenericGroupRelation{}
+	if err := sqlitedao.Sqlite.DB().Where("gid=? AND rid=?", uuidMap[group.UUID],
+		uuidMap[visual.UUID]).First(&relation).Error; err != nil {
+		t.Fatal("remapped group relation not found:", err)
+	}
+	// 替换模式回到导出时候的样子
+	result = importBundle(t, root, token, "mode=replace", bundle)
+	if result["code"].(float64) != 200 {
+		t.Fatal("replace import failed:", result)
+	}
+	if count(&model.MGenericGroup{}) != 1 || count(&model.MVisual{}) != 1 ||
+		count(&model.MGenericGroupRelation{}) != 1 || count(&model.MRule{}) != 1 {
+		t.Fatal("replace import should restore exported resources")
+	}
+	// 引用不存在的资源, 不导入
+	invalid := editBundle(t, bundle, func(config map[string]interface{}) {
+		rule := config["rules"].([]interface{})[0].(map[string]interface{})
+		rule["FromSource"] = []string{"INEND_NOT_EXISTS"}
+	})
+	result = importBundle(t, root, token, "mode=replace", invalid)
+	if result["code"].(float64) != 4001 ||
+		len(result["data"].(map[string]interface{})["errors"].([]interface{})) != 1 {
+		t.Fatal("invalid bundle should be rejected:", result)
+	}
+	if count(&model.MGenericGroup{}) != 1 || count(&model.MRule{}) != 1 {
+		t.Fatal("invalid bundle should not change database")
+	}
+	// UUID 会拼到应用脚本的路径里, 带路径的不导入
+	traversal := editBundle(t, bundle, func(config map[string]interface{}) {
+		config["apps"] = []interface{}{map[string]interface{}{
+			"UUID": "../../bundle-traversal", "Name": "app", "Version": "1.0.0"}}
+	})
+	for _, query := range []string{"mode=merge", "mode=merge&remap=true"} {
+		result = importBundle(t, root, token, query, traversal)
+		errors, _ := json.Marshal(result["data"].(map[string]interface{})["errors"])
+		if result["code"].(float64) != 4001 ||
+			!strings.Contains(string(errors), "invalid APP uuid") {
+			t.Fatal("bundle with invalid uuid should be rejected:", query, result)
+		}
+	}
+	if count(&model.MApp{}) != 0 {
+		t.Fatal("bundle with invalid uuid should not change database")
+	}
+}
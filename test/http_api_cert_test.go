@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func Test_HttpApi_Certificate(t *testing.T) {
+	_, _, root, _ := newHttpApiTestServer(t, "./cert-unitest.db")
+	t.Cleanup(func() { os.RemoveAll("./certs") })
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	ca, caKey, caPem, _ := issueTestCert(t, "rulex-ca", nil, nil)
+	_, _, _, clientKey := issueTestCert(t, "client", ca, caKey)
+
+	_, result := authRequest(t, "POST", root+"certs", token,
+		map[string]string{"name": "bad", "content": "not a pem"})
+	if result["code"].(float64) == 200 {
+		t.Fatal("invalid pem should be rejected")
+	}
+	// JSON 上传证书
+	_, result = authRequest(t, "POST", root+"certs", token,
+		map[string]string{"name": "ca", "content": string(caPem)})
+	if result["code"].(float64) != 200 {
+		t.Fatal("upload cert failed:", result)
+	}
+	cert := result["data"].(map[string]interface{})
+	if cert["type"] != "CERT" || cert["subject"] != "CN=rulex-ca" {
+		t.Fatal("unexpected cert:", cert)
+	}
+	if content, err := os.ReadFile(cert["path"].(string)); err != nil || !bytes.Equal(content, caPem) {
+		t.Fatal("cert file should be written:", err)
+	}
+	// 表单上传私钥
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("name", "client-key")
+	part, _ := writer.CreateFormFile("file", "client.key")
+	part.Write(clientKey)
+	writer.Close()
+	request, _ := http.NewRequest("POST", root+"certs", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = map[string]interface{}{}
+	json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if result["code"].(float64) != 200 || result["data"].(map[string]interface{})["type"] != "KEY" {
+		t.Fatal("upload key failed:", result)
+	}
+	key := result["data"].(map[string]interface{})
+	if info, err := os.Stat(key["path"].(string)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("key file should only be readable by owner:", err)
+	}
+	// 列表里不返回内容
+	_, result = authRequest(t, "GET", root+"certs", token, nil)
+	certs := result["data"].([]interface{})
+	if len(certs) != 2 {
+		t.Fatal("unexpected certs:", certs)
+	}
+	if _, ok := certs[1].(map[string]interface{})["content"]; ok {
+		t.Fatal("content should not be returned")
+	}
+	_, result = authRequest(t, "DELETE", root+"certs?uuid="+key["uuid"].(string), token, nil)
+	if result["code"].(float64) != 200 {
+		t.Fatal("delete cert failed:", result)
+	}
+	if _, err := os.Stat(key["path"].(string)); !os.IsNotExist(err) {
+		t.Fatal("key file should be removed")
+	}
+}
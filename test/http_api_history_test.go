@@ -0,0 +1,105 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 查询历史数据, 返回数据点
+func queryHistory(t *testing.T, root string, token string, query string) []interface{} {
+	_, result := authRequest(t, "GET", root+"history?"+query, token, nil)
+	if result["code"].(float64) != 200 {
+		t.Fatal("query history failed:", result)
+	}
+	return result["data"].(map[string]interface{})["points"].([]interface{})
+}
+
+func Test_HttpApi_History(t *testing.T) {
+	e, _, root, _ := newHttpApiTestServer(t, "./history-unitest.db")
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	controller := &flakyController{}
+	e.(*engine.RuleEngine).SourceTypeManager.Register("FLAKY", &typex.XConfig{NewSource: controller.newSource})
+	in := typex.NewInEnd("FLAKY", "flaky", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveInEnd(in.UUID)
+
+	_, result := authRequest(t, "POST", root+"history/tags", token,
+		map[string]interface{}{"resourceUuid": "NOT-EXISTS", "tag": "temp"})
+	if result["code"].(float64) == 200 {
+		t.Fatal("tag of not exists resource should be rejected")
+	}
+	_, result = authRequest(t, "POST", root+"history/tags", token,
+		map[string]interface{}{"resourceUuid": in.UUID, "tag": "temp", "retention": 3})
+	if result["code"].(float64) != 200 {
+		t.Fatal("create history tag failed:", result)
+	}
+	_, result = authRequest(t, "POST", root+"history/tags", token,
+		map[string]interface{}{"resourceUuid": in.UUID, "tag": "temp"})
+	if result["code"].(float64) == 200 {
+		t.Fatal("duplicate history tag should be rejected")
+	}
+
+	// 只记录配置了的点位, 不是数值的忽略
+	from := time.Now().UnixMilli()
+	for _, temp := range []float64{10, 20, 30, 40} {
+		e.RunSourceHooks(in, fmt.Sprintf(`{"temp":{"value":%v},"humi":50,"name":"room"}`, temp))
+	}
+	time.Sleep(1500 * time.Millisecond)
+	query := fmt.Sprintf("device=%s&tag=temp&from=%d", in.UUID, from)
+	points := queryHistory(t, root, token, query+"&agg=raw")
+	if len(points) != 4 || points[3].(map[string]interface{})["value"].(float64) != 40 {
+		t.Fatal("unexpected raw points:", points)
+	}
+	if len(queryHistory(t, root, token, "device="+in.UUID+"&tag=humi&agg=raw")) != 0 {
+		t.Fatal("tag not configured should not be recorded")
+	}
+	for _, agg := range []string{"1m", "1h"} {
+		points = queryHistory(t, root, token, query+"&agg="+agg)
+		if len(points) != 1 {
+			t.Fatal("unexpected rollups:", agg, points)
+		}
+		rollup := points[0].(map[string]interface{})
+		if rollup["min"].(float64) != 10 || rollup["max"].(float64) != 40 ||
+			rollup["avg"].(float64) != 25 || rollup["count"].(float64) != 4 {
+			t.Fatal("unexpected rollup:", agg, rollup)
+		}
+	}
+
+	// * 记录所有的数值点位, 统计和库里已有的合并
+	authRequest(t, "POST", root+"history/tags", token,
+		map[string]interface{}{"resourceUuid": in.UUID, "tag": "*"})
+	e.RunSourceHooks(in, `{"temp":50,"humi":"55.5","name":"room"}`)
+	time.Sleep(1500 * time.Millisecond)
+	points = queryHistory(t, root, token, "device="+in.UUID+"&tag=humi&agg=raw")
+	if len(points) != 1 || points[0].(map[string]interface{})["value"].(float64) != 55.5 {
+		t.Fatal("all tags should be recorded:", points)
+	}
+	points = queryHistory(t, root, token, query+"&agg=1h")
+	if len(points) != 1 || points[0].(map[string]interface{})["count"].(float64) != 5 ||
+		points[0].(map[string]interface{})["max"].(float64) != 50 {
+		t.Fatal("rollup should be merged:", points)
+	}
+
+	// 参数检查
+	_, result = authRequest(t, "GET", root+"history?device="+in.UUID+"&tag=temp&agg=1d", token, nil)
+	if result["code"].(float64) == 200 {
+		t.Fatal("invalid agg should be rejected")
+	}
+	_, result = authRequest(t, "GET", root+"history?device="+in.UUID+"&tag=temp&from=yesterday", token, nil)
+	if result["code"].(float64) == 200 {
+		t.Fatal("invalid time should be rejected")
+	}
+	_, result = authRequest(t, "GET", root+"history?device="+in.UUID+"&tag=temp", token, nil)
+	if result["code"].(float64) != 200 || result["data"].(map[string]interface{})["agg"] != "raw" {
+		t.Fatal("default query should be last hour raw data:", result)
+	}
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+func Test_HttpApi_Shadow(t *testing.T) {
+	e, hs, root, _ := newHttpApiTestServer(t, "./shadow-unitest.db")
+	authRequest(t, "POST", root+"users", "",
+		map[string]string{"username": "admin", "password": "admin123", "role": "admin"})
+	token := authLogin(t, root, "admin", "admin123")
+	device := &shadowDevice{e: e, writes: map[string]string{}}
+	e.(*engine.RuleEngine).DeviceTypeManager.Register("SHADOW", &typex.XConfig{
+		NewDevice: func(typex.RuleX) typex.XDevice { return device },
+	})
+	dev := typex.NewDevice("SHADOW", "shadow", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadDeviceWithCtx(dev, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveDevice(dev.UUID)
+
+	_, result := authRequest(t, "PUT", root+"shadows/desired", token, map[string]interface{}{
+		"uuid": "NOT-EXISTS", "desired": map[string]interface{}{"switch": true},
+	})
+	if result["code"].(float64) == 200 {
+		t.Fatal("desired of not exists device should be rejected")
+	}
+	// 设备在线, 期望值马上写到设备, 并且入库
+	_, result = authRequest(t, "PUT", root+"shadows/desired", token, map[string]interface{}{
+		"uuid": dev.UUID, "desired": map[string]interface{}{"switch": true},
+	})
+	if result["code"].(float64) != 200 {
+		t.Fatal("set desired failed:", result)
+	}
+	if device.written()["switch"] != "true" {
+		t.Fatal("desired should be written to device:", device.written())
+	}
+	if m, err := hs.GetMDeviceShadowWithUUID(dev.UUID); err != nil || m.Desired != `{"switch":true}` {
+		t.Fatal("desired should be saved:", m, err)
+	}
+	e.GetDeviceShadow().Report(dev.UUID, `{"switch":true,"temp":20}`)
+	_, result = authRequest(t, "GET", root+"shadows?uuid="+dev.UUID, token, nil)
+	shadow := result["data"].(map[string]interface{})
+	reported := shadow["reported"].(map[string]interface{})
+	if reported["temp"].(map[string]interface{})["value"].(float64) != 20 ||
+		len(shadow["delta"].(map[string]interface{})) != 0 {
+		t.Fatal("unexpected shadow:", shadow)
+	}
+	_, result = authRequest(t, "GET", root+"shadows", token, nil)
+	if len(result["data"].([]interface{})) != 1 {
+		t.Fatal("unexpected shadows:", result)
+	}
+}
@@ -0,0 +1,693 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/source/kafka"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+type fakeKafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+/*
+*
+* 进程内的 Kafka 协议替身: 一个节点, 每个 Topic 两个分区, PLAIN 认证, 消费组只支持一个成员
+*
+ */
+type fakeKafka struct {
+	t           *testing.T
+	listener    net.Listener
+	port        int32
+	username    string
+	password    string
+	lock        sync.Mutex
+	batches     map[fakeKafkaPartition][][]byte // 写进来的批次, 开头的 Offset 和 Leader Epoch 改成了服务端分配的
+	next        map[fakeKafkaPartition]int64
+	sequences   map[int64]map[fakeKafkaPartition]int32
+	producerId  int64
+	produces    map[string]int // 每个 Topic 收到的 Produce 请求数
+	dropCount   int            // 写进去以后不回响应的次数, 模拟响应丢了
+	fetchPaused bool           // 暂停的时候 Fetch 不返回数据
+	memberCount int
+	generation  int32
+	assignments map[string][]byte
+	commits     map[string]map[fakeKafkaPartition]int64
+	leaves      int
+}
+
+func startFakeKafka(t *testing.T, username, password string) *fakeKafka {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fk := &fakeKafka{
+		t:           t,
+		listener:    listener,
+		port:        int32(listener.Addr().(*net.TCPAddr).Port),
+		username:    username,
+		password:    password,
+		batches:     map[fakeKafkaPartition][][]byte{},
+		next:        map[fakeKafkaPartition]int64{},
+		sequences:   map[int64]map[fakeKafkaPartition]int32{},
+		producerId:  1000,
+		produces:    map[string]int{},
+		assignments: map[string][]byte{},
+		commits:     map[string]map[fakeKafkaPartition]int64{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fk.serve(conn)
+		}
+	}()
+	return fk
+}
+
+func (fk *fakeKafka) addr() string {
+	return fmt.Sprintf("127.0.0.1:%d", fk.port)
+}
+
+func (fk *fakeKafka) Close() {
+	fk.listener.Close()
+}
+
+func (fk *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	authenticated := false
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		key := int16(binary.BigEndian.Uint16(body[0:]))
+		version := int16(binary.BigEndian.Uint16(body[2:]))
+		correlationId := body[4:8]
+		clientIdLength := int16(binary.BigEndian.Uint16(body[8:]))
+		body = body[10:]
+		if clientIdLength > 0 {
+			body = body[clientIdLength:]
+		}
+		req := kmsg.RequestForKey(key)
+		req.SetVersion(version)
+		if req.IsFlexible() {
+			body = body[1:]
+		}
+		if err := req.ReadFrom(body); err != nil {
+			fk.t.Error("fake kafka decode request failed:", err)
+			return
+		}
+		// 没认证之前只能协商版本和认证
+		if fk.username != "" && !authenticated && key != 18 && key != 17 && key != 36 {
+			return
+		}
+		resp, drop := fk.handle(req, &authenticated)
+		if drop {
+			return
+		}
+		out := append([]byte{0, 0, 0, 0}, correlationId...)
+		if resp.IsFlexible() && key != 18 {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (fk *fakeKafka) handle(request kmsg.Request, authenticated *bool) (kmsg.Response, bool) {
+	if req, ok := request.(*kmsg.FetchRequest); ok {
+		return fk.fetch(req), false
+	}
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	switch req := request.(type) {
+	case *kmsg.ApiVersionsRequest:
+		resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+		for _, key := range []int16{0, 1, 2, 3, 8, 9, 10, 11, 12, 13, 14, 17, 18, 22, 36} {
+			apiKey := kmsg.NewApiVersionsResponseApiKey()
+			apiKey.ApiKey = key
+			apiKey.MaxVersion = kmsg.RequestForKey(key).MaxVersion()
+			resp.ApiKeys = append(resp.ApiKeys, apiKey)
+		}
+		return resp, false
+	case *kmsg.SASLHandshakeRequest:
+		resp := req.ResponseKind().(*kmsg.SASLHandshakeResponse)
+		resp.SupportedMechanisms = []string{"PLAIN"}
+		if req.Mechanism != "PLAIN" {
+			resp.ErrorCode = 33
+		}
+		return resp, false
+	case *kmsg.SASLAuthenticateRequest:
+		resp := req.ResponseKind().(*kmsg.SASLAuthenticateResponse)
+		if string(req.SASLAuthBytes) != "\x00"+fk.username+"\x00"+fk.password {
+			resp.ErrorCode = 58
+			resp.ErrorMessage = kmsg.StringPtr("invalid credentials")
+			return resp, false
+		}
+		*authenticated = true
+		return resp, false
+	case *kmsg.MetadataRequest:
+		resp := req.ResponseKind().(*kmsg.MetadataResponse)
+		broker := kmsg.NewMetadataResponseBroker()
+		broker.NodeID, broker.Host, broker.Port = 1, "127.0.0.1", fk.port
+		resp.Brokers = append(resp.Brokers, broker)
+		resp.ControllerID = 1
+		for _, requestTopic := range req.Topics {
+			topic := kmsg.NewMetadataResponseTopic()
+			topic.Topic = requestTopic.Topic
+			for i := int32(0); i < 2; i++ {
+				partition := kmsg.NewMetadataResponseTopicPartition()
+				partition.Partition, partition.Leader = i, 1
+				partition.Replicas, partition.ISR = []int32{1}, []int32{1}
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp, false
+	case *kmsg.InitProducerIDRequest:
+		resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+		fk.producerId++
+		resp.ProducerID = fk.producerId
+		return resp, false
+	case *kmsg.ProduceRequest:
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, topic := range req.Topics {
+			fk.produces[topic.Topic]++
+			respTopic := kmsg.NewProduceResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				respPartition := kmsg.NewProduceResponseTopicPartition()
+				respPartition.Partition = partition.Partition
+				respPartition.ErrorCode = fk.append(fakeKafkaPartition{topic.Topic, partition.Partition}, partition.Records)
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		if fk.dropCount > 0 {
+			fk.dropCount--
+			return nil, true
+		}
+		return resp, false
+	case *kmsg.FindCoordinatorRequest:
+		resp := req.ResponseKind().(*kmsg.FindCoordinatorResponse)
+		resp.NodeID, resp.Host, resp.Port = 1, "127.0.0.1", fk.port
+		// v4 以后一次可以查多个
+		for _, key := range req.CoordinatorKeys {
+			coordinator := kmsg.NewFindCoordinatorResponseCoordinator()
+			coordinator.Key, coordinator.NodeID, coordinator.Host, coordinator.Port = key, 1, "127.0.0.1", fk.port
+			resp.Coordinators = append(resp.Coordinators, coordinator)
+		}
+		return resp, false
+	case *kmsg.JoinGroupRequest:
+		resp := req.ResponseKind().(*kmsg.JoinGroupResponse)
+		if req.MemberID == "" {
+			fk.memberCount++
+			resp.MemberID = fmt.Sprintf("member-%d", fk.memberCount)
+			if req.Version >= 4 {
+				resp.ErrorCode = 79
+				return resp, false
+			}
+		} else {
+			resp.MemberID = req.MemberID
+		}
+		fk.generation++
+		resp.Generation = fk.generation
+		resp.LeaderID = resp.MemberID
+		resp.Protocol = kmsg.StringPtr(req.Protocols[0].Name)
+		member := kmsg.NewJoinGroupResponseMember()
+		member.MemberID = resp.MemberID
+		member.ProtocolMetadata = req.Protocols[0].Metadata
+		resp.Members = append(resp.Members, member)
+		return resp, false
+	case *kmsg.SyncGroupRequest:
+		resp := req.ResponseKind().(*kmsg.SyncGroupResponse)
+		for _, assignment := range req.GroupAssignment {
+			fk.assignments[assignment.MemberID] = assignment.MemberAssignment
+		}
+		resp.MemberAssignment = fk.assignments[req.MemberID]
+		return resp, false
+	case *kmsg.HeartbeatRequest:
+		resp := req.ResponseKind().(*kmsg.HeartbeatResponse)
+		if req.Generation != fk.generation {
+			resp.ErrorCode = 22
+		}
+		return resp, false
+	case *kmsg.LeaveGroupRequest:
+		fk.leaves++
+		return req.ResponseKind(), false
+	case *kmsg.OffsetCommitRequest:
+		resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+		if fk.commits[req.Group] == nil {
+			fk.commits[req.Group] = map[fakeKafkaPartition]int64{}
+		}
+		for _, topic := range req.Topics {
+			respTopic := kmsg.NewOffsetCommitResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				fk.commits[req.Group][fakeKafkaPartition{topic.Topic, partition.Partition}] = partition.Offset
+				respPartition := kmsg.NewOffsetCommitResponseTopicPartition()
+				respPartition.Partition = partition.Partition
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, false
+	case *kmsg.OffsetFetchRequest:
+		resp := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+		for _, topic := range req.Topics {
+			respTopic := kmsg.NewOffsetFetchResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				respPartition := kmsg.NewOffsetFetchResponseTopicPartition()
+				respPartition.Partition = partition
+				respPartition.Offset = fk.committedOffset(req.Group, topic.Topic, partition)
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		// v8 以后按消费组批量查
+		for _, group := range req.Groups {
+			respGroup := kmsg.NewOffsetFetchResponseGroup()
+			respGroup.Group = group.Group
+			for _, topic := range group.Topics {
+				respTopic := kmsg.NewOffsetFetchResponseGroupTopic()
+				respTopic.Topic = topic.Topic
+				for _, partition := range topic.Partitions {
+					respPartition := kmsg.NewOffsetFetchResponseGroupTopicPartition()
+					respPartition.Partition = partition
+					respPartition.Offset = fk.committedOffset(group.Group, topic.Topic, partition)
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				respGroup.Topics = append(respGroup.Topics, respTopic)
+			}
+			resp.Groups = append(resp.Groups, respGroup)
+		}
+		return resp, false
+	case *kmsg.ListOffsetsRequest:
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		for _, topic := range req.Topics {
+			respTopic := kmsg.NewListOffsetsResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				respPartition := kmsg.NewListOffsetsResponseTopicPartition()
+				respPartition.Partition = partition.Partition
+				respPartition.Offset = 0
+				if partition.Timestamp == -1 {
+					respPartition.Offset = fk.next[fakeKafkaPartition{topic.Topic, partition.Partition}]
+				}
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, false
+	}
+	fk.t.Error("fake kafka unexpected request:", kmsg.NameForKey(request.Key()))
+	return request.ResponseKind(), false
+}
+
+// 调用的时候要持有锁; 没有提交过的是 -1
+func (fk *fakeKafka) committedOffset(group, topic string, partition int32) int64 {
+	if offset, ok := fk.commits[group][fakeKafkaPartition{topic, partition}]; ok {
+		return offset
+	}
+	return -1
+}
+
+// 幂等写入的时候检查序号, 重复的批次不写
+func (fk *fakeKafka) append(tp fakeKafkaPartition, records []byte) int16 {
+	batch := kmsg.RecordBatch{}
+	if err := batch.ReadFrom(records); err != nil {
+		return 2
+	}
+	if _, err := decodeFakeKafkaBatch(records); err != nil {
+		fk.t.Error("fake kafka invalid batch:", err)
+		return 2
+	}
+	if batch.ProducerID >= 0 {
+		if fk.sequences[batch.ProducerID] == nil {
+			fk.sequences[batch.ProducerID] = map[fakeKafkaPartition]int32{}
+		}
+		expected := fk.sequences[batch.ProducerID][tp]
+		if batch.FirstSequence < expected {
+			return 46
+		}
+		if batch.FirstSequence > expected {
+			return 45
+		}
+		fk.sequences[batch.ProducerID][tp] = expected + batch.NumRecords
+	}
+	// 和真的 Broker 一样写上分区的 Offset 和 Leader Epoch
+	stored := append([]byte{}, records...)
+	binary.BigEndian.PutUint64(stored, uint64(fk.next[tp]))
+	binary.BigEndian.PutUint32(stored[12:], 0)
+	fk.batches[tp] = append(fk.batches[tp], stored)
+	fk.next[tp] += int64(batch.NumRecords)
+	return 0
+}
+
+// 没有新数据的时候最多等 MaxWaitMillis
+func (fk *fakeKafka) fetch(req *kmsg.FetchRequest) kmsg.Response {
+	deadline := time.Now().Add(time.Duration(req.MaxWaitMillis) * time.Millisecond)
+	for {
+		fk.lock.Lock()
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		found := false
+		for _, topic := range req.Topics {
+			if fk.fetchPaused {
+				break
+			}
+			respTopic := kmsg.NewFetchResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				tp := fakeKafkaPartition{topic.Topic, partition.Partition}
+				respPartition := kmsg.NewFetchResponseTopicPartition()
+				respPartition.Partition = partition.Partition
+				respPartition.HighWatermark = fk.next[tp]
+				for _, batch := range fk.batches[tp] {
+					base := int64(binary.BigEndian.Uint64(batch))
+					last := base + int64(binary.BigEndian.Uint32(batch[23:]))
+					if last >= partition.FetchOffset {
+						respPartition.RecordBatches = append(respPartition.RecordBatches, batch...)
+						found = true
+					}
+				}
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		fk.lock.Unlock()
+		if found || time.Now().After(deadline) {
+			return resp
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 解出批次里的记录, 只支持不压缩和 gzip
+func decodeFakeKafkaBatch(raw []byte) ([]*kgo.Record, error) {
+	batch := kmsg.RecordBatch{}
+	if err := batch.ReadFrom(raw); err != nil {
+		return nil, err
+	}
+	data := batch.Records
+	switch batch.Attributes & 0x07 {
+	case 0:
+	case 1:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression: %d", batch.Attributes&0x07)
+	}
+	records := []*kgo.Record{}
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(data)
+		if n <= 0 || length < 0 || len(data) < n+int(length) {
+			return nil, fmt.Errorf("invalid record %d", i)
+		}
+		record := kmsg.Record{}
+		if err := record.ReadFrom(data[:n+int(length)]); err != nil {
+			return nil, err
+		}
+		data = data[n+int(length):]
+		records = append(records, &kgo.Record{
+			Key:    record.Key,
+			Value:  record.Value,
+			Offset: batch.FirstOffset + int64(record.OffsetDelta),
+		})
+	}
+	return records, nil
+}
+
+// Topic 里所有的记录, 按分区和位置排
+func (fk *fakeKafka) records(topic string) []*kgo.Record {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	records := []*kgo.Record{}
+	for partition := int32(0); partition < 2; partition++ {
+		for _, batch := range fk.batches[fakeKafkaPartition{topic, partition}] {
+			decoded, err := decodeFakeKafkaBatch(batch)
+			if err != nil {
+				fk.t.Fatal(err)
+			}
+			for _, record := range decoded {
+				record.Topic, record.Partition = topic, partition
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+func (fk *fakeKafka) committed(group, topic string) int64 {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	total := int64(0)
+	for tp, offset := range fk.commits[group] {
+		if tp.topic == topic {
+			total += offset
+		}
+	}
+	return total
+}
+
+func (fk *fakeKafka) batchAttributes(topic string) []int16 {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	attributes := []int16{}
+	for partition := int32(0); partition < 2; partition++ {
+		for _, batch := range fk.batches[fakeKafkaPartition{topic, partition}] {
+			attributes = append(attributes, int16(binary.BigEndian.Uint16(batch[21:])))
+		}
+	}
+	return attributes
+}
+
+func (fk *fakeKafka) produceCount(topic string) int {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	return fk.produces[topic]
+}
+
+func (fk *fakeKafka) dropResponses(n int) {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	fk.dropCount = n
+}
+
+func (fk *fakeKafka) pauseFetch(paused bool) {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	fk.fetchPaused = paused
+}
+
+func waitKafka(t *testing.T, message string, ok func() bool) {
+	for i := 0; !ok(); i++ {
+		if i == 250 {
+			t.Fatal(message)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func Test_Kafka_Target_Source(t *testing.T) {
+	fk := startFakeKafka(t, "rulex", "secret")
+	defer fk.Close()
+	e := RunTestEngine()
+	e.Start()
+	sasl := map[string]interface{}{"mechanism": "PLAIN", "username": "rulex", "password": "secret"}
+
+	// 密码不对连不上
+	opts, err := kafka.ClientOpts(common.KafkaConfig{
+		Brokers: []string{fk.addr()},
+		Sasl:    common.KafkaSaslConfig{Mechanism: "PLAIN", Username: "rulex", Password: "wrong"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Fatal("wrong password should be error:", err)
+	}
+	client.Close()
+
+	out := typex.NewOutEnd(typex.KAFKA_TARGET, "kafka-out", "", map[string]interface{}{
+		"brokers": []string{fk.addr()}, "clientId": "rulex-test", "sasl": sasl,
+		"topic": "plant.{site}", "key": "{device}", "compression": "gzip",
+		"idempotent": true, "lingerMs": 50,
+	})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveOutEnd(out.UUID)
+	waitTargetUp(t, e, out.UUID)
+	target := e.GetOutEnd(out.UUID).Target
+
+	// 数组的每个元素一条记录, Topic 和 Key 从字段里取; To 不等发送结果
+	if _, err := target.To(`[{"site":"s1","device":"d1","v":1},{"site":"s1","device":"d2","v":2},{"site":"s1","device":"d1","v":3}]`); err != nil {
+		t.Fatal(err)
+	}
+	waitKafka(t, "records should be produced", func() bool { return len(fk.records("plant.s1")) == 3 })
+	records := fk.records("plant.s1")
+	partitions := map[string]int32{}
+	for _, record := range records {
+		if p, ok := partitions[string(record.Key)]; ok && p != record.Partition {
+			t.Fatal("same key should be same partition:", string(record.Key))
+		}
+		partitions[string(record.Key)] = record.Partition
+	}
+	// 压缩以后变小的批次才压缩
+	if _, err := target.To(fmt.Sprintf(`{"site":"s4","device":"d1","v":"%s"}`, strings.Repeat("x", 1024))); err != nil {
+		t.Fatal(err)
+	}
+	waitKafka(t, "compressed record should be produced", func() bool { return len(fk.records("plant.s4")) == 1 })
+	for _, attributes := range fk.batchAttributes("plant.s4") {
+		if attributes&0x07 != 1 {
+			t.Fatal("batch should be gzip compressed:", attributes)
+		}
+	}
+	if records := fk.records("plant.s4"); len(records) != 1 || len(records[0].Value) < 1024 {
+		t.Fatal("unexpected compressed records:", records)
+	}
+	if _, err := target.To(`{"device":"d1"}`); err == nil {
+		t.Fatal("missing template field should be error")
+	}
+
+	// 同时写的记录攒成一批
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := target.To(fmt.Sprintf(`{"site":"s2","device":"d1","v":%d}`, i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitKafka(t, "records should be produced", func() bool { return len(fk.records("plant.s2")) == 20 })
+	if fk.produceCount("plant.s2") >= 20 {
+		t.Fatal("records should be batched:", len(fk.records("plant.s2")), fk.produceCount("plant.s2"))
+	}
+
+	// 响应丢了以后重试, 幂等写入不会重复
+	fk.dropResponses(1)
+	if _, err := target.To(`{"site":"s3","device":"d1","v":1}`); err != nil {
+		t.Fatal(err)
+	}
+	waitKafka(t, "record should be retried", func() bool { return fk.produceCount("plant.s3") == 2 })
+	if len(fk.records("plant.s3")) != 1 || fk.produceCount("plant.s3") != 2 {
+		t.Fatal("retry should not duplicate:", len(fk.records("plant.s3")), fk.produceCount("plant.s3"))
+	}
+
+	// 停止的时候缓冲里的记录要先发完
+	flushOut := typex.NewOutEnd(typex.KAFKA_TARGET, "kafka-flush", "", map[string]interface{}{
+		"brokers": []string{fk.addr()}, "sasl": sasl, "topic": "plant.s5", "lingerMs": 2000,
+	})
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(flushOut, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	waitTargetUp(t, e, flushOut.UUID)
+	if _, err := e.GetOutEnd(flushOut.UUID).Target.To(`{"v":1}`); err != nil {
+		t.Fatal(err)
+	}
+	e.RemoveOutEnd(flushOut.UUID)
+	if len(fk.records("plant.s5")) != 1 {
+		t.Fatal("buffered record should be flushed on stop:", fk.records("plant.s5"))
+	}
+
+	// 消费组从最早的位置开始消费, 位置提交到 Kafka; 规则加载好以后再放数据
+	newSource := func() *typex.InEnd {
+		fk.pauseFetch(true)
+		defer fk.pauseFetch(false)
+		in := typex.NewInEnd(typex.KAFKA, "kafka-in", "", map[string]interface{}{
+			"brokers": []string{fk.addr()}, "sasl": sasl,
+			"topics": []string{"plant.s2"}, "groupId": "g1", "startOffset": "earliest",
+			"commitIntervalMs": 100,
+		})
+		ctx, cancelCTX := typex.NewCCTX()
+		if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+			t.Fatal(err)
+		}
+		rule := typex.NewLuaRule(e, "RULE_KAFKA_"+in.UUID, "kafka", "", []string{in.UUID}, []string{},
+			`function Success() end`,
+			`Actions = {
+				function(args)
+					local count = tonumber(rulexlib:VGet("kafka_count")) or 0
+					rulexlib:VSet("kafka_count", tostring(count + 1))
+					rulexlib:VSet("kafka_last", args)
+					return true, args
+				end
+			}`,
+			`function Failed(error) end`)
+		if err := e.LoadRule(rule); err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	core.GlobalStore.Set("kafka_count", "0")
+	in := newSource()
+	waitKafka(t, "records should be consumed and committed", func() bool {
+		return core.GlobalStore.Get("kafka_count") == "20" && fk.committed("g1", "plant.s2") == 20
+	})
+	e.RemoveInEnd(in.UUID)
+	fk.lock.Lock()
+	leaves := fk.leaves
+	fk.lock.Unlock()
+	if leaves != 1 {
+		t.Fatal("consumer should leave group")
+	}
+
+	// 重新加入消费组从提交的位置接着消费
+	if _, err := target.To(`{"site":"s2","device":"d2","v":100}`); err != nil {
+		t.Fatal(err)
+	}
+	core.GlobalStore.Set("kafka_count", "0")
+	in = newSource()
+	defer e.RemoveInEnd(in.UUID)
+	waitKafka(t, "new record should be consumed", func() bool {
+		return core.GlobalStore.Get("kafka_count") == "1" && fk.committed("g1", "plant.s2") == 21
+	})
+	if core.GlobalStore.Get("kafka_last") != `{"site":"s2","device":"d2","v":100}` {
+		t.Fatal("unexpected record:", core.GlobalStore.Get("kafka_last"))
+	}
+	time.Sleep(300 * time.Millisecond)
+	if core.GlobalStore.Get("kafka_count") != "1" {
+		t.Fatal("committed records should not be consumed again:", core.GlobalStore.Get("kafka_count"))
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 连续地址的点位合并成一次读, 每次读之间会等 frequency 毫秒, 用耗时来判断请求次数
+func Test_Modbus_Batch_Read(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	port := freeTcpPort(t)
+	slaver := typex.NewDevice(typex.GENERIC_MODBUS_SLAVER, "slaver", "slaver",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{"mode": "TCP", "slaverId": 1},
+			"tcpConfig":    map[string]interface{}{"host": "127.0.0.1", "port": port},
+			"registers": []map[string]interface{}{
+				{"tag": "regs", "type": "HOLDING_REGISTER", "address": 0, "quantity": 10,
+					"initValues": []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+				{"tag": "coils", "type": "COIL", "address": 0, "quantity": 8,
+					"initValues": []int{1, 0, 1, 0, 0, 1, 1, 0}},
+			},
+		})
+	ctx, cancel := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(slaver, ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	registers := []map[string]interface{}{
+		{"tag": "r0", "function": 3, "slaverId": 1, "address": 0, "quantity": 1, "dataType": "UINT16"},
+		{"tag": "r1", "function": 3, "slaverId": 1, "address": 1, "quantity": 2, "dataType": "UINT16"},
+		{"tag": "r3", "function": 3, "slaverId": 1, "address": 3, "quantity": 1, "dataType": "UINT16"},
+		// 和上一个点位间隔 2 个寄存器
+		{"tag": "r6", "function": 3, "slaverId": 1, "address": 6, "quantity": 2, "dataType": "UINT16"},
+		{"tag": "c0", "function": 1, "slaverId": 1, "address": 0, "quantity": 3, "dataType": "BOOL"},
+		{"tag": "c5", "function": 1, "slaverId": 1, "address": 5, "quantity": 2, "dataType": "BOOL"},
+	}
+	master := typex.NewDevice(typex.GENERIC_MODBUS, "master", "master",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{
+				"mode": "TCP", "timeout": 1000, "autoRequest": false, "frequency": 200, "maxGap": 2,
+			},
+			"tcpConfig": map[string]interface{}{"host": "127.0.0.1", "port": port},
+			"registers": registers,
+		})
+	ctx1, cancel1 := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(master, ctx1, cancel1); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, common.T_4KB)
+	start := time.Now()
+	n, err := engine.GetDevice(master.UUID).Device.OnRead([]byte{}, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 寄存器一次, 线圈一次
+	if cost := time.Since(start); cost > 600*time.Millisecond {
+		t.Fatal("requests not batched, cost:", cost)
+	}
+	result := map[string]map[string]interface{}{}
+	if err := json.Unmarshal(buffer[:n], &result); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(buffer[:n]))
+	expects := map[string]string{
+		"r0": "0000", "r1": "00010002", "r3": "0003", "r6": "00060007",
+		"c0": "05", "c5": "03",
+	}
+	for tag, hex := range expects {
+		if result[tag]["value"] != hex {
+			t.Fatal(tag, "unexpected value:", result[tag])
+		}
+	}
+	if result["r6"]["dataValue"].([]interface{})[1].(float64) != 7 {
+		t.Fatal("unexpected dataValue:", result["r6"])
+	}
+}
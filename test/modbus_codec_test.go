@@ -0,0 +1,146 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/driver"
+	"github.com/hootrhino/rulex/typex"
+)
+
+func Test_Modbus_Decode_Byte_Order(t *testing.T) {
+	// 25.5 的 float32 是 0x41CC0000
+	cases := map[string][]byte{
+		"ABCD": {0x41, 0xCC, 0x00, 0x00},
+		"CDAB": {0x00, 0x00, 0x41, 0xCC},
+		"BADC": {0xCC, 0x41, 0x00, 0x00},
+		"DCBA": {0x00, 0x00, 0xCC, 0x41},
+	}
+	for order, raw := range cases {
+		r := common.RegisterRW{Tag: "f", Function: common.READ_HOLDING_REGISTERS,
+			Quantity: 2, DataType: "FLOAT32", DataOrder: order}
+		value, err := driver.DecodeRegisterValue(r, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.(float32) != 25.5 {
+			t.Fatal(order, "decode failed:", value)
+		}
+		encoded, err := driver.EncodeRegisterValue(r, 25.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(encoded) != fmt.Sprint(raw) {
+			t.Fatal(order, "encode failed:", encoded)
+		}
+	}
+}
+
+func Test_Modbus_Decode_Scale(t *testing.T) {
+	r := common.RegisterRW{Tag: "t", Function: common.READ_INPUT_REGISTERS,
+		Quantity: 2, DataType: "INT16", Weight: 0.1, InitValue: -40}
+	// 两个值: -10 和 650
+	value, err := driver.DecodeRegisterValue(r, []byte{0xFF, 0xF6, 0x02, 0x8A})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := value.([]interface{})
+	if values[0].(float64) != -41 || values[1].(float64) != 25 {
+		t.Fatal("scale failed:", values)
+	}
+	encoded, err := driver.EncodeRegisterValue(r, []interface{}{-41.0, 25.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(encoded) != fmt.Sprint([]byte{0xFF, 0xF6, 0x02, 0x8A}) {
+		t.Fatal("reverse scale failed:", encoded)
+	}
+	// 数量和类型对不上
+	if err := driver.CheckRegisterDataType(common.RegisterRW{Tag: "x",
+		Function: common.READ_HOLDING_REGISTERS, Quantity: 3, DataType: "FLOAT32"}); err == nil {
+		t.Fatal("quantity 3 should not match FLOAT32")
+	}
+}
+
+// 用 Modbus 从机设备当被采集的设备, 通用 Modbus 设备去采集
+func Test_Modbus_Typed_Read_Write(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	port := freeTcpPort(t)
+	slaver := typex.NewDevice(typex.GENERIC_MODBUS_SLAVER, "slaver", "slaver",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{"mode": "TCP", "slaverId": 1},
+			"tcpConfig":    map[string]interface{}{"host": "127.0.0.1", "port": port},
+			"registers": []map[string]interface{}{
+				// 25.5, CDAB
+				{"tag": "flow", "type": "HOLDING_REGISTER", "address": 0, "quantity": 2,
+					"initValues": []int{0x0000, 0x41CC}},
+				{"tag": "temp", "type": "HOLDING_REGISTER", "address": 2, "quantity": 1,
+					"initValues": []int{655}},
+			},
+		})
+	ctx, cancel := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(slaver, ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	master := typex.NewDevice(typex.GENERIC_MODBUS, "master", "master",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{
+				"mode": "TCP", "timeout": 1000, "autoRequest": false, "frequency": 50,
+			},
+			"tcpConfig": map[string]interface{}{"host": "127.0.0.1", "port": port},
+			"registers": []map[string]interface{}{
+				{"tag": "flow", "function": 3, "slaverId": 1, "address": 0, "quantity": 2,
+					"dataType": "FLOAT32", "dataOrder": "CDAB"},
+				{"tag": "temp", "function": 3, "slaverId": 1, "address": 2, "quantity": 1,
+					"dataType": "INT16", "weight": 0.1, "initValue": -40},
+				// 从机没有这个地址, 读失败
+				{"tag": "missing", "function": 3, "slaverId": 1, "address": 1000, "quantity": 1,
+					"dataType": "INT16"},
+			},
+		})
+	ctx1, cancel1 := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(master, ctx1, cancel1); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, common.T_4KB)
+	n, err := engine.GetDevice(master.UUID).Device.OnRead([]byte{}, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]common.RegisterRW{}
+	if err := json.Unmarshal(buffer[:n], &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["flow"].Value != "000041cc" || result["flow"].DataValue.(float64) != 25.5 {
+		t.Fatal("unexpected flow:", result["flow"])
+	}
+	if fmt.Sprintf("%.1f", result["temp"].DataValue.(float64)) != "25.5" {
+		t.Fatal("unexpected temp:", result["temp"])
+	}
+	// 数据质量和时间戳
+	if flow := result["flow"]; flow.DataQuality == nil || flow.Quality != common.QUALITY_GOOD ||
+		flow.SourceTs == 0 || flow.GatewayTs == 0 {
+		t.Fatal("unexpected flow quality:", flow.DataQuality)
+	}
+	if missing := result["missing"]; missing.DataQuality == nil ||
+		missing.Quality != common.QUALITY_BAD_COMM || missing.Error == "" || missing.DataValue != nil {
+		t.Fatal("unexpected missing quality:", missing.DataQuality)
+	}
+	// 按工程值写回去
+	if _, err := engine.GetDevice(master.UUID).Device.OnWrite([]byte{},
+		[]byte(`[{"tag":"flow","value":-1.5},{"tag":"temp","value":30}]`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	n, _ = engine.GetDevice(slaver.UUID).Device.OnRead([]byte{}, buffer)
+	values := map[string]driver.ModbusSlaverValue{}
+	json.Unmarshal(buffer[:n], &values)
+	// -1.5 的 float32 是 0xBFC00000, CDAB; 30 = 700 * 0.1 - 40
+	if fmt.Sprint(values["flow"].Values) != "[0 49088]" || fmt.Sprint(values["temp"].Values) != "[700]" {
+		t.Fatal("write failed:", values)
+	}
+}
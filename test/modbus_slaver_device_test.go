@@ -0,0 +1,172 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/driver"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/tbrandon/mbserver"
+	modbus "github.com/wwhai/gomodbus"
+)
+
+// 把设备推上来的数据放进 channel
+type chanHook struct {
+	received chan string
+}
+
+func (h *chanHook) Work(data string) error {
+	h.received <- data
+	return nil
+}
+func (h *chanHook) Error(error)  {}
+func (h *chanHook) Name() string { return "chanHook" }
+
+func freeTcpPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func Test_Modbus_Slaver_Device(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	hook := &chanHook{received: make(chan string, 16)}
+	if err := engine.LoadHook(hook); err != nil {
+		t.Fatal(err)
+	}
+	port := freeTcpPort(t)
+	slaver := typex.NewDevice(typex.GENERIC_MODBUS_SLAVER, "slaver", "slaver",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{"mode": "TCP", "slaverId": 1},
+			"tcpConfig":    map[string]interface{}{"host": "127.0.0.1", "port": port},
+			"registers": []map[string]interface{}{
+				{"tag": "temp", "type": "INPUT_REGISTER", "address": 0, "quantity": 2},
+				{"tag": "running", "type": "COIL", "address": 0, "quantity": 1, "initValues": []int{1}},
+				{"tag": "setPoint", "type": "HOLDING_REGISTER", "address": 10, "quantity": 1},
+			},
+		})
+	ctx, cancel := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(slaver, ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	// 规则里 rulexlib:SetRegister 最终走的就是 OnWrite
+	if _, err := engine.GetDevice(slaver.UUID).Device.OnWrite([]byte("temp"), []byte("[1, 258]")); err != nil {
+		t.Fatal(err)
+	}
+	handler := modbus.NewTCPClientHandler(fmt.Sprintf("127.0.0.1:%d", port))
+	handler.Timeout = time.Second
+	handler.SlaveId = 1
+	if err := handler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	client := modbus.NewClient(handler)
+	results, err := client.ReadInputRegisters(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(results) != string([]byte{0, 1, 1, 2}) {
+		t.Fatal("unexpected input registers:", results)
+	}
+	if results, err := client.ReadCoils(0, 1); err != nil || results[0] != 1 {
+		t.Fatal("unexpected coils:", results, err)
+	}
+	// 没有映射的地址
+	if _, err := client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("unmapped address should be rejected")
+	}
+	// 主站写入以后推事件
+	if _, err := client.WriteSingleRegister(10, 500); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-hook.received:
+		event := map[string]interface{}{}
+		json.Unmarshal([]byte(data), &event)
+		if event["event"] != "write" || event["tag"] != "setPoint" ||
+			event["values"].([]interface{})[0].(float64) != 500 {
+			t.Fatal("unexpected event:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write event not received")
+	}
+}
+
+func Test_Modbus_Slaver_RTU_Frame(t *testing.T) {
+	d, err := driver.NewModbusSlaverDriver(1, []common.SlaverRegister{
+		{Tag: "regs", Type: common.MODBUS_HOLDING_REGISTER, Address: 0, Quantity: 10,
+			InitValues: []int{1, 2, 3}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 读 1 号从机 0 开始的 10 个保持寄存器
+	response := d.HandleRTUFrame([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A, 0xC5, 0xCD})
+	if len(response) != 25 || response[0] != 0x01 || response[1] != 0x03 ||
+		response[2] != 20 || response[4] != 1 || response[6] != 2 {
+		t.Fatal("unexpected response:", response)
+	}
+	// 不是发给自己的帧不回复, 广播只执行不回复
+	request := (&mbserver.RTUFrame{Address: 0x02, Function: 0x03,
+		Data: []byte{0x00, 0x00, 0x00, 0x0A}}).Bytes()
+	if response := d.HandleRTUFrame(request); response != nil {
+		t.Fatal("should not response to other slaver:", response)
+	}
+	request = (&mbserver.RTUFrame{Address: 0x00, Function: 0x06,
+		Data: []byte{0x00, 0x01, 0x00, 0x09}}).Bytes()
+	if response := d.HandleRTUFrame(request); response != nil {
+		t.Fatal("should not response to broadcast:", response)
+	}
+	if value, _ := d.GetValues("regs"); value.Values[1] != 9 {
+		t.Fatal("broadcast write should be executed:", value.Values)
+	}
+	// 残帧返回异常, 不能让 mbserver panic
+	request = (&mbserver.RTUFrame{Address: 0x01, Function: 0x10,
+		Data: []byte{0x00, 0x00, 0x00, 0x02, 0x04, 0x00}}).Bytes()
+	if response := d.HandleRTUFrame(request); len(response) != 5 || response[1] != 0x90 || response[2] != 0x03 {
+		t.Fatal("unexpected response:", response)
+	}
+	// 重叠的映射
+	if _, err := driver.NewModbusSlaverDriver(1, []common.SlaverRegister{
+		{Tag: "a", Type: common.MODBUS_COIL, Address: 0, Quantity: 2},
+		{Tag: "b", Type: common.MODBUS_COIL, Address: 1, Quantity: 1},
+	}, nil); err == nil {
+		t.Fatal("overlap registers should be rejected")
+	}
+}
+
+// 停止以后端口释放, 重启的时候可以重新监听
+func Test_Modbus_Slaver_Listen_Stop(t *testing.T) {
+	newDriver := func() *driver.ModbusSlaverDriver {
+		d, err := driver.NewModbusSlaverDriver(1, []common.SlaverRegister{
+			{Tag: "regs", Type: common.MODBUS_HOLDING_REGISTER, Address: 0, Quantity: 1},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", freeTcpPort(t))
+	d := newDriver()
+	if err := d.ListenTCP(address); err != nil {
+		t.Fatal(err)
+	}
+	if err := newDriver().ListenTCP(address); err == nil {
+		t.Fatal("address in use should be rejected")
+	}
+	d.Stop()
+	d.Stop()
+	d = newDriver()
+	if err := d.ListenTCP(address); err != nil {
+		t.Fatal("stopped driver should release address:", err)
+	}
+	d.Stop()
+}
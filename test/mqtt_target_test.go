@@ -0,0 +1,206 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/typex"
+	mqtt "github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/hooks/auth"
+	"github.com/mochi-co/mqtt/v2/listeners"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// 记录 Broker 收到的发布报文
+type publishRecorder struct {
+	mqtt.HookBase
+	sync.Mutex
+	published []packets.Packet
+}
+
+func (h *publishRecorder) ID() string { return "publish-recorder" }
+func (h *publishRecorder) Provides(b byte) bool {
+	return b == mqtt.OnPublish
+}
+func (h *publishRecorder) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.Lock()
+	defer h.Unlock()
+	h.published = append(h.published, pk)
+	return pk, nil
+}
+func (h *publishRecorder) take() []packets.Packet {
+	h.Lock()
+	defer h.Unlock()
+	published := h.published
+	h.published = nil
+	return published
+}
+
+func startRecordBroker(t *testing.T) (*mqtt.Server, *publishRecorder, int) {
+	port := freeTcpPort(t)
+	server, recorder := startRecordBrokerAt(t, port)
+	return server, recorder, port
+}
+
+func startRecordBrokerAt(t *testing.T, port int) (*mqtt.Server, *publishRecorder) {
+	server := mqtt.New(nil)
+	server.AddHook(new(auth.AllowHook), nil)
+	recorder := &publishRecorder{}
+	server.AddHook(recorder, nil)
+	if err := server.AddListener(listeners.NewTCP("t1", fmt.Sprintf("127.0.0.1:%d", port), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return server, recorder
+}
+
+func waitTargetUp(t *testing.T, e typex.RuleX, uuid string) {
+	for i := 0; e.GetOutEnd(uuid).Target.Status() != typex.SOURCE_UP; i++ {
+		if i == 200 {
+			t.Fatal("target should be up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func Test_Mqtt_Target_Template(t *testing.T) {
+	server, recorder, port := startRecordBroker(t)
+	defer server.Close()
+	e := RunTestEngine()
+	e.Start()
+	for _, version := range []int{3, 5} {
+		clientId := fmt.Sprintf("target-v%d", version)
+		out := typex.NewOutEnd(typex.MQTT_TARGET, clientId, "", map[string]interface{}{
+			"host": "127.0.0.1", "port": port, "clientId": clientId,
+			"username": "rulex", "password": "rulex",
+			"pubTopic": "factory/{deviceName}/{tag}", "qos": 2, "retain": true,
+			"protocolVersion": version, "persistSession": true,
+			"messageExpiry": 60, "responseTopic": "reply/{deviceName}",
+			"userProperties": map[string]string{"device": "{deviceName}", "site": "s1"},
+		})
+		ctx, cancelCTX := typex.NewCCTX()
+		if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+			t.Fatal(err)
+		}
+		waitTargetUp(t, e, out.UUID)
+		target := e.GetOutEnd(out.UUID).Target
+		// 数组的每个元素发布到自己的 Topic
+		if _, err := target.To(`[{"deviceName":"d1","tag":"temp","value":1},{"deviceName":"d2","tag":"hum","value":2}]`); err != nil {
+			t.Fatal(err)
+		}
+		published := recorder.take()
+		if len(published) != 2 || published[0].TopicName != "factory/d1/temp" || published[1].TopicName != "factory/d2/hum" {
+			t.Fatal("unexpected published:", published)
+		}
+		pk := published[0]
+		if pk.FixedHeader.Qos != 2 || !pk.FixedHeader.Retain || string(pk.Payload) != `{"deviceName":"d1","tag":"temp","value":1}` {
+			t.Fatal("unexpected packet:", pk.FixedHeader, string(pk.Payload))
+		}
+		if version == 5 {
+			if pk.ProtocolVersion != 5 || pk.Properties.MessageExpiryInterval != 60 || pk.Properties.ResponseTopic != "reply/d1" {
+				t.Fatal("unexpected properties:", pk.Properties)
+			}
+			users := map[string]string{}
+			for _, user := range pk.Properties.User {
+				users[user.Key] = user.Val
+			}
+			if users["device"] != "d1" || users["site"] != "s1" {
+				t.Fatal("unexpected user properties:", pk.Properties.User)
+			}
+		}
+		// 模板字段缺少或者不是 JSON 的时候返回错误
+		if _, err := target.To(`{"deviceName":"d1"}`); err == nil {
+			t.Fatal("missing topic field should be error")
+		}
+		if _, err := target.To(`hello`); err == nil {
+			t.Fatal("non JSON message should be error")
+		}
+		// 被踢下线以后自动重连, 会话还在
+		cl, ok := server.Clients.Get(clientId)
+		if !ok {
+			t.Fatal("client not found:", clientId)
+		}
+		cl.Stop(errors.New("kicked"))
+		for i := 0; ; i++ {
+			target.To(`{"deviceName":"d3","tag":"temp"}`)
+			if published := recorder.take(); len(published) > 0 && published[len(published)-1].TopicName == "factory/d3/temp" {
+				break
+			}
+			if i == 100 {
+				t.Fatal("target should reconnect")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if cl, ok := server.Clients.Get(clientId); !ok || cl.Properties.Clean {
+			t.Fatal("session should be persisted")
+		}
+		cancelCTX()
+		e.RemoveOutEnd(out.UUID)
+	}
+}
+
+/*
+*
+* MQTT5: 空闲超过心跳间隔的时候靠心跳保持连接; Broker 重启以后自动重连
+*
+ */
+func Test_Mqtt5_Target_Keepalive_Reconnect(t *testing.T) {
+	server, _, port := startRecordBroker(t)
+	e := RunTestEngine()
+	e.Start()
+	out := typex.NewOutEnd(typex.MQTT_TARGET, "target-keepalive", "", map[string]interface{}{
+		"host": "127.0.0.1", "port": port, "clientId": "target-keepalive",
+		"username": "rulex", "password": "rulex", "pubTopic": "factory/keepalive",
+		"protocolVersion": 5, "keepalive": 2,
+	})
+	ctx, cancelCTX := typex.NewCCTX()
+	defer cancelCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveOutEnd(out.UUID)
+	waitTargetUp(t, e, out.UUID)
+	target := e.GetOutEnd(out.UUID).Target
+	cl, ok := server.Clients.Get("target-keepalive")
+	if !ok {
+		t.Fatal("client not found")
+	}
+	// Broker 超过 1.5 倍心跳间隔收不到报文会断开连接
+	time.Sleep(5 * time.Second)
+	if current, ok := server.Clients.Get("target-keepalive"); !ok || current != cl || cl.Closed() {
+		t.Fatal("connection should be kept alive by ping")
+	}
+	if target.Status() != typex.SOURCE_UP {
+		t.Fatal("target should be up")
+	}
+
+	server.Close()
+	for i := 0; target.Status() != typex.SOURCE_DOWN; i++ {
+		if i == 200 {
+			t.Fatal("target should be down after broker closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := target.To(`{"value":1}`); err == nil {
+		t.Fatal("publish should fail when disconnected")
+	}
+	server, recorder := startRecordBrokerAt(t, port)
+	defer server.Close()
+	for i := 0; target.Status() != typex.SOURCE_UP; i++ {
+		if i == 300 {
+			t.Fatal("target should reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := target.To(`{"value":2}`); err != nil {
+		t.Fatal(err)
+	}
+	if published := recorder.take(); len(published) != 1 || string(published[0].Payload) != `{"value":2}` {
+		t.Fatal("unexpected published:", published)
+	}
+}
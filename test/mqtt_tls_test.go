@@ -0,0 +1,150 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/core"
+	mqttserver "github.com/hootrhino/rulex/plugin/mqtt_server"
+	"github.com/hootrhino/rulex/typex"
+	"gopkg.in/ini.v1"
+)
+
+// 签发证书, ca 为空的时候是自签名的 CA; 返回证书和私钥的 PEM
+func issueTestCert(t *testing.T, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func Test_Mqtt_Tls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPem, _ := issueTestCert(t, "rulex-ca", nil, nil)
+	_, _, serverPem, serverKey := issueTestCert(t, "server", ca, caKey)
+	_, _, clientPem, clientKey := issueTestCert(t, "client", ca, caKey)
+	files := map[string][]byte{"ca.pem": caPem, "server.pem": serverPem, "server.key": serverKey}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := RunTestEngine()
+	e.Start()
+	// 双向认证的 Broker
+	tlsPort := freeTcpPort(t)
+	section := ini.Empty().Section("plugin.mqtt_server")
+	section.NewKey("host", "127.0.0.1")
+	section.NewKey("port", fmt.Sprintf("%d", freeTcpPort(t)))
+	section.NewKey("tls_port", fmt.Sprintf("%d", tlsPort))
+	section.NewKey("cert_file", filepath.Join(dir, "server.pem"))
+	section.NewKey("key_file", filepath.Join(dir, "server.key"))
+	section.NewKey("ca_file", filepath.Join(dir, "ca.pem"))
+	server := mqttserver.NewMqttServer()
+	if err := server.Init(section); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	mqttConfig := func(clientId string, withClientCert bool) map[string]interface{} {
+		tlsConfig := map[string]interface{}{
+			"scheme": "ssl",
+			"caCert": filepath.Join(dir, "ca.pem"), // 文件路径
+		}
+		if withClientCert {
+			tlsConfig["clientCert"] = string(clientPem) // PEM 内容
+			tlsConfig["clientKey"] = string(clientKey)
+		}
+		return map[string]interface{}{
+			"host": "127.0.0.1", "port": tlsPort, "clientId": clientId,
+			"username": "rulex", "password": "rulex",
+			"pubTopic": "tls/test", "subTopic": "tls/test",
+			"tlsConfig": tlsConfig,
+		}
+	}
+	// 没有客户端证书连不上
+	noCert := typex.NewOutEnd(typex.MQTT_TARGET, "no-cert", "", mqttConfig("no-cert", false))
+	ctx, cancelCTX := typex.NewCCTX()
+	e.LoadOutEndWithCtx(noCert, ctx, cancelCTX)
+	if e.GetOutEnd(noCert.UUID).Target.Status() == typex.SOURCE_UP {
+		t.Fatal("connect without client cert should fail")
+	}
+	cancelCTX()
+	e.RemoveOutEnd(noCert.UUID)
+
+	in := typex.NewInEnd(typex.MQTT, "tls-in", "", mqttConfig("tls-in", true))
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveInEnd(in.UUID)
+	rule := typex.NewLuaRule(e, "RULE_MQTT_TLS", "mqtt tls", "", []string{in.UUID}, []string{},
+		`function Success() end`,
+		`Actions = {
+			function(args)
+				rulexlib:VSet("mqtt_tls", args)
+				return true, args
+			end
+		}`,
+		`function Failed(error) end`)
+	if err := e.LoadRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveRule(rule.UUID)
+	out := typex.NewOutEnd(typex.MQTT_TARGET, "tls-out", "", mqttConfig("tls-out", true))
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveOutEnd(out.UUID)
+	for i := 0; core.GlobalStore.Get("mqtt_tls") == ""; i++ {
+		if i == 100 {
+			t.Fatal("message over tls should be received")
+		}
+		e.PushOutQueue(e.GetOutEnd(out.UUID), "hello tls")
+		time.Sleep(50 * time.Millisecond)
+	}
+	if core.GlobalStore.Get("mqtt_tls") != "hello tls" {
+		t.Fatal("unexpected message:", core.GlobalStore.Get("mqtt_tls"))
+	}
+}
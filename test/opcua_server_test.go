@@ -0,0 +1,267 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	opcuaserver "github.com/hootrhino/rulex/plugin/opcua_server"
+	"github.com/hootrhino/rulex/typex"
+	modbus "github.com/wwhai/gomodbus"
+	"gopkg.in/ini.v1"
+)
+
+func Test_Opcua_Server(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	modbusPort := freeTcpPort(t)
+	slaver := typex.NewDevice(typex.GENERIC_MODBUS_SLAVER, "slaver", "slaver",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{"mode": "TCP", "slaverId": 1},
+			"tcpConfig":    map[string]interface{}{"host": "127.0.0.1", "port": modbusPort},
+			"registers": []map[string]interface{}{
+				{"tag": "setPoint", "type": "HOLDING_REGISTER", "address": 10, "quantity": 1},
+			},
+		})
+	ctx, cancel := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(slaver, ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	port := freeTcpPort(t)
+	clientCert, clientKey, trustedCert := newOpcuaClientCert(t)
+	untrustedCert, untrustedKey, _ := newOpcuaClientCert(t)
+	pkiDir := t.TempDir()
+	section := ini.Empty().Section("plugin.opcua_server")
+	section.NewKey("host", "127.0.0.1")
+	section.NewKey("port", fmt.Sprintf("%d", port))
+	section.NewKey("writable", "true")
+	section.NewKey("username", "opcua")
+	section.NewKey("password", "opcua-secret")
+	section.NewKey("trusted_certs", trustedCert)
+	section.NewKey("pki_dir", pkiDir)
+	server := opcuaserver.NewOpcuaServer()
+	if err := server.Init(section); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(engine); err != nil {
+		t.Fatal(err)
+	}
+	// 先关客户端再停服务端, 不然客户端会去重连
+	t.Cleanup(func() { server.Stop() })
+	// 设备上报一次数据, 点位会出现在地址空间里
+	engine.RunDeviceHooks(engine.GetDevice(slaver.UUID),
+		`{"setPoint":{"tag":"setPoint","value":"0023","dataValue":35},"running":true}`)
+
+	endpoint := fmt.Sprintf("opc.tcp://127.0.0.1:%d", port)
+	// 默认不开放 SecurityPolicy None
+	endpoints, err := opcua.GetEndpoints(context.Background(), endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcua.SelectEndpoint(endpoints, ua.SecurityPolicyURINone, ua.MessageSecurityModeNone) != nil {
+		t.Fatal("SecurityPolicy None should be disabled by default")
+	}
+	if opcua.SelectEndpoint(endpoints, ua.SecurityPolicyURIBasic256Sha256, ua.MessageSecurityModeSign) == nil {
+		t.Fatal("Basic256Sha256 Sign endpoint not found")
+	}
+	// 不信任的客户端证书不能建立安全通道, 证书保存到 rejected 目录
+	untrusted := opcua.NewClient(endpoint, opcuaIdentityOptions(t, endpoint, ua.UserTokenTypeAnonymous,
+		untrustedKey, untrustedCert)...)
+	if err := untrusted.Connect(context.Background()); err == nil {
+		untrusted.Close()
+		t.Fatal("untrusted certificate should be rejected")
+	}
+	if rejected, _ := os.ReadDir(filepath.Join(pkiDir, "rejected")); len(rejected) != 1 {
+		t.Fatal("untrusted certificate should be saved to the rejected directory")
+	}
+	// 自动生成的服务端证书要包含本机所有网卡的地址, 不然客户端用这些地址连接会被拒绝
+	serverPem, err := os.ReadFile(filepath.Join(pkiDir, "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(serverPem)
+	serverCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, _ := net.InterfaceAddrs()
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok {
+			if err := serverCert.VerifyHostname(ipNet.IP.String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	client := connectOpcuaServer(t, endpoint, ua.UserTokenTypeAnonymous, clientKey, clientCert)
+
+	browse, err := client.Browse(&ua.BrowseRequest{
+		View: &ua.ViewDescription{ViewID: ua.NewTwoByteNodeID(0)},
+		NodesToBrowse: []*ua.BrowseDescription{{
+			NodeID:          ua.NewStringNodeID(1, slaver.UUID),
+			BrowseDirection: ua.BrowseDirectionForward,
+			ReferenceTypeID: ua.NewNumericNodeID(0, 33),
+			IncludeSubtypes: true,
+			ResultMask:      uint32(ua.BrowseResultMaskAll),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, reference := range browse.Results[0].References {
+		names = append(names, reference.BrowseName.Name)
+	}
+	if fmt.Sprint(names) != "[running setPoint]" {
+		t.Fatal("unexpected references:", names)
+	}
+
+	read, err := client.Read(&ua.ReadRequest{
+		NodesToRead: []*ua.ReadValueID{
+			{NodeID: ua.NewStringNodeID(1, slaver.UUID+"/setPoint"), AttributeID: ua.AttributeIDValue,
+				DataEncoding: &ua.QualifiedName{}},
+			{NodeID: ua.NewStringNodeID(1, slaver.UUID+"/running"), AttributeID: ua.AttributeIDValue,
+				DataEncoding: &ua.QualifiedName{}},
+			{NodeID: ua.NewStringNodeID(1, slaver.UUID+"/unknown"), AttributeID: ua.AttributeIDValue,
+				DataEncoding: &ua.QualifiedName{}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Results[0].Value.Value() != float64(35) || read.Results[1].Value.Value() != true {
+		t.Fatal("unexpected values:", read.Results[0].Value.Value(), read.Results[1].Value.Value())
+	}
+	if read.Results[2].Status != ua.StatusBadNodeIDUnknown {
+		t.Fatal("unknown node should be rejected:", read.Results[2].Status)
+	}
+
+	// 匿名用户不能写
+	writeSetPoint := func(client *opcua.Client, value float64) ua.StatusCode {
+		write, err := client.Write(&ua.WriteRequest{
+			NodesToWrite: []*ua.WriteValue{{
+				NodeID:      ua.NewStringNodeID(1, slaver.UUID+"/setPoint"),
+				AttributeID: ua.AttributeIDValue,
+				Value: &ua.DataValue{
+					EncodingMask: ua.DataValueValue,
+					Value:        ua.MustVariant(value),
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return write.Results[0]
+	}
+	if status := writeSetPoint(client, 400); status != ua.StatusBadUserAccessDenied {
+		t.Fatal("anonymous write should be rejected:", status)
+	}
+	// 密码错误不能登录
+	wrong := opcua.NewClient(endpoint, opcuaIdentityOptions(t, endpoint, ua.UserTokenTypeUserName,
+		clientKey, clientCert, opcua.AuthUsername("opcua", "wrong"))...)
+	if err := wrong.Connect(context.Background()); err == nil {
+		wrong.Close()
+		t.Fatal("wrong password should be rejected")
+	}
+	// 证书登录以后可以写
+	certClient := connectOpcuaServer(t, endpoint, ua.UserTokenTypeCertificate,
+		clientKey, clientCert, opcua.AuthCertificate(clientCert))
+	if status := writeSetPoint(certClient, 300); status != ua.StatusOK {
+		t.Fatal("certificate user write failed:", status)
+	}
+	// 写变量最终调用设备的 OnWrite
+	userClient := connectOpcuaServer(t, endpoint, ua.UserTokenTypeUserName,
+		clientKey, clientCert, opcua.AuthUsername("opcua", "opcua-secret"))
+	if status := writeSetPoint(userClient, 500); status != ua.StatusOK {
+		t.Fatal("write failed:", status)
+	}
+	handler := modbus.NewTCPClientHandler(fmt.Sprintf("127.0.0.1:%d", modbusPort))
+	handler.Timeout = time.Second
+	handler.SlaveId = 1
+	if err := handler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	results, err := modbus.NewClient(handler).ReadHoldingRegisters(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(results) != string([]byte{0x01, 0xF4}) {
+		t.Fatal("unexpected holding register:", results)
+	}
+}
+
+const _OPCUA_TEST_CLIENT_URI = "urn:rulex:opcua-test-client"
+
+// 生成客户端证书, 返回 DER 证书, 私钥和服务端信任的 PEM 文件路径
+func newOpcuaClientCert(t *testing.T) ([]byte, *rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applicationURI, _ := url.Parse(_OPCUA_TEST_CLIENT_URI)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "opcua-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment |
+			x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{applicationURI},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return der, key, path
+}
+
+// 用 Basic256Sha256 SignAndEncrypt 通道, 按服务端的登录方式生成客户端参数
+func opcuaIdentityOptions(t *testing.T, endpoint string, tokenType ua.UserTokenType,
+	key *rsa.PrivateKey, cert []byte, options ...opcua.Option) []opcua.Option {
+	endpoints, err := opcua.GetEndpoints(context.Background(), endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := opcua.SelectEndpoint(endpoints, ua.SecurityPolicyURIBasic256Sha256,
+		ua.MessageSecurityModeSignAndEncrypt)
+	if ep == nil {
+		t.Fatal("endpoint not found")
+	}
+	return append([]opcua.Option{
+		opcua.ApplicationURI(_OPCUA_TEST_CLIENT_URI),
+		opcua.SecurityPolicy(ua.SecurityPolicyURIBasic256Sha256),
+		opcua.SecurityMode(ua.MessageSecurityModeSignAndEncrypt),
+		opcua.PrivateKey(key),
+		opcua.Certificate(cert),
+	}, append(options, opcua.SecurityFromEndpoint(ep, tokenType))...)
+}
+
+func connectOpcuaServer(t *testing.T, endpoint string, tokenType ua.UserTokenType,
+	key *rsa.PrivateKey, cert []byte, options ...opcua.Option) *opcua.Client {
+	client := opcua.NewClient(endpoint, opcuaIdentityOptions(t, endpoint, tokenType, key, cert, options...)...)
+	timeout, stop := context.WithTimeout(context.Background(), 3*time.Second)
+	defer stop()
+	if err := client.Connect(timeout); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
@@ -0,0 +1,309 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awcullen/opcua/server"
+	uaserver "github.com/awcullen/opcua/ua"
+	"github.com/hootrhino/rulex/device"
+	"github.com/hootrhino/rulex/typex"
+)
+
+func Test_Opcua_Variant(t *testing.T) {
+	cases := []struct {
+		dataType string
+		value    interface{}
+		expect   interface{}
+	}{
+		{"Int16", 12.0, int16(12)},
+		{"UInt32", "7", uint32(7)},
+		{"Float", 1.5, float32(1.5)},
+		{"Double", 2.25, 2.25},
+		{"Boolean", 1.0, true},
+		{"String", 3.0, "3"},
+		{"", "abc", "abc"},
+	}
+	for _, c := range cases {
+		variant, err := device.NewOpcuaVariant(c.dataType, c.value)
+		if err != nil {
+			t.Fatal(c.dataType, err)
+		}
+		if variant.Value() != c.expect {
+			t.Fatal(c.dataType, "unexpected value:", variant.Value())
+		}
+	}
+	if _, err := device.NewOpcuaVariant("Byte", 256.0); err == nil {
+		t.Fatal("out of range value should be rejected")
+	}
+	if _, err := device.NewOpcuaVariant("Int32", 1.5); err == nil {
+		t.Fatal("fraction should be rejected for integer type")
+	}
+}
+
+func Test_Opcua_Subscribe_Config(t *testing.T) {
+	engine := RunTestEngine()
+	config := func(deadbandType string) map[string]interface{} {
+		return map[string]interface{}{
+			"commonConfig": map[string]interface{}{
+				"endpoint":        "opc.tcp://127.0.0.1:4840",
+				"frequency":       500,
+				"retryTime":       5,
+				"subscribe":       true,
+				"publishInterval": 200,
+			},
+			"opcuaNodes": []map[string]interface{}{
+				{
+					"tag":              "temp",
+					"description":      "temp",
+					"nodeId":           "ns=2;i=1001",
+					"dataType":         "Double",
+					"samplingInterval": 100,
+					"queueSize":        5,
+					"deadbandType":     deadbandType,
+					"deadband":         0.5,
+				},
+			},
+		}
+	}
+	if err := device.NewGenericOpcuaDevice(engine).Init("opcua", config("ABS")); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.NewGenericOpcuaDevice(engine).Init("opcua", config("XX")); err == nil {
+		t.Fatal("invalid deadband type should be rejected")
+	}
+}
+
+// 只收某一个设备数据的 Hook
+type deviceDataHook struct {
+	uuid     string
+	received chan string
+}
+
+func (h *deviceDataHook) Work(data string) error { return nil }
+func (h *deviceDataHook) WorkDevice(Device *typex.Device, data string) error {
+	if Device != nil && Device.UUID == h.uuid {
+		select {
+		case h.received <- data:
+		default:
+		}
+	}
+	return nil
+}
+func (h *deviceDataHook) Error(error)  {}
+func (h *deviceDataHook) Name() string { return "deviceDataHook" }
+
+/*
+*
+* 用 awcullen/opcua 起一个独立的服务端, 只有一个可写的 Double 变量 ns=2;s=setPoint,
+* 用户名密码登录的用户可以写
+*
+ */
+func startOpcuaTestServer(t *testing.T, port int) (*server.Server, *server.VariableNode) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applicationURI, _ := url.Parse("urn:rulex:opcua-test-server")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "opcua-test-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageDataEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		// 服务端会检查客户端连接用的主机名在不在证书里
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		URIs:        []*url.URL{applicationURI},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	endpoint := fmt.Sprintf("opc.tcp://127.0.0.1:%d", port)
+	srv, err := server.New(
+		uaserver.ApplicationDescription{
+			ApplicationURI:  applicationURI.String(),
+			ApplicationName: uaserver.LocalizedText{Text: "opcua-test-server"},
+			ApplicationType: uaserver.ApplicationTypeServer,
+			DiscoveryURLs:   []string{endpoint},
+		},
+		certFile, keyFile, endpoint,
+		server.WithSecurityPolicyNone(true),
+		server.WithServerDiagnostics(false),
+		server.WithAuthenticateUserNameIdentityFunc(func(identity uaserver.UserNameIdentity,
+			applicationURI string, endpointURL string) error {
+			if identity.UserName != "opcua" || identity.Password != "opcua-secret" {
+				return uaserver.BadUserAccessDenied
+			}
+			return nil
+		}),
+		server.WithGetRolesFunc(func(identity any, applicationURI string, endpointURL string) ([]uaserver.NodeID, error) {
+			if _, ok := identity.(uaserver.UserNameIdentity); ok {
+				return []uaserver.NodeID{uaserver.ObjectIDWellKnownRoleOperator}, nil
+			}
+			return []uaserver.NodeID{uaserver.ObjectIDWellKnownRoleAnonymous}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := srv.NamespaceManager().Add("urn:rulex:opcua-test")
+	now := time.Now()
+	node := server.NewVariableNode(srv,
+		uaserver.NewNodeIDString(ns, "setPoint"),
+		uaserver.NewQualifiedName(ns, "setPoint"),
+		uaserver.NewLocalizedText("setPoint", ""),
+		uaserver.NewLocalizedText("", ""),
+		nil,
+		[]uaserver.Reference{
+			uaserver.NewReference(uaserver.ReferenceTypeIDHasTypeDefinition, false,
+				uaserver.NewExpandedNodeID(uaserver.VariableTypeIDBaseDataVariableType)),
+			uaserver.NewReference(uaserver.ReferenceTypeIDOrganizes, true,
+				uaserver.NewExpandedNodeID(uaserver.ObjectIDObjectsFolder)),
+		},
+		uaserver.NewDataValue(35.0, uaserver.Good, now, 0, now, 0),
+		uaserver.DataTypeIDDouble,
+		uaserver.ValueRankScalar,
+		[]uint32{},
+		uaserver.AccessLevelsCurrentRead|uaserver.AccessLevelsCurrentWrite,
+		50.0,
+		false,
+		nil,
+	)
+	if err := srv.NamespaceManager().AddNode(node); err != nil {
+		t.Fatal(err)
+	}
+	go srv.ListenAndServe()
+	// 等服务端开始监听
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("opcua test server not started:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return srv, node
+}
+
+/*
+*
+* 订阅独立服务端的节点: 先收到初始值, 服务端的值变了以后收到新值; 设备写节点以后服务端的值要变;
+* 服务端停掉以后会话断开, 设备要变成 DOWN
+*
+ */
+func Test_Opcua_Subscribe_Server(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	port := freeTcpPort(t)
+	srv, node := startOpcuaTestServer(t, port)
+	closed := false
+	defer func() {
+		if !closed {
+			srv.Close()
+		}
+	}()
+
+	opcuaDevice := typex.NewDevice(typex.GENERIC_OPCUA, "opcua", "opcua",
+		map[string]interface{}{
+			"commonConfig": map[string]interface{}{
+				"endpoint":        fmt.Sprintf("opc.tcp://127.0.0.1:%d", port),
+				"policy":          "None",
+				"mode":            "None",
+				"auth":            "UserName",
+				"username":        "opcua",
+				"password":        "opcua-secret",
+				"timeout":         3000,
+				"frequency":       1000,
+				"retryTime":       5,
+				"subscribe":       true,
+				"publishInterval": 100,
+			},
+			"opcuaNodes": []map[string]interface{}{
+				{
+					"tag":         "setPoint",
+					"description": "setPoint",
+					"nodeId":      "ns=2;s=setPoint",
+					"dataType":    "Double",
+				},
+			},
+		})
+	hook := &deviceDataHook{uuid: opcuaDevice.UUID, received: make(chan string, 16)}
+	if err := engine.LoadHook(hook); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := typex.NewCCTX()
+	if err := engine.LoadDeviceWithCtx(opcuaDevice, ctx, cancel); err != nil {
+		t.Fatal(err)
+	}
+	// 订阅以后先收到初始值, 节点变化以后收到新值
+	waitValue := func(expect string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case data := <-hook.received:
+				values := map[string]device.OpcuaNode{}
+				if err := json.Unmarshal([]byte(data), &values); err != nil {
+					t.Fatal(err)
+				}
+				if values["setPoint"].Value == expect {
+					return
+				}
+			case <-timeout:
+				t.Fatal("subscription value not received:", expect)
+			}
+		}
+	}
+	waitValue("35")
+	now := time.Now()
+	node.SetValue(uaserver.NewDataValue(36.0, uaserver.Good, now, 0, now, 0))
+	waitValue("36")
+
+	// 设备写节点, 服务端的值变成写入的值, 订阅也会收到
+	target := engine.GetDevice(opcuaDevice.UUID).Device
+	if _, err := target.OnWrite([]byte("setPoint"), []byte("500")); err != nil {
+		t.Fatal(err)
+	}
+	if value := node.Value().Value; value != 500.0 {
+		t.Fatal("unexpected server value:", value)
+	}
+	waitValue("500")
+
+	// 会话断开以后订阅不会恢复, 设备要变成 DOWN 等待重启
+	closed = true
+	srv.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for target.Status() != typex.DEV_DOWN {
+		if time.Now().After(deadline) {
+			t.Fatal("device should be down after the session is closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
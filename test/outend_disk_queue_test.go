@@ -0,0 +1,164 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
+)
+
+func Test_DiskQueue_Replay_In_Order(t *testing.T) {
+	dir := t.TempDir()
+	dq, err := core.NewDiskQueue(dir, common.OutEndCacheConfig{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := dq.Push(fmt.Sprintf("data-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 模拟目标在第5条的时候又挂了
+	replayed := []string{}
+	n, err := dq.Replay(func(data string) error {
+		if len(replayed) == 5 {
+			return errors.New("target down")
+		}
+		replayed = append(replayed, data)
+		return nil
+	})
+	if n != 5 || err == nil {
+		t.Fatal("replay should stop at 5:", n, err)
+	}
+	// 重新打开, 剩下的数据还在
+	dq.Close()
+	dq, err = core.NewDiskQueue(dir, common.OutEndCacheConfig{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dq.Count() != 5 {
+		t.Fatal("count should be 5 after reopen:", dq.Count())
+	}
+	if _, err := dq.Replay(func(data string) error {
+		replayed = append(replayed, data)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range replayed {
+		if data != fmt.Sprintf("data-%d", i) {
+			t.Fatal("replay out of order:", replayed)
+		}
+	}
+	if dq.Count() != 0 || dq.Size() != 0 {
+		t.Fatal("queue should be empty:", dq.Count(), dq.Size())
+	}
+	dq.Close()
+}
+
+func Test_DiskQueue_Drop_Policy(t *testing.T) {
+	// 每条记录 12 字节头 + 4 字节数据, 最多放3条
+	oldest, err := core.NewDiskQueue(t.TempDir(), common.OutEndCacheConfig{
+		Enable: true, MaxBytes: 48, DropPolicy: core.DROP_OLDEST,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldest.Close()
+	newest, err := core.NewDiskQueue(t.TempDir(), common.OutEndCacheConfig{
+		Enable: true, MaxBytes: 48, DropPolicy: core.DROP_NEWEST,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newest.Close()
+	for i := 0; i < 5; i++ {
+		oldest.Push(fmt.Sprintf("d-%02d", i))
+		newest.Push(fmt.Sprintf("d-%02d", i))
+	}
+	collect := func(dq interface {
+		Replay(func(string) error) (int, error)
+	}) []string {
+		result := []string{}
+		dq.Replay(func(data string) error {
+			result = append(result, data)
+			return nil
+		})
+		return result
+	}
+	if r := collect(oldest); fmt.Sprint(r) != "[d-02 d-03 d-04]" {
+		t.Fatal("DROP_OLDEST failed:", r)
+	}
+	if r := collect(newest); fmt.Sprint(r) != "[d-00 d-01 d-02]" {
+		t.Fatal("DROP_NEWEST failed:", r)
+	}
+}
+
+func Test_DiskQueue_TTL(t *testing.T) {
+	dq, err := core.NewDiskQueue(t.TempDir(), common.OutEndCacheConfig{
+		Enable: true, Ttl: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dq.Close()
+	dq.Push("expired")
+	time.Sleep(1100 * time.Millisecond)
+	dq.Push("alive")
+	result := []string{}
+	dq.Replay(func(data string) error {
+		result = append(result, data)
+		return nil
+	})
+	if fmt.Sprint(result) != "[alive]" {
+		t.Fatal("expired data should be dropped:", result)
+	}
+}
+
+// 发送的时候不占着队列的锁, 目标很慢的时候新数据照样能写进来
+func Test_DiskQueue_Replay_Not_Block_Push(t *testing.T) {
+	dir := t.TempDir()
+	dq, err := core.NewDiskQueue(dir, common.OutEndCacheConfig{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		dq.Push(fmt.Sprintf("data-%d", i))
+	}
+	replayed := []string{}
+	n, err := dq.Replay(func(data string) error {
+		if data == "data-0" {
+			pushed := make(chan error, 1)
+			go func() { pushed <- dq.Push("data-3") }()
+			select {
+			case err := <-pushed:
+				if err != nil {
+					return err
+				}
+			case <-time.After(time.Second):
+				t.Fatal("push blocked by replay")
+			}
+		}
+		replayed = append(replayed, data)
+		return nil
+	})
+	if err != nil || n != 4 {
+		t.Fatal("replay failed:", n, err)
+	}
+	if fmt.Sprint(replayed) != "[data-0 data-1 data-2 data-3]" {
+		t.Fatal("replay out of order:", replayed)
+	}
+	// 索引是整批写一次, 不会留下临时文件
+	if _, err := os.Stat(filepath.Join(dir, "queue.idx.tmp")); !os.IsNotExist(err) {
+		t.Fatal("temp index file should not exist:", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "queue.idx")); err != nil || string(b) != "0" {
+		t.Fatal("index should be reset:", string(b), err)
+	}
+	dq.Close()
+}
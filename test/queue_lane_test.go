@@ -0,0 +1,109 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 遇到 slow 就卡住, 用来模拟很慢的规则
+type slowHook struct {
+	release chan struct{}
+	done    chan string
+}
+
+func (h *slowHook) Work(data string) error {
+	if data == "slow" {
+		<-h.release
+	}
+	h.done <- data
+	return nil
+}
+func (h *slowHook) Error(error)  {}
+func (h *slowHook) Name() string { return "slowHook" }
+
+func Test_Queue_Lane_Isolation(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	hook := &slowHook{release: make(chan struct{}), done: make(chan string, 16)}
+	if err := engine.LoadHook(hook); err != nil {
+		t.Fatal(err)
+	}
+	slowDevice := typex.NewDevice(typex.GENERIC_UART, "slow", "slow", map[string]interface{}{
+		"laneConfig": map[string]interface{}{
+			"size":           2,
+			"overflowPolicy": typex.LANE_DROP_OLDEST,
+		},
+	})
+	fastDevice := typex.NewDevice(typex.GENERIC_UART, "fast", "fast", map[string]interface{}{})
+	engine.WorkDevice(slowDevice, "slow")
+	time.Sleep(50 * time.Millisecond)
+	// 慢设备的通道满了以后丢最老的
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := engine.WorkDevice(slowDevice, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 快设备不受影响
+	engine.WorkDevice(fastDevice, "fast")
+	select {
+	case data := <-hook.done:
+		if data != "fast" {
+			t.Fatal("unexpected data:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fast device blocked by slow device")
+	}
+	var slowLane typex.LaneStatistic
+	for _, lane := range engine.GetMetricStatistics().Snapshot().Lanes {
+		if lane.UUID == slowDevice.UUID {
+			slowLane = lane
+		}
+	}
+	t.Logf("%+v", slowLane)
+	if slowLane.Depth != 2 || slowLane.Dropped != 1 {
+		t.Fatal("slow lane statistic error:", slowLane)
+	}
+	close(hook.release)
+	result := []string{}
+	for i := 0; i < 3; i++ {
+		result = append(result, <-hook.done)
+	}
+	if result[0] != "slow" || result[1] != "b" || result[2] != "c" {
+		t.Fatal("DROP_OLDEST failed:", result)
+	}
+}
+
+// 删除通道的时候, 没处理的数据直接丢掉, 不会再交给已经删除的资源
+func Test_Queue_Lane_Remove(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	hook := &slowHook{release: make(chan struct{}), done: make(chan string, 16)}
+	if err := engine.LoadHook(hook); err != nil {
+		t.Fatal(err)
+	}
+	device := typex.NewDevice(typex.GENERIC_UART, "slow", "slow", map[string]interface{}{})
+	engine.WorkDevice(device, "slow")
+	time.Sleep(50 * time.Millisecond)
+	for _, data := range []string{"a", "b"} {
+		if _, err := engine.WorkDevice(device, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	typex.DefaultDataCacheQueue.RemoveLane(device.UUID)
+	for _, lane := range engine.GetMetricStatistics().Snapshot().Lanes {
+		if lane.UUID == device.UUID {
+			t.Fatal("lane should be removed:", lane)
+		}
+	}
+	close(hook.release)
+	if data := <-hook.done; data != "slow" {
+		t.Fatal("unexpected data:", data)
+	}
+	select {
+	case data := <-hook.done:
+		t.Fatal("queued data should be dropped:", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
+)
+
+func reportTags(t *testing.T, data []byte) map[string]interface{} {
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func Test_Report_Filter_Deadband(t *testing.T) {
+	filter, err := core.NewReportFilter(common.ReportConfig{
+		Enable:      true,
+		ChangedOnly: true,
+		Deadband:    0.5,
+		Tags: map[string]common.TagDeadband{
+			"p": {DeadbandType: common.DEADBAND_PERCENT, Deadband: 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一次全部上报
+	if _, ok := filter.Filter([]byte(`{"t":20,"p":"100","s":"on"}`)); !ok {
+		t.Fatal("first snapshot should be reported")
+	}
+	// 都在死区以内
+	if data, ok := filter.Filter([]byte(`{"t":20.4,"p":"109","s":"on"}`)); ok {
+		t.Fatal("should be filtered:", string(data))
+	}
+	// 和上次上报的值比较, 漂移累计超过死区
+	data, ok := filter.Filter([]byte(`{"t":20.6,"p":"109","s":"on"}`))
+	if !ok {
+		t.Fatal("drift should be reported")
+	}
+	if tags := reportTags(t, data); len(tags) != 1 || tags["t"] != 20.6 {
+		t.Fatal("only changed tag should be reported:", string(data))
+	}
+	data, ok = filter.Filter([]byte(`{"t":20.6,"p":"111","s":"off"}`))
+	if !ok {
+		t.Fatal("changes should be reported")
+	}
+	if tags := reportTags(t, data); len(tags) != 2 || tags["p"] != "111" || tags["s"] != "off" {
+		t.Fatal("unexpected report:", string(data))
+	}
+}
+
+func Test_Report_Filter_Modbus_Snapshot(t *testing.T) {
+	filter, _ := core.NewReportFilter(common.ReportConfig{Enable: true, Deadband: 5})
+	filter.Filter([]byte(`{"a":{"tag":"a","quantity":1,"value":"0001","dataValue":1},` +
+		`"b":{"tag":"b","quantity":1,"value":"0001"}}`))
+	// a 在死区以内, b 没有数据类型, 原始值变了就算变化, 全量模式上报全部点位
+	data, ok := filter.Filter([]byte(`{"a":{"tag":"a","quantity":1,"value":"0003","dataValue":3},` +
+		`"b":{"tag":"b","quantity":1,"value":"0002"}}`))
+	if !ok || len(reportTags(t, data)) != 2 {
+		t.Fatal("full snapshot should be reported:", string(data))
+	}
+	if _, ok := filter.Filter([]byte(`{"a":{"tag":"a","quantity":1,"value":"0004","dataValue":4},` +
+		`"b":{"tag":"b","quantity":1,"value":"0002"}}`)); ok {
+		t.Fatal("should be filtered")
+	}
+}
+
+func Test_Report_Filter_Quality(t *testing.T) {
+	filter, _ := core.NewReportFilter(common.ReportConfig{Enable: true, ChangedOnly: true})
+	filter.Filter([]byte(`{"a":{"value":"1","quality":"GOOD"},"b":{"value":"2","quality":"GOOD"}}`))
+	// 值没变, 质量变了也要上报
+	data, ok := filter.Filter([]byte(`{"a":{"value":"1","quality":"BAD_COMM"},"b":{"value":"2","quality":"GOOD"}}`))
+	if !ok {
+		t.Fatal("quality change should be reported")
+	}
+	if tags := reportTags(t, data); len(tags) != 1 || tags["a"] == nil {
+		t.Fatal("only changed tag should be reported:", string(data))
+	}
+	if _, ok := filter.Filter([]byte(`{"a":{"value":"1","quality":"BAD_COMM"},"b":{"value":"2","quality":"GOOD"}}`)); ok {
+		t.Fatal("should be filtered")
+	}
+}
+
+func Test_Report_Filter_Heartbeat(t *testing.T) {
+	filter, _ := core.NewReportFilter(common.ReportConfig{
+		Enable: true, ChangedOnly: true, Heartbeat: 1,
+	})
+	filter.Filter([]byte(`{"a":1,"b":2}`))
+	if _, ok := filter.Filter([]byte(`{"a":1,"b":2}`)); ok {
+		t.Fatal("should be filtered")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	data, ok := filter.Filter([]byte(`{"a":1,"b":2}`))
+	if !ok || len(reportTags(t, data)) != 2 {
+		t.Fatal("heartbeat should report full snapshot")
+	}
+}
+
+func Test_Report_Filter_Invalid_Config(t *testing.T) {
+	if _, err := core.NewReportFilter(common.ReportConfig{DeadbandType: "XX"}); err == nil {
+		t.Fatal("invalid deadband type should be rejected")
+	}
+	if _, err := core.NewReportFilter(common.ReportConfig{Deadband: -1}); err == nil {
+		t.Fatal("negative deadband should be rejected")
+	}
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/engine"
+	"github.com/hootrhino/rulex/typex"
+)
+
+// 可以控制启动失败和运行中挂掉的输入资源, 重启以后新建的实例共用一个控制器
+type flakyController struct {
+	sync.Mutex
+	failStart bool
+	starts    int
+	current   *flakySource
+}
+
+func (c *flakyController) newSource(typex.RuleX) typex.XSource {
+	c.Lock()
+	defer c.Unlock()
+	c.current = &flakySource{controller: c}
+	return c.current
+}
+
+func (c *flakyController) set(failStart bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.failStart = failStart
+}
+
+func (c *flakyController) down() {
+	c.Lock()
+	defer c.Unlock()
+	c.current.state = typex.SOURCE_DOWN
+}
+
+type flakySource struct {
+	controller *flakyController
+	state      typex.SourceState
+}
+
+func (s *flakySource) Test(inEndId string) bool { return true }
+func (s *flakySource) Init(inEndId string, configMap map[string]interface{}) error {
+	return nil
+}
+func (s *flakySource) Start(cctx typex.CCTX) error {
+	s.controller.Lock()
+	defer s.controller.Unlock()
+	s.controller.starts++
+	if s.controller.failStart {
+		s.state = typex.SOURCE_DOWN
+		return errors.New("connect refused")
+	}
+	s.state = typex.SOURCE_UP
+	return nil
+}
+func (s *flakySource) Status() typex.SourceState {
+	s.controller.Lock()
+	defer s.controller.Unlock()
+	return s.state
+}
+func (s *flakySource) Enabled() bool                   { return true }
+func (s *flakySource) DataModels() []typex.XDataModel  { return nil }
+func (s *flakySource) Configs() *typex.XConfig         { return &typex.XConfig{} }
+func (s *flakySource) Reload()                         {}
+func (s *flakySource) Pause()                          {}
+func (s *flakySource) Details() *typex.InEnd           { return nil }
+func (s *flakySource) Driver() typex.XExternalDriver   { return nil }
+func (s *flakySource) Topology() []typex.TopologyPoint { return nil }
+func (s *flakySource) Stop()                           {}
+func (s *flakySource) DownStream([]byte) (int, error)  { return 0, nil }
+func (s *flakySource) UpStream([]byte) (int, error)    { return 0, nil }
+
+func waitLifecycle(t *testing.T, e typex.RuleX, uuid string, event typex.LifecycleEventType,
+	count int) []typex.LifecycleEvent {
+	for i := 0; i < 100; i++ {
+		events := e.LifecycleEvents(uuid)
+		n := 0
+		for _, ev := range events {
+			if ev.Event == event {
+				n++
+			}
+		}
+		if n >= count {
+			return events
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("wait %d %s events timeout: %v", count, event, e.LifecycleEvents(uuid))
+	return nil
+}
+
+func Test_Resource_Supervisor(t *testing.T) {
+	e := RunTestEngine()
+	e.Start()
+	ruleEngine := e.(*engine.RuleEngine)
+	ruleEngine.Config.SourceRestartInterval = 20
+	ruleEngine.Config.RestartMaxInterval = 80
+	ruleEngine.Config.RestartMaxAttempts = 3
+	controller := &flakyController{}
+	ruleEngine.SourceTypeManager.Register("FLAKY", &typex.XConfig{NewSource: controller.newSource})
+
+	in := typex.NewInEnd("FLAKY", "flaky", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveInEnd(in.UUID)
+	waitLifecycle(t, e, in.UUID, typex.LIFECYCLE_STARTED, 1)
+
+	// 挂了以后前两次重启失败, 第三次成功
+	controller.set(true)
+	controller.down()
+	waitLifecycle(t, e, in.UUID, typex.LIFECYCLE_RESTARTING, 2)
+	controller.set(false)
+	events := waitLifecycle(t, e, in.UUID, typex.LIFECYCLE_STARTED, 2)
+	if events[0].Event != typex.LIFECYCLE_STARTED || events[0].Attempt < 2 {
+		t.Fatal("unexpected restart events:", events)
+	}
+	// 等待时间按指数增长
+	delays := []int64{}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Event == typex.LIFECYCLE_RESTARTING {
+			delays = append(delays, events[i].Delay)
+		}
+	}
+	if delays[0] > 24 || delays[1] < 32 {
+		t.Fatal("unexpected backoff:", delays)
+	}
+
+	// 一直失败, 超过最大次数以后放弃
+	controller.set(true)
+	controller.down()
+	waitLifecycle(t, e, in.UUID, typex.LIFECYCLE_GIVEN_UP, 1)
+	controller.Lock()
+	starts := controller.starts
+	controller.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	controller.Lock()
+	if controller.starts != starts {
+		t.Fatal("should not restart after given up")
+	}
+	controller.Unlock()
+
+	// 手动重启以后重新开始监控
+	controller.set(false)
+	if err := e.RestartInEnd(in.UUID); err != nil {
+		t.Fatal(err)
+	}
+	waitLifecycle(t, e, in.UUID, typex.LIFECYCLE_STARTED, 3)
+	if err := e.RestartInEnd("INEND_NOT_EXISTS"); err == nil {
+		t.Fatal("restart not exists inend should fail")
+	}
+}
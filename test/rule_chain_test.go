@@ -0,0 +1,162 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/typex"
+)
+
+func Test_Rule_Chain_Forward(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	alarmOut, alarmReceived := newChanOutEnd(engine)
+	storeOut, storeReceived := newChanOutEnd(engine)
+	in := typex.NewInEnd(typex.HTTP, "in", "in", map[string]interface{}{})
+	engine.SaveInEnd(in)
+	// 下游: 告警规则, 只有温度高的时候才转发
+	alarm := typex.NewExprRule(engine, "RULE_ALARM", "alarm", "expr",
+		`temp > 30 && meta.type == "RULE"`, "", []string{}, []string{}, "", "", "")
+	alarm.ToTargets = []string{alarmOut.UUID}
+	// 上游: 归一化规则, 把 t 改名成 temp, 同时给存储目标一份
+	normalize := typex.NewLuaRule(engine, "RULE_NORMALIZE", "normalize", "",
+		[]string{in.UUID}, []string{},
+		`function Success() end`,
+		`
+		Actions = {
+			function(data)
+				local v = rulexlib:J2T(data)
+				return true, rulexlib:T2J({temp = v.t})
+			end
+		}`,
+		`function Failed(error) end`)
+	normalize.ToRules = []string{alarm.UUID}
+	normalize.ToTargets = []string{storeOut.UUID}
+	if err := engine.LoadRule(alarm); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.LoadRule(normalize); err != nil {
+		t.Fatal(err)
+	}
+	engine.WorkInEnd(in, `{"t": 20}`)
+	engine.WorkInEnd(in, `{"t": 35}`)
+	for _, expect := range []string{`{"temp":20}`, `{"temp":35}`} {
+		select {
+		case data := <-storeReceived:
+			if data != expect {
+				t.Fatal("unexpected store data:", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("normalize rule not forward data")
+		}
+	}
+	select {
+	case data := <-alarmReceived:
+		if data != `{"temp":35}` {
+			t.Fatal("unexpected alarm data:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("alarm rule not receive data")
+	}
+	select {
+	case data := <-alarmReceived:
+		t.Fatal("data should be filtered:", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_Rule_Chain_Cycle(t *testing.T) {
+	graph := map[string][]string{
+		"A": {"B", "C"},
+		"B": {"D"},
+		"C": {"D"},
+		"D": {},
+	}
+	if err := core.VerifyRuleChain("A", graph); err != nil {
+		t.Fatal("diamond is not a cycle:", err)
+	}
+	graph["D"] = []string{"A"}
+	err := core.VerifyRuleChain("A", graph)
+	if err == nil {
+		t.Fatal("cycle should be detected")
+	}
+	t.Log(err)
+	if err := core.VerifyRuleChain("E", map[string][]string{"E": {"E"}}); err == nil {
+		t.Fatal("self loop should be detected")
+	}
+}
+
+// 最后一个 Action 返回 false 的时候不转发给下游
+func Test_Rule_Chain_Last_Action_Filter(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	out, received := newChanOutEnd(engine)
+	in := typex.NewInEnd(typex.HTTP, "in", "in", map[string]interface{}{})
+	engine.SaveInEnd(in)
+	rule := typex.NewLuaRule(engine, "RULE_FILTER", "filter", "",
+		[]string{in.UUID}, []string{},
+		`function Success() end`,
+		`
+		Actions = {
+			function(data)
+				return true, data
+			end,
+			function(data)
+				local v = rulexlib:J2T(data)
+				return v.temp > 30, data
+			end
+		}`,
+		`function Failed(error) end`)
+	rule.ToTargets = []string{out.UUID}
+	if err := engine.LoadRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	engine.WorkInEnd(in, `{"temp":20}`)
+	engine.WorkInEnd(in, `{"temp":35}`)
+	select {
+	case data := <-received:
+		if data != `{"temp":35}` {
+			t.Fatal("unexpected data:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rule not forward data")
+	}
+	select {
+	case data := <-received:
+		t.Fatal("data should be filtered:", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// 最后一个 Action 返回的不是 bool 的时候和以前一样照常转发
+func Test_Rule_Chain_Last_Action_Not_Bool(t *testing.T) {
+	engine := RunTestEngine()
+	engine.Start()
+	out, received := newChanOutEnd(engine)
+	in := typex.NewInEnd(typex.HTTP, "in", "in", map[string]interface{}{})
+	engine.SaveInEnd(in)
+	rule := typex.NewLuaRule(engine, "RULE_NOT_BOOL", "not-bool", "",
+		[]string{in.UUID}, []string{},
+		`function Success() end`,
+		`
+		Actions = {
+			function(data)
+				return 1, data
+			end
+		}`,
+		`function Failed(error) end`)
+	rule.ToTargets = []string{out.UUID}
+	if err := engine.LoadRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	engine.WorkInEnd(in, `{"temp":20}`)
+	select {
+	case data := <-received:
+		if data != `{"temp":20}` {
+			t.Fatal("unexpected data:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rule not forward data")
+	}
+}
@@ -0,0 +1,221 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/core"
+	"github.com/hootrhino/rulex/engine"
+	mqttserver "github.com/hootrhino/rulex/plugin/mqtt_server"
+	"github.com/hootrhino/rulex/source/sparkplugb"
+	"github.com/hootrhino/rulex/typex"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/ini.v1"
+)
+
+type sparkplugMessage struct {
+	messageType string
+	deviceId    string
+	payload     *sparkplugb.Payload
+}
+
+// 等到指定类型的消息, 中间别的消息跳过
+func waitSparkplug(t *testing.T, messages chan sparkplugMessage, messageType string) sparkplugMessage {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msg.messageType == messageType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("sparkplug message not received:", messageType)
+		}
+	}
+}
+
+// 按名字找指标, 返回数据类型和值
+func sparkplugMetricOf(payload *sparkplugb.Payload, name string) (sparkplugb.DataType, interface{}) {
+	for _, metric := range payload.GetMetrics() {
+		if metric.GetName() == name {
+			return sparkplugb.DataType(metric.GetDatatype()), sparkplugb.MetricValue(metric)
+		}
+	}
+	return sparkplugb.DataType_Unknown, nil
+}
+
+func Test_Sparkplug_B(t *testing.T) {
+	e := RunTestEngine()
+	e.Start()
+	e.(*engine.RuleEngine).Config.SourceRestartInterval = 20
+	port := freeTcpPort(t)
+	section := ini.Empty().Section("plugin.mqtt_server")
+	section.NewKey("host", "127.0.0.1")
+	section.NewKey("port", fmt.Sprintf("%d", port))
+	server := mqttserver.NewMqttServer()
+	if err := server.Init(section); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(e); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// 模拟 SCADA 主机
+	messages := make(chan sparkplugMessage, 64)
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port)).SetClientID("scada")
+	host := mqtt.NewClient(opts)
+	if token := host.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer host.Disconnect(0)
+	host.Subscribe("spBv1.0/G1/#", 0, func(c mqtt.Client, msg mqtt.Message) {
+		_, messageType, _, deviceId, err := common.ParseSparkplugTopic(msg.Topic())
+		if err != nil {
+			return
+		}
+		payload := &sparkplugb.Payload{}
+		if err := proto.Unmarshal(msg.Payload(), payload); err != nil {
+			t.Error(err)
+			return
+		}
+		messages <- sparkplugMessage{messageType: messageType, deviceId: deviceId, payload: payload}
+	}).Wait()
+
+	device := &shadowDevice{e: e, writes: map[string]string{}}
+	e.(*engine.RuleEngine).DeviceTypeManager.Register("SPARKPLUG_DEV", &typex.XConfig{
+		NewDevice: func(typex.RuleX) typex.XDevice { return device },
+	})
+	dev := typex.NewDevice("SPARKPLUG_DEV", "pump1", "", map[string]interface{}{})
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadDeviceWithCtx(dev, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveDevice(dev.UUID)
+
+	in := typex.NewInEnd(typex.SPARKPLUG_B, "edge", "", map[string]interface{}{
+		"host": "127.0.0.1", "port": port, "clientId": "edge-node",
+		"groupId": "G1", "edgeNodeId": "N1", "devices": []string{dev.UUID},
+	})
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadInEndWithCtx(in, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	nbirth := waitSparkplug(t, messages, common.SPARKPLUG_NBIRTH)
+	if nbirth.payload.Seq == nil || *nbirth.payload.Seq != 0 {
+		t.Fatal("NBIRTH seq should be 0:", nbirth.payload.Seq)
+	}
+	if dataType, bdSeq := sparkplugMetricOf(nbirth.payload, common.SPARKPLUG_BDSEQ); dataType != sparkplugb.DataType_Int64 ||
+		bdSeq != int64(0) {
+		t.Fatal("unexpected bdSeq:", dataType, bdSeq)
+	}
+	if dbirth := waitSparkplug(t, messages, common.SPARKPLUG_DBIRTH); dbirth.deviceId != "pump1" || *dbirth.payload.Seq != 1 {
+		t.Fatal("unexpected DBIRTH:", dbirth.deviceId, *dbirth.payload.Seq)
+	}
+
+	// 新的指标先发 DBIRTH, 后面发 DDATA
+	out := typex.NewOutEnd(typex.SPARKPLUG_B_TARGET, "edge-out", "", map[string]interface{}{"sourceId": in.UUID})
+	ctx, cancelCTX = typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	defer e.RemoveOutEnd(out.UUID)
+	target := e.GetOutEnd(out.UUID).Target
+	if _, err := target.To(fmt.Sprintf(`{"device":"%s","metrics":{"temp":21.5,"running":true}}`, dev.UUID)); err != nil {
+		t.Fatal(err)
+	}
+	dbirth := waitSparkplug(t, messages, common.SPARKPLUG_DBIRTH)
+	if dataType, temp := sparkplugMetricOf(dbirth.payload, "temp"); dataType != sparkplugb.DataType_Double || temp != 21.5 {
+		t.Fatal("unexpected temp metric:", dataType, temp)
+	}
+	if dataType, running := sparkplugMetricOf(dbirth.payload, "running"); dataType != sparkplugb.DataType_Boolean || running != true {
+		t.Fatal("unexpected running metric:", dataType, running)
+	}
+	// 设备数据通过脚本发出去, 命令记下来
+	deviceRule := typex.NewLuaRule(e, "RULE_SPARKPLUG_DEV", "sparkplug-dev", "", []string{}, []string{dev.UUID},
+		`function Success() end`,
+		`Actions = {
+			function(args)
+				rulexlib:DataToSparkplug("`+out.UUID+`", "`+dev.UUID+`", args)
+				return true, args
+			end
+		}`,
+		`function Failed(error) end`)
+	commandRule := typex.NewLuaRule(e, "RULE_SPARKPLUG_CMD", "sparkplug-cmd", "", []string{in.UUID}, []string{},
+		`function Success() end`,
+		`Actions = {
+			function(args)
+				rulexlib:VSet("sparkplug_cmd", args)
+				return true, args
+			end
+		}`,
+		`function Failed(error) end`)
+	for _, rule := range []*typex.Rule{deviceRule, commandRule} {
+		if err := e.LoadRule(rule); err != nil {
+			t.Fatal(err)
+		}
+		defer e.RemoveRule(rule.UUID)
+	}
+	e.PushDeviceQueue(e.GetDevice(dev.UUID), `{"temp":23}`)
+	ddata := waitSparkplug(t, messages, common.SPARKPLUG_DDATA)
+	if *ddata.payload.Seq != *dbirth.payload.Seq+1 || len(ddata.payload.Metrics) != 1 {
+		t.Fatal("unexpected DDATA:", ddata.payload)
+	}
+	if _, temp := sparkplugMetricOf(ddata.payload, "temp"); temp != 23.0 {
+		t.Fatal("unexpected temp metric:", temp)
+	}
+
+	// DCMD 写到设备, 命令也进规则
+	// Int32 的负数按 uint32 补码放在 int_value 里
+	speed := int32(-10)
+	command := &sparkplugb.Payload{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Seq:       proto.Uint64(0),
+		Metrics: []*sparkplugb.Payload_Metric{{
+			Name:     proto.String("speed"),
+			Datatype: proto.Uint32(uint32(sparkplugb.DataType_Int32)),
+			Value:    &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(speed)},
+		}},
+	}
+	bytes, _ := proto.Marshal(command)
+	host.Publish("spBv1.0/G1/DCMD/N1/pump1", 0, false, bytes)
+	for i := 0; device.written()["speed"] != "-10" || core.GlobalStore.Get("sparkplug_cmd") == ""; i++ {
+		if i == 100 {
+			t.Fatal("DCMD should be written:", device.written(), core.GlobalStore.Get("sparkplug_cmd"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(core.GlobalStore.Get("sparkplug_cmd"), dev.UUID) {
+		t.Fatal("unexpected command:", core.GlobalStore.Get("sparkplug_cmd"))
+	}
+
+	// Rebirth 以后序号从 0 开始, DBIRTH 带上设备影子里的值
+	command.Metrics = []*sparkplugb.Payload_Metric{sparkplugb.NewMetric(common.SPARKPLUG_REBIRTH, true, 0)}
+	bytes, _ = proto.Marshal(command)
+	host.Publish("spBv1.0/G1/NCMD/N1", 0, false, bytes)
+	if nbirth := waitSparkplug(t, messages, common.SPARKPLUG_NBIRTH); *nbirth.payload.Seq != 0 {
+		t.Fatal("NBIRTH seq should be 0:", *nbirth.payload.Seq)
+	}
+	dbirth = waitSparkplug(t, messages, common.SPARKPLUG_DBIRTH)
+	if _, temp := sparkplugMetricOf(dbirth.payload, "temp"); *dbirth.payload.Seq != 1 || temp != 23.0 {
+		t.Fatal("unexpected DBIRTH after rebirth:", dbirth.payload)
+	}
+
+	// 设备离线 DDEATH, 节点停止 NDEATH
+	device.SetState(typex.DEV_STOP)
+	if ddeath := waitSparkplug(t, messages, common.SPARKPLUG_DDEATH); ddeath.deviceId != "pump1" {
+		t.Fatal("unexpected DDEATH:", ddeath.deviceId)
+	}
+	e.RemoveInEnd(in.UUID)
+	ndeath := waitSparkplug(t, messages, common.SPARKPLUG_NDEATH)
+	if _, bdSeq := sparkplugMetricOf(ndeath.payload, common.SPARKPLUG_BDSEQ); bdSeq != int64(0) || ndeath.payload.Seq != nil {
+		t.Fatal("unexpected NDEATH:", ndeath.payload)
+	}
+	if _, err := target.To(fmt.Sprintf(`{"device":"%s","metrics":{"temp":1}}`, dev.UUID)); err == nil {
+		t.Fatal("publish without edge node should be error")
+	}
+}
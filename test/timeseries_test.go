@@ -0,0 +1,309 @@
+package test
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hootrhino/rulex/common"
+	"github.com/hootrhino/rulex/typex"
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type timeSeriesRequest struct {
+	path    string
+	query   string
+	headers http.Header
+	body    []byte
+}
+
+/*
+*
+* 记录写入请求的 HTTP 服务, failures 里的状态码按顺序返回给前几次写入
+*
+ */
+type timeSeriesRecorder struct {
+	lock     sync.Mutex
+	requests []timeSeriesRequest
+	failures []int
+}
+
+func (r *timeSeriesRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, timeSeriesRequest{
+		path:    req.URL.Path,
+		query:   req.URL.RawQuery,
+		headers: req.Header.Clone(),
+		body:    body,
+	})
+	if len(r.failures) > 0 {
+		status := r.failures[0]
+		r.failures = r.failures[1:]
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":"error"}`))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *timeSeriesRecorder) all() []timeSeriesRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]timeSeriesRequest{}, r.requests...)
+}
+
+func (r *timeSeriesRecorder) fail(statuses ...int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = statuses
+}
+
+func waitTimeSeries(t *testing.T, recorder *timeSeriesRecorder, count int) []timeSeriesRequest {
+	for i := 0; len(recorder.all()) < count; i++ {
+		if i == 200 {
+			t.Fatal("timeseries write should be received:", len(recorder.all()))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return recorder.all()
+}
+
+func loadTimeSeriesTarget(t *testing.T, e typex.RuleX, config map[string]interface{}) *typex.OutEnd {
+	out := typex.NewOutEnd(typex.TIMESERIES_TARGET, "timeseries", "", config)
+	ctx, cancelCTX := typex.NewCCTX()
+	if err := e.LoadOutEndWithCtx(out, ctx, cancelCTX); err != nil {
+		t.Fatal(err)
+	}
+	waitTargetUp(t, e, out.UUID)
+	return out
+}
+
+func Test_Line_Protocol_Escape(t *testing.T) {
+	line := string(common.EncodeLineProtocol([]common.TimeSeriesPoint{{
+		Measurement: "my measurement,1",
+		Tags:        map[string]string{"b tag": "x=1,y", "a": "1", "empty": ""},
+		Fields:      map[string]interface{}{"msg": `say "hi" \o/`, "v": 1.5, "ok": false, "big": 1e21},
+		Time:        time.Unix(1700000000, 123456789),
+	}}, "us"))
+	expected := `my\ measurement\,1,a=1,b\ tag=x\=1\,y big=1e+21,msg="say \"hi\" \\o/",ok=false,v=1.5 1700000000123456` + "\n"
+	if line != expected {
+		t.Fatalf("unexpected line:\n%s\n%s", line, expected)
+	}
+}
+
+func Test_TimeSeries_InfluxDB_V2(t *testing.T) {
+	recorder := &timeSeriesRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	e := RunTestEngine()
+	e.Start()
+	out := loadTimeSeriesTarget(t, e, map[string]interface{}{
+		"protocol": "INFLUXDB_V2", "url": server.URL, "org": "factory", "bucket": "plant", "token": "secret",
+		"mapping": map[string]interface{}{
+			"measurement": "{device}",
+			"tags":        map[string]string{"site": "{site}", "line": "L1"},
+			"timestamp":   "ts",
+		},
+		"batchSize": 3, "flushIntervalMs": 60000, "retryIntervalMs": 20,
+	})
+	defer e.RemoveOutEnd(out.UUID)
+	target := e.GetOutEnd(out.UUID).Target
+
+	// 攒够 3 个数据点写一次; 没有配置 fields 的时候其它简单值都是字段, 带数据质量的点位取 value
+	if _, err := target.To(`[{"device":"d1","site":"s 1","ts":1700000000000,"temp":21.5,"on":true,"mode":"auto","raw":[1,2]},
+		{"device":"d2","site":"s1","ts":1700000001000,"speed":{"value":10,"quality":"GOOD","sourceTs":1}}]`); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.all()) != 0 {
+		t.Fatal("points should be batched")
+	}
+	// 第一次写入 503, 重试以后写成功
+	recorder.fail(http.StatusServiceUnavailable)
+	if _, err := target.To(`{"device":"d1","site":"s1","ts":1700000002000,"temp":22}`); err != nil {
+		t.Fatal(err)
+	}
+	requests := waitTimeSeries(t, recorder, 2)
+	time.Sleep(100 * time.Millisecond)
+	if len(recorder.all()) != 2 {
+		t.Fatal("write should be retried once:", len(recorder.all()))
+	}
+	request := requests[1]
+	if request.path != "/api/v2/write" || request.query != "bucket=plant&org=factory&precision=ms" ||
+		request.headers.Get("Authorization") != "Token secret" {
+		t.Fatal("unexpected request:", request.path, request.query, request.headers)
+	}
+	expected := strings.Join([]string{
+		`d1,line=L1,site=s\ 1 mode="auto",on=true,temp=21.5 1700000000000`,
+		`d2,line=L1,site=s1 speed=10 1700000001000`,
+		`d1,line=L1,site=s1 temp=22 1700000002000`,
+	}, "\n") + "\n"
+	if string(request.body) != expected || string(requests[0].body) != expected {
+		t.Fatalf("unexpected body:\n%s", request.body)
+	}
+
+	// 映射失败的时候返回错误
+	if _, err := target.To(`{"site":"s1","temp":1}`); err == nil {
+		t.Fatal("missing measurement field should be error")
+	}
+	if _, err := target.To(`{"device":"d1","site":"s1","ts":1}`); err == nil {
+		t.Fatal("point without field should be error")
+	}
+	// 400 不重试
+	recorder.fail(http.StatusBadRequest)
+	for i := 0; i < 3; i++ {
+		if _, err := target.To(`{"device":"d1","site":"s1","ts":1700000003000,"temp":1}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitTimeSeries(t, recorder, 3)
+	time.Sleep(100 * time.Millisecond)
+	if len(recorder.all()) != 3 {
+		t.Fatal("bad request should not be retried:", len(recorder.all()))
+	}
+}
+
+func Test_TimeSeries_InfluxDB_V1(t *testing.T) {
+	recorder := &timeSeriesRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	e := RunTestEngine()
+	e.Start()
+	out := loadTimeSeriesTarget(t, e, map[string]interface{}{
+		"protocol": "INFLUXDB_V1", "url": server.URL, "database": "plant", "retentionPolicy": "week",
+		"username": "rulex", "password": "rulex", "precision": "s",
+		"mapping": map[string]interface{}{
+			"measurement": "env",
+			"tags":        map[string]string{"device": "{device.name}"},
+			"fields":      map[string]string{"t": "values.temp", "h": "values.hum"},
+			"timestamp":   "time", "timestampUnit": "s",
+		},
+		"flushIntervalMs": 60000,
+	})
+	target := e.GetOutEnd(out.UUID).Target
+	if _, err := target.To(`{"device":{"name":"d1"},"time":1700000000,"values":{"temp":21.5,"other":1}}`); err != nil {
+		t.Fatal(err)
+	}
+	// 停止的时候把缓存写完
+	e.RemoveOutEnd(out.UUID)
+	requests := waitTimeSeries(t, recorder, 1)
+	user, password, _ := (&http.Request{Header: requests[0].headers}).BasicAuth()
+	if requests[0].path != "/write" || requests[0].query != "db=plant&precision=s&rp=week" ||
+		user != "rulex" || password != "rulex" {
+		t.Fatal("unexpected request:", requests[0].path, requests[0].query, user, password)
+	}
+	if string(requests[0].body) != "env,device=d1 t=21.5 1700000000\n" {
+		t.Fatalf("unexpected body:\n%s", requests[0].body)
+	}
+}
+
+type remoteWriteSeries struct {
+	labels  map[string]string
+	order   []string
+	samples [][2]float64
+}
+
+// 解 remote write 的 WriteRequest
+func decodeRemoteWrite(t *testing.T, body []byte) []remoteWriteSeries {
+	data, err := s2.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []remoteWriteSeries{}
+	for len(data) > 0 {
+		_, _, n := protowire.ConsumeTag(data)
+		timeSeries, m := protowire.ConsumeBytes(data[n:])
+		data = data[n+m:]
+		s := remoteWriteSeries{labels: map[string]string{}}
+		for len(timeSeries) > 0 {
+			number, _, n := protowire.ConsumeTag(timeSeries)
+			message, m := protowire.ConsumeBytes(timeSeries[n:])
+			timeSeries = timeSeries[n+m:]
+			fields := map[protowire.Number][]byte{}
+			values := map[protowire.Number]uint64{}
+			for len(message) > 0 {
+				field, kind, n := protowire.ConsumeTag(message)
+				switch kind {
+				case protowire.BytesType:
+					v, m := protowire.ConsumeBytes(message[n:])
+					fields[field] = v
+					message = message[n+m:]
+				case protowire.Fixed64Type:
+					v, m := protowire.ConsumeFixed64(message[n:])
+					values[field] = v
+					message = message[n+m:]
+				case protowire.VarintType:
+					v, m := protowire.ConsumeVarint(message[n:])
+					values[field] = v
+					message = message[n+m:]
+				default:
+					t.Fatal("unexpected wire type:", kind)
+				}
+			}
+			if number == 1 {
+				s.labels[string(fields[1])] = string(fields[2])
+				s.order = append(s.order, string(fields[1]))
+			} else {
+				s.samples = append(s.samples, [2]float64{math.Float64frombits(values[1]), float64(values[2])})
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+func Test_TimeSeries_Prometheus(t *testing.T) {
+	recorder := &timeSeriesRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	e := RunTestEngine()
+	e.Start()
+	out := loadTimeSeriesTarget(t, e, map[string]interface{}{
+		"protocol": "PROMETHEUS", "url": server.URL + "/api/v1/write", "token": "secret",
+		"mapping": map[string]interface{}{
+			"measurement": "plant",
+			"tags":        map[string]string{"device": "{device}", "site-id": "s1"},
+			"timestamp":   "ts",
+		},
+		"flushIntervalMs": 100,
+	})
+	defer e.RemoveOutEnd(out.UUID)
+	target := e.GetOutEnd(out.UUID).Target
+	if _, err := target.To(`[{"device":"d1","ts":1700000001000,"temp":21.5,"on":true,"mode":"auto"},
+		{"device":"d1","ts":1700000000000,"temp":20}]`); err != nil {
+		t.Fatal(err)
+	}
+	request := waitTimeSeries(t, recorder, 1)[0]
+	if request.path != "/api/v1/write" || request.headers.Get("Content-Encoding") != "snappy" ||
+		request.headers.Get("Content-Type") != "application/x-protobuf" ||
+		request.headers.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" ||
+		request.headers.Get("Authorization") != "Bearer secret" {
+		t.Fatal("unexpected request:", request.path, request.headers)
+	}
+	// 字符串字段跳过, bool 是 1; 同一个序列的样本按时间排序
+	series := decodeRemoteWrite(t, request.body)
+	if len(series) != 2 {
+		t.Fatal("unexpected series:", series)
+	}
+	on, temp := series[0], series[1]
+	if on.labels["__name__"] != "plant_on" || on.labels["device"] != "d1" || on.labels["site_id"] != "s1" ||
+		strings.Join(on.order, ",") != "__name__,device,site_id" ||
+		len(on.samples) != 1 || on.samples[0] != [2]float64{1, 1700000001000} {
+		t.Fatal("unexpected series:", on)
+	}
+	if temp.labels["__name__"] != "plant_temp" || len(temp.samples) != 2 ||
+		temp.samples[0] != [2]float64{20, 1700000000000} || temp.samples[1] != [2]float64{21.5, 1700000001000} {
+		t.Fatal("unexpected series:", temp)
+	}
+}
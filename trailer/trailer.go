@@ -122,7 +122,9 @@ func (scm *TrailerManager) run(wg *sync.WaitGroup, goodsProcess *typex.GoodsProc
 		goodsProcess.Uuid,
 		goodsProcess.Addr,
 		goodsProcess.Args)
-	if err := goodsProcess.Cmd.Wait(); err != nil {
+	err := goodsProcess.Cmd.Wait()
+	scm.publishExit(goodsProcess, err)
+	if err != nil {
 		glogger.GLogger.Error("Cmd Wait error:", err)
 		wg.Done()
 		return err
@@ -131,6 +133,27 @@ func (scm *TrailerManager) run(wg *sync.WaitGroup, goodsProcess *typex.GoodsProc
 	return nil
 }
 
+// 进程退出以后发布 GOODS_EXIT 事件
+func (scm *TrailerManager) publishExit(goodsProcess *typex.GoodsProcess, err error) {
+	if scm.re == nil || scm.re.GetEventBus() == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"pid":   goodsProcess.Cmd.Process.Pid,
+		"addr":  goodsProcess.Addr,
+		"error": "",
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	scm.re.GetEventBus().Publish(typex.Event{
+		Type:     typex.EVENT_GOODS_EXIT,
+		Resource: "GOODS",
+		UUID:     goodsProcess.Uuid,
+		Data:     data,
+	})
+}
+
 // 探针
 func (scm *TrailerManager) probe(wg *sync.WaitGroup, goodsProcess *typex.GoodsProcess) {
 	defer func() {
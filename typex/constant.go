@@ -82,6 +82,14 @@ const (
 	// Ithings 平台
 	//
 	ITHINGS_IOT_HUB InEndType = "ITHINGS_IOT_HUB"
+	//
+	// Sparkplug B 边缘节点
+	//
+	SPARKPLUG_B InEndType = "SPARKPLUG_B"
+	//
+	// Kafka 消费组
+	//
+	KAFKA InEndType = "KAFKA"
 )
 
 // TargetType
@@ -118,6 +126,12 @@ const (
 	SQLITE_TARGET TargetType = "SQLITE_TARGET"
 	// USER_G776 DTU
 	USER_G776_TARGET TargetType = "USER_G776_TARGET"
+	// Sparkplug B 设备数据, 通过 Sparkplug B 输入资源发布
+	SPARKPLUG_B_TARGET TargetType = "SPARKPLUG_B"
+	// Kafka
+	KAFKA_TARGET TargetType = "KAFKA"
+	// InfluxDB 和 Prometheus remote write
+	TIMESERIES_TARGET TargetType = "TIMESERIES"
 )
 
 /*
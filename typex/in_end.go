@@ -1,6 +1,10 @@
 package typex
 
-import "github.com/hootrhino/rulex/utils"
+import (
+	"sync"
+
+	"github.com/hootrhino/rulex/utils"
+)
 
 type InEnd struct {
 	//
@@ -14,6 +18,8 @@ type InEnd struct {
 	Config        map[string]interface{} `json:"config"`
 	DataModelsMap map[string]XDataModel  `json:"-"`
 	Source        XSource                `json:"-"`
+	// BindRules 会被规则增删和数据回调同时访问, 用这个锁保护
+	bindLocker sync.RWMutex
 }
 
 
@@ -34,3 +40,43 @@ func NewInEnd(Type InEndType,
 func (in *InEnd) GetConfig(k string) interface{} {
 	return (in.Config)[k]
 }
+
+/*
+*
+* 绑定规则, 规则的增删和数据回调在不同的协程里面, 必须加锁
+*
+ */
+func (in *InEnd) BindRule(rule Rule) {
+	in.bindLocker.Lock()
+	defer in.bindLocker.Unlock()
+	if in.BindRules == nil {
+		in.BindRules = map[string]Rule{}
+	}
+	in.BindRules[rule.UUID] = rule
+}
+
+/*
+*
+* 解除规则绑定
+*
+ */
+func (in *InEnd) UnbindRule(ruleId string) {
+	in.bindLocker.Lock()
+	defer in.bindLocker.Unlock()
+	delete(in.BindRules, ruleId)
+}
+
+/*
+*
+* 取一份当前绑定规则的快照, 遍历的时候不用一直拿着锁
+*
+ */
+func (in *InEnd) SnapshotRules() []Rule {
+	in.bindLocker.RLock()
+	defer in.bindLocker.RUnlock()
+	rules := make([]Rule, 0, len(in.BindRules))
+	for _, rule := range in.BindRules {
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -13,9 +13,11 @@ type OutEnd struct {
 	//
 	Config map[string]interface{} `json:"config"`
 	Target XTarget                `json:"-"`
+	Cache  XPersistQueue          `json:"-"` // 离线缓存, 没开启的时候为nil
+	// 配置里的 qualityFilter: 只输出这些质量的点位, 为空的时候不过滤
+	QualityFilter []string `json:"-"`
 }
 
-
 func NewOutEnd(t TargetType,
 	n string,
 	d string,
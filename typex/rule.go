@@ -1,6 +1,8 @@
 package typex
 
 import (
+	"sync"
+
 	"github.com/antonmedv/expr"
 	"github.com/antonmedv/expr/vm"
 	lua "github.com/hootrhino/gopher-lua"
@@ -27,15 +29,23 @@ type Rule struct {
 	Name       string     `json:"name"`
 	FromSource []string   `json:"fromSource"` // 来自数据源
 	FromDevice []string   `json:"fromDevice"` // 来自设备
+	FromEvent  []string   `json:"fromEvent"`  // 来自引擎事件, 见 EventType
 	Actions    string     `json:"actions"`
 	// 0.5 新增功能：支持另一种脚本来筛选数据:https://github.com/antonmedv/expr
 	// 该字段只有在Type=="expr"的时候有效
-	Expression  string      `json:"expression"` // Expr脚本
+	Expression string `json:"expression"` // Expr脚本
+	// 规则的输出: Expr 规则结果为真的时候是原始数据, Lua 规则是 Actions 最后的返回值
+	ToRules     []string    `json:"toRules"`   // 下游规则 UUID, 不能成环
+	ToTargets   []string    `json:"toTargets"` // 转发的 OutEnd UUID
+	ToDevices   []string    `json:"toDevices"` // 写入的设备 UUID
+	DeviceCmd   string      `json:"deviceCmd"` // 写设备时候的指令, 即 OnWrite 的 cmd
 	Success     string      `json:"success"`
 	Failed      string      `json:"failed"`
 	Description string      `json:"description"`
 	LuaVM       *lua.LState `json:"-"` // Lua VM
 	ExprVM      *vm.Program `json:"-"` // Expr Vm
+	// Lua VM 不是协程安全的, 通道并发大于1的时候靠它串行执行
+	locker *sync.Mutex
 }
 
 func NewExprRule(e RuleX,
@@ -59,11 +69,11 @@ func NewExprRule(e RuleX,
 		actions,
 		failed)
 	rule.Type = "expr"
-	program, err := expr.Compile(Expression, expr.Env(map[string]interface{}{}))
-	if err != nil {
-		panic(err)
+	rule.Expression = Expression
+	// 编译失败的时候 ExprVM 为空, 在 LoadRule 的时候会再校验一次
+	if program, err := expr.Compile(Expression); err == nil {
+		rule.ExprVM = program
 	}
-	rule.ExprVM = program
 	return rule
 }
 func NewLuaRule(e RuleX,
@@ -108,6 +118,7 @@ func NewRule(e RuleX,
 		Actions:     actions,
 		Success:     success,
 		Failed:      failed,
+		locker:      &sync.Mutex{},
 		LuaVM: lua.NewState(lua.Options{
 			RegistrySize:     _VM_Registry_Size,
 			RegistryMaxSize:  _VM_Registry_MaxSize,
@@ -116,6 +127,22 @@ func NewRule(e RuleX,
 	}
 }
 
+/*
+*
+* 锁住规则的虚拟机, 规则是按值拷贝到资源上的, 所有拷贝共享同一把锁
+*
+ */
+func (r *Rule) AcquireVM() {
+	if r.locker != nil {
+		r.locker.Lock()
+	}
+}
+func (r *Rule) ReleaseVM() {
+	if r.locker != nil {
+		r.locker.Unlock()
+	}
+}
+
 /*
 *
 * 加载外部LUA脚本，方便用户自己写一些东西
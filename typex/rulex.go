@@ -13,7 +13,10 @@ type Extlib struct {
 type RulexConfig struct {
 	AppName               string `ini:"app_name" json:"appName"`
 	AppId                 string `ini:"app_id" json:"appId"`
-	MaxQueueSize          int    `ini:"max_queue_size" json:"maxQueueSize"`
+	MaxQueueSize          int    `ini:"max_queue_size" json:"maxQueueSize"` // 已经废弃, 只在没配 lane_size 的时候当通道容量
+	LaneSize              int    `ini:"lane_size" json:"laneSize"`
+	LaneConcurrency       int    `ini:"lane_concurrency" json:"laneConcurrency"`
+	LaneOverflowPolicy    string `ini:"lane_overflow_policy" json:"laneOverflowPolicy"`
 	SourceRestartInterval int    `ini:"resource_restart_interval" json:"sourceRestartInterval"`
 	GomaxProcs            int    `ini:"gomax_procs" json:"gomaxProcs"`
 	EnablePProf           bool   `ini:"enable_pprof" json:"enablePProf"`
@@ -25,6 +28,12 @@ type RulexConfig struct {
 	AppDebugMode          bool   `ini:"app_debug_mode" json:"appDebugMode"`
 	Extlibs               Extlib `ini:"extlibs,,allowshadow" json:"extlibs"`
 	UpdateServer          string `ini:"update_server" json:"updateServer"`
+	OutEndCachePath       string `ini:"outend_cache_path" json:"outEndCachePath"`
+	RestartMaxAttempts    int    `ini:"resource_restart_max_attempts" json:"restartMaxAttempts"`
+	RestartMaxInterval    int    `ini:"resource_restart_max_interval" json:"restartMaxInterval"`
+	ConfigMode            string `ini:"config_mode" json:"configMode"`
+	ConfigDir             string `ini:"config_dir" json:"configDir"`
+	ConfigWatchInterval   int    `ini:"config_watch_interval" json:"configWatchInterval"`
 }
 
 // RuleX interface
@@ -94,6 +103,10 @@ type RuleX interface {
 	//
 	LoadHook(XHook) error
 	//
+	// 卸载Hook
+	//
+	RemoveHook(name string)
+	//
 	// 加载插件
 	//
 	LoadPlugin(string, XPlugin) error
@@ -126,6 +139,8 @@ type RuleX interface {
 	// 运行 hook
 	//
 	RunHooks(string) //TODO Hook 未来某个版本会加强,主要用来加载本地动态库
+	RunDeviceHooks(*Device, string)
+	RunSourceHooks(*InEnd, string)
 	//
 	// 获取版本
 	//
@@ -194,6 +209,18 @@ type RuleX interface {
 	// 重启设备
 	//
 	RestartDevice(uuid string) error
+	//
+	// 资源生命周期事件, uuid 为空的时候返回所有资源的, 新的在前面
+	//
+	LifecycleEvents(uuid string) []LifecycleEvent
+	//
+	// 事件总线
+	//
+	GetEventBus() XEventBus
+	//
+	// 设备影子
+	//
+	GetDeviceShadow() XDeviceShadow
 	//----------------------------------------
 	// App
 	//----------------------------------------
@@ -2,13 +2,15 @@ package typex
 
 import (
 	"math"
+	"sync/atomic"
 )
 
 type MetricStatistics struct {
-	InSuccess  uint64 `json:"inSuccess"`
-	OutSuccess uint64 `json:"outSuccess"`
-	InFailed   uint64 `json:"inFailed"`
-	OutFailed  uint64 `json:"outFailed"`
+	InSuccess  uint64          `json:"inSuccess"`
+	OutSuccess uint64          `json:"outSuccess"`
+	InFailed   uint64          `json:"inFailed"`
+	OutFailed  uint64          `json:"outFailed"`
+	Lanes      []LaneStatistic `json:"lanes"` // 每个资源通道的深度和延迟, 只在快照里面有
 }
 
 func NewMetricStatistics() *MetricStatistics {
@@ -17,49 +19,68 @@ func NewMetricStatistics() *MetricStatistics {
 		OutSuccess: 0,
 		InFailed:   0,
 		OutFailed:  0,
+		Lanes:      nil,
 	}
 
 }
-func (statisticsCache *MetricStatistics) IncIn() {
-	if statisticsCache.InSuccess < math.MaxUint64 {
-		statisticsCache.InSuccess = statisticsCache.InSuccess + 1
+
+// 通道是并发处理的, 计数器都用原子操作
+func incUint64(v *uint64) {
+	if atomic.LoadUint64(v) < math.MaxUint64 {
+		atomic.AddUint64(v, 1)
 	}
 }
-func (statisticsCache *MetricStatistics) DecIn() {
-
-	if statisticsCache.InSuccess-1 > 0 {
-		statisticsCache.InSuccess = statisticsCache.InSuccess - 1
+func decUint64(v *uint64) {
+	for {
+		old := atomic.LoadUint64(v)
+		if old <= 1 || atomic.CompareAndSwapUint64(v, old, old-1) {
+			return
+		}
 	}
 }
+func (statisticsCache *MetricStatistics) IncIn() {
+	incUint64(&statisticsCache.InSuccess)
+}
+func (statisticsCache *MetricStatistics) DecIn() {
+	decUint64(&statisticsCache.InSuccess)
+}
 func (statisticsCache *MetricStatistics) IncOut() {
-
-	if statisticsCache.OutSuccess < math.MaxUint64 {
-		statisticsCache.OutSuccess = statisticsCache.OutSuccess + 1
-	}
+	incUint64(&statisticsCache.OutSuccess)
 }
 func (statisticsCache *MetricStatistics) DecOut() {
-
-	if statisticsCache.OutSuccess-1 > 0 {
-		statisticsCache.OutSuccess = statisticsCache.OutSuccess - 1
-	}
+	decUint64(&statisticsCache.OutSuccess)
 }
 func (statisticsCache *MetricStatistics) IncInFailed() {
-
-	if statisticsCache.InFailed < math.MaxUint64 {
-		statisticsCache.InFailed = statisticsCache.InFailed + 1
-	}
+	incUint64(&statisticsCache.InFailed)
 }
 
 func (statisticsCache *MetricStatistics) IncOutFailed() {
-
-	if statisticsCache.InFailed < math.MaxUint64 {
-		statisticsCache.OutFailed = statisticsCache.OutFailed + 1
-	}
+	incUint64(&statisticsCache.OutFailed)
 }
 
 func (statisticsCache *MetricStatistics) Reset() {
-	statisticsCache.InSuccess = 0
-	statisticsCache.InFailed = 0
-	statisticsCache.OutFailed = 0
-	statisticsCache.OutSuccess = 0
+	atomic.StoreUint64(&statisticsCache.InSuccess, 0)
+	atomic.StoreUint64(&statisticsCache.InFailed, 0)
+	atomic.StoreUint64(&statisticsCache.OutFailed, 0)
+	atomic.StoreUint64(&statisticsCache.OutSuccess, 0)
+}
+
+/*
+*
+* 统计快照: 计数器用原子读, 再带上所有通道的统计; 只给接口展示用,
+* 处理数据的时候直接改计数器, 不要每条数据都拿一次快照
+*
+ */
+func (statisticsCache *MetricStatistics) Snapshot() MetricStatistics {
+	snapshot := MetricStatistics{
+		InSuccess:  atomic.LoadUint64(&statisticsCache.InSuccess),
+		OutSuccess: atomic.LoadUint64(&statisticsCache.OutSuccess),
+		InFailed:   atomic.LoadUint64(&statisticsCache.InFailed),
+		OutFailed:  atomic.LoadUint64(&statisticsCache.OutFailed),
+		Lanes:      []LaneStatistic{},
+	}
+	if DefaultDataCacheQueue != nil {
+		snapshot.Lanes = DefaultDataCacheQueue.Lanes()
+	}
+	return snapshot
 }
@@ -7,6 +7,8 @@
 package typex
 
 import (
+	"sync"
+
 	"github.com/hootrhino/rulex/utils"
 )
 
@@ -45,6 +47,7 @@ const (
 	S1200PLC                   DeviceType = "S1200PLC"                   // SIEMENS-S71200
 	GENERIC_MODBUS             DeviceType = "GENERIC_MODBUS"             // 通用Modbus
 	GENERIC_MODBUS_POINT_EXCEL DeviceType = "GENERIC_MODBUS_POINT_EXCEL" // 通用Modbus通过Excel表配置点位
+	GENERIC_MODBUS_SLAVER      DeviceType = "GENERIC_MODBUS_SLAVER"      // 通用Modbus从机
 	GENERIC_UART               DeviceType = "GENERIC_UART"               // 通用串口
 	GENERIC_SNMP               DeviceType = "GENERIC_SNMP"               // SNMP 支持
 	USER_G776                  DeviceType = "USER_G776"                  // 有人 G776 4G模组
@@ -71,6 +74,8 @@ type Device struct {
 	State       DeviceState            `json:"state"`       // 状态
 	Config      map[string]interface{} `json:"config"`      // 配置
 	Device      XDevice                `json:"-"`           // 实体设备
+	// BindRules 会被规则增删和数据回调同时访问, 用这个锁保护
+	bindLocker sync.RWMutex
 }
 
 func NewDevice(t DeviceType,
@@ -89,6 +94,46 @@ func NewDevice(t DeviceType,
 	}
 }
 
+/*
+*
+* 绑定规则, 规则的增删和数据回调在不同的协程里面, 必须加锁
+*
+ */
+func (d *Device) BindRule(rule Rule) {
+	d.bindLocker.Lock()
+	defer d.bindLocker.Unlock()
+	if d.BindRules == nil {
+		d.BindRules = map[string]Rule{}
+	}
+	d.BindRules[rule.UUID] = rule
+}
+
+/*
+*
+* 解除规则绑定
+*
+ */
+func (d *Device) UnbindRule(ruleId string) {
+	d.bindLocker.Lock()
+	defer d.bindLocker.Unlock()
+	delete(d.BindRules, ruleId)
+}
+
+/*
+*
+* 取一份当前绑定规则的快照, 遍历的时候不用一直拿着锁
+*
+ */
+func (d *Device) SnapshotRules() []Rule {
+	d.bindLocker.RLock()
+	defer d.bindLocker.RUnlock()
+	rules := make([]Rule, 0, len(d.BindRules))
+	for _, rule := range d.BindRules {
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
 // 设备的属性，是个描述结构
 type DeviceProperty struct {
 	Name  string
@@ -0,0 +1,82 @@
+package typex
+
+import "time"
+
+/*
+*
+* 引擎内部事件: 资源状态变化, 规则出错, 通道溢出, 插件启停, 外挂进程退出, APP 退出, 报警;
+* 插件实现 XEventPlugin 就可以订阅, Lua 规则可以在 fromEvent 里面绑定事件类型
+*
+ */
+type EventType string
+
+const (
+	EVENT_RESOURCE_STATE EventType = "RESOURCE_STATE" // 资源状态变化, Data: from, to
+	EVENT_LIFECYCLE      EventType = "LIFECYCLE"      // 资源生命周期事件, Data: event, attempt, delay, error
+	EVENT_RULE_ERROR     EventType = "RULE_ERROR"     // 规则执行出错, Data: from, error
+	EVENT_QUEUE_OVERFLOW EventType = "QUEUE_OVERFLOW" // 通道满了, 数据被丢弃, Data: policy, size
+	EVENT_PLUGIN_START   EventType = "PLUGIN_START"   // 插件启动
+	EVENT_PLUGIN_STOP    EventType = "PLUGIN_STOP"    // 插件停止
+	EVENT_GOODS_EXIT     EventType = "GOODS_EXIT"     // 外挂进程退出, Data: pid, error
+	EVENT_APP_EXIT       EventType = "APP_EXIT"       // APP 退出, Data: error
+	EVENT_ALARM          EventType = "ALARM"          // 报警产生, 确认, 清除, Data: 报警
+)
+
+// 所有的事件类型
+var EventTypes = []EventType{
+	EVENT_RESOURCE_STATE,
+	EVENT_LIFECYCLE,
+	EVENT_RULE_ERROR,
+	EVENT_QUEUE_OVERFLOW,
+	EVENT_PLUGIN_START,
+	EVENT_PLUGIN_STOP,
+	EVENT_GOODS_EXIT,
+	EVENT_APP_EXIT,
+	EVENT_ALARM,
+}
+
+func IsEventType(t string) bool {
+	for _, eventType := range EventTypes {
+		if string(eventType) == t {
+			return true
+		}
+	}
+	return false
+}
+
+type Event struct {
+	Type     EventType              `json:"type"`
+	Time     time.Time              `json:"time"`
+	Resource string                 `json:"resource"` // INEND OUTEND DEVICE RULE PLUGIN GOODS APP ALARM
+	UUID     string                 `json:"uuid"`
+	Name     string                 `json:"name"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+type EventHandler func(Event)
+
+/*
+*
+* 事件总线: 发布不阻塞, 事件按顺序异步分发给订阅者; 订阅者太慢, 缓冲区满了的时候新事件会被丢弃
+*
+ */
+type XEventBus interface {
+	// 发布事件, Time 为空的时候填当前时间
+	Publish(Event)
+	// 订阅事件, types 为空表示订阅所有事件, 返回订阅ID
+	Subscribe(types []EventType, handler EventHandler) string
+	// 取消订阅
+	Unsubscribe(id string)
+}
+
+/*
+*
+* 需要订阅事件的插件实现这个接口, 插件启动以后自动订阅, 停止的时候取消
+*
+ */
+type XEventPlugin interface {
+	XPlugin
+	// 订阅的事件类型, 为空表示所有事件
+	EventTypes() []EventType
+	OnEvent(Event)
+}
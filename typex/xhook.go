@@ -8,3 +8,19 @@ type XHook interface {
 	Error(error)
 	Name() string
 }
+
+//
+// 需要知道设备数据来自哪个设备的 Hook, 设备数据会调用 WorkDevice 而不是 Work
+//
+type XDeviceHook interface {
+	XHook
+	WorkDevice(Device *Device, data string) error
+}
+
+//
+// 需要知道数据来自哪个输入资源的 Hook, 只有实现了这个接口的 Hook 才会收到输入资源的数据
+//
+type XSourceHook interface {
+	XHook
+	WorkInEnd(in *InEnd, data string) error
+}
@@ -0,0 +1,28 @@
+package typex
+
+import "time"
+
+/*
+*
+* 资源生命周期事件: 输入资源, 输出资源和设备在启动, 失败, 重启, 放弃重启的时候产生
+*
+ */
+type LifecycleEventType string
+
+const (
+	LIFECYCLE_STARTED    LifecycleEventType = "STARTED"    // 启动成功
+	LIFECYCLE_FAILED     LifecycleEventType = "FAILED"     // 启动失败或者运行中挂了
+	LIFECYCLE_RESTARTING LifecycleEventType = "RESTARTING" // 等待重启
+	LIFECYCLE_GIVEN_UP   LifecycleEventType = "GIVEN_UP"   // 超过最大重启次数, 不再重启
+)
+
+type LifecycleEvent struct {
+	Time     time.Time          `json:"time"`
+	Resource string             `json:"resource"` // INEND OUTEND DEVICE
+	UUID     string             `json:"uuid"`
+	Name     string             `json:"name"`
+	Event    LifecycleEventType `json:"event"`
+	Attempt  int                `json:"attempt"` // 第几次重启, 0 表示不是重启
+	Delay    int64              `json:"delay"`   // RESTARTING: 多少毫秒以后重启
+	Error    string             `json:"error"`
+}
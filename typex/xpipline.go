@@ -11,47 +11,55 @@ import (
 //
 //	Run lua as pipline
 func RunPipline(vm *lua.LState, funcs map[string]*lua.LFunction, arg lua.LValue) (lua.LValue, error) {
+	value, _, err := RunPiplineToEnd(vm, funcs, arg)
+	return value, err
+}
+
+// RunPiplineToEnd
+//
+//	Run lua as pipline, completed is false if some action returned false
+func RunPiplineToEnd(vm *lua.LState, funcs map[string]*lua.LFunction, arg lua.LValue) (lua.LValue, bool, error) {
 	// start 1
 	acc := 1
 	return pipLine(vm, acc, funcs, arg)
 }
 
-func pipLine(vm *lua.LState, acc int, funcs map[string]*lua.LFunction, arg lua.LValue) (lua.LValue, error) {
+func pipLine(vm *lua.LState, acc int, funcs map[string]*lua.LFunction, arg lua.LValue) (lua.LValue, bool, error) {
 	if acc == len(funcs) {
 		values, err0 := callLuaFunc(vm, funcs[strconv.Itoa(acc)], arg)
 		if err0 != nil {
-			return nil, err0
+			return nil, false, err0
 		}
-		return validate(values, func() (lua.LValue, error) {
-			result := values[1]
-			return result, nil
+		// 最后一个 Action 只有明确返回 false 的时候数据才被过滤掉, 其他的值和以前一样不检查
+		return validate(values, func() (lua.LValue, bool, error) {
+			return values[1], values[0] != lua.LFalse, nil
 		})
 
 	}
 	values, err0 := callLuaFunc(vm, funcs[strconv.Itoa(acc)], arg)
 	if err0 != nil {
-		return nil, err0
+		return nil, false, err0
 	}
-	return validate(values, func() (lua.LValue, error) {
+	return validate(values, func() (lua.LValue, bool, error) {
 		next := values[0]
 		result := values[1]
 		if next.Type() == lua.LTBool {
 			if next.(lua.LBool) {
 				return pipLine(vm, acc+1, funcs, result)
 			}
-			return result, nil
+			return result, false, nil
 		}
-		return nil, errors.New("'Action' callback first argument is must be bool")
+		return nil, false, errors.New("'Action' callback first argument is must be bool")
 
 	})
 
 }
 
 // validate lua callback
-func validate(values []lua.LValue, f func() (lua.LValue, error)) (lua.LValue, error) {
+func validate(values []lua.LValue, f func() (lua.LValue, bool, error)) (lua.LValue, bool, error) {
 	// Lua call back must have 2 args!!!
 	if len(values) != 2 {
-		return nil, errors.New("'Action' callback must have 2 return value:[bool, T]")
+		return nil, false, errors.New("'Action' callback must have 2 return value:[bool, T]")
 	} else {
 		return f()
 	}
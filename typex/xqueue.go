@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/hootrhino/rulex/common"
 	"github.com/hootrhino/rulex/glogger"
+	"github.com/hootrhino/rulex/utils"
 )
 
 var DefaultDataCacheQueue XQueue
@@ -16,9 +22,33 @@ var DefaultDataCacheQueue XQueue
 *
  */
 type XQueue interface {
-	GetQueue() chan QueueData
+	// 所有通道的总容量
 	GetSize() int
+	// 数据进入对应资源的通道
 	Push(QueueData) error
+	// 删除资源的通道, 资源被删除或者重新加载的时候调用, 没处理的数据会被丢掉
+	RemoveLane(uuid string)
+	// 所有通道的统计
+	Lanes() []LaneStatistic
+}
+
+/*
+*
+* XPersistQueue: OutEnd 的离线缓存队列, 目标不可用的时候数据先落盘,
+* 等目标恢复(SOURCE_UP)以后再按顺序补发
+*
+ */
+type XPersistQueue interface {
+	// 写入队尾
+	Push(data string) error
+	// 按顺序重放, 回调失败就停下, 返回成功补发的条数
+	Replay(func(data string) error) (int, error)
+	// 缓存的条数
+	Count() int
+	// 缓存占用的字节数
+	Size() int64
+	// 关闭, 数据保留在磁盘上
+	Close() error
 }
 
 type QueueData struct {
@@ -36,95 +66,410 @@ func (qd QueueData) String() string {
 
 /*
 *
-* NewXQueue
+* 数据属于哪个资源, 决定了进哪个通道
+*
+ */
+func (qd QueueData) lane() (string, string, map[string]interface{}) {
+	if qd.I != nil {
+		return qd.I.UUID, "INEND", qd.I.Config
+	}
+	if qd.D != nil {
+		return qd.D.UUID, "DEVICE", qd.D.Config
+	}
+	if qd.O != nil {
+		return qd.O.UUID, "OUTEND", qd.O.Config
+	}
+	return "", "", nil
+}
+
+// 通道溢出策略
+const (
+	LANE_BLOCK       string = "BLOCK"       // 阻塞生产者, 直到有空位
+	LANE_DROP_OLDEST string = "DROP_OLDEST" // 丢弃通道里最老的数据
+	LANE_DROP_NEWEST string = "DROP_NEWEST" // 丢弃新来的数据, 默认, 和以前的行为一致
+)
+
+/*
+*
+* 通道配置: 全局默认值来自 rulex.ini, 单个资源可以在配置的 laneConfig 字段里面覆盖
 *
  */
+type LaneConfig struct {
+	Size           int    `json:"size"`           // 通道容量
+	Concurrency    int    `json:"concurrency"`    // 并发数, 大于1的时候不保证顺序
+	OverflowPolicy string `json:"overflowPolicy"` // BLOCK | DROP_OLDEST | DROP_NEWEST
+}
 
 /*
 *
-* DataCacheQueue
+* 单个通道的统计, 延迟是从入队到处理完成的时间, 单位: 微秒
 *
  */
-type DataCacheQueue struct {
-	Queue chan QueueData
+type LaneStatistic struct {
+	UUID           string `json:"uuid"`
+	Type           string `json:"type"`
+	Size           int    `json:"size"`
+	Concurrency    int    `json:"concurrency"`
+	OverflowPolicy string `json:"overflowPolicy"`
+	Depth          int    `json:"depth"`
+	Processed      uint64 `json:"processed"`
+	Dropped        uint64 `json:"dropped"`
+	LastLatency    int64  `json:"lastLatency"`
+	AvgLatency     int64  `json:"avgLatency"`
+	MaxLatency     int64  `json:"maxLatency"`
 }
 
-func (q *DataCacheQueue) GetSize() int {
-	return cap(q.Queue)
+type laneItem struct {
+	qd         QueueData
+	enqueuedAt time.Time
 }
 
 /*
 *
-* Push
+* 每个 InEnd, Device, OutEnd 都有自己的通道和工作协程, 慢的资源不会拖住别的资源
 *
  */
-func (q *DataCacheQueue) Push(d QueueData) error {
-	// glogger.GLogger.Debug("DataCacheQueue Push:", d.Data)
-	// 比较数据和容积
-	if len(q.Queue)+1 > q.GetSize() {
-		msg := fmt.Sprintf("attached max queue size, max size is:%v, current size is: %v", q.GetSize(), len(q.Queue)+1)
-		glogger.GLogger.Error(msg)
-		return errors.New(msg)
-	} else {
-		q.Queue <- d
-		return nil
+type queueLane struct {
+	uuid         string
+	laneType     string
+	config       LaneConfig
+	queue        chan laneItem
+	ctx          context.Context
+	cancel       context.CancelFunc
+	processed    uint64
+	dropped      uint64
+	lastLatency  int64
+	maxLatency   int64
+	totalLatency int64
+	lastOverflow int64 // 上次发布溢出事件的时间, 纳秒
+}
+
+func newQueueLane(uuid, laneType string, config LaneConfig) *queueLane {
+	ctx, cancel := context.WithCancel(GCTX)
+	lane := &queueLane{
+		uuid:     uuid,
+		laneType: laneType,
+		config:   config,
+		queue:    make(chan laneItem, config.Size),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i := 0; i < config.Concurrency; i++ {
+		go lane.work()
+	}
+	return lane
+}
+
+func (lane *queueLane) push(qd QueueData) error {
+	item := laneItem{qd: qd, enqueuedAt: time.Now()}
+	switch lane.config.OverflowPolicy {
+	case LANE_BLOCK:
+		select {
+		case lane.queue <- item:
+			return nil
+		case <-lane.ctx.Done():
+			return fmt.Errorf("lane %s closed", lane.uuid)
+		}
+	case LANE_DROP_OLDEST:
+		for {
+			select {
+			case lane.queue <- item:
+				return nil
+			default:
+			}
+			select {
+			case <-lane.queue:
+				atomic.AddUint64(&lane.dropped, 1)
+				lane.overflow(qd)
+			default:
+			}
+		}
+	default:
+		select {
+		case lane.queue <- item:
+			return nil
+		default:
+			atomic.AddUint64(&lane.dropped, 1)
+			lane.overflow(qd)
+			msg := fmt.Sprintf("lane %s attached max queue size, max size is:%v",
+				lane.uuid, lane.config.Size)
+			glogger.GLogger.Error(msg)
+			return errors.New(msg)
+		}
 	}
 }
 
 /*
 *
-* GetQueue
+* 丢数据的时候发布 QUEUE_OVERFLOW 事件, 每个通道每秒最多一次, 防止把事件总线也挤满
 *
  */
-func (q *DataCacheQueue) GetQueue() chan QueueData {
-	return q.Queue
+func (lane *queueLane) overflow(qd QueueData) {
+	if qd.E == nil || qd.E.GetEventBus() == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lane.lastOverflow)
+	if now-last < int64(time.Second) ||
+		!atomic.CompareAndSwapInt64(&lane.lastOverflow, last, now) {
+		return
+	}
+	qd.E.GetEventBus().Publish(Event{
+		Type:     EVENT_QUEUE_OVERFLOW,
+		Resource: lane.laneType,
+		UUID:     lane.uuid,
+		Data: map[string]interface{}{
+			"policy":  lane.config.OverflowPolicy,
+			"size":    lane.config.Size,
+			"dropped": atomic.LoadUint64(&lane.dropped),
+		},
+	})
 }
 
-// 此处内置的消息队列用了go的channel, 看似好像很简单，但是经过测试发现完全满足网关需求，甚至都性能过剩了
-// 因此大家看到这里务必担心, 我也知道有很精美的高级框架, 但是用简单的方法来实现功能不是更好吗？
-func StartQueue(maxQueueSize int) {
-	DefaultDataCacheQueue = &DataCacheQueue{
-		Queue: make(chan QueueData, maxQueueSize),
+func (lane *queueLane) work() {
+	for {
+		select {
+		case <-lane.ctx.Done():
+			return
+		case item := <-lane.queue:
+			processQueueData(item.qd)
+			latency := time.Since(item.enqueuedAt).Microseconds()
+			atomic.AddUint64(&lane.processed, 1)
+			atomic.StoreInt64(&lane.lastLatency, latency)
+			atomic.AddInt64(&lane.totalLatency, latency)
+			for {
+				max := atomic.LoadInt64(&lane.maxLatency)
+				if latency <= max || atomic.CompareAndSwapInt64(&lane.maxLatency, max, latency) {
+					break
+				}
+			}
+		}
 	}
-	go func(ctx context.Context, xQueue XQueue) {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case qd := <-xQueue.GetQueue():
-				{
-					//
-					// Rulex内置消息队列用法:
-					// 1 进来的数据缓存
-					// 2 出去的消息缓存
-					// 3 设备数据缓存
-					// 只需要判断 in 或者 out 是不是 nil即可
-					//
-					if qd.I != nil {
-						// 如果是Debug消息直接打印出来
-						qd.E.RunSourceCallbacks(qd.I, qd.Data)
-					}
-					if qd.D != nil {
-						qd.E.RunDeviceCallbacks(qd.D, qd.Data)
-						qd.E.RunHooks(qd.Data)
-					}
-					if qd.O != nil {
-						v, ok := qd.E.AllOutEnd().Load(qd.O.UUID)
-						if ok {
-							target := v.(*OutEnd).Target
-							if target == nil {
-								continue
-							}
-							if _, err := target.To(qd.Data); err != nil {
-								glogger.GLogger.Error(err)
-								qd.E.GetMetricStatistics().IncOutFailed()
-							} else {
-								qd.E.GetMetricStatistics().IncOut()
-							}
-						}
-					}
+}
+
+/*
+*
+* 清空通道, 返回清掉的条数
+*
+ */
+func (lane *queueLane) drain() uint64 {
+	dropped := uint64(0)
+	for {
+		select {
+		case <-lane.queue:
+			dropped++
+		default:
+			atomic.AddUint64(&lane.dropped, dropped)
+			return dropped
+		}
+	}
+}
+
+func (lane *queueLane) statistic() LaneStatistic {
+	processed := atomic.LoadUint64(&lane.processed)
+	avg := int64(0)
+	if processed > 0 {
+		avg = atomic.LoadInt64(&lane.totalLatency) / int64(processed)
+	}
+	return LaneStatistic{
+		UUID:           lane.uuid,
+		Type:           lane.laneType,
+		Size:           lane.config.Size,
+		Concurrency:    lane.config.Concurrency,
+		OverflowPolicy: lane.config.OverflowPolicy,
+		Depth:          len(lane.queue),
+		Processed:      processed,
+		Dropped:        atomic.LoadUint64(&lane.dropped),
+		LastLatency:    atomic.LoadInt64(&lane.lastLatency),
+		AvgLatency:     avg,
+		MaxLatency:     atomic.LoadInt64(&lane.maxLatency),
+	}
+}
+
+/*
+*
+* LaneQueue: 按资源分通道的队列
+*
+ */
+type LaneQueue struct {
+	locker        sync.RWMutex
+	defaultConfig LaneConfig
+	lanes         map[string]*queueLane
+}
+
+func NewLaneQueue(defaultConfig LaneConfig) *LaneQueue {
+	return &LaneQueue{
+		defaultConfig: normalizeLaneConfig(defaultConfig, LaneConfig{
+			Size:           1024,
+			Concurrency:    1,
+			OverflowPolicy: LANE_DROP_NEWEST,
+		}),
+		lanes: map[string]*queueLane{},
+	}
+}
+
+/*
+*
+* 没有配置的值用默认值补齐
+*
+ */
+func normalizeLaneConfig(config LaneConfig, defaultConfig LaneConfig) LaneConfig {
+	if config.Size <= 0 {
+		config.Size = defaultConfig.Size
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConfig.Concurrency
+	}
+	if config.OverflowPolicy != LANE_BLOCK &&
+		config.OverflowPolicy != LANE_DROP_OLDEST &&
+		config.OverflowPolicy != LANE_DROP_NEWEST {
+		config.OverflowPolicy = defaultConfig.OverflowPolicy
+	}
+	return config
+}
+
+func (q *LaneQueue) GetSize() int {
+	q.locker.RLock()
+	defer q.locker.RUnlock()
+	size := 0
+	for _, lane := range q.lanes {
+		size += lane.config.Size
+	}
+	return size
+}
+
+/*
+*
+* Push: 第一次来数据的时候根据资源配置创建通道
+*
+ */
+func (q *LaneQueue) Push(qd QueueData) error {
+	uuid, laneType, config := qd.lane()
+	if uuid == "" {
+		return errors.New("queue data must belong to an InEnd, Device or OutEnd")
+	}
+	q.locker.RLock()
+	lane, ok := q.lanes[uuid]
+	q.locker.RUnlock()
+	if !ok {
+		q.locker.Lock()
+		if lane, ok = q.lanes[uuid]; !ok {
+			laneConfig := LaneConfig{}
+			if v, ok := config["laneConfig"].(map[string]interface{}); ok {
+				if err := utils.BindSourceConfig(v, &laneConfig); err != nil {
+					glogger.GLogger.Error("invalid laneConfig:", uuid, ", ", err)
 				}
 			}
+			lane = newQueueLane(uuid, laneType,
+				normalizeLaneConfig(laneConfig, q.defaultConfig))
+			q.lanes[uuid] = lane
 		}
-	}(GCTX, DefaultDataCacheQueue)
+		q.locker.Unlock()
+	}
+	return lane.push(qd)
+}
+
+/*
+*
+* RemoveLane: 资源已经停了, 通道里剩下的数据没法处理, 记到丢弃计数里面并打日志
+*
+ */
+func (q *LaneQueue) RemoveLane(uuid string) {
+	q.locker.Lock()
+	lane, ok := q.lanes[uuid]
+	delete(q.lanes, uuid)
+	q.locker.Unlock()
+	if !ok {
+		return
+	}
+	lane.cancel()
+	if dropped := lane.drain(); dropped > 0 {
+		glogger.GLogger.Warnf("lane %s removed, %d queued data dropped", uuid, dropped)
+	}
+}
+
+func (q *LaneQueue) Lanes() []LaneStatistic {
+	q.locker.RLock()
+	defer q.locker.RUnlock()
+	result := []LaneStatistic{}
+	for _, lane := range q.lanes {
+		result = append(result, lane.statistic())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UUID < result[j].UUID
+	})
+	return result
+}
+
+// 以前是全局一个 channel 加一个协程, 一个慢的 HTTP 目标或者重的 Lua 规则会把整个网关卡住,
+// 现在每个资源一个通道, 互不影响
+func StartQueue(defaultConfig LaneConfig) {
+	DefaultDataCacheQueue = NewLaneQueue(defaultConfig)
+}
+
+/*
+*
+* 处理一条数据
+* Rulex内置消息队列用法:
+* 1 进来的数据缓存
+* 2 出去的消息缓存
+* 3 设备数据缓存
+* 只需要判断 in 或者 out 是不是 nil即可
+*
+ */
+func processQueueData(qd QueueData) {
+	if qd.I != nil {
+		qd.E.RunSourceCallbacks(qd.I, qd.Data)
+		qd.E.RunSourceHooks(qd.I, qd.Data)
+	}
+	if qd.D != nil {
+		qd.E.GetDeviceShadow().Report(qd.D.UUID, qd.Data)
+		qd.E.RunDeviceCallbacks(qd.D, qd.Data)
+		qd.E.RunDeviceHooks(qd.D, qd.Data)
+	}
+	if qd.O != nil {
+		v, ok := qd.E.AllOutEnd().Load(qd.O.UUID)
+		if !ok {
+			return
+		}
+		outEnd := v.(*OutEnd)
+		target := outEnd.Target
+		if target == nil {
+			return
+		}
+		// 按数据质量过滤, 过滤完没有数据就不发了
+		data, ok := common.FilterQuality(qd.Data, outEnd.QualityFilter)
+		if !ok {
+			return
+		}
+		// 开启了离线缓存: 目标不可用或者还有没补发完的数据, 直接进缓存, 保证顺序
+		cache := outEnd.Cache
+		if cache != nil {
+			if target.Status() != SOURCE_UP || cache.Count() > 0 {
+				cacheOutData(qd.E, outEnd.UUID, cache, data)
+				return
+			}
+		}
+		if _, err := target.To(data); err != nil {
+			glogger.GLogger.Error(err)
+			qd.E.GetMetricStatistics().IncOutFailed()
+			if cache != nil {
+				cacheOutData(qd.E, outEnd.UUID, cache, data)
+			}
+		} else {
+			qd.E.GetMetricStatistics().IncOut()
+		}
+	}
+}
+
+/*
+*
+* 数据写入 OutEnd 的离线缓存
+*
+ */
+func cacheOutData(e RuleX, uuid string, cache XPersistQueue, data string) {
+	if err := cache.Push(data); err != nil {
+		glogger.GLogger.Error("OutEnd cache push error:", uuid, ", ", err)
+		e.GetMetricStatistics().IncOutFailed()
+	}
 }
@@ -0,0 +1,43 @@
+package typex
+
+import "time"
+
+// 设备上报的点位值
+type ShadowValue struct {
+	Value   interface{} `json:"value"`
+	Quality string      `json:"quality"` // 见 common.QUALITY_*
+	Time    time.Time   `json:"time"`
+}
+
+/*
+*
+* 设备影子: reported 是设备最后一次上报的值, desired 是期望的值, delta 是期望和上报不一样的点位
+*
+ */
+type DeviceShadow struct {
+	UUID     string                 `json:"uuid"`
+	Reported map[string]ShadowValue `json:"reported"`
+	Desired  map[string]interface{} `json:"desired"`
+	Delta    map[string]interface{} `json:"delta"`
+}
+
+/*
+*
+* 设备影子管理: 设备的数据自动更新 reported; 设置 desired 或者设备上线的时候,
+* delta 里面的点位通过 OnWrite(点位, JSON 值) 写到设备
+*
+ */
+type XDeviceShadow interface {
+	// 设备的影子, 返回的是副本; 没有的时候返回 nil
+	Get(uuid string) *DeviceShadow
+	// 设备某个点位最后一次上报的值
+	GetTag(uuid string, tag string) (ShadowValue, bool)
+	// 所有设备的影子
+	All() []*DeviceShadow
+	// 设备上报数据, 数据是 {"点位": 值} 格式的 JSON
+	Report(uuid string, data string)
+	// 合并期望值, 值是 nil 表示删除这个点位的期望值; 设备在线的时候马上写 delta
+	SetDesired(uuid string, desired map[string]interface{}) error
+	// 删除设备的影子
+	Delete(uuid string)
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var topicFieldRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Topic 模板里的字段, 比如 factory/{deviceName}/{tag} 返回 deviceName 和 tag
+func TopicTemplateFields(template string) []string {
+	fields := []string{}
+	for _, match := range topicFieldRegexp.FindAllStringSubmatch(template, -1) {
+		fields = append(fields, strings.TrimSpace(match[1]))
+	}
+	return fields
+}
+
+/*
+*
+* 渲染模板: {字段} 换成消息里字段的值, 字段可以用 . 取下一级, 比如 {device.name};
+* 字段不存在或者不是简单值的时候返回错误
+*
+ */
+func RenderTemplate(template string, message map[string]interface{}) (string, error) {
+	return renderTemplate(template, message, "")
+}
+
+/*
+*
+* 渲染 Topic 模板: 和 RenderTemplate 一样, 另外字段的值里有通配符的时候返回错误
+*
+ */
+func RenderTopicTemplate(template string, message map[string]interface{}) (string, error) {
+	return renderTemplate(template, message, "+#")
+}
+
+func renderTemplate(template string, message map[string]interface{}, forbidden string) (string, error) {
+	var renderErr error
+	result := topicFieldRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		field := strings.TrimSpace(placeholder[1 : len(placeholder)-1])
+		value, ok := lookupTopicField(message, field)
+		if !ok {
+			if renderErr == nil {
+				renderErr = fmt.Errorf("template field not found: %s", field)
+			}
+			return ""
+		}
+		if forbidden != "" && strings.ContainsAny(value, forbidden) {
+			if renderErr == nil {
+				renderErr = fmt.Errorf("topic field contains wildcard: %s=%s", field, value)
+			}
+			return ""
+		}
+		return value
+	})
+	return result, renderErr
+}
+
+func lookupTopicField(message map[string]interface{}, field string) (string, bool) {
+	var value interface{} = message
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprintf("%v", v), true
+	case float64, int, int64:
+		return fmt.Sprintf("%v", v), true
+	}
+	return "", false
+}
+
+/*
+*
+* 把要发布的数据拆成渲染模板用的消息: JSON 对象是一条消息, JSON 数组的每个对象是一条消息,
+* 返回每条消息的字段和它自己的 JSON 内容
+*
+ */
+func SplitTemplateMessages(data string) ([]map[string]interface{}, []string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, nil, fmt.Errorf("topic template need JSON message: %v", err)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, []string{data}, nil
+	case []interface{}:
+		messages := make([]map[string]interface{}, 0, len(v))
+		payloads := make([]string, 0, len(v))
+		for _, item := range v {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("topic template need JSON object, got: %v", item)
+			}
+			payload, _ := json.Marshal(object)
+			messages = append(messages, object)
+			payloads = append(payloads, string(payload))
+		}
+		return messages, payloads, nil
+	}
+	return nil, nil, fmt.Errorf("topic template need JSON object or array, got: %s", data)
+}